@@ -0,0 +1,31 @@
+package v1
+
+const (
+	// PinnedUntilAnnotation on a cluster is the RFC3339 time until which the
+	// cluster is pinned, protecting it from expiry. PinnedByAnnotation names
+	// who pinned it. Both are set with the pin command.
+	PinnedUntilAnnotation = "dowser.dowser/pinned-until"
+	PinnedByAnnotation    = "dowser.dowser/pinned-by"
+
+	// UndeleteAnnotation on a cluster kept after its deletion or expiry for
+	// the operator's soft delete grace period restores it.
+	UndeleteAnnotation = "dowser.dowser/undelete"
+
+	// InstanceLabel on a cluster names the operator instance reconciling it,
+	// when several share a namespace. Instances label the objects they create
+	// the same way. Unlabeled clusters belong to the unnamed instance.
+	InstanceLabel = "dowser.dowser/instance"
+
+	// ClusterLabel on a resource names the cluster controlling it, so it can
+	// be found, and pruned, should the cluster be gone without the garbage
+	// collector removing it.
+	ClusterLabel = "dowser.dowser/cluster"
+
+	// StoreReadyLabel on a replica's pod means its sidecar has been found
+	// serving its data, so clusters' store services may select it.
+	StoreReadyLabel = "dowser.dowser/store-ready"
+
+	// HookRuleLabel on a cluster names the rule of the operator's hook policy
+	// which created it from a finished build.
+	HookRuleLabel = "dowser.dowser/hook-rule"
+)
@@ -1,19 +1,722 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // MetricsClusterSpec defines the desired state of MetricsCluster
 type MetricsClusterSpec struct {
 	URLs []string `json:"urls,omitempty"`
+
+	// TemplateRef names a MetricsClusterTemplate in the cluster's namespace
+	// whose settings apply where the cluster doesn't set its own, so teams
+	// can share one configuration and only list sources. Changes to the
+	// template are applied to the clusters referencing it.
+	TemplateRef *corev1.LocalObjectReference `json:"templateRef,omitempty"`
+
+	// Sources are listed like URLs, with options per source. A URL both
+	// listed in URLs and here takes the options given here.
+	Sources []Source `json:"sources,omitempty"`
+
+	// JobSelector discovers sources from the Prow job archive in addition to
+	// URLs, rediscovering them periodically so new matching builds are
+	// materialized without editing the cluster.
+	JobSelector *JobSelector `json:"jobSelector,omitempty"`
+
+	// SourcesFrom reads more source URLs from a ConfigMap, for curated lists
+	// too long to keep in the cluster itself. Changes to the ConfigMap are
+	// picked up like changes to URLs.
+	SourcesFrom *SourcesFrom `json:"sourcesFrom,omitempty"`
+
+	// Schedule selects the node profile Prometheus replicas are scheduled
+	// onto. When set to "spot", replicas tolerate and select interruptible
+	// nodes and are recreated (re-fetching their artifacts) after preemption.
+	Schedule ScheduleProfile `json:"schedule,omitempty"`
+
+	// ScaleDownSchedule and ScaleUpSchedule are cron expressions at which the
+	// cluster's Prometheus replicas are scaled to zero and back up, e.g. to
+	// release resources outside working hours. When neither is set the
+	// operator-wide schedules apply.
+	ScaleDownSchedule string `json:"scaleDownSchedule,omitempty"`
+	ScaleUpSchedule   string `json:"scaleUpSchedule,omitempty"`
+
+	// RefreshSchedule is a cron expression controlling when changes to the
+	// cluster's sources are picked up. New sources are only materialized, and
+	// removed ones released, when the schedule fires. When unset the cluster
+	// is refreshed on every reconcile.
+	RefreshSchedule string `json:"refreshSchedule,omitempty"`
+
+	// TTL is how long after its creation the cluster expires: its replicas
+	// are released and its phase becomes Expired, while the cluster itself
+	// is kept for its status. A pinned cluster doesn't expire until its pin
+	// runs out. Defaults to the operator's default TTL.
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// SmokeTestQuery is an instant query evaluated against each replica once
+	// it becomes ready, at the completion time of its job. A replica whose
+	// query returns no samples is considered failed. Defaults to the
+	// operator's smoke test query.
+	SmokeTestQuery string `json:"smokeTestQuery,omitempty"`
+
+	// AdditionalScrapeConfigs reference keys holding YAML lists of scrape
+	// configs which are added to the configuration of the cluster's replicas,
+	// e.g. to scrape exporters running in the namespace.
+	AdditionalScrapeConfigs []ConfigSource `json:"additionalScrapeConfigs,omitempty"`
+
+	// AdditionalRuleFiles reference keys holding Prometheus rule files whose
+	// rule groups are evaluated by the cluster's replicas, e.g. recording
+	// rules over the replayed data.
+	AdditionalRuleFiles []ConfigSource `json:"additionalRuleFiles,omitempty"`
+
+	// SidecarResources overrides the operator's default resources for the
+	// Thanos sidecar of the cluster's replicas. Replicas shared with other
+	// clusters use the override of the first such cluster by name.
+	SidecarResources *corev1.ResourceRequirements `json:"sidecarResources,omitempty"`
+
+	// PrometheusResources overrides the operator's default resources for
+	// Prometheus in the cluster's replicas and in the Jobs loading its
+	// sources, e.g. to give sources with large TSDBs more memory. Replicas
+	// shared with other clusters use the override of the first such cluster
+	// by name. Clusters with an override don't claim warm pool pods.
+	PrometheusResources *corev1.ResourceRequirements `json:"prometheusResources,omitempty"`
+
+	// ThanosResources sets the resources of the cluster's Thanos query,
+	// query frontend and store gateway.
+	ThanosResources *corev1.ResourceRequirements `json:"thanosResources,omitempty"`
+
+	// Images overrides the operator's images for the cluster.
+	Images *ImagesSpec `json:"images,omitempty"`
+
+	// ExternalLabels are added to the external labels of the cluster's
+	// replicas, e.g. to tell sources apart by team or release. Values are Go
+	// templates of the source's Job, BuildID, Pull, Source (its source label)
+	// and URL, e.g. "{{.Job}}". They don't replace the labels the operator
+	// sets, and a replica shared with other clusters takes the labels of the
+	// first such cluster by name setting each.
+	ExternalLabels map[string]string `json:"externalLabels,omitempty"`
+
+	// Storage, if set, keeps the data of each of the cluster's replicas on a
+	// persistent volume rather than on the node, so a replica rescheduled
+	// after a node restart doesn't fetch its data again. Replicas shared with
+	// other clusters use the storage of the first such cluster by name.
+	// Clusters with storage don't claim warm pool pods.
+	Storage *StorageSpec `json:"storage,omitempty"`
+
+	// RemoteWrite replays the samples of each source to a remote write
+	// endpoint, e.g. a central Thanos receive, Mimir or VictoriaMetrics.
+	// It applies to the Thanos backend.
+	RemoteWrite *RemoteWriteSpec `json:"remoteWrite,omitempty"`
+
+	// Backend selects how the cluster's sources are stored and queried.
+	Backend Backend `json:"backend,omitempty"`
+
+	// ObjectStorage configures the cluster's archive bucket.
+	ObjectStorage *ObjectStorageSpec `json:"objectStorage,omitempty"`
+
+	// PrometheusFeatures are passed to the cluster's Prometheus replicas as
+	// --enable-feature flags, e.g. native-histograms for data which holds
+	// them.
+	PrometheusFeatures []string `json:"prometheusFeatures,omitempty"`
+
+	// QueryFrontend puts a Thanos query frontend in front of the cluster's
+	// query tier, for clusters with many sources.
+	QueryFrontend *QueryFrontendSpec `json:"queryFrontend,omitempty"`
+
+	// Query scales the cluster's Thanos query, for clusters aggregating
+	// many stores.
+	Query *QuerySpec `json:"query,omitempty"`
+
+	// RemoteRead exposes a Prometheus remote read endpoint serving the
+	// cluster's series, named remote-read-<cluster>.
+	RemoteRead bool `json:"remoteRead,omitempty"`
+
+	// AllowedExternalQueriers, if set, restricts who outside the namespace
+	// may query the cluster: clients in the listed address blocks reach its
+	// query URL, and the listed service accounts query it through the
+	// operator's aggregation API with their own tokens. A cluster only
+	// allowing service accounts has no query URL.
+	AllowedExternalQueriers []ExternalQuerier `json:"allowedExternalQueriers,omitempty"`
+
+	// ExposePrometheus exposes the Prometheus UI of each of the cluster's
+	// replicas by a route or ingress whose host names the source's job, for
+	// looking at a single run without going through the aggregated view. A
+	// replica shared with other clusters is exposed if any of them enables
+	// it. Clusters restricting their external queriers don't expose their
+	// replicas.
+	ExposePrometheus bool `json:"exposePrometheus,omitempty"`
+
+	// Grafana deploys a Grafana of the cluster's own, named
+	// grafana-<cluster>, querying it.
+	Grafana *GrafanaSpec `json:"grafana,omitempty"`
+
+	// PostMortemQueries are evaluated against each source when the cluster
+	// is deleted, and their results kept in a ConfigMap named
+	// <cluster>-postmortem which outlives the cluster.
+	PostMortemQueries []NamedQuery `json:"postMortemQueries,omitempty"`
+}
+
+// ImagesSpec overrides images of the operator.
+type ImagesSpec struct {
+	// Prometheus runs the cluster's replicas, unless their data needs the
+	// image the operator selects for its block format. Replicas shared with
+	// other clusters use the image of the first such cluster by name.
+	// Clusters with an image don't claim warm pool pods.
+	Prometheus string `json:"prometheus,omitempty"`
+
+	// Thanos runs the cluster's Thanos query, which must take the flags of
+	// the operator's Thanos version.
+	Thanos string `json:"thanos,omitempty"`
+}
+
+// NamedQuery is a PromQL expression with a name identifying its results.
+type NamedQuery struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// GrafanaSpec configures the cluster's Grafana.
+type GrafanaSpec struct {
+	// Enabled deploys the Grafana, with the cluster's query as its default
+	// data source and its overview dashboard as its home dashboard.
+	Enabled bool `json:"enabled"`
+}
+
+// QueryFrontendSpec configures how range queries are parallelized across the
+// query tier.
+type QueryFrontendSpec struct {
+	// SplitInterval splits range queries into queries over intervals of
+	// this length, run in parallel. Thanos defaults to 24h.
+	SplitInterval *metav1.Duration `json:"splitInterval,omitempty"`
+
+	// VerticalShards splits queries which aggregate by labels into this
+	// many queries over disjoint series. Needs Thanos v0.26.0 or later.
+	VerticalShards int32 `json:"verticalShards,omitempty"`
+
+	// QueryReplicas is the number of Thanos query replicas sharing the
+	// split and sharded queries.
+	QueryReplicas int32 `json:"queryReplicas,omitempty"`
+}
+
+// ExternalQuerier is a client allowed to query a cluster. Exactly one of its
+// fields is set.
+type ExternalQuerier struct {
+	// CIDR is a block of client addresses, e.g. 10.0.0.0/16.
+	CIDR string `json:"cidr,omitempty"`
+
+	// ServiceAccount is a service account, as <namespace>/<name>.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+// QuerySpec configures the cluster's Thanos query deployment.
+type QuerySpec struct {
+	// Replicas is the number of query replicas, overriding the query
+	// frontend's queryReplicas. Defaults to 1.
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// Autoscaling, if set, has a HorizontalPodAutoscaler scale the query
+	// instead, between replicas and maxReplicas.
+	Autoscaling *QueryAutoscalingSpec `json:"autoscaling,omitempty"`
+
+	// ReplicaLabels are passed to the query as --query.replica-label flags,
+	// deduplicating series which only differ by them, e.g. those of sources
+	// served both by a replica and from the archive bucket.
+	ReplicaLabels []string `json:"replicaLabels,omitempty"`
+}
+
+// QueryAutoscalingSpec configures the HorizontalPodAutoscaler of the
+// cluster's query.
+type QueryAutoscalingSpec struct {
+	// MaxReplicas is the most replicas the query is scaled to.
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// TargetCPUUtilizationPercentage is the average CPU utilization, of
+	// the query's CPU request, replicas are scaled to keep. Defaults to 80.
+	// The query needs a CPU request, e.g. from thanosResources.
+	TargetCPUUtilizationPercentage int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+}
+
+// ObjectStorageSpec configures an object storage bucket holding the cluster's
+// blocks.
+type ObjectStorageSpec struct {
+	// SecretName names a Secret in the cluster's namespace holding a Thanos
+	// object storage configuration in the objstore.yml key.
+	SecretName string `json:"secretName"`
+
+	// BucketWeb deploys the Thanos bucket web UI, exposed like the query, to
+	// browse and verify the blocks in the bucket.
+	BucketWeb bool `json:"bucketWeb,omitempty"`
+
+	// Verify runs the Thanos bucket verifier against the bucket once the
+	// cluster's sources are all ready, reporting the result in the
+	// BucketVerified condition.
+	Verify bool `json:"verify,omitempty"`
+
+	// BackupSecretName names a Secret holding the object storage
+	// configuration of a backup bucket in the objstore.yml key. When set the
+	// verifier repairs the blocks it finds issues with, keeping the
+	// originals in the backup bucket.
+	BackupSecretName string `json:"backupSecretName,omitempty"`
+
+	// ArchiveReplicas has the Thanos sidecars of the cluster's replicas ship
+	// their blocks to the bucket, served by the cluster's store gateway, so
+	// the data stays queryable once replicas are deleted, paused or
+	// rescheduled. Replicas shared with other clusters ship to the bucket of
+	// the first such cluster by name archiving them. Clusters archiving
+	// replicas don't claim warm pool pods.
+	ArchiveReplicas bool `json:"archiveReplicas,omitempty"`
+
+	// Compactor configures the Thanos compactor deployed for the bucket,
+	// which compacts and downsamples its blocks and applies retention. The
+	// compactor must be the only one of its bucket, so clusters mustn't
+	// share buckets.
+	Compactor *CompactorSpec `json:"compactor,omitempty"`
+}
+
+// CompactorSpec configures the compaction of a cluster's bucket.
+type CompactorSpec struct {
+	// RetentionRaw, Retention5m and Retention1h are how long samples are
+	// kept at raw, 5m and 1h resolution. Samples are kept forever when
+	// unset.
+	RetentionRaw *metav1.Duration `json:"retentionRaw,omitempty"`
+	Retention5m  *metav1.Duration `json:"retention5m,omitempty"`
+	Retention1h  *metav1.Duration `json:"retention1h,omitempty"`
+
+	// DisableDownsampling only compacts blocks, for buckets whose queries
+	// never span long enough to benefit from downsampled data.
+	DisableDownsampling bool `json:"disableDownsampling,omitempty"`
+
+	// Resources sets the resources of the compactor, which defaults to
+	// the cluster's ThanosResources.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// Source is a job whose metrics are served by the cluster.
+type Source struct {
+	URL string `json:"url"`
+
+	// Mode selects how the source is served.
+	Mode SourceMode `json:"mode,omitempty"`
+
+	// DisplayName, if set, is a short name for the source, such as "run-1"
+	// or "baseline". It's added to the source's series as the run label so
+	// sources can be told apart in dashboards, and reported in the job's
+	// status.
+	DisplayName string `json:"displayName,omitempty"`
+
+	// Paused scales the source's replica to zero while keeping it listed, to
+	// free its resources until it's needed again. Resuming the source fetches
+	// its data again. A replica shared with other clusters keeps running
+	// until every cluster referencing it pauses it.
+	Paused bool `json:"paused,omitempty"`
+
+	// SHA256, if set, is the hex digest the source's tarball must have.
+	// Replicas refuse to load a tarball with another digest, so the source
+	// is served from exactly the same data each time its replica is
+	// recreated. A replica shared with other clusters is pinned by the
+	// first of them, by name, setting a digest.
+	// +kubebuilder:validation:Pattern=`^[a-fA-F0-9]{64}$`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// StorageSpec describes the persistent volume claimed by each replica.
+type StorageSpec struct {
+	// StorageClassName is the class of the volumes, the default class if
+	// empty.
+	StorageClassName string `json:"storageClassName,omitempty"`
+
+	// Size is the capacity requested for each volume, which must hold the
+	// source's extracted data.
+	Size resource.Quantity `json:"size"`
+}
+
+// SourceMode is how a source of a cluster using the Thanos backend is served.
+type SourceMode string
+
+const (
+	// SourceModeReplica serves the source from its own Prometheus replica.
+	SourceModeReplica SourceMode = ""
+	// SourceModeBlocksOnly uploads the source's blocks to the cluster's
+	// object storage from a short-lived Job, and serves them from the
+	// cluster's store gateway. It avoids running a Prometheus per source,
+	// at the cost of slower queries. It needs objectStorage to be set.
+	SourceModeBlocksOnly SourceMode = "blocks-only"
+)
+
+// Backend is a storage and query implementation for a cluster's sources.
+type Backend string
+
+const (
+	// BackendThanos serves each source from its own Prometheus replica,
+	// queried through Thanos.
+	BackendThanos Backend = ""
+	// BackendVictoriaMetrics imports every source into a single
+	// VictoriaMetrics instance which serves the cluster's queries.
+	BackendVictoriaMetrics Backend = "victoriametrics"
+)
+
+// RemoteWriteSpec configures replaying sources to a remote write endpoint.
+type RemoteWriteSpec struct {
+	// SecretName names a Secret in the cluster's namespace holding the
+	// endpoint's URL in the url key, and optionally credentials in the
+	// username and password, or bearerToken keys.
+	SecretName string `json:"secretName"`
+}
+
+// ConfigSource selects a key of a ConfigMap or Secret in the cluster's
+// namespace. Exactly one of ConfigMap and Secret should be set.
+type ConfigSource struct {
+	ConfigMap *corev1.ConfigMapKeySelector `json:"configMap,omitempty"`
+	Secret    *corev1.SecretKeySelector    `json:"secret,omitempty"`
+}
+
+// ScheduleProfile is a named set of scheduling constraints for replicas.
+type ScheduleProfile string
+
+const (
+	// ScheduleDefault runs replicas wherever the scheduler places them.
+	ScheduleDefault ScheduleProfile = ""
+	// ScheduleSpot runs replicas on cheap interruptible (spot/preemptible) nodes.
+	ScheduleSpot ScheduleProfile = "spot"
+)
+
+// JobSelector matches finished Prow builds.
+type JobSelector struct {
+	// Name is a regular expression matching the names of jobs.
+	Name string `json:"name"`
+
+	// Branch, if set, is the branch a matching build must have checked out.
+	Branch string `json:"branch,omitempty"`
+
+	// Window is how far back matching builds may have started. Defaults to
+	// one day.
+	Window *metav1.Duration `json:"window,omitempty"`
+
+	// Limit is the maximum number of builds selected, the most recent first.
+	// Defaults to 10.
+	Limit int `json:"limit,omitempty"`
+
+	// ResyncInterval is how often builds are rediscovered. Defaults to one
+	// hour.
+	ResyncInterval *metav1.Duration `json:"resyncInterval,omitempty"`
 }
 
 // MetricsClusterStatus defines the observed state of MetricsCluster
 type MetricsClusterStatus struct {
+	// Phase summarizes whether the cluster's sources are queryable.
+	Phase MetricsClusterPhase `json:"phase,omitempty"`
+
+	// RequestedJobs is the number of sources materialized, and ReadyJobs the
+	// number of them whose replicas are serving data.
+	RequestedJobs int32 `json:"requestedJobs"`
+	ReadyJobs     int32 `json:"readyJobs"`
+
+	// QueryURL is where the cluster's Prometheus compatible query API is
+	// exposed, e.g. for Grafana, once its route or ingress has a host.
+	QueryURL string `json:"queryURL,omitempty"`
+
+	// DashboardURL is the cluster's overview dashboard in Grafana, once it's
+	// provisioned.
+	DashboardURL string `json:"dashboardURL,omitempty"`
+
+	// GrafanaURL is where the cluster's own Grafana is exposed, once its
+	// route or ingress has a host.
+	GrafanaURL string `json:"grafanaURL,omitempty"`
+
+	// GrafanaKeySecret names the Secret holding a viewer API key of the
+	// cluster's Grafana and its in-cluster URL, once the key is created.
+	GrafanaKeySecret string `json:"grafanaKeySecret,omitempty"`
+
+	// URLs are the sources materialized by the last refresh.
+	URLs []string `json:"urls,omitempty"`
+
+	// Discovery is the result of the last discovery of the job selector's
+	// builds.
+	Discovery *DiscoveryStatus `json:"discovery,omitempty"`
+
+	// SourcesFrom is the result of the last read of the cluster's
+	// SourcesFrom.
+	SourcesFrom *SourcesFromStatus `json:"sourcesFrom,omitempty"`
+
+	// LastRefreshTime is when the materialized sources last changed.
+	LastRefreshTime *metav1.Time `json:"lastRefreshTime,omitempty"`
+
+	// Jobs reports the state of each materialized source.
+	Jobs []JobStatus `json:"jobs,omitempty"`
+
+	// ExpirationTime is when the cluster expires, or expired, when it has a
+	// TTL.
+	ExpirationTime *metav1.Time `json:"expirationTime,omitempty"`
+
+	// ScheduleError describes invalid scale or refresh schedules. Replicas
+	// keep their current scale while the scale schedule is invalid.
+	ScheduleError string `json:"scheduleError,omitempty"`
+
+	// ConfigError describes additional scrape configs or rule files which
+	// couldn't be loaded. Replicas are configured without the cluster's
+	// additions while it's set.
+	ConfigError string `json:"configError,omitempty"`
+
+	// Conditions report the state of optional cluster features.
+	Conditions []ClusterCondition `json:"conditions,omitempty"`
+
+	// Footprint is the resources requested by the cluster's pods.
+	Footprint *ResourceFootprint `json:"footprint,omitempty"`
+}
+
+// ResourceFootprint approximates what a cluster costs to keep around, from the
+// requests of its running pods. Replicas shared with other clusters are
+// counted in full by each of them.
+type ResourceFootprint struct {
+	Pods   int32             `json:"pods"`
+	CPU    resource.Quantity `json:"cpu"`
+	Memory resource.Quantity `json:"memory"`
+
+	// Storage is the ephemeral storage requested by the pods and the
+	// capacity requested by their persistent volume claims.
+	Storage resource.Quantity `json:"storage"`
+
+	// HourlyCost is the estimated cost per hour of the requested resources,
+	// when the operator is configured with resource rates.
+	HourlyCost string `json:"hourlyCost,omitempty"`
+}
+
+// SourcesFrom references a list of source URLs, one per line. Blank lines and
+// lines starting with # are ignored.
+type SourcesFrom struct {
+	ConfigMapRef corev1.ConfigMapKeySelector `json:"configMapRef"`
+}
+
+// SourcesFromStatus is the result of reading a cluster's SourcesFrom.
+type SourcesFromStatus struct {
+	// URLs read from the list. They're kept when the list can't be read.
+	URLs []string `json:"urls,omitempty"`
+
+	// Error describes why the list last couldn't be read, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// DiscoveryStatus is the result of discovering a job selector's builds.
+type DiscoveryStatus struct {
+	// Selector is the job selector the builds were discovered for.
+	Selector JobSelector `json:"selector"`
+
+	// URLs of the discovered builds. They're kept when discovery fails.
+	URLs []string `json:"urls,omitempty"`
+
+	// Time is when discovery last ran.
+	Time metav1.Time `json:"time"`
+
+	// Error describes why discovery last failed, if it did.
+	Error string `json:"error,omitempty"`
 }
 
+// ClusterCondition is the state of an aspect of a cluster.
+type ClusterCondition struct {
+	Type   ClusterConditionType   `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// LastTransitionTime is when the status last changed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+}
+
+// ClusterConditionType names a cluster condition.
+type ClusterConditionType string
+
+const (
+	// ConditionBucketVerified reports whether the archive bucket passed
+	// verification.
+	ConditionBucketVerified ClusterConditionType = "BucketVerified"
+	// ConditionStorageAvailable reports whether every source's data fits on
+	// a node.
+	ConditionStorageAvailable ClusterConditionType = "StorageAvailable"
+	// ConditionExpressionsValid reports whether the cluster's rules and
+	// queries parse. Rule groups with invalid expressions are left out of
+	// the replicas' configuration.
+	ConditionExpressionsValid ClusterConditionType = "ExpressionsValid"
+	// ConditionPinned reports whether the cluster is pinned, and by whom and
+	// until when.
+	ConditionPinned ClusterConditionType = "Pinned"
+	// ConditionTornDown reports the teardown of a cluster being deleted:
+	// false while its replicas and resources are being removed, listing
+	// those remaining, and true once they're gone.
+	ConditionTornDown ClusterConditionType = "TornDown"
+	// ConditionSourcesLoaded reports whether every source's data could be
+	// fetched and loaded. When some couldn't, its reason is their most
+	// common failure reason and its message counts them by reason.
+	ConditionSourcesLoaded ClusterConditionType = "SourcesLoaded"
+	// ConditionQuotaAvailable is false while replicas can't be created
+	// because of the namespace's resource quotas or limit ranges, with the
+	// API server's messages. Their sources are pending until then.
+	ConditionQuotaAvailable ClusterConditionType = "QuotaAvailable"
+	// ConditionArtifactsExpiring is true while the tarballs of some of the
+	// cluster's sources are about to be deleted by the bucket keeping them,
+	// listing them, so they can be archived or mirrored first.
+	ConditionArtifactsExpiring ClusterConditionType = "ArtifactsExpiring"
+	// ConditionSourcesQuarantined is true while some of the cluster's
+	// sources are skipped because processing them kept panicking, listing
+	// them and the last panic of each.
+	ConditionSourcesQuarantined ClusterConditionType = "SourcesQuarantined"
+
+	// ConditionAvailable, ConditionProgressing and ConditionDegraded follow
+	// the cluster's phase, so automation can wait on them, e.g. with
+	// kubectl wait --for=condition=Available. The cluster is available once
+	// its query serves data, all of it when ready or that of the sources
+	// which loaded when degraded; progressing while sources are being
+	// loaded; and degraded while some failed or became unavailable.
+	ConditionAvailable   ClusterConditionType = "Available"
+	ConditionProgressing ClusterConditionType = "Progressing"
+	ConditionDegraded    ClusterConditionType = "Degraded"
+)
+
+// JobStatus is the observed state of a single source.
+type JobStatus struct {
+	URL string `json:"url"`
+
+	// DisplayName is the source's display name, if it has one.
+	DisplayName string `json:"displayName,omitempty"`
+
+	// Resolver is the name of the resolver the source's tarball was found
+	// by: prow for builds, or gs, s3, file or http for tarballs.
+	Resolver string `json:"resolver,omitempty"`
+
+	// Source is the value of the source label of the job's series, which
+	// queries can select the job's store with, e.g. with a
+	// storeMatch[]={source="<source>"} parameter.
+	Source string `json:"source,omitempty"`
+
+	// Annotation is the ID of the Grafana annotation marking the job's run,
+	// once one is created.
+	Annotation int64 `json:"annotation,omitempty"`
+
+	// Deployment is the name of the Prometheus deployment serving the job.
+	Deployment string `json:"deployment,omitempty"`
+
+	// Ready means the job's replica is serving data.
+	Ready bool `json:"ready,omitempty"`
+
+	// Message explains why the source isn't being served yet, if it isn't.
+	Message string `json:"message,omitempty"`
+
+	// Reason classifies why the source failed, if it did for a known reason.
+	Reason FailureReason `json:"reason,omitempty"`
+
+	// SmokeTest is the result of the smoke test query against the replica.
+	SmokeTest *SmokeTestStatus `json:"smokeTest,omitempty"`
+
+	// Replay is the progress of replaying the source to the remote write
+	// endpoint, or of loading it into storage for sources served without a
+	// replica (the victoriametrics backend, blocks-only sources).
+	Replay ReplayPhase `json:"replay,omitempty"`
+
+	// UnhealthySince is when the replica became unavailable or started
+	// failing its smoke test, if it's unhealthy.
+	UnhealthySince *metav1.Time `json:"unhealthySince,omitempty"`
+
+	// Excluded means the replica's store was dropped from the cluster's
+	// query view.
+	Excluded bool `json:"excluded,omitempty"`
+
+	// ArtifactExpirationTime is when the bucket keeping the source's
+	// tarball deletes it, if its retention is known. Replicas can't be
+	// recreated after then.
+	ArtifactExpirationTime *metav1.Time `json:"artifactExpirationTime,omitempty"`
+
+	// SHA256 is the hex digest of the tarball the source's replica last
+	// loaded, which can be set as the source's sha256 to pin it.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// PrometheusURL is where the Prometheus UI of the job's replica is
+	// exposed, when the cluster exposes it and its route or ingress has a
+	// host.
+	PrometheusURL string `json:"prometheusURL,omitempty"`
+}
+
+// FailureReason classifies why a source failed to be served.
+type FailureReason string
+
+const (
+	// FailureArtifactMissing means the build archived no Prometheus
+	// tarball.
+	FailureArtifactMissing FailureReason = "ArtifactMissing"
+	// FailureDownloadFailed means the build's metadata or its tarball
+	// couldn't be fetched.
+	FailureDownloadFailed FailureReason = "DownloadFailed"
+	// FailureTSDBCorrupt means the tarball's blocks couldn't be read, or
+	// Prometheus keeps failing to load them.
+	FailureTSDBCorrupt FailureReason = "TSDBCorrupt"
+	// FailureQuotaExceeded means the namespace's resource quota doesn't
+	// allow the replica's pod.
+	FailureQuotaExceeded FailureReason = "QuotaExceeded"
+	// FailureImagePullFailed means an image of the replica's pod can't be
+	// pulled.
+	FailureImagePullFailed FailureReason = "ImagePullFailed"
+	// FailureInsufficientStorage means the source's data doesn't fit on any
+	// node.
+	FailureInsufficientStorage FailureReason = "InsufficientStorage"
+	// FailureQuarantined means processing the source kept panicking, so the
+	// operator stopped trying.
+	FailureQuarantined FailureReason = "Quarantined"
+	// FailureChecksumMismatch means the source's tarball doesn't have the
+	// digest the source is pinned to.
+	FailureChecksumMismatch FailureReason = "ChecksumMismatch"
+)
+
+// ReplayPhase is the progress of a source's remote write replay.
+type ReplayPhase string
+
+const (
+	ReplayRunning   ReplayPhase = "Running"
+	ReplaySucceeded ReplayPhase = "Succeeded"
+	ReplayFailed    ReplayPhase = "Failed"
+)
+
+// SmokeTestStatus is the result of a smoke test query.
+type SmokeTestStatus struct {
+	Succeeded bool `json:"succeeded"`
+
+	// Samples is the number of samples the query returned.
+	Samples int `json:"samples"`
+
+	// Value is the query's result when it returned a single sample, e.g. the
+	// number of series for count(up).
+	Value string `json:"value,omitempty"`
+
+	Message string      `json:"message,omitempty"`
+	Time    metav1.Time `json:"time"`
+}
+
+// MetricsClusterPhase is a coarse summary of a cluster's state.
+type MetricsClusterPhase string
+
+const (
+	// PhasePending means the cluster's sources haven't all become available yet.
+	PhasePending MetricsClusterPhase = "Pending"
+	// PhaseReady means every source and the query frontend are available.
+	PhaseReady MetricsClusterPhase = "Ready"
+	// PhaseDegraded means some sources failed or stopped being available.
+	PhaseDegraded MetricsClusterPhase = "Degraded"
+	// PhaseExpired means the cluster outlived its TTL and its replicas were
+	// released.
+	PhaseExpired MetricsClusterPhase = "Expired"
+	// PhaseDeleted means the cluster was deleted and its replicas were
+	// released; it's kept until the operator's soft delete grace period
+	// runs out.
+	PhaseDeleted MetricsClusterPhase = "Deleted"
+)
+
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyJobs`
+// +kubebuilder:printcolumn:name="Jobs",type=integer,JSONPath=`.status.requestedJobs`
+// +kubebuilder:printcolumn:name="Query URL",type=string,JSONPath=`.status.queryURL`
+// +kubebuilder:printcolumn:name="Runs",type=string,JSONPath=`.status.jobs[*].displayName`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // MetricsCluster is the Schema for the metricsclusters API
 type MetricsCluster struct {
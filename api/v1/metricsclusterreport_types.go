@@ -0,0 +1,67 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MetricsClusterReportStatus rolls up the state of every cluster of an
+// operator instance.
+type MetricsClusterReportStatus struct {
+	// LastUpdateTime is when the report was last refreshed.
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+
+	// Clusters is the number of clusters.
+	Clusters int32 `json:"clusters"`
+
+	// Phases counts the clusters by phase.
+	Phases map[MetricsClusterPhase]int32 `json:"phases,omitempty"`
+
+	// Jobs is the number of sources requested across clusters, and ReadyJobs
+	// how many of them are being served.
+	Jobs      int32 `json:"jobs"`
+	ReadyJobs int32 `json:"readyJobs"`
+
+	// Replicas is the number of Prometheus replicas, counting the ones
+	// shared between clusters once, and AvailableReplicas how many of them
+	// are available.
+	Replicas          int32 `json:"replicas"`
+	AvailableReplicas int32 `json:"availableReplicas"`
+
+	// Failures counts the failed sources across clusters by reason.
+	Failures map[FailureReason]int32 `json:"failures,omitempty"`
+
+	// Footprint is the resources requested by the pods of all clusters and
+	// the warm pool.
+	Footprint *ResourceFootprint `json:"footprint,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Namespaced
+// +kubebuilder:printcolumn:name="Clusters",type=integer,JSONPath=`.status.clusters`
+// +kubebuilder:printcolumn:name="Ready Jobs",type=integer,JSONPath=`.status.readyJobs`
+// +kubebuilder:printcolumn:name="Jobs",type=integer,JSONPath=`.status.jobs`
+// +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.status.replicas`
+// +kubebuilder:printcolumn:name="Updated",type=date,JSONPath=`.status.lastUpdateTime`
+
+// MetricsClusterReport is the Schema for the metricsclusterreports API. Each
+// operator instance maintains a single report in its namespace.
+type MetricsClusterReport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status MetricsClusterReportStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MetricsClusterReportList contains a list of MetricsClusterReport
+type MetricsClusterReportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetricsClusterReport `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetricsClusterReport{}, &MetricsClusterReportList{})
+}
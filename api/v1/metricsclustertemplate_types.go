@@ -0,0 +1,59 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MetricsClusterTemplateSpec is the configuration shared by the clusters
+// referencing the template. Each setting applies to the clusters which don't
+// set it themselves, so they only need to list their sources.
+type MetricsClusterTemplateSpec struct {
+	// TTL is how long after their creation the clusters expire.
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// SidecarResources, PrometheusResources and ThanosResources are the
+	// resources of the clusters' Thanos sidecars, Prometheus replicas and
+	// Thanos query tiers.
+	SidecarResources    *corev1.ResourceRequirements `json:"sidecarResources,omitempty"`
+	PrometheusResources *corev1.ResourceRequirements `json:"prometheusResources,omitempty"`
+	ThanosResources     *corev1.ResourceRequirements `json:"thanosResources,omitempty"`
+
+	// Images are the images the clusters run.
+	Images *ImagesSpec `json:"images,omitempty"`
+
+	// ExternalLabels are added to the external labels of the clusters'
+	// replicas.
+	ExternalLabels map[string]string `json:"externalLabels,omitempty"`
+
+	// Query and QueryFrontend configure the clusters' query tiers.
+	Query         *QuerySpec         `json:"query,omitempty"`
+	QueryFrontend *QueryFrontendSpec `json:"queryFrontend,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Namespaced
+// +kubebuilder:printcolumn:name="TTL",type=string,JSONPath=`.spec.ttl`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// MetricsClusterTemplate is the Schema for the metricsclustertemplates API.
+// Clusters reference a template in their namespace with spec.templateRef.
+type MetricsClusterTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MetricsClusterTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MetricsClusterTemplateList contains a list of MetricsClusterTemplate
+type MetricsClusterTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetricsClusterTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetricsClusterTemplate{}, &MetricsClusterTemplateList{})
+}
@@ -0,0 +1,86 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MetricsQuerySpec is a range query evaluated against a cluster.
+type MetricsQuerySpec struct {
+	// Cluster is the name of the MetricsCluster in the query's namespace
+	// the query is evaluated against.
+	Cluster string `json:"cluster"`
+
+	// Query is the PromQL expression.
+	Query string `json:"query"`
+
+	// Start and End bound the range the query is evaluated over, at every
+	// Step.
+	Start metav1.Time     `json:"start"`
+	End   metav1.Time     `json:"end"`
+	Step  metav1.Duration `json:"step"`
+}
+
+// MetricsQueryStatus is the outcome of the query's last evaluation.
+type MetricsQueryStatus struct {
+	// ObservedGeneration is the generation of the query the result is for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// DataVersion is the version of the cluster's data the result was
+	// evaluated against: the cluster's generation, followed for clusters
+	// listing their sources in a ConfigMap by a hash of the sources read
+	// from it.
+	DataVersion string `json:"dataVersion,omitempty"`
+
+	// ResultConfigMap is the ConfigMap holding the result as JSON under
+	// ResultKey. It caches the results of the cluster's queries, so
+	// identical queries share an entry.
+	ResultConfigMap string `json:"resultConfigMap,omitempty"`
+	ResultKey       string `json:"resultKey,omitempty"`
+
+	// Samples is the number of samples of the result.
+	Samples int32 `json:"samples,omitempty"`
+
+	// Cached is whether the result was read from the cache rather than
+	// evaluated against the cluster.
+	Cached bool `json:"cached,omitempty"`
+
+	// LastEvaluationTime is when the result was evaluated against the
+	// cluster, unset until the query could be evaluated.
+	LastEvaluationTime *metav1.Time `json:"lastEvaluationTime,omitempty"`
+
+	// Error is why the query has no result, e.g. an unparseable expression,
+	// a cluster which isn't ready yet or a result too large to keep.
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Namespaced
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.cluster`
+// +kubebuilder:printcolumn:name="Samples",type=integer,JSONPath=`.status.samples`
+// +kubebuilder:printcolumn:name="Cached",type=boolean,JSONPath=`.status.cached`
+// +kubebuilder:printcolumn:name="Evaluated",type=date,JSONPath=`.status.lastEvaluationTime`
+// +kubebuilder:printcolumn:name="Error",type=string,JSONPath=`.status.error`,priority=1
+
+// MetricsQuery is the Schema for the metricsqueries API. Its result is kept
+// in the cluster's query result cache.
+type MetricsQuery struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MetricsQuerySpec   `json:"spec,omitempty"`
+	Status MetricsQueryStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MetricsQueryList contains a list of MetricsQuery
+type MetricsQueryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetricsQuery `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetricsQuery{}, &MetricsQueryList{})
+}
@@ -0,0 +1,23 @@
+package v1
+
+import (
+	"bufio"
+	"strings"
+)
+
+// ParseSourceList returns the URLs of a SourcesFrom list, with one per line,
+// skipping blank lines, comments and duplicates.
+func ParseSourceList(data string) []string {
+	var urls []string
+	listed := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") || listed[line] {
+			continue
+		}
+		listed[line] = true
+		urls = append(urls, line)
+	}
+	return urls
+}
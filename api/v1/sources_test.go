@@ -0,0 +1,20 @@
+package v1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSourceList(t *testing.T) {
+	list := `# baseline runs
+https://a
+
+  https://b
+https://a
+#https://c
+`
+	expected := []string{"https://a", "https://b"}
+	if urls := ParseSourceList(list); !reflect.DeepEqual(urls, expected) {
+		t.Errorf("expected %v, got %v", expected, urls)
+	}
+}
@@ -0,0 +1,151 @@
+// Package create creates clusters from a file listing their sources, so long
+// curated lists of runs don't have to be written into a cluster by hand.
+package create
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// sourcesKey is the key of the source list in the ConfigMap holding it.
+const sourcesKey = "urls.txt"
+
+type createOptions struct {
+	FromFile  string
+	Namespace string
+	Template  string
+}
+
+func NewCreateCommand() *cobra.Command {
+	var options createOptions
+
+	var command = &cobra.Command{
+		Use:   "create CLUSTER --from-file FILE",
+		Short: "Creates a cluster serving the sources listed in a file.",
+		Long: `Creates a cluster serving the sources listed in a file.
+
+The file lists a source URL per line; blank lines and lines starting with #
+are ignored. It's stored in a ConfigMap named <cluster>-sources which the
+cluster's spec.sourcesFrom references. Running the command again with an
+edited file updates the ConfigMap, and the operator adds and removes only the
+sources which changed.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := create(options, args[0])
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.FromFile, "from-file", "", "", "file listing the cluster's source URLs, one per line")
+	command.Flags().StringVarP(&options.Namespace, "namespace", "", "dowser", "namespace of the cluster")
+	command.Flags().StringVarP(&options.Template, "template", "", "", "metricsclustertemplate configuring the cluster (empty for none)")
+
+	return command
+}
+
+// sourcesConfigMapName returns the name of the ConfigMap holding the sources
+// of the named cluster.
+func sourcesConfigMapName(clusterName string) string {
+	return clusterName + "-sources"
+}
+
+// manifests returns the cluster reading its sources from the ConfigMap, and
+// configured by the template if one is given, and the ConfigMap holding them.
+func manifests(namespace, clusterName, template, sources string) (*api.MetricsCluster, *corev1.ConfigMap) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: sourcesConfigMapName(clusterName)},
+		Data:       map[string]string{sourcesKey: sources},
+	}
+	cluster := &api.MetricsCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: clusterName},
+		Spec: api.MetricsClusterSpec{
+			SourcesFrom: &api.SourcesFrom{
+				ConfigMapRef: corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: configMap.Name},
+					Key:                  sourcesKey,
+				},
+			},
+		},
+	}
+	if len(template) > 0 {
+		cluster.Spec.TemplateRef = &corev1.LocalObjectReference{Name: template}
+	}
+	return cluster, configMap
+}
+
+func create(options createOptions, clusterName string) error {
+	if len(options.FromFile) == 0 {
+		return fmt.Errorf("no --from-file given")
+	}
+	data, err := ioutil.ReadFile(options.FromFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read sources: %w", err)
+	}
+	urls := api.ParseSourceList(string(data))
+	if len(urls) == 0 {
+		return fmt.Errorf("%s lists no sources", filepath.Base(options.FromFile))
+	}
+	config, err := clientconfig.GetConfig()
+	if err != nil {
+		return fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	clientScheme := runtime.NewScheme()
+	if err := api.AddToScheme(clientScheme); err != nil {
+		return err
+	}
+	if err := corev1.AddToScheme(clientScheme); err != nil {
+		return err
+	}
+	kubeClient, err := client.New(config, client.Options{Scheme: clientScheme})
+	if err != nil {
+		return fmt.Errorf("couldn't create client: %w", err)
+	}
+
+	cluster, configMap := manifests(options.Namespace, clusterName, options.Template, string(data))
+	existing := &corev1.ConfigMap{}
+	err = kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name}, existing)
+	switch {
+	case errors.IsNotFound(err):
+		if err := kubeClient.Create(context.TODO(), configMap); err != nil {
+			return fmt.Errorf("couldn't create configmap %s: %w", configMap.Name, err)
+		}
+	case err != nil:
+		return fmt.Errorf("couldn't fetch configmap %s: %w", configMap.Name, err)
+	default:
+		existing.Data = configMap.Data
+		if err := kubeClient.Update(context.TODO(), existing); err != nil {
+			return fmt.Errorf("couldn't update configmap %s: %w", configMap.Name, err)
+		}
+	}
+
+	if err := kubeClient.Create(context.TODO(), cluster); err != nil {
+		if !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("couldn't create metricscluster %s: %w", clusterName, err)
+		}
+		if err := kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}, cluster); err != nil {
+			return fmt.Errorf("couldn't fetch metricscluster %s: %w", clusterName, err)
+		}
+		if cluster.Spec.SourcesFrom == nil || cluster.Spec.SourcesFrom.ConfigMapRef.Name != configMap.Name {
+			return fmt.Errorf("metricscluster %s exists and doesn't read its sources from configmap %s", clusterName, configMap.Name)
+		}
+		fmt.Printf("metricscluster %s sources updated (%d urls)\n", clusterName, len(urls))
+		return nil
+	}
+	fmt.Printf("metricscluster %s created (%d urls)\n", clusterName, len(urls))
+	return nil
+}
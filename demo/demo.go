@@ -0,0 +1,178 @@
+// Package demo creates a sample cluster and walks through it becoming ready,
+// so new users can see the operator work end to end with one command.
+package demo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// demoJob is the job whose latest build the demo cluster serves unless a
+// source is given: a public periodic of the OpenShift CI archiving a
+// Prometheus tarball.
+const demoJob = "release-openshift-ocp-installer-e2e-aws-4.6"
+
+type demoOptions struct {
+	Name         string
+	Namespace    string
+	URL          string
+	Job          string
+	Grafana      bool
+	Timeout      time.Duration
+	PollInterval time.Duration
+}
+
+func NewDemoCommand() *cobra.Command {
+	var options demoOptions
+
+	var command = &cobra.Command{
+		Use:   "demo",
+		Short: "Creates a sample cluster and waits for it to serve queries.",
+		Long: `Creates a sample cluster and waits for it to serve queries.
+
+The cluster serves the latest build of a public CI job from the last week, or
+the source given with --url, e.g. a small prometheus.tar. Its progress is
+printed as the operator discovers the source's artifacts, starts its replica
+and exposes its query, and once it's ready, where to query it and how to
+clean it up. Running the command again reuses the cluster. The operator must
+be running and watching the namespace.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := demo(options, cmd.OutOrStdout())
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.Name, "name", "", "demo", "name of the sample cluster")
+	command.Flags().StringVarP(&options.Namespace, "namespace", "", "dowser", "namespace of the sample cluster")
+	command.Flags().StringVarP(&options.URL, "url", "", "", "source the sample cluster serves (empty for the latest build of --job)")
+	command.Flags().StringVarP(&options.Job, "job", "", demoJob, "job whose latest build the sample cluster serves")
+	command.Flags().BoolVarP(&options.Grafana, "grafana", "", true, "deploy a Grafana for the sample cluster")
+	command.Flags().DurationVarP(&options.Timeout, "timeout", "", 30*time.Minute, "how long to wait for the sample cluster to become ready")
+	command.Flags().DurationVarP(&options.PollInterval, "poll-interval", "", 5*time.Second, "how often to check the sample cluster")
+
+	return command
+}
+
+// manifest returns the sample cluster.
+func manifest(options demoOptions) *api.MetricsCluster {
+	cluster := &api.MetricsCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: options.Namespace, Name: options.Name},
+	}
+	if len(options.URL) > 0 {
+		cluster.Spec.URLs = []string{options.URL}
+	} else {
+		cluster.Spec.JobSelector = &api.JobSelector{
+			Name:   "^" + strings.ReplaceAll(options.Job, ".", `\.`) + "$",
+			Window: &metav1.Duration{Duration: 7 * 24 * time.Hour},
+			Limit:  1,
+		}
+	}
+	if options.Grafana {
+		cluster.Spec.Grafana = &api.GrafanaSpec{Enabled: true}
+	}
+	return cluster
+}
+
+// progress describes how far along the cluster is.
+func progress(cluster *api.MetricsCluster) string {
+	if len(cluster.Status.Phase) == 0 {
+		return "waiting for the operator to pick up the cluster"
+	}
+	if cluster.Status.RequestedJobs == 0 {
+		return fmt.Sprintf("%s: discovering sources", cluster.Status.Phase)
+	}
+	state := fmt.Sprintf("%s: %d/%d sources ready", cluster.Status.Phase, cluster.Status.ReadyJobs, cluster.Status.RequestedJobs)
+	for _, job := range cluster.Status.Jobs {
+		if len(job.Message) > 0 {
+			state += fmt.Sprintf("\n  %s: %s", job.URL, job.Message)
+		}
+	}
+	return state
+}
+
+// summary tells how to use and remove the ready cluster.
+func summary(cluster *api.MetricsCluster) string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("metricscluster %s is ready.", cluster.Name))
+	if len(cluster.Status.QueryURL) > 0 {
+		lines = append(lines, "", "Query it like Prometheus:", "",
+			fmt.Sprintf("  curl '%s/api/v1/query?query=count(up)'", strings.TrimSuffix(cluster.Status.QueryURL, "/")))
+	}
+	if len(cluster.Status.GrafanaURL) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Browse it in Grafana at %s", cluster.Status.GrafanaURL))
+	}
+	lines = append(lines, "", "Delete it with:", "",
+		fmt.Sprintf("  kubectl delete metricscluster %s --namespace %s", cluster.Name, cluster.Namespace))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func demo(options demoOptions, out io.Writer) error {
+	config, err := clientconfig.GetConfig()
+	if err != nil {
+		return fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	clientScheme := runtime.NewScheme()
+	if err := api.AddToScheme(clientScheme); err != nil {
+		return err
+	}
+	kubeClient, err := client.New(config, client.Options{Scheme: clientScheme})
+	if err != nil {
+		return fmt.Errorf("couldn't create client: %w", err)
+	}
+
+	cluster := manifest(options)
+	if err := kubeClient.Create(context.TODO(), cluster); err != nil {
+		if !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("couldn't create metricscluster %s: %w", cluster.Name, err)
+		}
+		fmt.Fprintf(out, "metricscluster %s exists, waiting for it\n", cluster.Name)
+	} else {
+		fmt.Fprintf(out, "metricscluster %s created\n", cluster.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+	name := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	ticker := time.NewTicker(options.PollInterval)
+	defer ticker.Stop()
+	var state string
+	for {
+		err := kubeClient.Get(ctx, name, cluster)
+		switch {
+		case err == nil:
+			if cluster.Status.Phase == api.PhaseReady {
+				_, err := io.WriteString(out, summary(cluster))
+				return err
+			}
+			if current := progress(cluster); current != state {
+				state = current
+				fmt.Fprintln(out, state)
+			}
+		case ctx.Err() == nil:
+			return fmt.Errorf("couldn't fetch metricscluster %s: %w", cluster.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for metricscluster %s to become ready: %s", cluster.Name, state)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package demo
+
+import (
+	"strings"
+	"testing"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestManifest(t *testing.T) {
+	cluster := manifest(demoOptions{Name: "demo", Namespace: "dowser", Job: demoJob, Grafana: true})
+	if cluster.Spec.JobSelector == nil || cluster.Spec.JobSelector.Name != `^release-openshift-ocp-installer-e2e-aws-4\.6$` || cluster.Spec.JobSelector.Limit != 1 {
+		t.Errorf("expected the latest build of the job selected, got %+v", cluster.Spec.JobSelector)
+	}
+	if cluster.Spec.Grafana == nil || !cluster.Spec.Grafana.Enabled {
+		t.Errorf("expected a Grafana enabled")
+	}
+
+	url := "https://example.com/prometheus.tar"
+	cluster = manifest(demoOptions{Name: "demo", Namespace: "dowser", URL: url})
+	if cluster.Spec.JobSelector != nil || len(cluster.Spec.URLs) != 1 || cluster.Spec.URLs[0] != url {
+		t.Errorf("expected only the given source, got %v and %+v", cluster.Spec.URLs, cluster.Spec.JobSelector)
+	}
+	if cluster.Spec.Grafana != nil {
+		t.Errorf("expected no Grafana")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	cluster := &api.MetricsCluster{}
+	if state := progress(cluster); !strings.Contains(state, "waiting for the operator") {
+		t.Errorf("expected the operator awaited, got %q", state)
+	}
+	cluster.Status.Phase = api.PhasePending
+	cluster.Status.RequestedJobs = 1
+	cluster.Status.Jobs = []api.JobStatus{{URL: "https://example.com/prometheus.tar", Message: "discovering the source's artifacts"}}
+	expected := "Pending: 0/1 sources ready\n  https://example.com/prometheus.tar: discovering the source's artifacts"
+	if state := progress(cluster); state != expected {
+		t.Errorf("expected %q, got %q", expected, state)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	cluster := &api.MetricsCluster{}
+	cluster.Name = "demo"
+	cluster.Namespace = "dowser"
+	cluster.Status.QueryURL = "https://thanos-querier-demo.apps.example.com/"
+	text := summary(cluster)
+	for _, expected := range []string{
+		"curl 'https://thanos-querier-demo.apps.example.com/api/v1/query?query=count(up)'",
+		"kubectl delete metricscluster demo --namespace dowser",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %q in the summary, got:\n%s", expected, text)
+		}
+	}
+	if strings.Contains(text, "Grafana") {
+		t.Errorf("expected no Grafana without one, got:\n%s", text)
+	}
+}
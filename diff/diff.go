@@ -0,0 +1,208 @@
+// Package diff compares the results of the same queries against two clusters,
+// for ad-hoc A/B debugging.
+package diff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+
+	"github.com/ironcladlou/dowser/query"
+)
+
+type diffOptions struct {
+	QueriesFile  string
+	Namespace    string
+	Time         string
+	Threshold    float64
+	IgnoreLabels []string
+	Color        bool
+}
+
+func NewDiffCommand() *cobra.Command {
+	var options diffOptions
+
+	var command = &cobra.Command{
+		Use:   "diff CLUSTER_A CLUSTER_B",
+		Short: "Compares query results between two clusters.",
+		Long: `Compares query results between two clusters.
+
+Each cluster is the name of a MetricsCluster, whose query route is looked up
+with the current kubeconfig, or the URL of a Prometheus compatible API.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := diff(options, args[0], args[1], os.Stdout)
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.QueriesFile, "queries", "", "", "YAML file listing the queries to compare")
+	command.Flags().StringVarP(&options.Namespace, "namespace", "", "dowser", "namespace of the clusters")
+	command.Flags().StringVarP(&options.Time, "time", "", "", "evaluation time (RFC3339, defaults to now)")
+	command.Flags().Float64VarP(&options.Threshold, "threshold", "", 0.1, "relative change highlighted for queries without their own threshold")
+	command.Flags().StringSliceVarP(&options.IgnoreLabels, "ignore-label", "", []string{"cluster_name", "prometheus", "replica"}, "labels ignored when matching series, as they differ between clusters")
+	command.Flags().BoolVarP(&options.Color, "color", "", false, "highlight with terminal colors rather than a marker")
+
+	return command
+}
+
+func diff(options diffOptions, clusterA, clusterB string, out io.Writer) error {
+	if len(options.QueriesFile) == 0 {
+		return fmt.Errorf("no queries given")
+	}
+	queries, err := query.LoadQueries(options.QueriesFile)
+	if err != nil {
+		return err
+	}
+	at := time.Now()
+	if len(options.Time) > 0 {
+		at, err = time.Parse(time.RFC3339, options.Time)
+		if err != nil {
+			return fmt.Errorf("invalid time: %w", err)
+		}
+	}
+
+	ctx := context.Background()
+	endpointA, err := query.ResolveEndpoint(ctx, clusterA, options.Namespace)
+	if err != nil {
+		return err
+	}
+	endpointB, err := query.ResolveEndpoint(ctx, clusterB, options.Namespace)
+	if err != nil {
+		return err
+	}
+	clientA, clientB := query.NewClient(endpointA), query.NewClient(endpointB)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "QUERY\tSERIES\t%s\t%s\tDELTA\tCHANGE\t\n", clusterA, clusterB)
+	for _, q := range queries {
+		threshold := q.Threshold
+		if threshold == 0 {
+			threshold = options.Threshold
+		}
+		valueA, errA := clientA.Instant(ctx, q.Query, at, nil)
+		valueB, errB := clientB.Instant(ctx, q.Query, at, nil)
+		if errA != nil || errB != nil {
+			fmt.Fprintf(w, "%s\t\t%s\t%s\t\t\t\n", q.Name, errorText(errA), errorText(errB))
+			continue
+		}
+		for _, row := range compare(valueA, valueB, options.IgnoreLabels) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", q.Name, row.Series, formatValue(row.A), formatValue(row.B), row.format(threshold, options.Color))
+		}
+	}
+	return w.Flush()
+}
+
+// row is a series' value in each cluster; a missing value is NaN.
+type row struct {
+	Series string
+	A, B   float64
+}
+
+// change returns the relative change from A to B.
+func (r row) change() float64 {
+	if r.A == 0 {
+		if r.B == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return (r.B - r.A) / math.Abs(r.A)
+}
+
+// exceeds reports whether the row changed by more than threshold, or its
+// series is missing from one of the clusters.
+func (r row) exceeds(threshold float64) bool {
+	if math.IsNaN(r.A) != math.IsNaN(r.B) {
+		return true
+	}
+	return math.Abs(r.change()) > threshold
+}
+
+// format returns the delta and change columns, highlighted if the change
+// exceeds threshold.
+func (r row) format(threshold float64, color bool) string {
+	columns := "\t\t"
+	if !math.IsNaN(r.A) && !math.IsNaN(r.B) {
+		columns = fmt.Sprintf("%+g\t%+.1f%%\t", r.B-r.A, r.change()*100)
+	}
+	if !r.exceeds(threshold) {
+		return columns
+	}
+	if color {
+		return "\x1b[31m" + columns + "\x1b[0m"
+	}
+	return columns + "!"
+}
+
+// compare pairs up the series of two instant query results by their labels,
+// ignoring the given ones.
+func compare(a, b model.Value, ignore []string) []row {
+	valuesA, valuesB := seriesValues(a, ignore), seriesValues(b, ignore)
+	var series []string
+	for s := range valuesA {
+		series = append(series, s)
+	}
+	for s := range valuesB {
+		if _, found := valuesA[s]; !found {
+			series = append(series, s)
+		}
+	}
+	sort.Strings(series)
+
+	rows := make([]row, 0, len(series))
+	for _, s := range series {
+		r := row{Series: s, A: math.NaN(), B: math.NaN()}
+		if v, found := valuesA[s]; found {
+			r.A = v
+		}
+		if v, found := valuesB[s]; found {
+			r.B = v
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// seriesValues returns the values of an instant query result keyed by their
+// series' labels. A scalar is a series without labels.
+func seriesValues(value model.Value, ignore []string) map[string]float64 {
+	values := map[string]float64{}
+	switch v := value.(type) {
+	case model.Vector:
+		for _, sample := range v {
+			metric := sample.Metric.Clone()
+			for _, name := range ignore {
+				delete(metric, model.LabelName(name))
+			}
+			values[metric.String()] = float64(sample.Value)
+		}
+	case *model.Scalar:
+		values["{}"] = float64(v.Value)
+	}
+	return values
+}
+
+func formatValue(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return "error: " + err.Error()
+}
@@ -0,0 +1,44 @@
+package diff
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestCompare(t *testing.T) {
+	a := model.Vector{
+		{Metric: model.Metric{"job": "apiserver", "cluster_name": "prometheus-a"}, Value: 10},
+		{Metric: model.Metric{"job": "etcd", "cluster_name": "prometheus-a"}, Value: 4},
+	}
+	b := model.Vector{
+		{Metric: model.Metric{"job": "apiserver", "cluster_name": "prometheus-b"}, Value: 12},
+		{Metric: model.Metric{"job": "kubelet", "cluster_name": "prometheus-b"}, Value: 1},
+	}
+	rows := compare(a, b, []string{"cluster_name"})
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %v", rows)
+	}
+
+	apiserver, etcd, kubelet := rows[0], rows[1], rows[2]
+	if apiserver.Series != `{job="apiserver"}` || apiserver.A != 10 || apiserver.B != 12 {
+		t.Errorf("unexpected apiserver row %+v", apiserver)
+	}
+	if !apiserver.exceeds(0.1) || apiserver.exceeds(0.25) {
+		t.Errorf("apiserver changed by %v, expected 20%%", apiserver.change())
+	}
+	if etcd.A != 4 || !math.IsNaN(etcd.B) || !etcd.exceeds(1) {
+		t.Errorf("etcd is only in a, got %+v", etcd)
+	}
+	if !math.IsNaN(kubelet.A) || kubelet.B != 1 || !kubelet.exceeds(1) {
+		t.Errorf("kubelet is only in b, got %+v", kubelet)
+	}
+}
+
+func TestCompareScalars(t *testing.T) {
+	rows := compare(&model.Scalar{Value: 0}, &model.Scalar{Value: 0}, nil)
+	if len(rows) != 1 || rows[0].exceeds(0) {
+		t.Errorf("expected one unchanged row, got %+v", rows)
+	}
+}
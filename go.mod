@@ -9,12 +9,20 @@ replace (
 )
 
 require (
+	cloud.google.com/go/storage v1.10.0
 	github.com/go-logr/logr v0.1.0
+	github.com/klauspost/compress v1.11.13
+	github.com/klauspost/pgzip v1.2.5
 	github.com/mattn/go-sqlite3 v2.0.1+incompatible
 	github.com/openshift/api v0.0.0-20200520235321-2bd66cee3218
+	github.com/prometheus/client_golang v1.6.0
+	github.com/prometheus/common v0.9.1
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/cobra v1.0.0
+	golang.org/x/mod v0.3.0
 	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	google.golang.org/api v0.29.0
+	google.golang.org/protobuf v1.25.0
 	k8s.io/api v0.18.7-rc.0
 	k8s.io/apimachinery v0.18.7-rc.0
 	k8s.io/client-go v11.0.1-0.20190805182717-6502b5e7b1b5+incompatible
@@ -0,0 +1,133 @@
+// Package history keeps a ledger of the clusters the operator has served, for
+// capacity planning and usage reporting.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+type historyOptions struct {
+	Namespace string
+	Since     time.Duration
+	Output    string
+}
+
+func NewHistoryCommand() *cobra.Command {
+	var options historyOptions
+
+	var command = &cobra.Command{
+		Use:   "history",
+		Short: "Lists the clusters the operator has created and deleted.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := history(options, os.Stdout)
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.Namespace, "namespace", "", "dowser", "namespace of the operator")
+	command.Flags().DurationVarP(&options.Since, "since", "", 0, "only list clusters created within this long (0 for all)")
+	command.Flags().StringVarP(&options.Output, "output", "o", "table", "output format (table or json)")
+
+	return command
+}
+
+func history(options historyOptions, out io.Writer) error {
+	if options.Output != "table" && options.Output != "json" {
+		return fmt.Errorf("unknown output format %q", options.Output)
+	}
+	config, err := clientconfig.GetConfig()
+	if err != nil {
+		return fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	clientScheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(clientScheme); err != nil {
+		return err
+	}
+	kubeClient, err := client.New(config, client.Options{Scheme: clientScheme})
+	if err != nil {
+		return fmt.Errorf("couldn't create client: %w", err)
+	}
+	configMap := &corev1.ConfigMap{}
+	err = kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: options.Namespace, Name: ConfigMapName}, configMap)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't fetch history: %w", err)
+	}
+	ledger, err := Decode(configMap)
+	if err != nil {
+		return err
+	}
+	if options.Since > 0 {
+		ledger = ledger.since(time.Now().Add(-options.Since))
+	}
+
+	if options.Output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(ledger)
+	}
+	return ledger.write(out)
+}
+
+func (l Ledger) since(t time.Time) Ledger {
+	var recent Ledger
+	for _, entry := range l {
+		if !entry.Created.Before(t) {
+			recent = append(recent, entry)
+		}
+	}
+	return recent
+}
+
+// write prints a table of the ledger followed by a summary.
+func (l Ledger) write(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tREQUESTED BY\tURLS\tCREATED\tTIME TO READY\tDELETED")
+	var ready int
+	var totalTimeToReady time.Duration
+	for i := range l {
+		entry := &l[i]
+		timeToReady := "-"
+		if entry.Ready != nil {
+			ready++
+			totalTimeToReady += entry.TimeToReady()
+			timeToReady = entry.TimeToReady().Round(time.Second).String()
+		}
+		deleted := "-"
+		if entry.Deleted != nil {
+			deleted = entry.Deleted.UTC().Format(time.RFC3339)
+		}
+		requestedBy := entry.RequestedBy
+		if len(requestedBy) == 0 {
+			requestedBy = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Name, requestedBy, strconv.Itoa(len(entry.URLs)),
+			entry.Created.UTC().Format(time.RFC3339), timeToReady, deleted)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\n%d clusters, %d became ready", len(l), ready)
+	if ready > 0 {
+		fmt.Fprintf(out, " in %s on average", (totalTimeToReady / time.Duration(ready)).Round(time.Second))
+	}
+	fmt.Fprintln(out)
+	return nil
+}
@@ -0,0 +1,142 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ConfigMapName is the ConfigMap in the operator's namespace holding the
+	// ledger under ConfigMapKey.
+	ConfigMapName = "cluster-history"
+	ConfigMapKey  = "history.json"
+
+	// RequestedByAnnotation on a cluster names who asked for it, for the
+	// ledger. Pipelines and tools creating clusters should set it.
+	RequestedByAnnotation = "dowser.dowser/requested-by"
+)
+
+// Entry is the history of a single cluster.
+type Entry struct {
+	Name        string     `json:"name"`
+	UID         string     `json:"uid"`
+	RequestedBy string     `json:"requestedBy,omitempty"`
+	URLs        []string   `json:"urls,omitempty"`
+	Created     time.Time  `json:"created"`
+	Ready       *time.Time `json:"ready,omitempty"`
+	Deleted     *time.Time `json:"deleted,omitempty"`
+}
+
+// TimeToReady is how long the cluster took to first become ready, or zero if
+// it never did.
+func (e *Entry) TimeToReady() time.Duration {
+	if e.Ready == nil {
+		return 0
+	}
+	return e.Ready.Sub(e.Created)
+}
+
+// Ledger is the history of every cluster, oldest first.
+type Ledger []Entry
+
+// Decode reads the ledger from its ConfigMap.
+func Decode(configMap *corev1.ConfigMap) (Ledger, error) {
+	var ledger Ledger
+	data, hasData := configMap.Data[ConfigMapKey]
+	if !hasData || len(data) == 0 {
+		return ledger, nil
+	}
+	if err := json.Unmarshal([]byte(data), &ledger); err != nil {
+		return nil, fmt.Errorf("couldn't decode history: %w", err)
+	}
+	return ledger, nil
+}
+
+// Encode writes the ledger to its ConfigMap.
+func (l Ledger) Encode(configMap *corev1.ConfigMap) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("couldn't encode history: %w", err)
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[ConfigMapKey] = string(data)
+	return nil
+}
+
+// Observe records a live cluster, adding its entry if it's new and updating
+// its sources and readiness. It returns whether the ledger changed.
+func (l *Ledger) Observe(observed Entry, ready bool, now time.Time) bool {
+	for i := range *l {
+		entry := &(*l)[i]
+		if entry.UID != observed.UID {
+			continue
+		}
+		changed := false
+		if !equalURLs(entry.URLs, observed.URLs) {
+			entry.URLs = observed.URLs
+			changed = true
+		}
+		if ready && entry.Ready == nil {
+			entry.Ready = &now
+			changed = true
+		}
+		return changed
+	}
+	if ready {
+		observed.Ready = &now
+	}
+	*l = append(*l, observed)
+	sort.SliceStable(*l, func(i, j int) bool { return (*l)[i].Created.Before((*l)[j].Created) })
+	return true
+}
+
+// Delete records the deletion of the newest live cluster with the name. It
+// returns whether the ledger changed.
+func (l *Ledger) Delete(name string, now time.Time) bool {
+	for i := len(*l) - 1; i >= 0; i-- {
+		entry := &(*l)[i]
+		if entry.Name == name && entry.Deleted == nil {
+			entry.Deleted = &now
+			return true
+		}
+	}
+	return false
+}
+
+// Prune drops the oldest deleted clusters until at most limit remain. It
+// returns whether the ledger changed.
+func (l *Ledger) Prune(limit int) bool {
+	excess := len(*l) - limit
+	if limit <= 0 || excess <= 0 {
+		return false
+	}
+	kept := Ledger{}
+	for _, entry := range *l {
+		if excess > 0 && entry.Deleted != nil {
+			excess--
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	changed := len(kept) != len(*l)
+	*l = kept
+	return changed
+}
+
+func equalURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	var ledger Ledger
+
+	a := Entry{Name: "a", UID: "1", URLs: []string{"u1"}, Created: start}
+	if !ledger.Observe(a, false, start.Add(time.Minute)) || len(ledger) != 1 {
+		t.Fatalf("expected a to be added, got %+v", ledger)
+	}
+	if ledger.Observe(a, false, start.Add(2*time.Minute)) {
+		t.Errorf("expected observing a again to change nothing")
+	}
+	if !ledger.Observe(a, true, start.Add(5*time.Minute)) || ledger[0].TimeToReady() != 5*time.Minute {
+		t.Errorf("expected a to be ready after 5m, got %v", ledger[0].TimeToReady())
+	}
+	if ledger.Observe(a, true, start.Add(10*time.Minute)) || ledger[0].TimeToReady() != 5*time.Minute {
+		t.Errorf("expected a's time to ready to be kept")
+	}
+	a.URLs = []string{"u1", "u2"}
+	if !ledger.Observe(a, true, start.Add(10*time.Minute)) || len(ledger[0].URLs) != 2 {
+		t.Errorf("expected a's urls to be updated, got %v", ledger[0].URLs)
+	}
+
+	// A cluster recreated with the same name is a new entry.
+	if !ledger.Delete("a", start.Add(time.Hour)) || ledger.Delete("a", start.Add(time.Hour)) {
+		t.Errorf("expected a to be deleted once")
+	}
+	ledger.Observe(Entry{Name: "a", UID: "2", Created: start.Add(2 * time.Hour)}, false, start.Add(2*time.Hour))
+	ledger.Observe(Entry{Name: "b", UID: "3", Created: start.Add(3 * time.Hour)}, false, start.Add(3*time.Hour))
+	if len(ledger) != 3 || ledger[1].UID != "2" || ledger[1].Deleted != nil {
+		t.Fatalf("expected a to be recreated, got %+v", ledger)
+	}
+
+	if !ledger.Prune(2) || len(ledger) != 2 || ledger[0].UID != "2" {
+		t.Errorf("expected the deleted a to be pruned, got %+v", ledger)
+	}
+	if ledger.Prune(1) {
+		t.Errorf("expected live clusters to never be pruned, got %+v", ledger)
+	}
+}
@@ -4,14 +4,33 @@ import (
 	"github.com/spf13/cobra"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
+	"github.com/ironcladlou/dowser/create"
+	"github.com/ironcladlou/dowser/demo"
+	"github.com/ironcladlou/dowser/diff"
+	"github.com/ironcladlou/dowser/history"
 	"github.com/ironcladlou/dowser/operator"
+	"github.com/ironcladlou/dowser/pin"
 	"github.com/ironcladlou/dowser/prow"
+	"github.com/ironcladlou/dowser/replay"
+	"github.com/ironcladlou/dowser/report"
+	"github.com/ironcladlou/dowser/wait"
 )
 
 func main() {
 	var cmd = &cobra.Command{Use: "dowser"}
 	cmd.AddCommand(operator.NewStartCommand())
 	cmd.AddCommand(prow.NewDBCommand())
+	cmd.AddCommand(replay.NewReplayCommand())
+	cmd.AddCommand(diff.NewDiffCommand())
+	cmd.AddCommand(report.NewReportCommand())
+	cmd.AddCommand(wait.NewWaitCommand())
+	cmd.AddCommand(history.NewHistoryCommand())
+	cmd.AddCommand(pin.NewPinCommand())
+	cmd.AddCommand(create.NewCreateCommand())
+	cmd.AddCommand(operator.NewRenderCommand())
+	cmd.AddCommand(operator.NewFetchCommand())
+	cmd.AddCommand(operator.NewFetcherCommand())
+	cmd.AddCommand(demo.NewDemoCommand())
 
 	if err := cmd.Execute(); err != nil {
 		panic(err)
@@ -0,0 +1,86 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+const (
+	// urlLimitOverrideAnnotation set to "true" on a cluster exempts it from
+	// the URL limit. Only admins may set or change it.
+	urlLimitOverrideAnnotation = "dowser.dowser/url-limit-override"
+
+	validateClusterPath = "/validate-metricscluster"
+)
+
+// urlLimitValidator rejects clusters with more sources than the operator
+// allows, so a mistaken list can't flood the namespace with replicas.
+type urlLimitValidator struct {
+	maxURLs     int
+	adminGroups []string
+	decoder     *admission.Decoder
+}
+
+func (v *urlLimitValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+func (v *urlLimitValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	cluster := &api.MetricsCluster{}
+	if err := v.decoder.Decode(req, cluster); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	old := &api.MetricsCluster{}
+	if req.Operation == admissionv1beta1.Update {
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+
+	override := cluster.Annotations[urlLimitOverrideAnnotation]
+	if override != old.Annotations[urlLimitOverrideAnnotation] && !v.isAdmin(req.UserInfo) {
+		return admission.Denied(fmt.Sprintf("only members of %v may change the %s annotation", v.adminGroups, urlLimitOverrideAnnotation))
+	}
+	if override == "true" {
+		return admission.Allowed("")
+	}
+	// Clusters which were already over the limit, e.g. before it was
+	// lowered, may still shrink.
+	if urls := maxURLs(cluster); urls > v.maxURLs && urls > maxURLs(old) {
+		return admission.Denied(fmt.Sprintf("cluster may have %d urls, more than the limit of %d", urls, v.maxURLs))
+	}
+	return admission.Allowed("")
+}
+
+// maxURLs returns how many sources the cluster may have: those it lists and
+// the most its job selector may discover.
+func maxURLs(cluster *api.MetricsCluster) int {
+	urls := len(cluster.Spec.URLs) + len(cluster.Spec.Sources)
+	if selector := cluster.Spec.JobSelector; selector != nil {
+		if selector.Limit > 0 {
+			urls += selector.Limit
+		} else {
+			urls += defaultDiscoveryLimit
+		}
+	}
+	return urls
+}
+
+func (v *urlLimitValidator) isAdmin(user authenticationv1.UserInfo) bool {
+	for _, group := range user.Groups {
+		for _, admin := range v.adminGroups {
+			if group == admin {
+				return true
+			}
+		}
+	}
+	return false
+}
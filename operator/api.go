@@ -0,0 +1,161 @@
+package operator
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// clusterAPIPrefix roots the aggregation API. A request for
+// /api/clusters/<name>/api/v1/query is proxied to the query API of the named
+// cluster, so external tools reach every cluster through the operator with a
+// single credential.
+const clusterAPIPrefix = "/api/clusters/"
+
+// proxiedPaths are the query API paths served for each cluster. The metadata
+// endpoints are included for data sources which offer completion, like
+// Grafana's.
+var proxiedPaths = map[string]bool{
+	"/api/v1/query":       true,
+	"/api/v1/query_range": true,
+	"/api/v1/series":      true,
+	"/api/v1/labels":      true,
+}
+
+// isProxiedPath reports whether path is served for each cluster.
+func isProxiedPath(path string) bool {
+	if proxiedPaths[path] {
+		return true
+	}
+	// Label values, e.g. /api/v1/label/job/values.
+	parts := strings.Split(path, "/")
+	return len(parts) == 6 && parts[3] == "label" && len(parts[4]) > 0 && parts[5] == "values" && strings.HasPrefix(path, "/api/v1/label/")
+}
+
+// everyReplica is a runnable run by every replica of the operator, rather
+// than only by the leader when leader election is enabled.
+type everyReplica func(stop <-chan struct{}) error
+
+func (r everyReplica) Start(stop <-chan struct{}) error {
+	return r(stop)
+}
+
+func (r everyReplica) NeedLeaderElection() bool {
+	return false
+}
+
+// serveAPI runs the aggregation API until stop is closed.
+func (o *Operator) serveAPI(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle(clusterAPIPrefix, o.authenticate(http.HandlerFunc(o.proxyClusterAPI)))
+	mux.HandleFunc("/", o.serveIndex)
+	server := &http.Server{Addr: o.APIBindAddress, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		o.log.Info("serving cluster api", "address", o.APIBindAddress)
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("couldn't serve cluster api: %w", err)
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+}
+
+// querierKey keys the service account a request was authenticated as in its
+// context.
+type querierKey struct{}
+
+// authenticate admits requests bearing the token in APITokenFile. The file is
+// read for each request, so a rotated token takes effect without a restart.
+// Requests bearing another token are admitted if it authenticates a service
+// account, which proxyClusterAPI then checks the cluster allows.
+func (o *Operator) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, err := ioutil.ReadFile(o.APITokenFile)
+		if err != nil {
+			o.log.Error(err, "couldn't read api token")
+			http.Error(w, "couldn't authenticate request", http.StatusInternalServerError)
+			return
+		}
+		token := strings.TrimSpace(string(content))
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(token) > 0 && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		account, err := o.reviewServiceAccount(r.Context(), given)
+		if err != nil {
+			o.log.Error(err, "couldn't authenticate api request")
+			http.Error(w, "couldn't authenticate request", http.StatusInternalServerError)
+			return
+		}
+		if len(account) == 0 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), querierKey{}, account)))
+	})
+}
+
+// proxyClusterAPI forwards a query to the cluster named in the request path.
+func (o *Operator) proxyClusterAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, clusterAPIPrefix)
+	slash := strings.Index(rest, "/")
+	if slash <= 0 || !isProxiedPath(rest[slash:]) {
+		http.NotFound(w, r)
+		return
+	}
+	name, path := rest[:slash], rest[slash:]
+
+	cluster := &api.MetricsCluster{}
+	err := o.client.Get(r.Context(), types.NamespacedName{Namespace: o.Namespace, Name: name}, cluster)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			http.Error(w, fmt.Sprintf("cluster %s not found", name), http.StatusNotFound)
+			return
+		}
+		o.log.Error(err, "couldn't fetch metricscluster", "name", name)
+		http.Error(w, "couldn't fetch cluster", http.StatusInternalServerError)
+		return
+	}
+	if account, isServiceAccount := r.Context().Value(querierKey{}).(string); isServiceAccount {
+		queriers, _ := parseExternalQueriers(cluster)
+		if !queriers.serviceAccounts[account] {
+			http.Error(w, fmt.Sprintf("%s may not query cluster %s", account, name), http.StatusForbidden)
+			return
+		}
+	}
+
+	target, err := url.Parse(o.queryEndpoint(cluster))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = path
+			req.Host = target.Host
+			// The operator's credential is meaningless to the query API.
+			req.Header.Del("Authorization")
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,121 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Sources are often loaded by several clusters, and every replica fetching
+// a source downloads the same multi-GB tarball. With an ArtifactCacheSize,
+// the operator keeps a ReadWriteMany claim of that size in its namespace,
+// which the setup containers of replicas, and of the jobs replaying or
+// uploading sources, mount at artifactCachePath. Tarballs are downloaded into
+// the cache under the SHA-256 of their URL, moved in place once complete so
+// that setups fetching the same tarball at once never read a partial one,
+// and extracted from there. Each setup also deletes the tarballs no setup
+// used for ArtifactCacheTTL, so the cache keeps the sources in use.
+
+// artifactCachePath is where setup containers mount the artifact cache.
+const artifactCachePath = "/cache"
+
+// artifactCacheClaimName returns the name of the artifact cache claim of an
+// operator instance.
+func artifactCacheClaimName(instance string) string {
+	if len(instance) == 0 {
+		return "artifact-cache"
+	}
+	return "artifact-cache-" + instance
+}
+
+func (o *Operator) artifactCacheClaimManifest() *corev1.PersistentVolumeClaim {
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: o.Namespace,
+			Name:      artifactCacheClaimName(o.Instance),
+			Labels: map[string]string{
+				"app": "artifact-cache",
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: *o.artifactCacheSize,
+				},
+			},
+		},
+	}
+	if len(o.ArtifactCacheStorageClass) > 0 {
+		className := o.ArtifactCacheStorageClass
+		claim.Spec.StorageClassName = &className
+	}
+	return claim
+}
+
+// ensureArtifactCache creates the artifact cache claim if it's missing. Like
+// replicas' claims, it isn't updated; resizing the cache means recreating it.
+func (o *Operator) ensureArtifactCache() error {
+	if o.artifactCacheSize == nil {
+		return nil
+	}
+	claim := &corev1.PersistentVolumeClaim{}
+	err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: o.Namespace, Name: artifactCacheClaimName(o.Instance)}, claim)
+	if err == nil {
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't fetch artifact cache: %w", err)
+	}
+	claim = o.artifactCacheClaimManifest()
+	if err := o.client.Create(context.TODO(), claim); err != nil {
+		return fmt.Errorf("couldn't create artifact cache: %w", err)
+	}
+	o.log.Info("created persistentvolumeclaim", "name", claim.Name)
+	return nil
+}
+
+// applyArtifactCache has the pod's setup container fetch through the
+// artifact cache.
+func (o *Operator) applyArtifactCache(podSpec *corev1.PodSpec) {
+	if o.artifactCacheSize == nil {
+		return
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "artifact-cache",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: artifactCacheClaimName(o.Instance)},
+		},
+	})
+	setup := &podSpec.InitContainers[0]
+	setup.VolumeMounts = append(setup.VolumeMounts, corev1.VolumeMount{
+		Name:      "artifact-cache",
+		MountPath: artifactCachePath,
+	})
+	setup.Env = append(setup.Env,
+		corev1.EnvVar{Name: "ARTIFACT_CACHE", Value: artifactCachePath},
+		corev1.EnvVar{Name: "ARTIFACT_CACHE_TTL_MINUTES", Value: strconv.Itoa(int(o.ArtifactCacheTTL.Minutes()))},
+	)
+}
+
+// parseArtifactCacheSize returns the size of the artifact cache, or nil if
+// there's none.
+func parseArtifactCacheSize(size string) (*resource.Quantity, error) {
+	if len(size) == 0 {
+		return nil, nil
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact cache size %q: %w", size, err)
+	}
+	if quantity.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid artifact cache size %q: not positive", size)
+	}
+	return &quantity, nil
+}
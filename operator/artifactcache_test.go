@@ -0,0 +1,94 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseArtifactCacheSize(t *testing.T) {
+	tests := map[string]struct {
+		size    string
+		enabled bool
+		invalid bool
+	}{
+		"disabled": {size: ""},
+		"sized":    {size: "500Gi", enabled: true},
+		"zero":     {size: "0", invalid: true},
+		"garbage":  {size: "lots", invalid: true},
+	}
+	for name, test := range tests {
+		size, err := parseArtifactCacheSize(test.size)
+		if (err != nil) != test.invalid {
+			t.Errorf("%s: expected invalid %t, got %v", name, test.invalid, err)
+		}
+		if (size != nil) != test.enabled {
+			t.Errorf("%s: expected enabled %t, got %v", name, test.enabled, size)
+		}
+	}
+}
+
+func TestApplyArtifactCache(t *testing.T) {
+	o := &Operator{Instance: "ci", PrometheusMemory: "350Mi", ArtifactCacheTTL: 48 * time.Hour}
+	podSpec := o.prometheusPodSpec("prometheus", deploymentInitScript(), nil, corev1.VolumeSource{})
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == "artifact-cache" {
+			t.Fatalf("expected no artifact cache without a size")
+		}
+	}
+
+	o.artifactCacheSize, _ = parseArtifactCacheSize("100Gi")
+	podSpec = o.prometheusPodSpec("prometheus", deploymentInitScript(), nil, corev1.VolumeSource{})
+	claimName := ""
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == "artifact-cache" && volume.PersistentVolumeClaim != nil {
+			claimName = volume.PersistentVolumeClaim.ClaimName
+		}
+	}
+	if claimName != "artifact-cache-ci" {
+		t.Errorf("expected the instance's cache claim to be mounted, got %q", claimName)
+	}
+	setup := podSpec.InitContainers[0]
+	mounted := false
+	for _, mount := range setup.VolumeMounts {
+		if mount.Name == "artifact-cache" && mount.MountPath == artifactCachePath {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Errorf("expected the setup container to mount the cache at %s", artifactCachePath)
+	}
+	env := map[string]string{}
+	for _, variable := range setup.Env {
+		env[variable.Name] = variable.Value
+	}
+	if env["ARTIFACT_CACHE"] != artifactCachePath || env["ARTIFACT_CACHE_TTL_MINUTES"] != "2880" {
+		t.Errorf("unexpected cache environment %v", env)
+	}
+	for _, container := range podSpec.Containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == "artifact-cache" {
+				t.Errorf("expected only the setup container to mount the cache, got %s", container.Name)
+			}
+		}
+	}
+}
+
+func TestArtifactCacheClaimManifest(t *testing.T) {
+	o := &Operator{Namespace: "dowser", ArtifactCacheStorageClass: "nfs"}
+	o.artifactCacheSize, _ = parseArtifactCacheSize("1Ti")
+	claim := o.artifactCacheClaimManifest()
+	if claim.Name != "artifact-cache" || claim.Namespace != "dowser" {
+		t.Errorf("unexpected claim %s/%s", claim.Namespace, claim.Name)
+	}
+	if len(claim.Spec.AccessModes) != 1 || claim.Spec.AccessModes[0] != corev1.ReadWriteMany {
+		t.Errorf("expected the cache to be shared, got access modes %v", claim.Spec.AccessModes)
+	}
+	if size := claim.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != "1Ti" {
+		t.Errorf("expected a 1Ti claim, got %s", size.String())
+	}
+	if claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName != "nfs" {
+		t.Errorf("expected the nfs storage class, got %v", claim.Spec.StorageClassName)
+	}
+}
@@ -0,0 +1,76 @@
+package operator
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+)
+
+// Builds of the OpenShift CI archive their Prometheus tarball as
+// metrics/prometheus.tar under a step's artifacts, and any such tarball is
+// found. Prow deployments laying out artifacts differently are given
+// ArtifactPathTemplates instead: Go templates over the build's prow job
+// rendering globs of the tarball's path relative to the build's directory in
+// the bucket, e.g. artifacts/{{.Job}}/*/prometheus.tar.gz. The first glob
+// matching an object of the build wins.
+
+// artifactPathData is what artifact path templates are rendered with.
+type artifactPathData struct {
+	// Job, BuildID and Type are the build's job name, ID and type
+	// (periodic, postsubmit, presubmit or batch).
+	Job     string
+	BuildID string
+	Type    string
+
+	// Org, Repo and BaseRef are the repository the build checked out, if
+	// any, and Pull the number of the pull request it tested, or 0.
+	Org     string
+	Repo    string
+	BaseRef string
+	Pull    int
+
+	// ProwJob is the whole prow job, for anything else.
+	ProwJob prowapi.ProwJob
+}
+
+// parseArtifactPathTemplates parses the artifact path templates given as
+// options.
+func parseArtifactPathTemplates(texts []string) ([]*template.Template, error) {
+	var templates []*template.Template
+	for i, text := range texts {
+		parsed, err := template.New(fmt.Sprintf("artifact-path-%d", i)).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifact path template %q: %w", text, err)
+		}
+		templates = append(templates, parsed)
+	}
+	return templates, nil
+}
+
+// artifactPaths returns the globs of the path of the job's tarball rendered
+// from ArtifactPathTemplates, or nil if there are none.
+func (o *Operator) artifactPaths(job prowapi.ProwJob) ([]string, error) {
+	data := artifactPathData{
+		Job:     job.Spec.Job,
+		BuildID: job.Status.BuildID,
+		Type:    string(job.Spec.Type),
+		ProwJob: job,
+	}
+	if refs := job.Spec.Refs; refs != nil {
+		data.Org, data.Repo, data.BaseRef = refs.Org, refs.Repo, refs.BaseRef
+		if len(refs.Pulls) > 0 {
+			data.Pull = refs.Pulls[0].Number
+		}
+	}
+	var paths []string
+	for _, pathTemplate := range o.artifactPathTemplates {
+		var path bytes.Buffer
+		if err := pathTemplate.Execute(&path, data); err != nil {
+			return nil, fmt.Errorf("couldn't render artifact path template %s: %w", pathTemplate.Name(), err)
+		}
+		paths = append(paths, path.String())
+	}
+	return paths, nil
+}
@@ -0,0 +1,46 @@
+package operator
+
+import (
+	"reflect"
+	"testing"
+
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+)
+
+func TestArtifactPaths(t *testing.T) {
+	templates, err := parseArtifactPathTemplates([]string{
+		"artifacts/{{.Job}}/*/prometheus.tar.gz",
+		"pr-logs/{{.Org}}_{{.Repo}}/{{.Pull}}/{{.BuildID}}/prometheus.tar",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Operator{artifactPathTemplates: templates}
+	job := prowapi.ProwJob{
+		Spec: prowapi.ProwJobSpec{
+			Job:  "pull-e2e",
+			Type: prowapi.PresubmitJob,
+			Refs: &prowapi.Refs{Org: "kubernetes", Repo: "kubernetes", Pulls: []prowapi.Pull{{Number: 42}}},
+		},
+		Status: prowapi.ProwJobStatus{BuildID: "1"},
+	}
+	paths, err := o.artifactPaths(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"artifacts/pull-e2e/*/prometheus.tar.gz", "pr-logs/kubernetes_kubernetes/42/1/prometheus.tar"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	if paths, err := (&Operator{}).artifactPaths(job); err != nil || paths != nil {
+		t.Errorf("expected no paths without templates, got %v, %v", paths, err)
+	}
+	if _, err := parseArtifactPathTemplates([]string{"{{.Job"}); err == nil {
+		t.Errorf("expected an invalid template to be refused")
+	}
+	templates, _ = parseArtifactPathTemplates([]string{"{{.Missing}}"})
+	if _, err := (&Operator{artifactPathTemplates: templates}).artifactPaths(job); err == nil {
+		t.Errorf("expected a template of an unknown field to fail")
+	}
+}
@@ -0,0 +1,252 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Fetchers can be held to a download bandwidth so mass imports don't saturate
+// the cluster's egress. Each fetcher limits itself with a token bucket to
+// the per-pod bandwidth, and, with a namespace-wide bandwidth, to its share
+// of it: the operator periodically splits the bandwidth evenly between the
+// pods whose setup container is running and annotates each with its share,
+// which the fetcher reads through the downward API as it changes. Until a
+// new pod is given its share, it's only held to the per-pod bandwidth.
+
+// fetchBandwidthAnnotation on a fetching pod is its share of the
+// namespace-wide bandwidth, in bytes per second.
+const fetchBandwidthAnnotation = "dowser.dowser/fetch-bandwidth"
+
+// The downward API volume the fetcher reads its share from.
+const (
+	fetchBandwidthVolume = "fetch-bandwidth"
+	fetchBandwidthPath   = "/etc/fetch-bandwidth/"
+	fetchBandwidthKey    = "bandwidth"
+)
+
+// fetchBandwidthInterval is how often shares are rebalanced, and how often
+// fetchers read theirs.
+const fetchBandwidthInterval = 5 * time.Second
+
+// parseBandwidth returns a bandwidth given as a quantity of bytes per
+// second, e.g. 50Mi, or zero if none is given.
+func parseBandwidth(flag, bandwidth string) (int64, error) {
+	if len(bandwidth) == 0 {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(bandwidth)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", flag, bandwidth, err)
+	}
+	if quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: not positive", flag, bandwidth)
+	}
+	return quantity.Value(), nil
+}
+
+// applyFetchBandwidth holds the pod's setup container to the per-pod
+// bandwidth, and has it read its share of the namespace-wide one.
+func (o *Operator) applyFetchBandwidth(podSpec *corev1.PodSpec) {
+	setup := &podSpec.InitContainers[0]
+	if o.fetchBandwidthPerPod > 0 {
+		setup.Env = append(setup.Env, corev1.EnvVar{Name: "FETCH_BANDWIDTH", Value: strconv.FormatInt(o.fetchBandwidthPerPod, 10)})
+	}
+	if o.fetchBandwidth == 0 {
+		return
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: fetchBandwidthVolume,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{
+						Path:     fetchBandwidthKey,
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", fetchBandwidthAnnotation)},
+					},
+				},
+			},
+		},
+	})
+	setup.VolumeMounts = append(setup.VolumeMounts, corev1.VolumeMount{
+		Name:      fetchBandwidthVolume,
+		MountPath: fetchBandwidthPath,
+		ReadOnly:  true,
+	})
+	setup.Env = append(setup.Env, corev1.EnvVar{Name: "FETCH_BANDWIDTH_FILE", Value: fetchBandwidthPath + fetchBandwidthKey})
+}
+
+// fetchBandwidthShare returns the share of the namespace-wide bandwidth of
+// each of the fetching pods, at most the per-pod bandwidth if there's one.
+func fetchBandwidthShare(bandwidth, perPod int64, fetching int) int64 {
+	share := bandwidth
+	if fetching > 1 {
+		share = bandwidth / int64(fetching)
+	}
+	if perPod > 0 && share > perPod {
+		share = perPod
+	}
+	if share < 1 {
+		share = 1
+	}
+	return share
+}
+
+// isFetching returns whether the pod's setup container is fetching within the
+// namespace-wide bandwidth. Idle pool pods wait for a claim in theirs.
+func isFetching(pod *corev1.Pod) bool {
+	if pod.Labels["pool"] == "idle" || pod.DeletionTimestamp != nil {
+		return false
+	}
+	hasVolume := false
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == fetchBandwidthVolume {
+			hasVolume = true
+		}
+	}
+	if !hasVolume {
+		return false
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name == "setup" && status.State.Running != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// balanceFetchBandwidth periodically splits the namespace-wide bandwidth
+// between the fetching pods.
+func (o *Operator) balanceFetchBandwidth(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if err := o.updateFetchBandwidthShares(); err != nil {
+			o.log.Error(err, "couldn't balance fetch bandwidth")
+		}
+	}, fetchBandwidthInterval, stop)
+	return nil
+}
+
+// updateFetchBandwidthShares annotates each fetching pod with its share of the
+// namespace-wide bandwidth.
+func (o *Operator) updateFetchBandwidthShares() error {
+	pods := &corev1.PodList{}
+	if err := o.client.List(context.TODO(), pods, client.InNamespace(o.Namespace)); err != nil {
+		return fmt.Errorf("couldn't list pods: %w", err)
+	}
+	var fetching []*corev1.Pod
+	for i := range pods.Items {
+		if pod := &pods.Items[i]; o.ownsObject(pod) && isFetching(pod) {
+			fetching = append(fetching, pod)
+		}
+	}
+	if len(fetching) == 0 {
+		return nil
+	}
+	share := strconv.FormatInt(fetchBandwidthShare(o.fetchBandwidth, o.fetchBandwidthPerPod, len(fetching)), 10)
+	for _, pod := range fetching {
+		if pod.Annotations[fetchBandwidthAnnotation] == share {
+			continue
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[fetchBandwidthAnnotation] = share
+		if err := o.client.Update(context.TODO(), pod); err != nil {
+			// The pod is given its share on the next round.
+			o.log.Error(err, "couldn't update fetch bandwidth", "pod", pod.Name)
+			continue
+		}
+		o.log.V(1).Info("updated fetch bandwidth", "pod", pod.Name, "bandwidth", share, "fetching", len(fetching))
+	}
+	return nil
+}
+
+// tokenBucket limits a flow of bytes to a rate in bytes per second, letting
+// through bursts of up to a second's worth. Bytes taken beyond the tokens
+// available are owed, and taking them waits until they're paid back.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newTokenBucket returns a bucket limiting to rate bytes per second, or not
+// limiting while the rate is zero.
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), now: time.Now, sleep: time.Sleep}
+}
+
+// setRate changes the rate of the bucket; zero stops limiting.
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = float64(rate)
+}
+
+// take takes n bytes from the bucket, waiting for them to be available.
+func (b *tokenBucket) take(n int) {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+	now := b.now()
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+	if wait > 0 {
+		b.sleep(wait)
+	}
+}
+
+// fetchBandwidth returns the token bucket holding the fetcher to its
+// bandwidth: the per-pod one, and its share of the namespace-wide one, read
+// from the bandwidth file until stop is closed.
+func fetchBandwidth(options fetcherOptions, log logr.Logger, stop <-chan struct{}) *tokenBucket {
+	bucket := newTokenBucket(options.Bandwidth)
+	if len(options.BandwidthFile) == 0 {
+		return bucket
+	}
+	var current int64 = -1
+	update := func() {
+		rate := options.Bandwidth
+		content, err := ioutil.ReadFile(options.BandwidthFile)
+		if err == nil {
+			if share, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err == nil && share > 0 && (rate == 0 || share < rate) {
+				rate = share
+			}
+		}
+		if rate != current {
+			bucket.setRate(rate)
+			current = rate
+			log.Info("fetch bandwidth", "bytesPerSecond", rate)
+		}
+	}
+	update()
+	go wait.Until(update, fetchBandwidthInterval, stop)
+	return bucket
+}
@@ -0,0 +1,122 @@
+package operator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logging "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestTokenBucket(t *testing.T) {
+	clock := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	start := clock
+	bucket := newTokenBucket(1000)
+	bucket.now = func() time.Time { return clock }
+	bucket.sleep = func(d time.Duration) { clock = clock.Add(d) }
+
+	// A second's worth goes through at once, the rest at the rate.
+	for i := 0; i < 10; i++ {
+		bucket.take(500)
+	}
+	if elapsed := clock.Sub(start); elapsed != 4*time.Second {
+		t.Errorf("expected 5000 bytes at 1000/s after a burst of 1000 to take 4s, took %s", elapsed)
+	}
+
+	bucket.setRate(0)
+	before := clock
+	bucket.take(1 << 30)
+	if clock != before {
+		t.Errorf("expected no wait without a rate")
+	}
+}
+
+func TestFetchBandwidthShare(t *testing.T) {
+	tests := []struct {
+		bandwidth, perPod int64
+		fetching          int
+		expected          int64
+	}{
+		{bandwidth: 100, fetching: 1, expected: 100},
+		{bandwidth: 100, fetching: 4, expected: 25},
+		{bandwidth: 100, perPod: 10, fetching: 4, expected: 10},
+		{bandwidth: 3, fetching: 4, expected: 1},
+	}
+	for _, test := range tests {
+		if share := fetchBandwidthShare(test.bandwidth, test.perPod, test.fetching); share != test.expected {
+			t.Errorf("%d split between %d pods of at most %d: expected %d, got %d", test.bandwidth, test.fetching, test.perPod, test.expected, share)
+		}
+	}
+}
+
+func TestIsFetching(t *testing.T) {
+	pod := func(labels map[string]string, volume bool, running bool) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: labels}}
+		if volume {
+			pod.Spec.Volumes = []corev1.Volume{{Name: fetchBandwidthVolume}}
+		}
+		state := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}
+		if running {
+			state = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+		}
+		pod.Status.InitContainerStatuses = []corev1.ContainerStatus{{Name: "setup", State: state}}
+		return pod
+	}
+
+	if !isFetching(pod(map[string]string{"app": "prometheus"}, true, true)) {
+		t.Errorf("expected a replica in its setup container to be fetching")
+	}
+	if isFetching(pod(map[string]string{"app": "prometheus"}, true, false)) {
+		t.Errorf("expected a replica done with its setup container not to be fetching")
+	}
+	if isFetching(pod(map[string]string{"app": "prometheus-pool", "pool": "idle"}, true, true)) {
+		t.Errorf("expected an idle pool pod not to be fetching")
+	}
+	if isFetching(pod(map[string]string{"app": "prometheus"}, false, true)) {
+		t.Errorf("expected a pod created without a share not to be counted")
+	}
+}
+
+func TestFetchBandwidth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bandwidth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, fetchBandwidthKey)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	rate := func(bucket *tokenBucket) float64 {
+		bucket.lock.Lock()
+		defer bucket.lock.Unlock()
+		return bucket.rate
+	}
+
+	// Until the pod is given its share, the per-pod bandwidth applies.
+	bucket := fetchBandwidth(fetcherOptions{Bandwidth: 1000, BandwidthFile: file}, logging.Log, stop)
+	if rate(bucket) != 1000 {
+		t.Errorf("expected the per-pod bandwidth, got %v", rate(bucket))
+	}
+
+	if err := ioutil.WriteFile(file, []byte("250"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if bucket := fetchBandwidth(fetcherOptions{Bandwidth: 1000, BandwidthFile: file}, logging.Log, stop); rate(bucket) != 250 {
+		t.Errorf("expected the pod's share, got %v", rate(bucket))
+	}
+	if bucket := fetchBandwidth(fetcherOptions{Bandwidth: 100, BandwidthFile: file}, logging.Log, stop); rate(bucket) != 100 {
+		t.Errorf("expected the per-pod bandwidth below the pod's share, got %v", rate(bucket))
+	}
+
+	if _, err := parseBandwidth("fetch bandwidth", "50Mi"); err != nil {
+		t.Errorf("expected a quantity to be valid: %v", err)
+	}
+	if _, err := parseBandwidth("fetch bandwidth", "-1"); err == nil {
+		t.Errorf("expected a negative bandwidth to be refused")
+	}
+}
@@ -0,0 +1,401 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Blocks-only sources are uploaded to the cluster's bucket by a Job per
+// cluster and source. The Job's pod fetches the data like a replica and runs
+// Prometheus over it with a Thanos sidecar shipping its blocks; once every
+// block is shipped the sidecar stops and shuts Prometheus down so the pod
+// completes. A store gateway per cluster serves the bucket to the cluster's
+// query. Only persisted blocks are uploaded: samples still in the WAL when
+// the tarball was taken aren't served.
+
+// sourceMode returns how the source at url is served.
+func sourceMode(cluster *api.MetricsCluster, url string) api.SourceMode {
+	for _, source := range cluster.Spec.Sources {
+		if source.URL == url {
+			return source.Mode
+		}
+	}
+	return api.SourceModeReplica
+}
+
+// hasStoreGateway returns whether the cluster serves blocks-only sources or
+// archived replicas from a store gateway.
+func hasStoreGateway(cluster *api.MetricsCluster) bool {
+	if cluster.Spec.ObjectStorage == nil || cluster.Spec.Backend == api.BackendVictoriaMetrics {
+		return false
+	}
+	if cluster.Spec.ObjectStorage.ArchiveReplicas {
+		return true
+	}
+	for _, source := range cluster.Spec.Sources {
+		if source.Mode == api.SourceModeBlocksOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// applyReplicaArchive has the sidecar of a replica's deployment ship its
+// blocks to the bucket of the first of the referencing clusters archiving
+// replicas, if any.
+func applyReplicaArchive(deployment *appsv1.Deployment, referencing []*api.MetricsCluster) {
+	for _, cluster := range referencing {
+		if !hasStoreGateway(cluster) || !cluster.Spec.ObjectStorage.ArchiveReplicas {
+			continue
+		}
+		podSpec := &deployment.Spec.Template.Spec
+		podSpec.Volumes = append(podSpec.Volumes, objstoreVolume(cluster))
+		for i := range podSpec.Containers {
+			container := &podSpec.Containers[i]
+			if container.Name != "thanos-sidecar" {
+				continue
+			}
+			container.Command = append(container.Command, "--objstore.config-file=/etc/thanos/"+objstoreConfigKey)
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      "objstore",
+				MountPath: "/etc/thanos/",
+				ReadOnly:  true,
+			})
+		}
+		return
+	}
+}
+
+// blockUploadScript runs the sidecar command until every block in the TSDB is
+// recorded as shipped, then stops Prometheus. Blocks being written are in
+// directories with a suffix after their ULID.
+func blockUploadScript(sidecarCommand []string) string {
+	return strings.Join(sidecarCommand, " ") + ` &
+SIDECAR=$!
+while sleep 10; do
+  PENDING=0
+  for META in /prometheus/*/meta.json; do
+    [ -e "${META}" ] || continue
+    BLOCK=$(basename $(dirname ${META}))
+    case "${BLOCK}" in *.*) continue;; esac
+    grep -q "${BLOCK}" /prometheus/thanos.shipper.json 2>/dev/null || PENDING=1
+  done
+  [ ${PENDING} = 0 ] && break
+done
+kill ${SIDECAR}
+until wget -q -O /dev/null --post-data= http://localhost:9090/-/quit; do
+  sleep 5
+done
+`
+}
+
+func (o *Operator) blockUploadJobManifest(name types.NamespacedName, cluster *api.MetricsCluster, job *Job, deploymentName string) (*batchv1.Job, error) {
+	var backoffLimit int32 = 2
+
+	// The sidecar only ships blocks of a Prometheus with external labels, so
+	// the fetcher writes the configuration of a replica for the uploading
+	// Prometheus.
+	podSpec := o.prometheusPodSpec(job.PrometheusImage, deploymentInitScript(), []corev1.EnvVar{
+		{
+			Name:  "PROMTAR",
+			Value: job.PrometheusTarURL,
+		},
+		{
+			Name:  "PROMETHEUS_CONFIG_FILE",
+			Value: "/etc/prometheus/" + prometheusConfigKey,
+		},
+		{
+			Name:  "REPLICA",
+			Value: deploymentName,
+		},
+		{
+			Name:  "JOB_URL",
+			Value: job.Status.URL,
+		},
+		{
+			Name:  "JOB_NAME",
+			Value: job.Spec.Job,
+		},
+		{
+			Name:  "DISPLAY_NAME",
+			Value: job.DisplayName,
+		},
+	}, corev1.VolumeSource{
+		EmptyDir: &corev1.EmptyDirVolumeSource{},
+	})
+	podSpec.InitContainers[0].VolumeMounts = append(podSpec.InitContainers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      "prometheus-config",
+		MountPath: "/etc/prometheus/",
+	})
+	applyChecksumPin(&podSpec, job.SHA256)
+	enablePrometheusFeatures(&podSpec, cluster.Spec.PrometheusFeatures)
+	applyPrometheusResources(&podSpec, []*api.MetricsCluster{cluster})
+	podSpec.RestartPolicy = corev1.RestartPolicyNever
+	podSpec.Volumes = append(podSpec.Volumes, objstoreVolume(cluster))
+	sidecar := &podSpec.Containers[1]
+	sidecarCommand := append(sidecar.Command, "--objstore.config-file=/etc/thanos/"+objstoreConfigKey)
+	sidecar.Name = "upload"
+	sidecar.Command = []string{"/bin/sh", "-c", blockUploadScript(sidecarCommand)}
+	sidecar.VolumeMounts = append(sidecar.VolumeMounts, corev1.VolumeMount{
+		Name:      "objstore",
+		MountPath: "/etc/thanos/",
+		ReadOnly:  true,
+	})
+
+	uploadJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: name.Namespace,
+			Name:      name.Name,
+			Labels: map[string]string{
+				"app":        "block-upload",
+				"cluster":    cluster.Name,
+				"prometheus": deploymentName,
+			},
+			Annotations: map[string]string{
+				"url": job.Status.URL,
+			},
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"app":     "block-upload",
+						"cluster": cluster.Name,
+					},
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+	o.hardenPodSpec(&uploadJob.Spec.Template.Spec)
+	return uploadJob, nil
+}
+
+// ensureBlockUpload starts the named Job uploading the job's blocks to the
+// cluster's bucket if it hasn't been yet, and returns the upload's progress.
+// Like replays, uploads run once and only for jobs which have completed.
+func (o *Operator) ensureBlockUpload(name types.NamespacedName, cluster *api.MetricsCluster, job *Job, deploymentName string) (api.ReplayPhase, error) {
+	if job.Status.CompletionTime == nil {
+		return "", nil
+	}
+	uploadJob := &batchv1.Job{}
+	err := o.client.Get(context.TODO(), name, uploadJob)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return "", fmt.Errorf("couldn't fetch block upload job: %w", err)
+		}
+		uploadJob, err = o.blockUploadJobManifest(name, cluster, job, deploymentName)
+		if err != nil {
+			return "", err
+		}
+		if err := o.client.Create(context.TODO(), uploadJob); err != nil {
+			return "", fmt.Errorf("couldn't create block upload job: %w", err)
+		}
+		o.log.Info("created block upload job", "name", uploadJob.Name, "url", job.Status.URL)
+		return api.ReplayRunning, nil
+	}
+	return replayJobPhase(uploadJob), nil
+}
+
+// uploadSourceBlocks uploads the blocks of a blocks-only source to the
+// cluster's bucket, and returns its status and whether the upload failed.
+func (o *Operator) uploadSourceBlocks(cluster *api.MetricsCluster, job *Job, url, deploymentName string) (api.JobStatus, bool, error) {
+	jobStatus := api.JobStatus{URL: url}
+	if cluster.Spec.ObjectStorage == nil {
+		jobStatus.Message = "blocks-only sources need objectStorage to be set"
+		return jobStatus, true, nil
+	}
+	var err error
+	jobStatus.Replay, err = o.ensureBlockUpload(o.replayJobName("upload", cluster, deploymentName), cluster, job, deploymentName)
+	if err != nil {
+		return jobStatus, false, err
+	}
+	switch jobStatus.Replay {
+	case api.ReplaySucceeded:
+		jobStatus.Ready = true
+	case api.ReplayFailed:
+		jobStatus.Message = "couldn't upload the blocks"
+		return jobStatus, true, nil
+	case "":
+		jobStatus.Message = "waiting for the job to complete"
+	}
+	return jobStatus, false, nil
+}
+
+func (o *Operator) storeGatewayName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("storegateway-%s", cluster.Name)}
+}
+
+func (o *Operator) storeGatewayDeploymentManifest(cluster *api.MetricsCluster) *appsv1.Deployment {
+	name := o.storeGatewayName(cluster)
+	var replicas int32 = 1
+	labels := map[string]string{
+		"app":     "thanos-store-gateway",
+		"cluster": cluster.Name,
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						objstoreVolume(cluster),
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:  "store",
+							Image: o.ThanosImage,
+							Command: []string{
+								"/bin/thanos",
+								"store",
+								"--data-dir=/var/thanos/store",
+								"--objstore.config-file=/etc/thanos/" + objstoreConfigKey,
+								"--grpc-address=0.0.0.0:10901",
+								"--http-address=0.0.0.0:10902",
+								// Uploads finishing are picked up quickly
+								// rather than at the default 3m.
+								"--sync-block-duration=1m",
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "grpc",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: 10901,
+								},
+								{
+									Name:          "http",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: 10902,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "objstore",
+									MountPath: "/etc/thanos/",
+									ReadOnly:  true,
+								},
+								{
+									Name:      "data",
+									MountPath: "/var/thanos/store",
+								},
+							},
+							ReadinessProbe: readinessProbe("/-/ready", 10902),
+							LivenessProbe:  livenessProbe("/-/healthy", 10902),
+						},
+					},
+				},
+			},
+		},
+	}
+	applyThanosResources(&deployment.Spec.Template.Spec, cluster)
+	o.applyTracing(&deployment.Spec.Template.Spec, "store", "thanos-store")
+	o.hardenPodSpec(&deployment.Spec.Template.Spec)
+	return deployment
+}
+
+func (o *Operator) storeGatewayServiceManifest(cluster *api.MetricsCluster) *corev1.Service {
+	name := o.storeGatewayName(cluster)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Ports: []corev1.ServicePort{
+				{
+					Name:     "grpc",
+					Port:     10901,
+					Protocol: corev1.ProtocolTCP,
+				},
+				{
+					Name:     "http",
+					Port:     10902,
+					Protocol: corev1.ProtocolTCP,
+				},
+			},
+			Selector: map[string]string{
+				"app":     "thanos-store-gateway",
+				"cluster": cluster.Name,
+			},
+		},
+	}
+}
+
+// ensureStoreGateway creates the cluster's store gateway when it has
+// blocks-only sources, and removes it otherwise. It returns whether the
+// gateway is available; clusters without one report false.
+func (o *Operator) ensureStoreGateway(cluster *api.MetricsCluster) (bool, error) {
+	enabled := hasStoreGateway(cluster)
+	name := o.storeGatewayName(cluster)
+	deployment := &appsv1.Deployment{}
+	resources := []managedResource{
+		{"deployment", deployment, func() runtime.Object { return o.storeGatewayDeploymentManifest(cluster) }},
+		{"service", &corev1.Service{}, func() runtime.Object { return o.storeGatewayServiceManifest(cluster) }},
+	}
+	for _, resource := range resources {
+		err := o.client.Get(context.TODO(), name, resource.current)
+		exists := true
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return false, fmt.Errorf("couldn't fetch store gateway %s: %w", resource.kind, err)
+			}
+			exists = false
+		}
+		switch {
+		case enabled && !exists:
+			if err := o.client.Create(context.TODO(), resource.manifest()); err != nil {
+				return false, fmt.Errorf("couldn't create store gateway %s: %w", resource.kind, err)
+			}
+			o.log.Info("created store gateway "+resource.kind, "name", name.Name)
+		case enabled && exists && resource.kind == "deployment":
+			current, wanted := &deployment.Spec.Template.Spec.Containers[0], resource.manifest().(*appsv1.Deployment).Spec.Template.Spec.Containers[0]
+			if !equality.Semantic.DeepEqual(current.Resources, wanted.Resources) {
+				current.Resources = wanted.Resources
+				if err := o.client.Update(context.TODO(), deployment); err != nil {
+					return false, fmt.Errorf("couldn't update store gateway deployment: %w", err)
+				}
+				o.log.Info("updated store gateway deployment", "name", name.Name)
+			}
+		case !enabled && exists:
+			if err := o.client.Delete(context.TODO(), resource.current); err != nil && !errors.IsNotFound(err) {
+				return false, fmt.Errorf("couldn't delete store gateway %s: %w", resource.kind, err)
+			}
+			o.log.Info("deleted store gateway "+resource.kind, "name", name.Name)
+		}
+	}
+	return enabled && deployment.Status.AvailableReplicas > 0, nil
+}
@@ -0,0 +1,49 @@
+package operator
+
+import (
+	"reflect"
+	"testing"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestDesiredURLsWithSources(t *testing.T) {
+	cluster := &api.MetricsCluster{
+		Spec: api.MetricsClusterSpec{
+			URLs: []string{"https://a", "https://b"},
+			Sources: []api.Source{
+				{URL: "https://b", Mode: api.SourceModeBlocksOnly},
+				{URL: "https://c", Mode: api.SourceModeBlocksOnly},
+			},
+		},
+		Status: api.MetricsClusterStatus{
+			SourcesFrom: &api.SourcesFromStatus{URLs: []string{"https://a", "https://e"}},
+			Discovery:   &api.DiscoveryStatus{URLs: []string{"https://c", "https://d"}},
+		},
+	}
+	expected := []string{"https://a", "https://b", "https://c", "https://e", "https://d"}
+	if urls := desiredURLs(cluster); !reflect.DeepEqual(urls, expected) {
+		t.Errorf("expected %v, got %v", expected, urls)
+	}
+	if mode := sourceMode(cluster, "https://b"); mode != api.SourceModeBlocksOnly {
+		t.Errorf("expected listed source's mode to apply, got %q", mode)
+	}
+	if mode := sourceMode(cluster, "https://d"); mode != api.SourceModeReplica {
+		t.Errorf("expected discovered source to be served by a replica, got %q", mode)
+	}
+	if hasStoreGateway(cluster) {
+		t.Errorf("expected no store gateway without object storage")
+	}
+	cluster.Spec.ObjectStorage = &api.ObjectStorageSpec{SecretName: "bucket"}
+	if !hasStoreGateway(cluster) {
+		t.Errorf("expected a store gateway serving blocks-only sources")
+	}
+	cluster.Spec.Sources = nil
+	if hasStoreGateway(cluster) {
+		t.Errorf("expected no store gateway without blocks-only sources")
+	}
+	cluster.Spec.ObjectStorage.ArchiveReplicas = true
+	if !hasStoreGateway(cluster) {
+		t.Errorf("expected a store gateway serving archived replicas")
+	}
+}
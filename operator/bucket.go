@@ -0,0 +1,163 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// objstoreConfigKey is the key of the Thanos object storage configuration in
+// a cluster's object storage Secret.
+const objstoreConfigKey = "objstore.yml"
+
+// objstoreVolume mounts the cluster's object storage configuration.
+func objstoreVolume(cluster *api.MetricsCluster) corev1.Volume {
+	return corev1.Volume{
+		Name: "objstore",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: cluster.Spec.ObjectStorage.SecretName,
+			},
+		},
+	}
+}
+
+// thanosBucketCommand returns the command running a bucket tool, which moved
+// under the tools command in v0.15.0.
+func (o *Operator) thanosBucketCommand(tool string) []string {
+	if o.thanosAtLeast("v0.15.0") {
+		return []string{"/bin/thanos", "tools", "bucket", tool}
+	}
+	return []string{"/bin/thanos", "bucket", tool}
+}
+
+func (o *Operator) bucketWebName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("bucket-%s", cluster.Name)}
+}
+
+func (o *Operator) bucketWebDeploymentManifest(cluster *api.MetricsCluster) *appsv1.Deployment {
+	name := o.bucketWebName(cluster)
+	var replicas int32 = 1
+	labels := map[string]string{
+		"app":     "thanos-bucket-web",
+		"cluster": cluster.Name,
+	}
+	command := append(o.thanosBucketCommand("web"),
+		"--http-address=0.0.0.0:10902",
+		"--objstore.config-file=/etc/thanos/"+objstoreConfigKey,
+	)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{objstoreVolume(cluster)},
+					Containers: []corev1.Container{
+						{
+							Name:    "bucket-web",
+							Image:   o.ThanosImage,
+							Command: command,
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: 10902,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "objstore",
+									MountPath: "/etc/thanos/",
+									ReadOnly:  true,
+								},
+							},
+							ReadinessProbe: readinessProbe("/-/ready", 10902),
+							LivenessProbe:  livenessProbe("/-/healthy", 10902),
+						},
+					},
+				},
+			},
+		},
+	}
+	o.hardenPodSpec(&deployment.Spec.Template.Spec)
+	return deployment
+}
+
+func (o *Operator) bucketWebServiceManifest(cluster *api.MetricsCluster) *corev1.Service {
+	name := o.bucketWebName(cluster)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port:     10902,
+					Protocol: corev1.ProtocolTCP,
+					Name:     "http",
+				},
+			},
+			Selector: map[string]string{
+				"app":     "thanos-bucket-web",
+				"cluster": cluster.Name,
+			},
+		},
+	}
+}
+
+// ensureBucketWeb creates the cluster's bucket web UI when it's enabled, and
+// removes it otherwise.
+func (o *Operator) ensureBucketWeb(cluster *api.MetricsCluster) error {
+	enabled := cluster.Spec.ObjectStorage != nil && cluster.Spec.ObjectStorage.BucketWeb
+	name := o.bucketWebName(cluster)
+	resources := []managedResource{
+		{"deployment", &appsv1.Deployment{}, func() runtime.Object { return o.bucketWebDeploymentManifest(cluster) }},
+		{"service", &corev1.Service{}, func() runtime.Object { return o.bucketWebServiceManifest(cluster) }},
+	}
+	resources = append(resources, o.exposureResources(name, name.Name, clusterOwner(cluster))...)
+	for _, resource := range resources {
+		err := o.client.Get(context.TODO(), name, resource.current)
+		exists := true
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return fmt.Errorf("couldn't fetch %s: %w", resource.kind, err)
+			}
+			exists = false
+		}
+		switch {
+		case enabled && !exists:
+			if err := o.client.Create(context.TODO(), resource.manifest()); err != nil {
+				return fmt.Errorf("couldn't create %s: %w", resource.kind, err)
+			}
+			o.log.Info("created "+resource.kind, "name", name.Name)
+		case !enabled && exists:
+			if err := o.client.Delete(context.TODO(), resource.current); err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("couldn't delete %s: %w", resource.kind, err)
+			}
+			o.log.Info("deleted "+resource.kind, "name", name.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package operator
+
+import (
+	"sort"
+
+	"github.com/go-logr/logr"
+	routev1 "github.com/openshift/api/route/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Optional APIs are detected once at startup, and the features depending on
+// them are only enabled when the cluster serves them, so the operator runs
+// on vanilla Kubernetes as well as on OpenShift. What was detected is logged
+// and reported by the dowser_capability metric.
+
+// Capabilities the operator detects.
+const (
+	capabilityRoute          = "route"
+	capabilityConsoleLink    = "consolelink"
+	capabilityServiceMonitor = "servicemonitor"
+	capabilityVPA            = "vpa"
+	capabilityGatewayAPI     = "gateway"
+)
+
+// optionalAPIs are the kinds whose availability makes each capability.
+var optionalAPIs = map[string]schema.GroupVersionKind{
+	capabilityRoute:          routev1.GroupVersion.WithKind("Route"),
+	capabilityConsoleLink:    {Group: "console.openshift.io", Version: "v1", Kind: "ConsoleLink"},
+	capabilityServiceMonitor: {Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"},
+	capabilityVPA:            {Group: "autoscaling.k8s.io", Version: "v1", Kind: "VerticalPodAutoscaler"},
+	capabilityGatewayAPI:     {Group: "gateway.networking.k8s.io", Version: "v1beta1", Kind: "HTTPRoute"},
+}
+
+var capabilityAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "dowser_capability",
+	Help: "Whether an optional API the operator can use is served, detected at startup.",
+}, []string{"capability"})
+
+func init() {
+	metrics.Registry.MustRegister(capabilityAvailable)
+}
+
+// capabilities are the optional APIs the cluster serves.
+type capabilities map[string]bool
+
+// detectCapabilities looks up which optional APIs the cluster serves. APIs
+// which can't be looked up, such as aggregated APIs whose server is down, are
+// taken as unavailable rather than failing the operator's startup.
+func detectCapabilities(mapper meta.RESTMapper, log logr.Logger) capabilities {
+	detected := capabilities{}
+	for name, gvk := range optionalAPIs {
+		_, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil && !meta.IsNoMatchError(err) {
+			log.Error(err, "couldn't look up optional api, disabling it", "capability", name, "kind", gvk.String())
+		}
+		detected[name] = err == nil
+	}
+	return detected
+}
+
+// report logs the capabilities and records them in the dowser_capability
+// metric.
+func (c capabilities) report(log logr.Logger) {
+	var available, unavailable []string
+	for name := range optionalAPIs {
+		if c[name] {
+			available = append(available, name)
+			capabilityAvailable.WithLabelValues(name).Set(1)
+		} else {
+			unavailable = append(unavailable, name)
+			capabilityAvailable.WithLabelValues(name).Set(0)
+		}
+	}
+	sort.Strings(available)
+	sort.Strings(unavailable)
+	log.Info("detected capabilities", "available", available, "unavailable", unavailable)
+}
@@ -0,0 +1,107 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Setup containers compute the SHA-256 of the tarball they extract and report
+// it as their termination message, which the operator records in the
+// source's status. A source pinned to a digest has its setup container
+// refuse a tarball with another one: it fails reporting the mismatch, which
+// the operator classifies as ChecksumMismatch, rather than serving different
+// data under the same source.
+
+// Prefixes of the termination messages of setup containers.
+const (
+	checksumDigestPrefix   = "sha256:"
+	checksumMismatchPrefix = "sha256 mismatch: "
+)
+
+// sourceSHA256 returns the digest the cluster pins the source at url to, if
+// any.
+func sourceSHA256(cluster *api.MetricsCluster, url string) string {
+	for _, source := range cluster.Spec.Sources {
+		if source.URL == url {
+			return strings.ToLower(source.SHA256)
+		}
+	}
+	return ""
+}
+
+// sharedSHA256 returns the digest a shared replica serving the source at url
+// is pinned to: the first given by the clusters referencing it.
+func sharedSHA256(referencing []*api.MetricsCluster, url string) string {
+	for _, cluster := range referencing {
+		if digest := sourceSHA256(cluster, url); len(digest) > 0 {
+			return digest
+		}
+	}
+	return ""
+}
+
+// applyChecksumPin has the pod's setup container verify the tarball's digest.
+func applyChecksumPin(podSpec *corev1.PodSpec, digest string) {
+	if len(digest) == 0 {
+		return
+	}
+	setup := &podSpec.InitContainers[0]
+	setup.Env = append(setup.Env, corev1.EnvVar{Name: "PROMTAR_SHA256", Value: digest})
+}
+
+// checksumMismatch returns the mismatch reported by a setup container's
+// termination message, if any.
+func checksumMismatch(message string) string {
+	message = strings.TrimSpace(message)
+	if !strings.HasPrefix(message, checksumMismatchPrefix) {
+		return ""
+	}
+	return message
+}
+
+// loadedDigest returns the digest of the tarball the pod's setup container
+// loaded, once it completed.
+func loadedDigest(pod *corev1.Pod) string {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name != "setup" {
+			continue
+		}
+		terminated := status.State.Terminated
+		if terminated == nil || terminated.ExitCode != 0 {
+			return ""
+		}
+		message := strings.TrimSpace(terminated.Message)
+		if !strings.HasPrefix(message, checksumDigestPrefix) {
+			return ""
+		}
+		return strings.TrimPrefix(message, checksumDigestPrefix)
+	}
+	return ""
+}
+
+// replicaDigest returns the digest of the tarball loaded by the replica of
+// the deployment, or by the pool pod it claimed, if one of its pods reports
+// it.
+func (o *Operator) replicaDigest(deployment *appsv1.Deployment, claimedPod *corev1.Pod) (string, error) {
+	if claimedPod != nil {
+		return loadedDigest(claimedPod), nil
+	}
+	pods := &corev1.PodList{}
+	err := o.client.List(context.TODO(), pods, client.InNamespace(deployment.Namespace), client.MatchingLabels(deployment.Spec.Selector.MatchLabels))
+	if err != nil {
+		return "", fmt.Errorf("couldn't list pods: %w", err)
+	}
+	for i := range pods.Items {
+		if digest := loadedDigest(&pods.Items[i]); len(digest) > 0 {
+			return digest, nil
+		}
+	}
+	return "", nil
+}
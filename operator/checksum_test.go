@@ -0,0 +1,76 @@
+package operator
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+const testDigest = "8d940354991cdf25a1af7f4056099867fd476c92e0fba9b07e3230eb5d35756f"
+
+func TestSharedSHA256(t *testing.T) {
+	cluster := func(name string, sources ...api.Source) *api.MetricsCluster {
+		return &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: api.MetricsClusterSpec{Sources: sources}}
+	}
+	unpinned := cluster("a", api.Source{URL: "https://a"})
+	pinned := cluster("b", api.Source{URL: "https://a", SHA256: "8D940354991CDF25A1AF7F4056099867FD476C92E0FBA9B07E3230EB5D35756F"})
+	other := cluster("c", api.Source{URL: "https://a", SHA256: "ffff"})
+
+	if digest := sharedSHA256([]*api.MetricsCluster{unpinned}, "https://a"); digest != "" {
+		t.Errorf("expected no pin, got %q", digest)
+	}
+	if digest := sharedSHA256([]*api.MetricsCluster{unpinned, pinned, other}, "https://a"); digest != testDigest {
+		t.Errorf("expected the first cluster's pin in lower case, got %q", digest)
+	}
+	if digest := sharedSHA256([]*api.MetricsCluster{pinned}, "https://b"); digest != "" {
+		t.Errorf("expected other sources not to be pinned, got %q", digest)
+	}
+}
+
+func TestLoadedDigest(t *testing.T) {
+	pod := func(state corev1.ContainerState) *corev1.Pod {
+		return &corev1.Pod{Status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{Name: "setup", State: state}}}}
+	}
+	completed := func(exitCode int32, message string) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode, Message: message}}
+	}
+	tests := map[string]struct {
+		pod    *corev1.Pod
+		digest string
+	}{
+		"completed":   {pod(completed(0, checksumDigestPrefix+testDigest+"\n")), testDigest},
+		"running":     {pod(corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}), ""},
+		"mismatch":    {pod(completed(1, checksumMismatchPrefix+"expected 00, got "+testDigest)), ""},
+		"no digest":   {pod(completed(0, "")), ""},
+		"not started": {&corev1.Pod{}, ""},
+	}
+	for name, test := range tests {
+		if digest := loadedDigest(test.pod); digest != test.digest {
+			t.Errorf("%s: expected digest %q, got %q", name, test.digest, digest)
+		}
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	if mismatch := checksumMismatch(checksumMismatchPrefix + "expected 00, got 11\n"); mismatch != "sha256 mismatch: expected 00, got 11" {
+		t.Errorf("unexpected mismatch %q", mismatch)
+	}
+	if mismatch := checksumMismatch(checksumDigestPrefix + testDigest); mismatch != "" {
+		t.Errorf("expected a digest not to be a mismatch, got %q", mismatch)
+	}
+}
+
+func TestApplyChecksumPin(t *testing.T) {
+	podSpec := corev1.PodSpec{InitContainers: []corev1.Container{{Name: "setup"}}}
+	applyChecksumPin(&podSpec, "")
+	if len(podSpec.InitContainers[0].Env) != 0 {
+		t.Errorf("expected no pin, got %v", podSpec.InitContainers[0].Env)
+	}
+	applyChecksumPin(&podSpec, testDigest)
+	if env := podSpec.InitContainers[0].Env; len(env) != 1 || env[0].Name != "PROMTAR_SHA256" || env[0].Value != testDigest {
+		t.Errorf("expected the setup container to be pinned, got %v", env)
+	}
+}
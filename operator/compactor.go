@@ -0,0 +1,176 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// hasCompactor returns whether the cluster's bucket is compacted, which it is
+// whenever Thanos serves a cluster with object storage.
+func hasCompactor(cluster *api.MetricsCluster) bool {
+	return cluster.Spec.ObjectStorage != nil && cluster.Spec.Backend != api.BackendVictoriaMetrics
+}
+
+func (o *Operator) compactorName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("compactor-%s", cluster.Name)}
+}
+
+// compactorCommand returns the command running the compactor of the
+// cluster's bucket. Retention flags are Prometheus durations, which are
+// formatted in a single unit rather than Go's.
+func compactorCommand(cluster *api.MetricsCluster) []string {
+	command := []string{
+		"/bin/thanos",
+		"compact",
+		"--wait",
+		"--data-dir=/var/thanos/compact",
+		"--objstore.config-file=/etc/thanos/" + objstoreConfigKey,
+		"--http-address=0.0.0.0:10902",
+	}
+	spec := cluster.Spec.ObjectStorage.Compactor
+	if spec == nil {
+		return command
+	}
+	for _, retention := range []struct {
+		resolution string
+		duration   *metav1.Duration
+	}{
+		{"raw", spec.RetentionRaw},
+		{"5m", spec.Retention5m},
+		{"1h", spec.Retention1h},
+	} {
+		if retention.duration != nil {
+			command = append(command, fmt.Sprintf("--retention.resolution-%s=%s", retention.resolution, model.Duration(retention.duration.Duration)))
+		}
+	}
+	if spec.DisableDownsampling {
+		command = append(command, "--downsampling.disable")
+	}
+	return command
+}
+
+func (o *Operator) compactorDeploymentManifest(cluster *api.MetricsCluster) *appsv1.Deployment {
+	name := o.compactorName(cluster)
+	var replicas int32 = 1
+	labels := map[string]string{
+		"app":     "thanos-compactor",
+		"cluster": cluster.Name,
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			// Two compactors of a bucket would compact the same blocks.
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						objstoreVolume(cluster),
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "compactor",
+							Image:   o.ThanosImage,
+							Command: compactorCommand(cluster),
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: 10902,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "objstore",
+									MountPath: "/etc/thanos/",
+									ReadOnly:  true,
+								},
+								{
+									Name:      "data",
+									MountPath: "/var/thanos/compact",
+								},
+							},
+							ReadinessProbe: readinessProbe("/-/ready", 10902),
+							LivenessProbe:  livenessProbe("/-/healthy", 10902),
+						},
+					},
+				},
+			},
+		},
+	}
+	podSpec := &deployment.Spec.Template.Spec
+	if spec := cluster.Spec.ObjectStorage.Compactor; spec != nil && spec.Resources != nil {
+		podSpec.Containers[0].Resources = *spec.Resources.DeepCopy()
+	} else {
+		applyThanosResources(podSpec, cluster)
+	}
+	o.hardenPodSpec(podSpec)
+	return deployment
+}
+
+// ensureCompactor creates the compactor of the cluster's bucket when it has
+// one, keeping its command and resources up to date, and removes it
+// otherwise.
+func (o *Operator) ensureCompactor(cluster *api.MetricsCluster) error {
+	enabled := hasCompactor(cluster)
+	name := o.compactorName(cluster)
+	deployment := &appsv1.Deployment{}
+	err := o.client.Get(context.TODO(), name, deployment)
+	exists := true
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch compactor deployment: %w", err)
+		}
+		exists = false
+	}
+	switch {
+	case enabled && !exists:
+		if err := o.client.Create(context.TODO(), o.compactorDeploymentManifest(cluster)); err != nil {
+			return fmt.Errorf("couldn't create compactor deployment: %w", err)
+		}
+		o.log.Info("created compactor deployment", "name", name.Name)
+	case enabled && exists:
+		current, wanted := &deployment.Spec.Template.Spec.Containers[0], o.compactorDeploymentManifest(cluster).Spec.Template.Spec.Containers[0]
+		if !equality.Semantic.DeepEqual(current.Command, wanted.Command) || !equality.Semantic.DeepEqual(current.Resources, wanted.Resources) {
+			current.Command = wanted.Command
+			current.Resources = wanted.Resources
+			if err := o.client.Update(context.TODO(), deployment); err != nil {
+				return fmt.Errorf("couldn't update compactor deployment: %w", err)
+			}
+			o.log.Info("updated compactor deployment", "name", name.Name)
+		}
+	case !enabled && exists:
+		if err := o.client.Delete(context.TODO(), deployment); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete compactor deployment: %w", err)
+		}
+		o.log.Info("deleted compactor deployment", "name", name.Name)
+	}
+	return nil
+}
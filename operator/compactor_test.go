@@ -0,0 +1,55 @@
+package operator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestCompactorCommand(t *testing.T) {
+	base := []string{
+		"/bin/thanos",
+		"compact",
+		"--wait",
+		"--data-dir=/var/thanos/compact",
+		"--objstore.config-file=/etc/thanos/objstore.yml",
+		"--http-address=0.0.0.0:10902",
+	}
+	tests := []struct {
+		name      string
+		compactor *api.CompactorSpec
+		expect    []string
+	}{
+		{
+			name:   "defaults",
+			expect: base,
+		},
+		{
+			name: "retention and no downsampling",
+			compactor: &api.CompactorSpec{
+				RetentionRaw:        &metav1.Duration{Duration: 30 * 24 * time.Hour},
+				Retention1h:         &metav1.Duration{Duration: 36 * time.Hour},
+				DisableDownsampling: true,
+			},
+			expect: append(append([]string{}, base...),
+				"--retention.resolution-raw=30d",
+				"--retention.resolution-1h=36h",
+				"--downsampling.disable",
+			),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := &api.MetricsCluster{Spec: api.MetricsClusterSpec{
+				ObjectStorage: &api.ObjectStorageSpec{SecretName: "archive", Compactor: test.compactor},
+			}}
+			if command := compactorCommand(cluster); !reflect.DeepEqual(command, test.expect) {
+				t.Errorf("expected %v, got %v", test.expect, command)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package operator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// setCondition records a condition of the cluster, keeping its transition
+// time unless its status changes.
+func setCondition(cluster *api.MetricsCluster, conditionType api.ClusterConditionType, status corev1.ConditionStatus, reason, message string) {
+	for i := range cluster.Status.Conditions {
+		condition := &cluster.Status.Conditions[i]
+		if condition.Type != conditionType {
+			continue
+		}
+		if condition.Status != status {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		condition.Status = status
+		condition.Reason = reason
+		condition.Message = message
+		return
+	}
+	cluster.Status.Conditions = append(cluster.Status.Conditions, api.ClusterCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	})
+}
+
+// findCondition returns the cluster's condition of a type, if it has one.
+func findCondition(cluster *api.MetricsCluster, conditionType api.ClusterConditionType) *api.ClusterCondition {
+	for i := range cluster.Status.Conditions {
+		if cluster.Status.Conditions[i].Type == conditionType {
+			return &cluster.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// removeCondition drops a condition which no longer applies.
+func removeCondition(cluster *api.MetricsCluster, conditionType api.ClusterConditionType) {
+	var conditions []api.ClusterCondition
+	for _, condition := range cluster.Status.Conditions {
+		if condition.Type != conditionType {
+			conditions = append(conditions, condition)
+		}
+	}
+	cluster.Status.Conditions = conditions
+}
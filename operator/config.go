@@ -0,0 +1,384 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"text/template"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/yaml"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// prometheusConfigKey is the key of the Prometheus configuration in a
+// replica's ConfigMap, and its file name once mounted.
+const prometheusConfigKey = "prometheus.yml"
+
+// prometheusRulesKey holds the rule groups added by clusters, if any.
+const prometheusRulesKey = "rules.yml"
+
+// prometheusConfigAnnotation and prometheusRulesAnnotation carry the
+// configuration of a claimed pool pod, which can't mount its deployment's
+// ConfigMap; they're projected into the pod through the downward API instead.
+const (
+	prometheusConfigAnnotation = "dowser.dowser/prometheus-config"
+	prometheusRulesAnnotation  = "dowser.dowser/prometheus-rules"
+)
+
+// prometheusConfig is the part of the Prometheus configuration file generated
+// by the operator.
+type prometheusConfig struct {
+	Global        prometheusGlobalConfig `json:"global"`
+	RuleFiles     []string               `json:"rule_files,omitempty"`
+	ScrapeConfigs []interface{}          `json:"scrape_configs"`
+}
+
+type prometheusGlobalConfig struct {
+	ExternalLabels map[string]string `json:"external_labels"`
+}
+
+type prometheusRuleFile struct {
+	Groups []interface{} `json:"groups"`
+}
+
+// additionalConfig is the configuration a cluster adds to its replicas.
+type additionalConfig struct {
+	ScrapeConfigs  []interface{}
+	RuleGroups     []interface{}
+	ExternalLabels map[string]*template.Template
+}
+
+// externalLabelName matches valid Prometheus label names.
+var externalLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// externalLabelData is what the external labels clusters add are rendered
+// with.
+type externalLabelData struct {
+	Job     string
+	BuildID string
+	Pull    string
+	Source  string
+	URL     string
+}
+
+// renderPrometheusConfig returns the configuration files of the replica
+// serving the job, keyed by file name. The external labels identify the
+// replica's store to Thanos, the run label names the source if it has a
+// display name, and the source label lets queries select the replica's store
+// alone. Additions are merged in order; scrape jobs and
+// rule groups must have unique names, and the first addition setting an
+// external label the operator doesn't set gives its value.
+func renderPrometheusConfig(deploymentName string, job *Job, additions []*additionalConfig) (map[string]string, error) {
+	config := prometheusConfig{
+		Global: prometheusGlobalConfig{
+			ExternalLabels: map[string]string{
+				"cluster_name": deploymentName,
+				"cluster_url":  job.Status.URL,
+				"cluster_job":  job.Spec.Job,
+			},
+		},
+		ScrapeConfigs: []interface{}{
+			map[string]interface{}{
+				"job_name": "prometheus",
+				"static_configs": []interface{}{
+					map[string]interface{}{"targets": []string{"localhost:9090"}},
+				},
+			},
+		},
+	}
+	if len(job.DisplayName) > 0 {
+		config.Global.ExternalLabels["run"] = job.DisplayName
+	}
+	if source := sourceLabel(job); len(source) > 0 {
+		config.Global.ExternalLabels["source"] = source
+	}
+	pull, _, build := parseBuildURL(job.Status.URL)
+	labelData := externalLabelData{Job: job.Spec.Job, BuildID: build, Pull: pull, Source: sourceLabel(job), URL: job.Status.URL}
+	rules := prometheusRuleFile{}
+	for _, addition := range additions {
+		config.ScrapeConfigs = append(config.ScrapeConfigs, addition.ScrapeConfigs...)
+		rules.Groups = append(rules.Groups, addition.RuleGroups...)
+		for name, value := range addition.ExternalLabels {
+			if _, set := config.Global.ExternalLabels[name]; set {
+				continue
+			}
+			var rendered bytes.Buffer
+			if err := value.Execute(&rendered, labelData); err != nil {
+				return nil, fmt.Errorf("couldn't render external label %s: %w", name, err)
+			}
+			if rendered.Len() > 0 {
+				config.Global.ExternalLabels[name] = rendered.String()
+			}
+		}
+	}
+	if err := checkUniqueNames(config.ScrapeConfigs, "job_name", "scrape job"); err != nil {
+		return nil, err
+	}
+	if err := checkUniqueNames(rules.Groups, "name", "rule group"); err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{}
+	if len(rules.Groups) > 0 {
+		config.RuleFiles = []string{"/etc/prometheus/" + prometheusRulesKey}
+		out, err := yaml.Marshal(rules)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode prometheus rules: %w", err)
+		}
+		files[prometheusRulesKey] = string(out)
+	}
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode prometheus config: %w", err)
+	}
+	files[prometheusConfigKey] = string(out)
+	return files, nil
+}
+
+// sourceLabel returns the value of the source label of the job's series: its
+// display name, or else the ID of its build.
+func sourceLabel(job *Job) string {
+	if len(job.DisplayName) > 0 {
+		return job.DisplayName
+	}
+	_, _, build := parseBuildURL(job.Status.URL)
+	return build
+}
+
+// checkUniqueNames returns an error if two of the items share a name.
+func checkUniqueNames(items []interface{}, nameKey string, kind string) error {
+	names := map[string]bool{}
+	for _, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", kind)
+		}
+		name, _ := fields[nameKey].(string)
+		if len(name) == 0 {
+			return fmt.Errorf("%s has no %s", kind, nameKey)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate %s %q", kind, name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// loadAdditionalConfig reads the scrape configs and rule files the cluster
+// adds to its replicas.
+func (o *Operator) loadAdditionalConfig(cluster *api.MetricsCluster) (*additionalConfig, error) {
+	addition := &additionalConfig{}
+	for _, source := range cluster.Spec.AdditionalScrapeConfigs {
+		data, err := o.readConfigSource(cluster.Namespace, source)
+		if err != nil {
+			return nil, err
+		}
+		var scrapeConfigs []interface{}
+		if err := yaml.Unmarshal([]byte(data), &scrapeConfigs); err != nil {
+			return nil, fmt.Errorf("couldn't decode scrape configs from %s: %w", describeConfigSource(source), err)
+		}
+		addition.ScrapeConfigs = append(addition.ScrapeConfigs, scrapeConfigs...)
+	}
+	for _, source := range cluster.Spec.AdditionalRuleFiles {
+		data, err := o.readConfigSource(cluster.Namespace, source)
+		if err != nil {
+			return nil, err
+		}
+		var rules prometheusRuleFile
+		if err := yaml.Unmarshal([]byte(data), &rules); err != nil {
+			return nil, fmt.Errorf("couldn't decode rule file from %s: %w", describeConfigSource(source), err)
+		}
+		addition.RuleGroups = append(addition.RuleGroups, rules.Groups...)
+	}
+	for name, value := range cluster.Spec.ExternalLabels {
+		if !externalLabelName.MatchString(name) {
+			return nil, fmt.Errorf("invalid external label name %q", name)
+		}
+		label, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid external label %s: %w", name, err)
+		}
+		if addition.ExternalLabels == nil {
+			addition.ExternalLabels = map[string]*template.Template{}
+		}
+		addition.ExternalLabels[name] = label
+	}
+	return addition, nil
+}
+
+// loadSharedAdditionalConfig returns the valid additions of the other
+// clusters, keyed by cluster name. Clusters report their own invalid
+// additions.
+func (o *Operator) loadSharedAdditionalConfig(cluster *api.MetricsCluster, clusters map[string]*api.MetricsCluster) map[string]*additionalConfig {
+	additions := map[string]*additionalConfig{}
+	for name, other := range clusters {
+		if name == cluster.Name {
+			continue
+		}
+		if addition, err := o.loadAdditionalConfig(other); err == nil {
+			additions[name] = addition
+		}
+	}
+	return additions
+}
+
+// deploymentAdditions returns the additions of the clusters referencing a
+// deployment.
+func deploymentAdditions(referencing []*api.MetricsCluster, additions map[string]*additionalConfig) []*additionalConfig {
+	var merged []*additionalConfig
+	for _, cluster := range referencing {
+		if addition, hasAddition := additions[cluster.Name]; hasAddition {
+			merged = append(merged, addition)
+		}
+	}
+	return merged
+}
+
+func (o *Operator) readConfigSource(namespace string, source api.ConfigSource) (string, error) {
+	switch {
+	case source.ConfigMap != nil:
+		configMap := &corev1.ConfigMap{}
+		err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: source.ConfigMap.Name}, configMap)
+		if err != nil {
+			if errors.IsNotFound(err) && source.ConfigMap.Optional != nil && *source.ConfigMap.Optional {
+				return "", nil
+			}
+			return "", fmt.Errorf("couldn't fetch configmap %s: %w", source.ConfigMap.Name, err)
+		}
+		data, hasKey := configMap.Data[source.ConfigMap.Key]
+		if !hasKey && !(source.ConfigMap.Optional != nil && *source.ConfigMap.Optional) {
+			return "", fmt.Errorf("configmap %s has no key %s", source.ConfigMap.Name, source.ConfigMap.Key)
+		}
+		return data, nil
+	case source.Secret != nil:
+		secret := &corev1.Secret{}
+		err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: source.Secret.Name}, secret)
+		if err != nil {
+			if errors.IsNotFound(err) && source.Secret.Optional != nil && *source.Secret.Optional {
+				return "", nil
+			}
+			return "", fmt.Errorf("couldn't fetch secret %s: %w", source.Secret.Name, err)
+		}
+		data, hasKey := secret.Data[source.Secret.Key]
+		if !hasKey && !(source.Secret.Optional != nil && *source.Secret.Optional) {
+			return "", fmt.Errorf("secret %s has no key %s", source.Secret.Name, source.Secret.Key)
+		}
+		return string(data), nil
+	default:
+		return "", fmt.Errorf("config source must reference a configmap or a secret")
+	}
+}
+
+// clustersReferencingConfig maps a ConfigMap, or a Secret if isSecret, to the
+// clusters whose additions, or whose SourcesFrom, reference it.
+func (o *Operator) clustersReferencingConfig(isSecret bool) handler.ToRequestsFunc {
+	return func(object handler.MapObject) []reconcile.Request {
+		clusters := &api.MetricsClusterList{}
+		if err := o.client.List(context.TODO(), clusters, client.InNamespace(object.Meta.GetNamespace())); err != nil {
+			o.log.Error(err, "couldn't list metricsclusters")
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, cluster := range clusters.Items {
+			sources := append(append([]api.ConfigSource{}, cluster.Spec.AdditionalScrapeConfigs...), cluster.Spec.AdditionalRuleFiles...)
+			if cluster.Spec.SourcesFrom != nil {
+				ref := cluster.Spec.SourcesFrom.ConfigMapRef
+				sources = append(sources, api.ConfigSource{ConfigMap: &ref})
+			}
+			for _, source := range sources {
+				if (!isSecret && source.ConfigMap != nil && source.ConfigMap.Name == object.Meta.GetName()) ||
+					(isSecret && source.Secret != nil && source.Secret.Name == object.Meta.GetName()) {
+					requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
+
+func describeConfigSource(source api.ConfigSource) string {
+	if source.ConfigMap != nil {
+		return fmt.Sprintf("configmap %s key %s", source.ConfigMap.Name, source.ConfigMap.Key)
+	}
+	if source.Secret != nil {
+		return fmt.Sprintf("secret %s key %s", source.Secret.Name, source.Secret.Key)
+	}
+	return "config source"
+}
+
+func (o *Operator) prometheusConfigMapName(deploymentName string) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: deploymentName + "-config"}
+}
+
+// prometheusConfigMapManifest returns the ConfigMap holding the configuration
+// of the deployment's replica. It's owned by the deployment so it's removed
+// along with it.
+func (o *Operator) prometheusConfigMapManifest(deployment *appsv1.Deployment, config map[string]string) *corev1.ConfigMap {
+	name := o.prometheusConfigMapName(deployment.Name)
+	isController := true
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: name.Namespace,
+			Name:      name.Name,
+			Labels: map[string]string{
+				"app":        "prometheus",
+				"prometheus": deployment.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       deployment.Name,
+					UID:        deployment.UID,
+					Controller: &isController,
+				},
+			},
+		},
+		Data: config,
+	}
+}
+
+// ensurePrometheusConfig creates or updates the configuration of the
+// deployment's replica.
+func (o *Operator) ensurePrometheusConfig(deployment *appsv1.Deployment, config map[string]string) error {
+	configMap := &corev1.ConfigMap{}
+	hasConfigMap := true
+	err := o.client.Get(context.TODO(), o.prometheusConfigMapName(deployment.Name), configMap)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			hasConfigMap = false
+		} else {
+			return fmt.Errorf("couldn't fetch configmap: %w", err)
+		}
+	}
+	if !hasConfigMap {
+		configMap = o.prometheusConfigMapManifest(deployment, config)
+		if err := o.client.Create(context.TODO(), configMap); err != nil {
+			return fmt.Errorf("couldn't create configmap: %w", err)
+		}
+		o.log.Info("created configmap", "name", configMap.Name)
+		return nil
+	}
+	if equality.Semantic.DeepEqual(configMap.Data, config) {
+		return nil
+	}
+	configMap.Data = config
+	if err := o.client.Update(context.TODO(), configMap); err != nil {
+		return fmt.Errorf("couldn't update configmap: %w", err)
+	}
+	o.log.Info("updated configmap", "name", configMap.Name)
+	return nil
+}
@@ -0,0 +1,149 @@
+package operator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		valid   bool
+		minute  uint64
+		dow     uint64
+		domRest bool
+		dowRest bool
+	}{
+		{spec: "* * * * *", valid: true, minute: 1<<60 - 1, dow: 0xff},
+		{spec: "*/15 * * * *", valid: true, minute: 1 | 1<<15 | 1<<30 | 1<<45, dow: 0xff},
+		{spec: "5-10/2 * * * *", valid: true, minute: 1<<5 | 1<<7 | 1<<9, dow: 0xff},
+		{spec: "0,30 * * * 1-5", valid: true, minute: 1 | 1<<30, dow: 0x3e, dowRest: true},
+		{spec: "0 0 * * 7", valid: true, minute: 1, dow: 1 | 1<<7, dowRest: true},
+		{spec: "0 0 1 * 0", valid: true, minute: 1, dow: 1, domRest: true, dowRest: true},
+		{spec: "0 0 */2 * */2", valid: true, minute: 1, dow: 1 | 1<<2 | 1<<4 | 1<<6},
+		{spec: "0 0 * *", valid: false},
+		{spec: "60 * * * *", valid: false},
+		{spec: "* 24 * * *", valid: false},
+		{spec: "* * 0 * *", valid: false},
+		{spec: "*/0 * * * *", valid: false},
+		{spec: "5-1 * * * *", valid: false},
+		{spec: "a * * * *", valid: false},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.spec)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.spec, err)
+			continue
+		}
+		if schedule.minute != test.minute {
+			t.Errorf("%q: expected minutes %b, got %b", test.spec, test.minute, schedule.minute)
+		}
+		if schedule.dow != test.dow {
+			t.Errorf("%q: expected days of week %b, got %b", test.spec, test.dow, schedule.dow)
+		}
+		if schedule.domRestricted != test.domRest || schedule.dowRestricted != test.dowRest {
+			t.Errorf("%q: expected restricted dom=%v dow=%v, got dom=%v dow=%v", test.spec, test.domRest, test.dowRest, schedule.domRestricted, schedule.dowRestricted)
+		}
+	}
+}
+
+func TestCronNextPrev(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	at := func(value string, location *time.Location) time.Time {
+		t.Helper()
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name     string
+		spec     string
+		location *time.Location
+		from     string
+		next     string
+		prev     string
+	}{
+		{
+			name: "step",
+			spec: "*/20 * * * *", location: time.UTC,
+			from: "2020-06-01 10:25", next: "2020-06-01 10:40", prev: "2020-06-01 10:20",
+		},
+		{
+			name: "prev includes the current minute",
+			spec: "30 10 * * *", location: time.UTC,
+			from: "2020-06-01 10:30", next: "2020-06-02 10:30", prev: "2020-06-01 10:30",
+		},
+		{
+			name: "weekday range",
+			spec: "0 19 * * 1-5", location: time.UTC,
+			// Saturday
+			from: "2020-06-06 12:00", next: "2020-06-08 19:00", prev: "2020-06-05 19:00",
+		},
+		{
+			name: "seven is sunday",
+			spec: "0 7 * * 7", location: time.UTC,
+			// Wednesday
+			from: "2020-06-03 12:00", next: "2020-06-07 07:00", prev: "2020-05-31 07:00",
+		},
+		{
+			name: "both day fields restricted match either",
+			spec: "0 0 15 * 1", location: time.UTC,
+			// Wednesday 10th; Monday 15th is also the 15th, next is Monday 22nd
+			from: "2020-06-10 12:00", next: "2020-06-15 00:00", prev: "2020-06-08 00:00",
+		},
+		{
+			name: "stepped day field isn't restricted",
+			spec: "0 0 */2 * 1", location: time.UTC,
+			// Only odd days which are Mondays: June 1st, 15th and 29th.
+			from: "2020-06-02 12:00", next: "2020-06-15 00:00", prev: "2020-06-01 00:00",
+		},
+		{
+			name: "month range",
+			spec: "0 0 1 3-4 *", location: time.UTC,
+			from: "2020-06-01 12:00", next: "2021-03-01 00:00", prev: "2020-04-01 00:00",
+		},
+		{
+			name: "skipped hour at dst start",
+			spec: "30 2 * * *", location: newYork,
+			// 2:30 doesn't exist on 2020-03-08.
+			from: "2020-03-08 01:00", next: "2020-03-09 02:30", prev: "2020-03-07 02:30",
+		},
+		{
+			name: "hourly across dst start",
+			spec: "0 * * * *", location: newYork,
+			from: "2020-03-08 01:30", next: "2020-03-08 03:00", prev: "2020-03-08 01:00",
+		},
+		{
+			name: "daily across dst end",
+			spec: "0 9 * * *", location: newYork,
+			from: "2020-11-01 08:00", next: "2020-11-01 09:00", prev: "2020-10-31 09:00",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseCron(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from := at(test.from, test.location)
+			if next := schedule.next(from); !next.Equal(at(test.next, test.location)) {
+				t.Errorf("expected next %s, got %s", test.next, next)
+			}
+			if prev := schedule.prev(from); !prev.Equal(at(test.prev, test.location)) {
+				t.Errorf("expected prev %s, got %s", test.prev, prev)
+			}
+		})
+	}
+}
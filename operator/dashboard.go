@@ -0,0 +1,194 @@
+package operator
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// With GrafanaURL, each cluster gets a data source querying it and an
+// overview dashboard with a row per source, repeated over the source's
+// cluster_name label, so investigations start from a dashboard rather than
+// an empty Grafana. Both are deleted with the cluster.
+
+// maxDashboardUIDLength is the longest UID Grafana accepts.
+const maxDashboardUIDLength = 40
+
+// overviewPanels are the panels of each source's row of the overview
+// dashboard, with their queries scoped to the source.
+var overviewPanels = []struct {
+	title  string
+	expr   string
+	legend string
+}{
+	{"Targets down", `count by (job) (up{cluster_name="$cluster_name"} == 0)`, "{{job}}"},
+	{"Firing alerts", `count by (alertname) (ALERTS{cluster_name="$cluster_name",alertstate="firing"})`, "{{alertname}}"},
+	{"CPU by namespace", `topk(10, sum by (namespace) (rate(container_cpu_usage_seconds_total{cluster_name="$cluster_name",container!=""}[5m])))`, "{{namespace}}"},
+	{"Memory by namespace", `topk(10, sum by (namespace) (container_memory_working_set_bytes{cluster_name="$cluster_name",container!=""}))`, "{{namespace}}"},
+	{"API requests by code", `sum by (code) (rate(apiserver_request_total{cluster_name="$cluster_name"}[5m]))`, "{{code}}"},
+}
+
+// dashboardDataSourceName returns the name of the cluster's Grafana data
+// source.
+func dashboardDataSourceName(cluster *api.MetricsCluster) string {
+	return "dowser-" + cluster.Name
+}
+
+// dashboardUID returns the UID of the cluster's overview dashboard: its name,
+// or a hash of it if that's too long.
+func dashboardUID(cluster *api.MetricsCluster) string {
+	uid := "dowser-" + cluster.Name
+	if len(uid) > maxDashboardUIDLength {
+		uid = fmt.Sprintf("dowser-%x", sha256.Sum256([]byte(cluster.Name)))[:maxDashboardUIDLength]
+	}
+	return uid
+}
+
+// overviewDashboard returns the cluster's overview dashboard, querying the
+// named data source and showing the annotations of its sources' runs.
+func overviewDashboard(cluster *api.MetricsCluster, dataSource string) map[string]interface{} {
+	panels := []interface{}{
+		map[string]interface{}{
+			"type":      "row",
+			"title":     "$cluster_name",
+			"repeat":    "cluster_name",
+			"collapsed": false,
+			"gridPos":   map[string]int{"h": 1, "w": 24, "x": 0, "y": 0},
+			"panels":    []interface{}{},
+		},
+	}
+	for i, panel := range overviewPanels {
+		panels = append(panels, map[string]interface{}{
+			"type":       "graph",
+			"title":      panel.title,
+			"datasource": dataSource,
+			"gridPos":    map[string]int{"h": 8, "w": 8, "x": (i % 3) * 8, "y": 1 + (i/3)*8},
+			"targets": []interface{}{
+				map[string]interface{}{"expr": panel.expr, "legendFormat": panel.legend, "refId": "A"},
+			},
+		})
+	}
+	return map[string]interface{}{
+		"uid":           dashboardUID(cluster),
+		"title":         "dowser: " + cluster.Name,
+		"tags":          []string{grafanaTag},
+		"editable":      true,
+		"schemaVersion": 22,
+		"time":          map[string]string{"from": "now-7d", "to": "now"},
+		"annotations": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{
+					"name":       "Runs",
+					"datasource": "-- Grafana --",
+					"enable":     true,
+					"iconColor":  "rgba(0, 211, 255, 1)",
+					"type":       "tags",
+					"tags":       []string{"cluster:" + cluster.Name},
+				},
+			},
+		},
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{
+					"name":       "cluster_name",
+					"label":      "Run",
+					"type":       "query",
+					"datasource": dataSource,
+					"query":      "label_values(up, cluster_name)",
+					"refresh":    1,
+					"multi":      true,
+					"includeAll": true,
+					"current":    map[string]interface{}{"text": "All", "value": []string{"$__all"}},
+				},
+			},
+		},
+		"panels": panels,
+	}
+}
+
+// ensureDashboard provisions the cluster's data source and overview dashboard
+// in Grafana once its query is exposed, and records the dashboard's URL.
+// Failures are logged and retried on the next reconcile.
+func (o *Operator) ensureDashboard(cluster *api.MetricsCluster) {
+	if len(o.GrafanaURL) == 0 || len(cluster.Status.QueryURL) == 0 || len(cluster.Status.DashboardURL) > 0 {
+		return
+	}
+	log := o.log.WithValues("cluster", cluster.Name)
+	dataSource := dashboardDataSourceName(cluster)
+	if err := o.ensureDataSource(dataSource, cluster.Status.QueryURL); err != nil {
+		log.Error(err, "couldn't provision grafana data source")
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"dashboard": overviewDashboard(cluster, dataSource),
+		"overwrite": true,
+	})
+	if err != nil {
+		log.Error(err, "couldn't encode dashboard")
+		return
+	}
+	resp, err := o.grafanaRequest(http.MethodPost, "/api/dashboards/db", body)
+	if err != nil {
+		log.Error(err, "couldn't provision dashboard")
+		return
+	}
+	defer resp.Body.Close()
+	var created struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		log.Error(err, "couldn't decode provisioned dashboard")
+		return
+	}
+	cluster.Status.DashboardURL = strings.TrimSuffix(o.GrafanaURL, "/") + created.URL
+	o.log.Info("provisioned dashboard", "cluster", cluster.Name, "url", cluster.Status.DashboardURL)
+}
+
+// ensureDataSource creates the named Prometheus data source querying
+// queryURL, unless it exists.
+func (o *Operator) ensureDataSource(name, queryURL string) error {
+	if resp, err := o.grafanaRequest(http.MethodGet, "/api/datasources/name/"+name, nil); err == nil {
+		resp.Body.Close()
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"name":   name,
+		"type":   "prometheus",
+		"access": "proxy",
+		"url":    queryURL,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := o.grafanaRequest(http.MethodPost, "/api/datasources", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	o.log.Info("created grafana data source", "name", name)
+	return nil
+}
+
+// deleteDashboard deletes the cluster's overview dashboard and data source,
+// logging failures.
+func (o *Operator) deleteDashboard(cluster *api.MetricsCluster) {
+	if len(o.GrafanaURL) == 0 || len(cluster.Status.DashboardURL) == 0 {
+		return
+	}
+	for _, path := range []string{
+		"/api/dashboards/uid/" + dashboardUID(cluster),
+		"/api/datasources/name/" + dashboardDataSourceName(cluster),
+	} {
+		resp, err := o.grafanaRequest(http.MethodDelete, path, nil)
+		if err != nil {
+			o.log.Error(err, "couldn't delete from grafana", "cluster", cluster.Name, "path", path)
+			continue
+		}
+		resp.Body.Close()
+	}
+	o.log.Info("deleted dashboard", "cluster", cluster.Name)
+}
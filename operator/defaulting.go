@@ -0,0 +1,134 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+const defaultClusterPath = "/default-metricscluster"
+
+// clusterDefaulter normalizes the sources of clusters being created or
+// updated, so the same build listed as a gcsweb link, a gs:// path or with a
+// trailing slash is materialized once under its Prow view URL. Clusters being
+// created also get the operator's default TTL and sidecar resources written
+// into their spec, so later changes to the operator's defaults don't change
+// existing clusters.
+type clusterDefaulter struct {
+	// prowBaseURL is the view URL of the operator's bucket, e.g.
+	// https://prow.ci.openshift.org/view/gs/origin-ci-test.
+	prowBaseURL      string
+	ttl              time.Duration
+	sidecarResources corev1.ResourceRequirements
+	decoder          *admission.Decoder
+}
+
+func (d *clusterDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+func (d *clusterDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	cluster := &api.MetricsCluster{}
+	if err := d.decoder.Decode(req, cluster); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	original := cluster.DeepCopy()
+	d.normalizeSources(cluster)
+	if req.Operation == admissionv1beta1.Create {
+		d.fillDefaults(cluster)
+	}
+	if equality.Semantic.DeepEqual(original, cluster) {
+		return admission.Allowed("")
+	}
+	defaulted, err := json.Marshal(cluster)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, defaulted)
+}
+
+// normalizeSources canonicalizes the cluster's listed URLs and drops the
+// duplicates, keeping the first of them. Sources listed with options are
+// de-duplicated among themselves, since a URL both in URLs and in Sources
+// takes the options of the latter.
+func (d *clusterDefaulter) normalizeSources(cluster *api.MetricsCluster) {
+	var urls []string
+	listed := map[string]bool{}
+	for _, sourceURL := range cluster.Spec.URLs {
+		sourceURL = d.canonicalURL(sourceURL)
+		if len(sourceURL) == 0 || listed[sourceURL] {
+			continue
+		}
+		listed[sourceURL] = true
+		urls = append(urls, sourceURL)
+	}
+	cluster.Spec.URLs = urls
+
+	var sources []api.Source
+	listed = map[string]bool{}
+	for _, source := range cluster.Spec.Sources {
+		source.URL = d.canonicalURL(source.URL)
+		if listed[source.URL] {
+			continue
+		}
+		listed[source.URL] = true
+		sources = append(sources, source)
+	}
+	cluster.Spec.Sources = sources
+}
+
+// fillDefaults writes the operator's defaults into the fields the cluster
+// leaves unset. Prometheus resources are left to the operator, since
+// clusters overriding them don't claim warm pool pods, and clusters with a
+// template get the template's settings rather than the defaults.
+func (d *clusterDefaulter) fillDefaults(cluster *api.MetricsCluster) {
+	if cluster.Spec.TemplateRef != nil {
+		return
+	}
+	if cluster.Spec.TTL == nil && d.ttl > 0 {
+		cluster.Spec.TTL = &metav1.Duration{Duration: d.ttl}
+	}
+	if cluster.Spec.SidecarResources == nil && (len(d.sidecarResources.Requests) > 0 || len(d.sidecarResources.Limits) > 0) {
+		cluster.Spec.SidecarResources = d.sidecarResources.DeepCopy()
+	}
+}
+
+// canonicalURL returns the Prow view URL of the build at a gcsweb link or a
+// gs:// path, e.g. gs://origin-ci-test/logs/job/1 becomes
+// https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1. Tarballs
+// are sources in their own right and are kept as they are, as are URLs of
+// other forms, except for their surrounding space and trailing slashes.
+func (d *clusterDefaulter) canonicalURL(sourceURL string) string {
+	sourceURL = strings.TrimRight(strings.TrimSpace(sourceURL), "/")
+	parsed, err := url.Parse(sourceURL)
+	if err != nil {
+		return sourceURL
+	}
+	var object string
+	switch {
+	case hasTarballExtension(parsed.Path):
+		return sourceURL
+	case parsed.Scheme == "gs":
+		object = parsed.Host + parsed.Path
+	case strings.HasPrefix(parsed.Host, "gcsweb") && strings.HasPrefix(parsed.Path, "/gcs/"):
+		object = strings.TrimPrefix(parsed.Path, "/gcs/")
+	default:
+		return sourceURL
+	}
+	// The view URLs of every bucket share the prefix of the operator's.
+	viewPrefix := strings.TrimSuffix(d.prowBaseURL, "/"+path.Base(d.prowBaseURL))
+	return viewPrefix + "/" + strings.Trim(object, "/")
+}
@@ -0,0 +1,65 @@
+package operator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	d := &clusterDefaulter{prowBaseURL: "https://prow.ci.openshift.org/view/gs/origin-ci-test"}
+	tests := map[string]string{
+		"https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1/":                           "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1",
+		" https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1 ":                          "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1",
+		"gs://origin-ci-test/pr-logs/pull/openshift_origin/123/job/1/":                               "https://prow.ci.openshift.org/view/gs/origin-ci-test/pr-logs/pull/openshift_origin/123/job/1",
+		"gs://other-bucket/logs/job/1":                                                               "https://prow.ci.openshift.org/view/gs/other-bucket/logs/job/1",
+		"https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/origin-ci-test/logs/job/1/":         "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1",
+		"gs://origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar":                            "gs://origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar",
+		"https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/origin-ci-test/logs/job/1/a.tar.gz": "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/origin-ci-test/logs/job/1/a.tar.gz",
+		"https://example.com/builds/1/":                                                              "https://example.com/builds/1",
+	}
+	for sourceURL, expected := range tests {
+		if actual := d.canonicalURL(sourceURL); actual != expected {
+			t.Errorf("%q: expected %q, got %q", sourceURL, expected, actual)
+		}
+	}
+}
+
+func TestNormalizeSources(t *testing.T) {
+	d := &clusterDefaulter{prowBaseURL: "https://prow.ci.openshift.org/view/gs/origin-ci-test", ttl: 48 * time.Hour}
+	cluster := &api.MetricsCluster{
+		Spec: api.MetricsClusterSpec{
+			URLs: []string{
+				"https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1/",
+				"gs://origin-ci-test/logs/job/2",
+				"gs://origin-ci-test/logs/job/1",
+				"",
+			},
+			Sources: []api.Source{
+				{URL: "gs://origin-ci-test/logs/job/3", DisplayName: "first"},
+				{URL: "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/3", DisplayName: "second"},
+			},
+		},
+	}
+	d.normalizeSources(cluster)
+	d.fillDefaults(cluster)
+
+	expectedURLs := []string{
+		"https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1",
+		"https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/2",
+	}
+	if !reflect.DeepEqual(cluster.Spec.URLs, expectedURLs) {
+		t.Errorf("expected urls %v, got %v", expectedURLs, cluster.Spec.URLs)
+	}
+	if len(cluster.Spec.Sources) != 1 || cluster.Spec.Sources[0].DisplayName != "first" {
+		t.Errorf("expected the first source to be kept, got %+v", cluster.Spec.Sources)
+	}
+	if cluster.Spec.TTL == nil || cluster.Spec.TTL.Duration != 48*time.Hour {
+		t.Errorf("expected the default ttl, got %v", cluster.Spec.TTL)
+	}
+	if cluster.Spec.SidecarResources != nil {
+		t.Errorf("expected no sidecar resources without defaults, got %v", cluster.Spec.SidecarResources)
+	}
+}
@@ -0,0 +1,131 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/prow"
+)
+
+const (
+	defaultDiscoveryWindow         = 24 * time.Hour
+	defaultDiscoveryLimit          = 10
+	defaultDiscoveryResyncInterval = time.Hour
+
+	discoveryTimeout = 5 * time.Minute
+)
+
+// discoverJobs rediscovers the builds matching the cluster's job selector when
+// the selector changed or a resync is due, and returns the time of the next
+// resync (zero if the cluster has no selector). Builds found earlier are kept
+// when discovery fails.
+func (o *Operator) discoverJobs(cluster *api.MetricsCluster, now time.Time) time.Time {
+	selector := cluster.Spec.JobSelector
+	if selector == nil {
+		cluster.Status.Discovery = nil
+		return time.Time{}
+	}
+	resyncInterval := defaultDiscoveryResyncInterval
+	if selector.ResyncInterval != nil && selector.ResyncInterval.Duration > 0 {
+		resyncInterval = selector.ResyncInterval.Duration
+	}
+	previous := cluster.Status.Discovery
+	sameSelector := previous != nil && equality.Semantic.DeepEqual(previous.Selector, *selector)
+	if sameSelector && now.Before(previous.Time.Add(resyncInterval)) {
+		return previous.Time.Add(resyncInterval)
+	}
+
+	discovery := &api.DiscoveryStatus{
+		Selector: *selector.DeepCopy(),
+		Time:     metav1.Time{Time: now},
+	}
+	if sameSelector {
+		discovery.URLs = previous.URLs
+	}
+	urls, err := o.findSelectedJobs(selector, now)
+	if err != nil {
+		o.log.Error(err, "couldn't discover jobs", "cluster", cluster.Name)
+		discovery.Error = err.Error()
+	} else {
+		discovery.URLs = urls
+		o.log.Info("discovered jobs", "cluster", cluster.Name, "count", len(urls))
+	}
+	cluster.Status.Discovery = discovery
+	return now.Add(resyncInterval)
+}
+
+// findSelectedJobs returns the URLs of the finished builds matching the
+// selector, the most recent first.
+func (o *Operator) findSelectedJobs(selector *api.JobSelector, now time.Time) ([]string, error) {
+	name, err := regexp.Compile(selector.Name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job name expression: %w", err)
+	}
+	window := defaultDiscoveryWindow
+	if selector.Window != nil && selector.Window.Duration > 0 {
+		window = selector.Window.Duration
+	}
+	limit := defaultDiscoveryLimit
+	if selector.Limit > 0 {
+		limit = selector.Limit
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	builds, err := prow.Discover(ctx, o.storageOpener, path.Base(o.GCSStorageBaseURL), prow.Selector{
+		Name:   name,
+		Branch: selector.Branch,
+		Since:  now.Add(-window),
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	for _, build := range builds {
+		urls = append(urls, build.URL(o.ProwBaseURL))
+	}
+	return urls, nil
+}
+
+// desiredURLs returns the cluster's listed sources, followed by those read
+// from its SourcesFrom and those discovered by its job selector.
+func desiredURLs(cluster *api.MetricsCluster) []string {
+	var urls []string
+	listed := map[string]bool{}
+	for _, url := range cluster.Spec.URLs {
+		listed[url] = true
+		urls = append(urls, url)
+	}
+	for _, source := range cluster.Spec.Sources {
+		if !listed[source.URL] {
+			listed[source.URL] = true
+			urls = append(urls, source.URL)
+		}
+	}
+	if cluster.Status.SourcesFrom != nil {
+		for _, url := range cluster.Status.SourcesFrom.URLs {
+			if !listed[url] {
+				listed[url] = true
+				urls = append(urls, url)
+			}
+		}
+	}
+	if cluster.Status.Discovery == nil {
+		return urls
+	}
+	for _, url := range cluster.Status.Discovery.URLs {
+		if !listed[url] {
+			listed[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
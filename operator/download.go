@@ -0,0 +1,203 @@
+package operator
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/spf13/cobra"
+	logging "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type fetchOptions struct {
+	OutputDir string
+}
+
+func NewFetchCommand() *cobra.Command {
+	operator := &Operator{}
+	var options fetchOptions
+
+	var command = &cobra.Command{
+		Use:   "fetch URL",
+		Short: "Downloads the TSDB of a source to run Prometheus on locally.",
+		Long: `Downloads the TSDB of a source to run Prometheus on locally.
+
+The source's Prometheus tarball is discovered as the operator would, then
+downloaded and extracted into the output directory, which must be empty. The
+configuration the source's replica would be given is written next to the data
+as prometheus.yml, and the command running Prometheus on them is printed.
+Tarballs on disk can be given as file:// URLs.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := fetch(operator, args[0], options, cmd.OutOrStdout())
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.OutputDir, "out", "", "./tsdb", "directory to extract the TSDB into")
+	operator.addFlags(command)
+
+	return command
+}
+
+func fetch(o *Operator, url string, options fetchOptions, out io.Writer) error {
+	o.log = logging.Log.WithName("fetch")
+	if err := o.parseOptions(o.log); err != nil {
+		return err
+	}
+	o.enableFileSources()
+	if err := checkEmptyDir(options.OutputDir); err != nil {
+		return err
+	}
+
+	artifacts := newArtifactFetcher(o).discover(url)
+	if artifacts.err != nil {
+		return fmt.Errorf("couldn't discover the artifacts of %s: %w", url, artifacts.err)
+	}
+	job := &Job{
+		ProwJob:          artifacts.prowJob,
+		PrometheusTarURL: artifacts.tarURL,
+		PrometheusImage:  artifacts.image,
+	}
+
+	o.log.Info("downloading prometheus tarball", "url", artifacts.tarURL, "dir", options.OutputDir)
+	if err := downloadTarball(artifacts.tarURL, options.OutputDir); err != nil {
+		return err
+	}
+	config, err := renderPrometheusConfig(o.prometheusDeploymentName(job).Name, job, nil)
+	if err != nil {
+		return err
+	}
+	configFile := filepath.Join(options.OutputDir, prometheusConfigKey)
+	if err := ioutil.WriteFile(configFile, []byte(config[prometheusConfigKey]), 0644); err != nil {
+		return fmt.Errorf("couldn't write %s: %w", configFile, err)
+	}
+
+	_, err = fmt.Fprintf(out, `Extracted %s into %s. Run Prometheus (%s reads it) with:
+
+prometheus --storage.tsdb.path=%s --config.file=%s
+`, artifacts.tarURL, options.OutputDir, job.PrometheusImage, options.OutputDir, configFile)
+	return err
+}
+
+// checkEmptyDir returns an error unless dir is empty or doesn't exist yet,
+// so extracted blocks aren't mixed with others.
+func checkEmptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", dir, err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s isn't empty", dir)
+	}
+	return nil
+}
+
+// downloadTarball extracts the tarball at tarURL into dir.
+func downloadTarball(tarURL, dir string) error {
+	resp, err := http.Get(tarURL)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch %s: %w", tarURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("couldn't fetch %s: %s", tarURL, resp.Status)
+	}
+	if err := extractTarball(resp.Body, dir); err != nil {
+		return fmt.Errorf("couldn't extract %s: %w", tarURL, err)
+	}
+	return nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress returns the tarball read from r, decompressed if it's gzipped or
+// zstd-compressed. It doesn't go by the tarball's name: CI archives gzipped
+// tarballs as prometheus.tar. Both are decompressed concurrently with reading,
+// as extracting multi-GB tarballs takes a good part of a replica's time to
+// ready otherwise.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(r)
+	magic, _ := reader.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := pgzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+// extractTarball extracts the regular files and directories of a tarball,
+// compressed or not, into dir.
+func extractTarball(r io.Reader, dir string) error {
+	stream, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	archive := tar.NewReader(stream)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, header.Name)
+		if target != filepath.Clean(dir) && !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("%s is outside of the tarball", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, archive)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package operator
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestExtractTarball(t *testing.T) {
+	compressors := map[string]func(io.Writer) (io.WriteCloser, error){
+		"plain": func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+		"gzip":  func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		"zstd":  func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	}
+	tarball := func(compression string, files map[string][]byte) *bytes.Buffer {
+		out := &bytes.Buffer{}
+		compressor, err := compressors[compression](out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive := tar.NewWriter(compressor)
+		for name, content := range files {
+			archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+			archive.Write(content)
+		}
+		archive.Close()
+		compressor.Close()
+		return out
+	}
+
+	// Chunks span several of the parallel decompressors' blocks, and the
+	// content compresses like samples do, neither all alike nor random.
+	random := rand.New(rand.NewSource(1))
+	chunk := make([]byte, 8<<20)
+	for i := range chunk {
+		chunk[i] = byte(random.Intn(16))
+	}
+	files := map[string][]byte{
+		"01EXAMPLE/meta.json":     []byte("{}"),
+		"01EXAMPLE/chunks/000001": chunk,
+		"wal/00000000":            chunk[:3<<20],
+		"wal/00000001":            []byte("wal"),
+		"chunks_head/000001":      []byte{},
+		"01EXAMPLE/tombstones":    chunk[1:4097],
+	}
+
+	for compression := range compressors {
+		dir, err := ioutil.TempDir("", "extract")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := extractTarball(tarball(compression, files), dir); err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		for name, expected := range files {
+			content, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Errorf("%s: expected %s extracted: %v", compression, name, err)
+				continue
+			}
+			if !bytes.Equal(content, expected) {
+				t.Errorf("%s: expected %s extracted as %d bytes, got %d different ones", compression, name, len(expected), len(content))
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := extractTarball(tarball("plain", map[string][]byte{"../escaped": []byte("data")}), dir); err == nil {
+		t.Errorf("expected an entry outside of the directory to be refused")
+	}
+	if err := extractTarball(bytes.NewReader(append(append([]byte{}, zstdMagic...), "truncated"...)), dir); err == nil {
+		t.Errorf("expected a corrupt zstd tarball to be refused")
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,58 @@
+package operator
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Milestones and failures of a cluster are recorded as events on it, so they
+// show in `oc describe metricscluster`. Failures are recorded as they start
+// rather than on each reconcile.
+const (
+	eventPrometheusCreated   = "PrometheusCreated"
+	eventQueryCreated        = "QueryCreated"
+	eventQueryReady          = "QueryReady"
+	eventDegraded            = "Degraded"
+	eventArtifactFetchFailed = "ArtifactFetchFailed"
+	eventSourceFailed        = "SourceFailed"
+	eventExpired             = "Expired"
+	eventSoftDeleted         = "SoftDeleted"
+	eventUndeleted           = "Undeleted"
+	eventQuotaExceeded       = "QuotaExceeded"
+	eventArtifactsExpiring   = "ArtifactsExpiring"
+	eventSourceQuarantined   = "SourceQuarantined"
+	eventHookSourceAdded     = "HookSourceAdded"
+)
+
+// recordSourceFailure records a warning on the cluster for a source which has
+// just failed, or is failing for another reason than it was.
+func (o *Operator) recordSourceFailure(cluster *api.MetricsCluster, previous, status api.JobStatus) {
+	if len(status.Reason) == 0 || status.Reason == previous.Reason {
+		return
+	}
+	reason := eventSourceFailed
+	switch status.Reason {
+	case api.FailureArtifactMissing, api.FailureDownloadFailed:
+		reason = eventArtifactFetchFailed
+	case api.FailureQuarantined:
+		reason = eventSourceQuarantined
+	}
+	o.recorder.Eventf(cluster, corev1.EventTypeWarning, reason, "%s: %s: %s", status.URL, status.Reason, status.Message)
+}
+
+// recordPhaseChange records the event of a lifecycle notification, if any.
+func (o *Operator) recordPhaseChange(cluster *api.MetricsCluster, n notification) {
+	switch n.Event {
+	case notificationReady:
+		message := fmt.Sprintf("%d sources can be queried", cluster.Status.ReadyJobs)
+		if len(cluster.Status.QueryURL) > 0 {
+			message += " at " + cluster.Status.QueryURL
+		}
+		o.recorder.Event(cluster, corev1.EventTypeNormal, eventQueryReady, message)
+	case notificationDegraded:
+		o.recorder.Event(cluster, corev1.EventTypeWarning, eventDegraded, n.Message)
+	}
+}
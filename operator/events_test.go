@@ -0,0 +1,41 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestRecordSourceFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous api.FailureReason
+		reason   api.FailureReason
+		expected string
+	}{
+		{name: "healthy", expected: ""},
+		{name: "missing artifact", reason: api.FailureArtifactMissing, expected: "Warning ArtifactFetchFailed"},
+		{name: "corrupt", reason: api.FailureTSDBCorrupt, expected: "Warning SourceFailed"},
+		{name: "still failing", previous: api.FailureDownloadFailed, reason: api.FailureDownloadFailed, expected: ""},
+		{name: "failing differently", previous: api.FailureDownloadFailed, reason: api.FailureQuotaExceeded, expected: "Warning SourceFailed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(1)
+			o := &Operator{recorder: recorder}
+			o.recordSourceFailure(&api.MetricsCluster{}, api.JobStatus{Reason: test.previous}, api.JobStatus{URL: "u", Reason: test.reason})
+			var recorded string
+			select {
+			case event := <-recorder.Events:
+				recorded = event
+			default:
+			}
+			if (len(test.expected) == 0) != (len(recorded) == 0) || !strings.HasPrefix(recorded, test.expected) {
+				t.Errorf("expected event %q, got %q", test.expected, recorded)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// A replica's store is in a cluster's query view while its pods carry the
+// cluster's reference label set to "true". Excluded replicas keep the label,
+// so they're still referenced by the cluster, with another value.
+const (
+	// evictUnhealthyStoresAnnotation on a cluster is how long a replica may
+	// stay unhealthy before its store is excluded from the query view, e.g.
+	// "30m". Replicas stay excluded until their deployment is replaced or the
+	// annotation is removed.
+	evictUnhealthyStoresAnnotation = "dowser.dowser/evict-unhealthy-stores-after"
+
+	// excludedURLsAnnotation on a cluster lists, comma separated, sources
+	// whose stores are excluded from the query view regardless of health.
+	excludedURLsAnnotation = "dowser.dowser/excluded-urls"
+
+	excludedReferenceValue = "excluded"
+)
+
+// storeExclusion returns whether the replica serving url should be left out of
+// the cluster's query view, and why.
+func storeExclusion(cluster *api.MetricsCluster, url string, previous api.JobStatus, deploymentName string, now time.Time) (bool, string, error) {
+	for _, excluded := range strings.Split(cluster.Annotations[excludedURLsAnnotation], ",") {
+		if strings.TrimSpace(excluded) == url {
+			return true, fmt.Sprintf("listed in the %s annotation", excludedURLsAnnotation), nil
+		}
+	}
+	value, evicts := cluster.Annotations[evictUnhealthyStoresAnnotation]
+	if !evicts {
+		return false, "", nil
+	}
+	after, err := time.ParseDuration(value)
+	if err != nil {
+		return false, "", fmt.Errorf("invalid %s annotation: %w", evictUnhealthyStoresAnnotation, err)
+	}
+	if previous.Deployment != deploymentName || previous.UnhealthySince == nil {
+		return false, "", nil
+	}
+	if previous.Excluded || now.Sub(previous.UnhealthySince.Time) >= after {
+		return true, fmt.Sprintf("unhealthy since %s", previous.UnhealthySince.UTC().Format(time.RFC3339)), nil
+	}
+	return false, "", nil
+}
+
+// updateUnhealthySince records when the replica became unhealthy, keeping the
+// time while it stays excluded.
+func updateUnhealthySince(status *api.JobStatus, unhealthy bool, now time.Time) {
+	switch {
+	case status.Excluded && status.UnhealthySince != nil:
+	case !unhealthy:
+		status.UnhealthySince = nil
+	case status.UnhealthySince == nil:
+		status.UnhealthySince = &metav1.Time{Time: now}
+	}
+}
+
+// labelStoreExclusion sets the cluster's reference on the pods serving the
+// deployment to include or exclude them from the cluster's query view.
+func (o *Operator) labelStoreExclusion(cluster *api.MetricsCluster, deployment *appsv1.Deployment, claimedPod *corev1.Pod, excluded bool) error {
+	value := "true"
+	if excluded {
+		value = excludedReferenceValue
+	}
+	pods := &corev1.PodList{}
+	err := o.client.List(context.TODO(), pods, client.InNamespace(o.Namespace), client.MatchingLabels(deployment.Spec.Selector.MatchLabels))
+	if err != nil {
+		return fmt.Errorf("couldn't list pods of deployment %s: %w", deployment.Name, err)
+	}
+	if claimedPod != nil {
+		pods.Items = append(pods.Items, *claimedPod)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		current, hasReference := pod.Labels[cluster.Name]
+		if !hasReference || current == value || pod.DeletionTimestamp != nil {
+			continue
+		}
+		pod.Labels[cluster.Name] = value
+		if err := o.client.Update(context.TODO(), pod); err != nil {
+			return fmt.Errorf("couldn't update reference of pod %s: %w", pod.Name, err)
+		}
+		if excluded {
+			o.log.Info("excluded store from query view", "cluster", cluster.Name, "pod", pod.Name)
+		} else {
+			o.log.Info("restored store to query view", "cluster", cluster.Name, "pod", pod.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestStoreExclusion(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	since := func(ago time.Duration) *metav1.Time { return &metav1.Time{Time: now.Add(-ago)} }
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		previous    api.JobStatus
+		excluded    bool
+		invalid     bool
+	}{
+		{
+			name:     "healthy",
+			previous: api.JobStatus{Deployment: "prometheus-a"},
+		},
+		{
+			name:     "eviction disabled",
+			previous: api.JobStatus{Deployment: "prometheus-a", UnhealthySince: since(time.Hour)},
+		},
+		{
+			name:        "listed",
+			annotations: map[string]string{excludedURLsAnnotation: "https://other, https://a"},
+			previous:    api.JobStatus{Deployment: "prometheus-a"},
+			excluded:    true,
+		},
+		{
+			name:        "recently unhealthy",
+			annotations: map[string]string{evictUnhealthyStoresAnnotation: "30m"},
+			previous:    api.JobStatus{Deployment: "prometheus-a", UnhealthySince: since(10 * time.Minute)},
+		},
+		{
+			name:        "persistently unhealthy",
+			annotations: map[string]string{evictUnhealthyStoresAnnotation: "30m"},
+			previous:    api.JobStatus{Deployment: "prometheus-a", UnhealthySince: since(time.Hour)},
+			excluded:    true,
+		},
+		{
+			name:        "still excluded",
+			annotations: map[string]string{evictUnhealthyStoresAnnotation: "30m"},
+			previous:    api.JobStatus{Deployment: "prometheus-a", UnhealthySince: since(time.Minute), Excluded: true},
+			excluded:    true,
+		},
+		{
+			name:        "replaced deployment",
+			annotations: map[string]string{evictUnhealthyStoresAnnotation: "30m"},
+			previous:    api.JobStatus{Deployment: "prometheus-b", UnhealthySince: since(time.Hour), Excluded: true},
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{evictUnhealthyStoresAnnotation: "soon"},
+			previous:    api.JobStatus{Deployment: "prometheus-a", UnhealthySince: since(time.Hour)},
+			invalid:     true,
+		},
+	}
+	for _, test := range tests {
+		cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+		excluded, _, err := storeExclusion(cluster, "https://a", test.previous, "prometheus-a", now)
+		if (err != nil) != test.invalid {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if excluded != test.excluded {
+			t.Errorf("%s: expected excluded %v, got %v", test.name, test.excluded, excluded)
+		}
+	}
+}
+
+func TestUpdateUnhealthySince(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	status := &api.JobStatus{}
+	updateUnhealthySince(status, true, now)
+	if status.UnhealthySince == nil || !status.UnhealthySince.Time.Equal(now) {
+		t.Fatalf("expected unhealthy since %v, got %v", now, status.UnhealthySince)
+	}
+	updateUnhealthySince(status, true, now.Add(time.Minute))
+	if !status.UnhealthySince.Time.Equal(now) {
+		t.Errorf("expected the first unhealthy time to be kept, got %v", status.UnhealthySince)
+	}
+	status.Excluded = true
+	updateUnhealthySince(status, false, now.Add(time.Hour))
+	if status.UnhealthySince == nil {
+		t.Errorf("expected excluded replicas to stay unhealthy")
+	}
+	status.Excluded = false
+	updateUnhealthySince(status, false, now.Add(time.Hour))
+	if status.UnhealthySince != nil {
+		t.Errorf("expected healthy replicas to be cleared, got %v", status.UnhealthySince)
+	}
+}
@@ -0,0 +1,92 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// clusterTTL returns how long the cluster lasts, or zero if it doesn't
+// expire.
+func (o *Operator) clusterTTL(cluster *api.MetricsCluster) time.Duration {
+	if cluster.Spec.TTL != nil {
+		return cluster.Spec.TTL.Duration
+	}
+	return o.DefaultTTL
+}
+
+// checkExpiration records when the cluster expires in its status, and
+// returns whether it has expired, or otherwise when it's due to. A cluster
+// pinned past its expiration expires when its pin runs out, which its pinned
+// condition already requeues for. An invalid pin doesn't protect the cluster.
+func (o *Operator) checkExpiration(cluster *api.MetricsCluster, now time.Time) (bool, time.Time) {
+	ttl := o.clusterTTL(cluster)
+	if ttl <= 0 {
+		cluster.Status.ExpirationTime = nil
+		return false, time.Time{}
+	}
+	expiration := cluster.CreationTimestamp.Add(ttl)
+	cluster.Status.ExpirationTime = &metav1.Time{Time: expiration}
+	if now.Before(expiration) {
+		return false, expiration
+	}
+	if until, _ := o.pinnedUntil(cluster, now); !until.IsZero() {
+		return false, time.Time{}
+	}
+	return true, time.Time{}
+}
+
+// expireCluster releases the replicas of an expired cluster, deleting those
+// no other cluster references, and marks it Expired. The cluster's other
+// resources are kept until it's deleted. Extending its TTL or pinning it
+// brings its replicas back on the next reconcile.
+func (o *Operator) expireCluster(cluster *api.MetricsCluster, originalStatus *api.MetricsClusterStatus) (reconcile.Result, error) {
+	expired := cluster.Status.Phase != api.PhaseExpired
+	released, err := o.releaseCluster(cluster, api.PhaseExpired)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if !equality.Semantic.DeepEqual(*originalStatus, cluster.Status) {
+		if err := o.client.Status().Update(context.TODO(), cluster); err != nil {
+			return reconcile.Result{}, fmt.Errorf("couldn't update metricscluster status: %w", err)
+		}
+	}
+	if expired {
+		message := fmt.Sprintf("expired at %s, released %d sources", cluster.Status.ExpirationTime.UTC().Format(time.RFC3339), released)
+		o.log.Info("expired metricscluster", "name", cluster.Name, "jobs", released)
+		o.notify(newNotification(cluster.Namespace, cluster.Name, notificationExpired, message))
+		o.recorder.Event(cluster, corev1.EventTypeNormal, eventExpired, message)
+	}
+	return o.collectExpiredCluster(cluster, time.Now())
+}
+
+// releaseCluster releases the replicas of a cluster which stops serving,
+// deleting those no other cluster references, and sets its phase. It returns
+// the number of sources released.
+func (o *Operator) releaseCluster(cluster *api.MetricsCluster, phase api.MetricsClusterPhase) (int, error) {
+	previousJobs := map[string]api.JobStatus{}
+	for _, job := range cluster.Status.Jobs {
+		previousJobs[job.URL] = job
+	}
+	cluster.Status.Jobs = nil
+	if err := o.releaseRemovedJobs(cluster, previousJobs); err != nil {
+		return 0, err
+	}
+	cluster.Status.RequestedJobs = 0
+	cluster.Status.ReadyJobs = 0
+	cluster.Status.Phase = phase
+	updatePhaseConditions(cluster, phase, 0, 0, 0)
+	if err := o.updateFootprint(cluster); err != nil {
+		return 0, err
+	}
+	updateJobCounts(cluster)
+	return len(previousJobs), nil
+}
@@ -0,0 +1,47 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestCheckExpiration(t *testing.T) {
+	o := &Operator{DefaultTTL: 48 * time.Hour, MaxPinDuration: 7 * 24 * time.Hour}
+	created := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		ttl        *metav1.Duration
+		pin        string
+		now        time.Time
+		expired    bool
+		expiration time.Time
+	}{
+		{name: "default ttl", now: created.Add(time.Hour), expiration: created.Add(48 * time.Hour)},
+		{name: "default ttl past", now: created.Add(49 * time.Hour), expired: true},
+		{name: "own ttl", ttl: &metav1.Duration{Duration: time.Hour}, now: created.Add(2 * time.Hour), expired: true},
+		{name: "no ttl", ttl: &metav1.Duration{}, now: created.Add(100 * time.Hour)},
+		{name: "pinned", pin: "2020-06-04T00:00:00Z", now: created.Add(49 * time.Hour)},
+		{name: "pin ran out", pin: "2020-06-02T00:00:00Z", now: created.Add(49 * time.Hour), expired: true},
+		{name: "invalid pin", pin: "2020-07-01T00:00:00Z", now: created.Add(49 * time.Hour), expired: true},
+	}
+	for _, test := range tests {
+		cluster := &api.MetricsCluster{
+			ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.Time{Time: created}, Annotations: map[string]string{}},
+			Spec:       api.MetricsClusterSpec{TTL: test.ttl},
+		}
+		if len(test.pin) > 0 {
+			cluster.Annotations[api.PinnedUntilAnnotation] = test.pin
+		}
+		expired, expiration := o.checkExpiration(cluster, test.now)
+		if expired != test.expired || !expiration.Equal(test.expiration) {
+			t.Errorf("%s: expected expired %v and expiration %v, got %v and %v", test.name, test.expired, test.expiration, expired, expiration)
+		}
+		if (cluster.Status.ExpirationTime == nil) != (o.clusterTTL(cluster) == 0) {
+			t.Errorf("%s: unexpected expiration time %v", test.name, cluster.Status.ExpirationTime)
+		}
+	}
+}
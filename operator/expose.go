@@ -0,0 +1,231 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	routev1 "github.com/openshift/api/route/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/query"
+)
+
+// Services reached from outside the cluster (queries, the bucket web UI,
+// remote read) are exposed by OpenShift routes, by ingresses where the route
+// API isn't served, or not at all.
+const (
+	exposeRoute   = "route"
+	exposeIngress = "ingress"
+	exposeNone    = "none"
+)
+
+// resolveExposeMode returns the configured expose mode, which is routes when
+// the route API is served and ingresses otherwise if none is configured.
+func resolveExposeMode(mode string, capabilities capabilities) (string, error) {
+	switch mode {
+	case exposeRoute:
+		if !capabilities[capabilityRoute] {
+			return "", fmt.Errorf("can't expose services with routes: the route API isn't served")
+		}
+		return mode, nil
+	case exposeIngress, exposeNone:
+		return mode, nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid expose mode %q", mode)
+	}
+	if capabilities[capabilityRoute] {
+		return exposeRoute, nil
+	}
+	return exposeIngress, nil
+}
+
+// managedResource is an object created when a component is enabled and
+// deleted when it isn't.
+type managedResource struct {
+	kind     string
+	current  runtime.Object
+	manifest func() runtime.Object
+}
+
+// exposureResources returns the route or ingress exposing the named service,
+// if services are exposed.
+func (o *Operator) exposureResources(name types.NamespacedName, serviceName string, owners []metav1.OwnerReference) []managedResource {
+	if o.exposeMode == exposeNone {
+		return nil
+	}
+	return []managedResource{
+		{o.exposeMode, o.newExposure(), func() runtime.Object { return o.exposureManifest(name, serviceName, owners) }},
+	}
+}
+
+// newExposure returns an empty object of the kind exposing services.
+func (o *Operator) newExposure() runtime.Object {
+	if o.exposeMode == exposeIngress {
+		return &networkingv1beta1.Ingress{}
+	}
+	return &routev1.Route{}
+}
+
+// exposureManifest returns the route or ingress exposing the http port of the
+// named service. Both terminate TLS; ingresses are served at
+// <name>-<namespace> under the ingress domain.
+func (o *Operator) exposureManifest(name types.NamespacedName, serviceName string, owners []metav1.OwnerReference) runtime.Object {
+	objectMeta := metav1.ObjectMeta{
+		Namespace:       name.Namespace,
+		Name:            name.Name,
+		OwnerReferences: owners,
+	}
+	if o.exposeMode != exposeIngress {
+		return &routev1.Route{
+			ObjectMeta: objectMeta,
+			Spec: routev1.RouteSpec{
+				To: routev1.RouteTargetReference{
+					Kind: "Service",
+					Name: serviceName,
+				},
+				Port: &routev1.RoutePort{
+					TargetPort: intstr.FromString("http"),
+				},
+				TLS: &routev1.TLSConfig{
+					Termination:                   routev1.TLSTerminationEdge,
+					InsecureEdgeTerminationPolicy: routev1.InsecureEdgeTerminationPolicyRedirect,
+				},
+			},
+		}
+	}
+
+	host := fmt.Sprintf("%s-%s.%s", name.Name, name.Namespace, o.IngressDomain)
+	pathType := networkingv1beta1.PathTypePrefix
+	ingress := &networkingv1beta1.Ingress{
+		ObjectMeta: objectMeta,
+		Spec: networkingv1beta1.IngressSpec{
+			TLS: []networkingv1beta1.IngressTLS{
+				{
+					Hosts:      []string{host},
+					SecretName: o.IngressTLSSecret,
+				},
+			},
+			Rules: []networkingv1beta1.IngressRule{
+				{
+					Host: host,
+					IngressRuleValue: networkingv1beta1.IngressRuleValue{
+						HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+							Paths: []networkingv1beta1.HTTPIngressPath{
+								{
+									Path:     "/",
+									PathType: &pathType,
+									Backend: networkingv1beta1.IngressBackend{
+										ServiceName: serviceName,
+										ServicePort: intstr.FromString("http"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if len(o.IngressClass) > 0 {
+		ingressClass := o.IngressClass
+		ingress.Spec.IngressClassName = &ingressClass
+	}
+	return ingress
+}
+
+// exposedService returns the name of the service a route or ingress made by
+// exposureManifest exposes.
+func exposedService(exposure runtime.Object) string {
+	switch exposure := exposure.(type) {
+	case *routev1.Route:
+		return exposure.Spec.To.Name
+	case *networkingv1beta1.Ingress:
+		if len(exposure.Spec.Rules) > 0 && exposure.Spec.Rules[0].HTTP != nil && len(exposure.Spec.Rules[0].HTTP.Paths) > 0 {
+			return exposure.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName
+		}
+	}
+	return ""
+}
+
+// exposureURL returns the URL a route or ingress exposes, or an empty string
+// if it has no host yet.
+func exposureURL(exposure runtime.Object) string {
+	switch exposure := exposure.(type) {
+	case *routev1.Route:
+		return query.RouteURL(exposure)
+	case *networkingv1beta1.Ingress:
+		if len(exposure.Spec.Rules) == 0 || len(exposure.Spec.Rules[0].Host) == 0 {
+			return ""
+		}
+		scheme := "http"
+		if len(exposure.Spec.TLS) > 0 {
+			scheme = "https"
+		}
+		return fmt.Sprintf("%s://%s", scheme, exposure.Spec.Rules[0].Host)
+	}
+	return ""
+}
+
+// ensureQueryExposure exposes the cluster's query, served by the named
+// service, to its allowed external queriers, and returns its URL.
+func (o *Operator) ensureQueryExposure(cluster *api.MetricsCluster, serviceName string) (string, error) {
+	// Invalid queriers are reported with the cluster's config errors.
+	queriers, _ := parseExternalQueriers(cluster)
+	if err := o.ensureQueriersPolicy(cluster, serviceName, queriers); err != nil {
+		return "", err
+	}
+	if o.exposeMode == exposeNone {
+		return "", nil
+	}
+	name := o.thanosQueryRouteName(cluster)
+	exposure := o.newExposure()
+	err := o.client.Get(context.TODO(), name, exposure)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return "", fmt.Errorf("couldn't fetch %s: %w", o.exposeMode, err)
+		}
+		if !queriers.exposed() {
+			return "", nil
+		}
+		exposure = o.exposureManifest(name, serviceName, clusterOwner(cluster))
+		applyQuerierAllowList(exposure, queriers)
+		if err := o.client.Create(context.TODO(), exposure); err != nil {
+			return "", fmt.Errorf("couldn't create %s: %w", o.exposeMode, err)
+		}
+		o.log.Info("created "+o.exposeMode, "name", name.Name)
+		return exposureURL(exposure), nil
+	}
+	if !queriers.exposed() {
+		if err := o.client.Delete(context.TODO(), exposure); err != nil && !errors.IsNotFound(err) {
+			return "", fmt.Errorf("couldn't delete %s: %w", o.exposeMode, err)
+		}
+		o.log.Info("deleted "+o.exposeMode, "name", name.Name)
+		return "", nil
+	}
+	updated := applyQuerierAllowList(exposure, queriers)
+	if exposedService(exposure) != serviceName {
+		// Clusters gaining or losing a query frontend switch services.
+		desired := o.exposureManifest(name, serviceName, clusterOwner(cluster))
+		switch exposure := exposure.(type) {
+		case *routev1.Route:
+			exposure.Spec.To = desired.(*routev1.Route).Spec.To
+		case *networkingv1beta1.Ingress:
+			exposure.Spec.Rules = desired.(*networkingv1beta1.Ingress).Spec.Rules
+		}
+		updated = true
+	}
+	if updated {
+		if err := o.client.Update(context.TODO(), exposure); err != nil {
+			return "", fmt.Errorf("couldn't update %s: %w", o.exposeMode, err)
+		}
+		o.log.Info("updated "+o.exposeMode, "name", name.Name)
+	}
+	return exposureURL(exposure), nil
+}
@@ -0,0 +1,47 @@
+package operator
+
+import (
+	"testing"
+
+	routev1 "github.com/openshift/api/route/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestResolveExposeMode(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(routev1.GroupVersion.WithKind("Route"), meta.RESTScopeNamespace)
+	withRoutes := detectCapabilities(mapper, log.NullLogger{})
+	withoutRoutes := detectCapabilities(meta.NewDefaultRESTMapper(nil), log.NullLogger{})
+
+	tests := []struct {
+		name         string
+		mode         string
+		capabilities capabilities
+		expected     string
+		invalid      bool
+	}{
+		{name: "detected route", capabilities: withRoutes, expected: exposeRoute},
+		{name: "detected ingress", capabilities: withoutRoutes, expected: exposeIngress},
+		{name: "configured", mode: exposeNone, capabilities: withRoutes, expected: exposeNone},
+		{name: "route without the route api", mode: exposeRoute, capabilities: withoutRoutes, invalid: true},
+		{name: "invalid", mode: "loadbalancer", capabilities: withRoutes, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mode, err := resolveExposeMode(test.mode, test.capabilities)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got mode %q", mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, mode)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters exposing Prometheus have the UI of each replica served by a
+// service named after its deployment and a route or ingress whose host starts
+// with the source's job name, so a single run can be looked at without going
+// through the aggregated view. Both are owned by the deployment, so they go
+// away with the replica. The service follows the replica's pod: the
+// deployment's own, or the pool pod it claimed.
+
+// maxHostLabel is the longest a DNS label, such as the first one of the
+// hosts routes and ingresses are served at, may be.
+const maxHostLabel = 63
+
+var invalidHostRunes = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// exposesPrometheus returns whether the cluster exposes its replicas' UIs.
+// Raw UIs would bypass a restriction of the cluster's external queriers.
+func exposesPrometheus(cluster *api.MetricsCluster) bool {
+	return cluster.Spec.ExposePrometheus && len(cluster.Spec.AllowedExternalQueriers) == 0
+}
+
+// sharedExposePrometheus returns whether a shared replica's UI is exposed:
+// when any of the clusters referencing it exposes it.
+func sharedExposePrometheus(referencing []*api.MetricsCluster) bool {
+	for _, cluster := range referencing {
+		if exposesPrometheus(cluster) {
+			return true
+		}
+	}
+	return false
+}
+
+// prometheusExposureName returns the name of the route or ingress exposing
+// the UI of the deployment's replica: the job's name, cut so the host it's
+// served at, <name>-<namespace>, fits in a DNS label, followed by the hash
+// naming the deployment. The deployment's name is used for jobs without a
+// name.
+func prometheusExposureName(deployment *appsv1.Deployment, job *Job) types.NamespacedName {
+	name := types.NamespacedName{Namespace: deployment.Namespace, Name: deployment.Name}
+	hash := strings.TrimPrefix(deployment.Name, "prometheus-")
+	jobName := strings.Trim(invalidHostRunes.ReplaceAllString(strings.ToLower(job.Spec.Job), "-"), "-")
+	budget := maxHostLabel - len(deployment.Namespace) - len(hash) - 2
+	if len(jobName) > budget {
+		jobName = strings.TrimRight(jobName[:budget], "-")
+	}
+	if len(jobName) > 0 && budget > 0 {
+		name.Name = jobName + "-" + hash
+	}
+	return name
+}
+
+// prometheusServiceManifest returns the service of the UI of the
+// deployment's replica, selecting the claimed pool pod serving it, if any.
+func prometheusServiceManifest(deployment *appsv1.Deployment, claimedPod *corev1.Pod) *corev1.Service {
+	selector := map[string]string{
+		"app":        "prometheus",
+		"prometheus": deployment.Name,
+	}
+	if claimedPod != nil {
+		selector = map[string]string{
+			"app":        "prometheus",
+			"claimed-by": deployment.Name,
+		}
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: deployment.Namespace,
+			Name:      deployment.Name,
+			Labels: map[string]string{
+				"app":        "prometheus",
+				"prometheus": deployment.Name,
+			},
+			OwnerReferences: deploymentOwner(deployment),
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: selector,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       9090,
+					TargetPort: intstr.FromInt(9090),
+				},
+			},
+		},
+	}
+}
+
+// deploymentOwner returns the owner references making an object go away
+// with the deployment.
+func deploymentOwner(deployment *appsv1.Deployment) []metav1.OwnerReference {
+	isController := true
+	return []metav1.OwnerReference{
+		{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Name:       deployment.Name,
+			UID:        deployment.UID,
+			Controller: &isController,
+		},
+	}
+}
+
+// ensurePrometheusExposure exposes, or stops exposing, the UI of the
+// deployment's replica, and returns its URL.
+func (o *Operator) ensurePrometheusExposure(deployment *appsv1.Deployment, job *Job, claimedPod *corev1.Pod, enabled bool) (string, error) {
+	// The service is only there to be exposed.
+	if o.exposeMode == exposeNone {
+		enabled = false
+	}
+	serviceName := types.NamespacedName{Namespace: deployment.Namespace, Name: deployment.Name}
+	exposureName := prometheusExposureName(deployment, job)
+	resources := []managedResource{
+		{"service", &corev1.Service{}, func() runtime.Object { return prometheusServiceManifest(deployment, claimedPod) }},
+	}
+	resources = append(resources, o.exposureResources(exposureName, serviceName.Name, deploymentOwner(deployment))...)
+
+	url := ""
+	for _, resource := range resources {
+		name := exposureName
+		if resource.kind == "service" {
+			name = serviceName
+		}
+		err := o.client.Get(context.TODO(), name, resource.current)
+		exists := true
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return "", fmt.Errorf("couldn't fetch prometheus %s: %w", resource.kind, err)
+			}
+			exists = false
+		}
+		switch {
+		case enabled && !exists:
+			manifest := resource.manifest()
+			if err := o.client.Create(context.TODO(), manifest); err != nil {
+				return "", fmt.Errorf("couldn't create prometheus %s: %w", resource.kind, err)
+			}
+			o.log.Info("created prometheus "+resource.kind, "name", name.Name)
+			resource.current = manifest
+		case enabled && exists:
+			// Replicas claiming or releasing a pool pod switch selectors.
+			if service, isService := resource.current.(*corev1.Service); isService {
+				desired := resource.manifest().(*corev1.Service)
+				if !equality.Semantic.DeepEqual(service.Spec.Selector, desired.Spec.Selector) {
+					service.Spec.Selector = desired.Spec.Selector
+					if err := o.client.Update(context.TODO(), service); err != nil {
+						return "", fmt.Errorf("couldn't update prometheus %s: %w", resource.kind, err)
+					}
+					o.log.Info("updated prometheus "+resource.kind, "name", name.Name)
+				}
+			}
+		case !enabled && exists:
+			if err := o.client.Delete(context.TODO(), resource.current); err != nil && !errors.IsNotFound(err) {
+				return "", fmt.Errorf("couldn't delete prometheus %s: %w", resource.kind, err)
+			}
+			o.log.Info("deleted prometheus "+resource.kind, "name", name.Name)
+		}
+		if enabled && resource.kind == o.exposeMode {
+			url = exposureURL(resource.current)
+		}
+	}
+	return url, nil
+}
@@ -0,0 +1,72 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestPrometheusExposureName(t *testing.T) {
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: "prometheus-0123456789ab"}}
+	job := func(name string) *Job {
+		return &Job{ProwJob: prowapi.ProwJob{Spec: prowapi.ProwJobSpec{Job: name}}}
+	}
+
+	tests := []struct {
+		job      string
+		expected string
+	}{
+		{job: "e2e-aws", expected: "e2e-aws-0123456789ab"},
+		{job: "periodic-ci-openshift_release_4.6", expected: "periodic-ci-openshift-release-4-6-0123456789ab"},
+		{job: "pull-ci-openshift-origin-master-e2e-aws-serial-upgrade-ovn", expected: "pull-ci-openshift-origin-master-e2e-aws-ser-0123456789ab"},
+		{job: "", expected: "prometheus-0123456789ab"},
+	}
+	for _, test := range tests {
+		name := prometheusExposureName(deployment, job(test.job))
+		if name.Name != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.job, test.expected, name.Name)
+		}
+		if host := name.Name + "-" + name.Namespace; len(host) > maxHostLabel {
+			t.Errorf("%q: host %s doesn't fit in a DNS label", test.job, host)
+		}
+		if strings.Contains(name.Name, "--") {
+			t.Errorf("%q: expected no empty segment, got %s", test.job, name.Name)
+		}
+	}
+}
+
+func TestSharedExposePrometheus(t *testing.T) {
+	exposing := &api.MetricsCluster{Spec: api.MetricsClusterSpec{ExposePrometheus: true}}
+	restricted := &api.MetricsCluster{Spec: api.MetricsClusterSpec{ExposePrometheus: true, AllowedExternalQueriers: []api.ExternalQuerier{{CIDR: "10.0.0.0/8"}}}}
+	other := &api.MetricsCluster{}
+
+	if !sharedExposePrometheus([]*api.MetricsCluster{other, exposing}) {
+		t.Errorf("expected a replica exposed by one of its clusters to be exposed")
+	}
+	if sharedExposePrometheus([]*api.MetricsCluster{other, restricted}) {
+		t.Errorf("expected a cluster restricting its queriers not to expose its replicas")
+	}
+}
+
+func TestPrometheusServiceManifest(t *testing.T) {
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: "prometheus-0123456789ab", UID: "uid"}}
+
+	service := prometheusServiceManifest(deployment, nil)
+	if service.Spec.Selector["prometheus"] != deployment.Name {
+		t.Errorf("expected the deployment's pods selected, got %v", service.Spec.Selector)
+	}
+	if len(service.OwnerReferences) != 1 || service.OwnerReferences[0].UID != deployment.UID {
+		t.Errorf("expected the service owned by the deployment, got %v", service.OwnerReferences)
+	}
+
+	service = prometheusServiceManifest(deployment, &corev1.Pod{})
+	if service.Spec.Selector["claimed-by"] != deployment.Name || len(service.Spec.Selector["prometheus"]) > 0 {
+		t.Errorf("expected the claimed pool pod selected, got %v", service.Spec.Selector)
+	}
+}
@@ -0,0 +1,128 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// failureReasons are the reasons sources are counted by, in the order ties
+// between them are broken.
+var failureReasons = []api.FailureReason{
+	api.FailureArtifactMissing,
+	api.FailureDownloadFailed,
+	api.FailureTSDBCorrupt,
+	api.FailureQuotaExceeded,
+	api.FailureImagePullFailed,
+	api.FailureInsufficientStorage,
+	api.FailureQuarantined,
+	api.FailureChecksumMismatch,
+}
+
+var failedSources = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "dowser_cluster_failed_sources",
+	Help: "Sources of a cluster which failed to be served, by failure reason.",
+}, []string{"cluster", "reason"})
+
+func init() {
+	metrics.Registry.MustRegister(failedSources)
+}
+
+// replicaFailure returns why the replica of an unavailable deployment fails,
+// if it does for a known reason: its pods can't be created within the quota,
+// their images can't be pulled, the fetch of their data keeps failing, told
+// with the end of the setup container's log, or Prometheus keeps crashing on
+// it.
+func (o *Operator) replicaFailure(deployment *appsv1.Deployment) (api.FailureReason, string, error) {
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue &&
+			strings.Contains(condition.Message, "exceeded quota") {
+			return api.FailureQuotaExceeded, condition.Message, nil
+		}
+	}
+	pods := &corev1.PodList{}
+	err := o.client.List(context.TODO(), pods, client.InNamespace(deployment.Namespace), client.MatchingLabels(deployment.Spec.Selector.MatchLabels))
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't list pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if waiting := status.State.Waiting; waiting != nil {
+				switch waiting.Reason {
+				case "ErrImagePull", "ImagePullBackOff", "InvalidImageName":
+					return api.FailureImagePullFailed, fmt.Sprintf("couldn't pull %s: %s", status.Image, waiting.Message), nil
+				}
+			}
+			if status.RestartCount == 0 {
+				continue
+			}
+			terminated := status.LastTerminationState.Terminated
+			if terminated == nil || terminated.ExitCode == 0 || terminated.Reason == "OOMKilled" {
+				continue
+			}
+			switch status.Name {
+			case "setup":
+				if mismatch := checksumMismatch(terminated.Message); len(mismatch) > 0 {
+					return api.FailureChecksumMismatch, mismatch, nil
+				}
+				message := fmt.Sprintf("fetching the data failed %d times", status.RestartCount)
+				if o.setupLogs != nil {
+					tail, err := o.setupLogs.tail(context.TODO(), &pod, status.RestartCount)
+					if err != nil {
+						o.log.Error(err, "couldn't read setup log", "pod", pod.Name)
+					} else if len(tail) > 0 {
+						message += ": " + tail
+					}
+				}
+				return api.FailureDownloadFailed, message, nil
+			case "prometheus":
+				return api.FailureTSDBCorrupt, fmt.Sprintf("prometheus exited with %d %d times", terminated.ExitCode, status.RestartCount), nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// updateFailureReasons reports the cluster's failed sources by reason in the
+// SourcesLoaded condition and the failed sources metric.
+func updateFailureReasons(cluster *api.MetricsCluster) {
+	counts := map[api.FailureReason]int{}
+	for _, job := range cluster.Status.Jobs {
+		if len(job.Reason) > 0 {
+			counts[job.Reason]++
+		}
+	}
+	var worst api.FailureReason
+	var summary []string
+	for _, reason := range failureReasons {
+		failedSources.WithLabelValues(cluster.Name, string(reason)).Set(float64(counts[reason]))
+		if counts[reason] == 0 {
+			continue
+		}
+		summary = append(summary, fmt.Sprintf("%d %s", counts[reason], reason))
+		if len(worst) == 0 || counts[reason] > counts[worst] {
+			worst = reason
+		}
+	}
+	if len(worst) == 0 {
+		setCondition(cluster, api.ConditionSourcesLoaded, corev1.ConditionTrue, "SourcesLoaded", "")
+		return
+	}
+	setCondition(cluster, api.ConditionSourcesLoaded, corev1.ConditionFalse, string(worst), strings.Join(summary, ", "))
+}
+
+// forgetFailureReasons drops the metrics of a deleted cluster.
+func forgetFailureReasons(clusterName string) {
+	for _, reason := range failureReasons {
+		failedSources.DeleteLabelValues(clusterName, string(reason))
+	}
+}
@@ -0,0 +1,58 @@
+package operator
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestUpdateFailureReasons(t *testing.T) {
+	tests := []struct {
+		name    string
+		reasons []api.FailureReason
+		status  corev1.ConditionStatus
+		reason  string
+		message string
+	}{
+		{
+			name:    "none failed",
+			reasons: []api.FailureReason{"", ""},
+			status:  corev1.ConditionTrue,
+			reason:  "SourcesLoaded",
+		},
+		{
+			name:    "most common",
+			reasons: []api.FailureReason{api.FailureDownloadFailed, api.FailureImagePullFailed, api.FailureImagePullFailed, ""},
+			status:  corev1.ConditionFalse,
+			reason:  string(api.FailureImagePullFailed),
+			message: "1 DownloadFailed, 2 ImagePullFailed",
+		},
+		{
+			name:    "tie",
+			reasons: []api.FailureReason{api.FailureTSDBCorrupt, api.FailureArtifactMissing},
+			status:  corev1.ConditionFalse,
+			reason:  string(api.FailureArtifactMissing),
+			message: "1 ArtifactMissing, 1 TSDBCorrupt",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := &api.MetricsCluster{}
+			cluster.Name = "test"
+			for _, reason := range test.reasons {
+				cluster.Status.Jobs = append(cluster.Status.Jobs, api.JobStatus{Reason: reason})
+			}
+			updateFailureReasons(cluster)
+			defer forgetFailureReasons(cluster.Name)
+			if len(cluster.Status.Conditions) != 1 {
+				t.Fatalf("expected one condition, got %v", cluster.Status.Conditions)
+			}
+			condition := cluster.Status.Conditions[0]
+			if condition.Status != test.status || condition.Reason != test.reason || condition.Message != test.message {
+				t.Errorf("expected %s %s %q, got %s %s %q", test.status, test.reason, test.message, condition.Status, condition.Reason, condition.Message)
+			}
+		})
+	}
+}
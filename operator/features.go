@@ -0,0 +1,41 @@
+package operator
+
+import (
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// prometheusFeatures returns the Prometheus feature flags enabled by any of
+// the clusters, as data a cluster needs a feature to load must load for every
+// cluster sharing the replica.
+func prometheusFeatures(clusters []*api.MetricsCluster) []string {
+	enabled := map[string]bool{}
+	for _, cluster := range clusters {
+		for _, feature := range cluster.Spec.PrometheusFeatures {
+			enabled[feature] = true
+		}
+	}
+	var features []string
+	for feature := range enabled {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// enablePrometheusFeatures passes the feature flags to the pod's Prometheus.
+func enablePrometheusFeatures(podSpec *corev1.PodSpec, features []string) {
+	if len(features) == 0 {
+		return
+	}
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container.Name == "prometheus" {
+			container.Args = append(container.Args, "--enable-feature="+strings.Join(features, ","))
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package operator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Sources' artifacts, their prow job and the tarball of their Prometheus
+// data, are discovered by a pool of workers rather than by reconciles, which
+// would otherwise block the controller fetching them one after the other for
+// clusters with dozens of sources. Reconciles report sources still being
+// discovered as restoring, and clusters are reconciled again as the results
+// they wait for arrive.
+
+// artifactRetryInterval is how long failed discoveries, and those of prow
+// jobs which haven't completed, are kept before being retried.
+const artifactRetryInterval = time.Minute
+
+// sourceArtifacts is what's discovered about a source.
+type sourceArtifacts struct {
+	prowJob prowapi.ProwJob
+	tarURL  string
+	image   string
+
+	// artifacts are the URLs of the job's other artifacts matching
+	// JobArtifacts, by kind.
+	artifacts map[string][]string
+
+	// extractedSize is the estimated size of the source's data with
+	// StoragePreflight, if it's known.
+	extractedSize int64
+
+	// err is why discovery failed, classified by reason.
+	err    error
+	reason api.FailureReason
+
+	// quarantined means discovery kept panicking and isn't retried.
+	quarantined bool
+
+	fetched time.Time
+}
+
+// isFinal returns whether the artifacts won't change anymore, or won't be
+// looked for again.
+func (a *sourceArtifacts) isFinal() bool {
+	return a.quarantined || (a.err == nil && a.prowJob.Status.CompletionTime != nil)
+}
+
+// artifactFetcher discovers the artifacts of sources with a pool of workers,
+// making at most rateLimit requests per second to each host if it's
+// positive.
+type artifactFetcher struct {
+	operator  *Operator
+	workers   int
+	rateLimit float64
+
+	queue workqueue.Interface
+
+	// events requeues the clusters waiting for a source's artifacts.
+	events chan event.GenericEvent
+
+	lock    sync.Mutex
+	results map[string]*sourceArtifacts
+	waiting map[string]map[types.NamespacedName]bool
+
+	// nextRequest is when the next request to each host may be made.
+	nextRequest map[string]time.Time
+}
+
+func newArtifactFetcher(o *Operator) *artifactFetcher {
+	return &artifactFetcher{
+		operator:    o,
+		workers:     o.ArtifactFetchWorkers,
+		rateLimit:   o.ArtifactFetchRate,
+		queue:       workqueue.New(),
+		events:      make(chan event.GenericEvent, 100),
+		results:     map[string]*sourceArtifacts{},
+		waiting:     map[string]map[types.NamespacedName]bool{},
+		nextRequest: map[string]time.Time{},
+	}
+}
+
+// artifacts returns the artifacts of the source at url, and whether they've
+// been discovered. Sources which weren't, or whose artifacts may have changed
+// since, are queued for discovery, and the cluster is requeued once it's
+// done. Artifacts being rediscovered are returned as they were meanwhile.
+func (f *artifactFetcher) artifacts(cluster *api.MetricsCluster, url string) (*sourceArtifacts, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result, found := f.results[url]
+	if found && (result.isFinal() || time.Since(result.fetched) < artifactRetryInterval) {
+		return result, true
+	}
+	if f.waiting[url] == nil {
+		f.waiting[url] = map[types.NamespacedName]bool{}
+	}
+	f.waiting[url][types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}] = true
+	f.queue.Add(url)
+	return result, found
+}
+
+// forget drops what's been discovered about the source at url.
+func (f *artifactFetcher) forget(url string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.results, url)
+}
+
+// run discovers queued sources until stop is closed.
+func (f *artifactFetcher) run(stop <-chan struct{}) error {
+	go func() {
+		<-stop
+		f.queue.ShutDown()
+	}()
+	var workers sync.WaitGroup
+	for i := 0; i < f.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for f.processNext() {
+			}
+		}()
+	}
+	workers.Wait()
+	return nil
+}
+
+// processNext discovers the next queued source and requeues the clusters
+// waiting for it. It returns false once the queue is shut down.
+func (f *artifactFetcher) processNext() bool {
+	item, shutdown := f.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer f.queue.Done(item)
+	url := item.(string)
+	start := time.Now()
+	result := f.discoverRecovering(url)
+	outcome := "found"
+	if result.err != nil {
+		outcome = "failed"
+	}
+	artifactFetchDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+
+	f.lock.Lock()
+	f.results[url] = result
+	waiting := f.waiting[url]
+	delete(f.waiting, url)
+	f.lock.Unlock()
+
+	for name := range waiting {
+		cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name}}
+		f.events <- event.GenericEvent{Meta: cluster, Object: cluster}
+	}
+	return true
+}
+
+// discover resolves the prow job of the source at url and its tarball, and
+// finds the image able to read it.
+func (f *artifactFetcher) discover(url string) *sourceArtifacts {
+	o := f.operator
+	log := o.log.WithValues("url", url)
+	result := &sourceArtifacts{fetched: time.Now()}
+
+	resolverFor(url).resolve(f, url, result)
+	if result.err != nil {
+		return result
+	}
+	tarURL := result.tarURL
+	if len(o.MirrorBucket) > 0 && result.prowJob.Status.CompletionTime != nil {
+		f.wait(tarURL)
+		mirroredURL, err := o.mirrorTarball(tarURL)
+		if err != nil {
+			log.Error(err, "couldn't mirror prometheus tarball")
+			result.err, result.reason = fmt.Errorf("couldn't mirror prometheus tarball: %w", err), api.FailureDownloadFailed
+			return result
+		}
+		tarURL = mirroredURL
+	}
+	result.tarURL = tarURL
+
+	f.wait(tarURL)
+	var err error
+	result.image, err = o.prometheusImageFor(tarURL)
+	if err != nil {
+		log.Error(err, "couldn't select prometheus image")
+		result.err, result.reason = fmt.Errorf("couldn't inspect the TSDB blocks"), api.FailureTSDBCorrupt
+		return result
+	}
+
+	if o.StoragePreflight {
+		f.wait(tarURL)
+		result.extractedSize, err = o.extractedSize(tarURL)
+		if err != nil {
+			log.Error(err, "couldn't size prometheus tarball")
+		}
+	}
+	return result
+}
+
+// fetchProwJob decodes the prow job at prowInfoURL into prowJob.
+func fetchProwJob(prowInfoURL string, prowJob *prowapi.ProwJob) error {
+	resp, err := http.Get(prowInfoURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(prowJob); err != nil {
+		return fmt.Errorf("couldn't decode prow job: %w", err)
+	}
+	return nil
+}
+
+// wait blocks until a request to the host of url is allowed, and reserves
+// it.
+func (f *artifactFetcher) wait(url string) {
+	if f.rateLimit <= 0 {
+		return
+	}
+	parsed, err := neturl.Parse(url)
+	if err != nil {
+		return
+	}
+	f.lock.Lock()
+	now := time.Now()
+	at := f.nextRequest[parsed.Host]
+	if at.Before(now) {
+		at = now
+	}
+	f.nextRequest[parsed.Host] = at.Add(time.Duration(float64(time.Second) / f.rateLimit))
+	f.lock.Unlock()
+	time.Sleep(at.Sub(now))
+}
@@ -0,0 +1,66 @@
+package operator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestArtifactFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/found/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", "Thu, 01 Oct 2020 13:00:00 GMT")
+	}))
+	defer server.Close()
+	o := &Operator{
+		PrometheusImage:   "prometheus",
+		ProwBaseURL:       server.URL + "/view/gs/origin-ci-test",
+		GCSStorageBaseURL: server.URL + "/gcs/origin-ci-test",
+		log:               log.NullLogger{},
+	}
+	fetcher := newArtifactFetcher(o)
+	cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: "blocking-46"}}
+
+	found := server.URL + "/found/logs/job/1/artifacts/metrics/prometheus.tar"
+	if _, discovered := fetcher.artifacts(cluster, found); discovered {
+		t.Fatalf("expected the source to be queued for discovery")
+	}
+	if !fetcher.processNext() {
+		t.Fatalf("expected the queue to be running")
+	}
+	requeued := <-fetcher.events
+	if requeued.Meta.GetName() != cluster.Name || requeued.Meta.GetNamespace() != cluster.Namespace {
+		t.Errorf("expected %s/%s to be requeued, got %s/%s", cluster.Namespace, cluster.Name, requeued.Meta.GetNamespace(), requeued.Meta.GetName())
+	}
+	completed := metav1.Date(2020, 10, 1, 13, 0, 0, 0, time.UTC)
+	artifacts, discovered := fetcher.artifacts(cluster, found)
+	if !discovered || artifacts.err != nil || artifacts.tarURL != found || artifacts.image != "prometheus" || !artifacts.isFinal() {
+		t.Errorf("unexpected artifacts %+v", artifacts)
+	}
+	if fetcher.queue.Len() != 0 {
+		t.Errorf("expected completed jobs not to be rediscovered")
+	}
+
+	if artifacts.prowJob.Spec.Job != "job" || artifacts.prowJob.Status.BuildID != "1" || !artifacts.prowJob.Status.CompletionTime.Equal(&completed) {
+		t.Errorf("unexpected prow job %+v", artifacts.prowJob)
+	}
+
+	missing := server.URL + "/view/gs/origin-ci-test/logs/job/2"
+	fetcher.artifacts(cluster, missing)
+	fetcher.processNext()
+	<-fetcher.events
+	artifacts, discovered = fetcher.artifacts(cluster, missing)
+	if !discovered || artifacts.err == nil || artifacts.reason != api.FailureDownloadFailed {
+		t.Errorf("expected the missing prow job to fail discovery, got %+v", artifacts)
+	}
+}
@@ -0,0 +1,520 @@
+package operator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	logging "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The fetcher runs as the setup container of replicas, loading the tarball of
+// their source into the Prometheus data volume. Downloads are retried, and
+// resumed with range requests where they broke off rather than restarted, so
+// a flaky connection doesn't cost a multi-GB tarball from scratch. The
+// tarball is checked against the size the server announced and the source's
+// pinned digest, if any, before its data is trusted, and the outcome is
+// reported as the container's termination message: the digest of the loaded
+// tarball, or the reason it was refused. Logs are structured so they can be
+// searched by field.
+
+// fetchedMarker and digestFile are written into the data directory once a
+// fetch completes, so a restarted setup container doesn't fetch again.
+const (
+	fetchedMarker = ".fetched"
+	digestFile    = ".sha256"
+)
+
+// fetcherProgressInterval is how often the fetcher logs its progress.
+const fetcherProgressInterval = 10 * time.Second
+
+type fetcherOptions struct {
+	URL            string
+	Dir            string
+	SHA256         string
+	Size           int64
+	Cache          string
+	CacheTTL       time.Duration
+	Retries        int
+	RetryDelay     time.Duration
+	TerminationLog string
+
+	// Downloads are held to Bandwidth bytes per second, if set, and to the
+	// share of the namespace-wide bandwidth read from BandwidthFile.
+	Bandwidth     int64
+	BandwidthFile string
+
+	// The WAL of tarballs holding blocks is dropped if larger than TrimWALOver
+	// bytes, if set.
+	TrimWALOver int64
+
+	// The configuration of the replica is written to ConfigFile, if given,
+	// from the metadata of the source's job.
+	ConfigFile  string
+	Replica     string
+	JobURL      string
+	JobName     string
+	DisplayName string
+}
+
+func NewFetcherCommand() *cobra.Command {
+	var options fetcherOptions
+
+	var command = &cobra.Command{
+		Use:   "fetcher",
+		Short: "Loads the TSDB of a source into a replica's data volume.",
+		Long: `Loads the TSDB of a source into a replica's data volume.
+
+This is the setup container of replicas. The source's Prometheus tarball is
+downloaded, resuming interrupted downloads, checked against its size and
+digest, and extracted into the data directory, dropping a large WAL if
+asked to. With an artifact cache, the tarball is read from the cache, where
+it's downloaded first unless another replica already did. The digest of the
+loaded tarball, or the reason it was refused, is written to the termination
+log.
+
+Flags default to the environment variables the operator sets on setup
+containers.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			log := logging.Log.WithName("fetcher")
+			message, err := runFetcher(options, http.DefaultClient, log)
+			if err != nil {
+				message = err.Error()
+			}
+			if len(options.TerminationLog) > 0 && len(message) > 0 {
+				if err := ioutil.WriteFile(options.TerminationLog, []byte(message+"\n"), 0644); err != nil {
+					log.Error(err, "couldn't write the termination log", "path", options.TerminationLog)
+				}
+			}
+			if err != nil {
+				log.Error(err, "fetch failed", "url", options.URL)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cacheTTLMinutes, _ := strconv.Atoi(os.Getenv("ARTIFACT_CACHE_TTL_MINUTES"))
+	size, _ := strconv.ParseInt(os.Getenv("PROMTAR_SIZE"), 10, 64)
+	bandwidth, _ := strconv.ParseInt(os.Getenv("FETCH_BANDWIDTH"), 10, 64)
+	trimWALOver, _ := strconv.ParseInt(os.Getenv("TRIM_WAL_OVER"), 10, 64)
+	flags := command.Flags()
+	flags.StringVarP(&options.URL, "url", "", os.Getenv("PROMTAR"), "URL of the Prometheus tarball")
+	flags.StringVarP(&options.Dir, "dir", "", "/prometheus", "data directory to extract the tarball into")
+	flags.StringVarP(&options.SHA256, "sha256", "", os.Getenv("PROMTAR_SHA256"), "digest the tarball must have, if any")
+	flags.Int64VarP(&options.Size, "size", "", size, "size in bytes the tarball must have, if any")
+	flags.StringVarP(&options.Cache, "cache", "", os.Getenv("ARTIFACT_CACHE"), "directory of the artifact cache, if any")
+	flags.DurationVarP(&options.CacheTTL, "cache-ttl", "", time.Duration(cacheTTLMinutes)*time.Minute, "time after which tarballs no replica read are removed from the cache")
+	flags.IntVarP(&options.Retries, "retries", "", 5, "number of times a failed download is retried")
+	flags.DurationVarP(&options.RetryDelay, "retry-delay", "", 10*time.Second, "delay between retries")
+	flags.StringVarP(&options.TerminationLog, "termination-log", "", "/dev/termination-log", "file the outcome is reported to")
+	flags.Int64VarP(&options.Bandwidth, "bandwidth", "", bandwidth, "bytes per second downloads are held to (0 for no limit)")
+	flags.StringVarP(&options.BandwidthFile, "bandwidth-file", "", os.Getenv("FETCH_BANDWIDTH_FILE"), "file holding the pod's share of the namespace-wide bandwidth, read as it changes")
+	flags.Int64VarP(&options.TrimWALOver, "trim-wal-over", "", trimWALOver, "size in bytes over which the WAL of a tarball holding blocks is dropped (0 to keep it)")
+	flags.StringVarP(&options.ConfigFile, "config-file", "", os.Getenv("PROMETHEUS_CONFIG_FILE"), "file to write the replica's Prometheus configuration to, if any")
+	flags.StringVarP(&options.Replica, "replica", "", os.Getenv("REPLICA"), "name of the replica, for its configuration")
+	flags.StringVarP(&options.JobURL, "job-url", "", os.Getenv("JOB_URL"), "URL of the source's job, for the replica's configuration")
+	flags.StringVarP(&options.JobName, "job-name", "", os.Getenv("JOB_NAME"), "name of the source's job, for the replica's configuration")
+	flags.StringVarP(&options.DisplayName, "display-name", "", os.Getenv("DISPLAY_NAME"), "display name of the source, for the replica's configuration")
+
+	return command
+}
+
+// runFetcher loads the tarball into the data directory unless an earlier run
+// already did, and returns the termination message reporting its digest.
+// An error refusing the tarball has the checksum mismatch prefix.
+func runFetcher(options fetcherOptions, client *http.Client, log logr.Logger) (string, error) {
+	if len(options.URL) == 0 {
+		return "", fmt.Errorf("no tarball URL given")
+	}
+	if err := writeReplicaConfig(options); err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(options.Dir, fetchedMarker)); err == nil {
+		log.Info("data already fetched", "dir", options.Dir)
+		return loadedDigestMessage(options.Dir)
+	}
+	// Only a completed fetch is trusted; anything else is what a failed
+	// attempt left behind.
+	if err := clearDir(options.Dir); err != nil {
+		return "", err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	bucket := fetchBandwidth(options, log, stop)
+
+	var cached string
+	if len(options.Cache) > 0 {
+		var err error
+		if cached, err = fillCache(options, client, bucket, log); err != nil {
+			return "", err
+		}
+	}
+
+	digest := sha256.New()
+	var extractErr error
+	if len(cached) > 0 {
+		log.Info("extracting cached tarball", "url", options.URL, "path", cached)
+		extractErr = extractCachedTarball(cached, digest, options.Dir)
+	} else {
+		log.Info("downloading tarball", "url", options.URL, "dir", options.Dir)
+		body := newResumableBody(client, options, bucket, log)
+		extractErr = extractVerified(body, digest, options.Dir)
+		if extractErr == nil {
+			extractErr = body.verifySize()
+		}
+	}
+	if extractErr != nil {
+		clearDir(options.Dir)
+		return "", fmt.Errorf("couldn't extract %s: %w", options.URL, extractErr)
+	}
+
+	sum := hex.EncodeToString(digest.Sum(nil))
+	if pinned := strings.ToLower(options.SHA256); len(pinned) > 0 && sum != pinned {
+		clearDir(options.Dir)
+		if len(cached) > 0 {
+			os.Remove(cached)
+		}
+		return "", errors.New(checksumMismatchPrefix + fmt.Sprintf("expected %s, got %s", options.SHA256, sum))
+	}
+	if err := trimWAL(options.Dir, options.TrimWALOver, log); err != nil {
+		clearDir(options.Dir)
+		return "", err
+	}
+	// Prometheus may run as another user than the fetcher.
+	if err := shareTree(options.Dir); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(options.Dir, digestFile), []byte(sum+"\n"), 0666); err != nil {
+		return "", fmt.Errorf("couldn't record the digest: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(options.Dir, fetchedMarker), nil, 0666); err != nil {
+		return "", fmt.Errorf("couldn't mark the data fetched: %w", err)
+	}
+	log.Info("fetched tarball", "url", options.URL, "sha256", sum)
+	return checksumDigestPrefix + sum, nil
+}
+
+// writeReplicaConfig writes the configuration of the replica to ConfigFile,
+// if given, as the operator renders it for the source's job.
+func writeReplicaConfig(options fetcherOptions) error {
+	if len(options.ConfigFile) == 0 {
+		return nil
+	}
+	job := &Job{
+		ProwJob: prowapi.ProwJob{
+			Spec:   prowapi.ProwJobSpec{Job: options.JobName},
+			Status: prowapi.ProwJobStatus{URL: options.JobURL},
+		},
+		DisplayName: options.DisplayName,
+	}
+	config, err := renderPrometheusConfig(options.Replica, job, nil)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(options.ConfigFile, []byte(config[prometheusConfigKey]), 0644); err != nil {
+		return fmt.Errorf("couldn't write %s: %w", options.ConfigFile, err)
+	}
+	return nil
+}
+
+// loadedDigestMessage returns the termination message reporting the digest
+// recorded by the run which fetched the data.
+func loadedDigestMessage(dir string) (string, error) {
+	sum, err := ioutil.ReadFile(filepath.Join(dir, digestFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't read the digest: %w", err)
+	}
+	return checksumDigestPrefix + strings.TrimSpace(string(sum)), nil
+}
+
+// fillCache returns the path of the tarball in the cache, downloading it
+// first unless another replica already did, and removes the tarballs no
+// replica read within the cache's TTL. Downloads are moved in place once
+// complete so partial tarballs are never read.
+func fillCache(options fetcherOptions, client *http.Client, bucket *tokenBucket, log logr.Logger) (string, error) {
+	key := sha256.Sum256([]byte(options.URL))
+	cached := filepath.Join(options.Cache, hex.EncodeToString(key[:])+".tar")
+	if _, err := os.Stat(cached); os.IsNotExist(err) {
+		log.Info("downloading tarball into the cache", "url", options.URL, "path", cached)
+		partial, err := ioutil.TempFile(options.Cache, "partial.")
+		if err != nil {
+			return "", fmt.Errorf("couldn't create a file in the cache: %w", err)
+		}
+		body := newResumableBody(client, options, bucket, log)
+		_, err = io.Copy(partial, body)
+		if err == nil {
+			err = body.verifySize()
+		}
+		if closeErr := partial.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(partial.Name(), cached)
+		}
+		if err != nil {
+			os.Remove(partial.Name())
+			return "", fmt.Errorf("couldn't download %s: %w", options.URL, err)
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(cached, now, now); err != nil {
+		return "", fmt.Errorf("couldn't touch %s: %w", cached, err)
+	}
+	if options.CacheTTL > 0 {
+		pruneCache(options.Cache, now.Add(-options.CacheTTL), log)
+	}
+	return cached, nil
+}
+
+// pruneCache removes the files of the cache last touched before cutoff.
+func pruneCache(cache string, cutoff time.Time, log logr.Logger) {
+	entries, err := ioutil.ReadDir(cache)
+	if err != nil {
+		log.Error(err, "couldn't list the cache", "path", cache)
+		return
+	}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && entry.ModTime().Before(cutoff) {
+			path := filepath.Join(cache, entry.Name())
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Error(err, "couldn't remove expired tarball", "path", path)
+				continue
+			}
+			log.Info("removed expired tarball", "path", path)
+		}
+	}
+}
+
+// extractCachedTarball extracts the tarball at path into dir, hashing it.
+func extractCachedTarball(path string, digest hash.Hash, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return extractVerified(file, digest, dir)
+}
+
+// extractVerified extracts the tarball read from r into dir, hashing all of
+// it: what follows the end of the archive counts towards the digest too.
+func extractVerified(r io.Reader, digest hash.Hash, dir string) error {
+	stream := io.TeeReader(r, digest)
+	if err := extractTarball(stream, dir); err != nil {
+		return err
+	}
+	_, err := io.Copy(ioutil.Discard, stream)
+	return err
+}
+
+// clearDir removes the contents of dir, keeping dir itself, which is usually
+// a volume's mount point.
+func clearDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("couldn't clear %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// shareTree makes the contents of dir writable by all users, so Prometheus
+// can compact the TSDB and write its WAL whichever user it runs as. dir
+// itself is left as the volume has it.
+func shareTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		mode := os.FileMode(0666)
+		if info.IsDir() {
+			mode = 0777
+		}
+		return os.Chmod(path, mode)
+	})
+}
+
+// resumableBody reads the tarball at a URL, resuming from where it broke off
+// with range requests when reading fails, up to the given number of retries.
+// Reads are held to the bandwidth of the bucket.
+type resumableBody struct {
+	client     *http.Client
+	url        string
+	retries    int
+	retryDelay time.Duration
+	bucket     *tokenBucket
+	log        logr.Logger
+
+	// size is the tarball's size: the one expected, if given, or the one the
+	// server announced, or -1 if neither is known.
+	size     int64
+	expected bool
+	body     io.ReadCloser
+	offset   int64
+	attempts int
+
+	lastProgress time.Time
+}
+
+func newResumableBody(client *http.Client, options fetcherOptions, bucket *tokenBucket, log logr.Logger) *resumableBody {
+	body := &resumableBody{
+		client:     client,
+		url:        options.URL,
+		retries:    options.Retries,
+		retryDelay: options.RetryDelay,
+		bucket:     bucket,
+		log:        log,
+		size:       -1,
+	}
+	if options.Size > 0 {
+		body.size = options.Size
+		body.expected = true
+	}
+	return body
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		if b.body == nil {
+			if err := b.open(); err != nil {
+				if !b.retry(err) {
+					return 0, err
+				}
+				continue
+			}
+		}
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		b.bucket.take(n)
+		b.logProgress()
+		if err == io.EOF && b.size >= 0 && b.offset < b.size {
+			err = fmt.Errorf("connection closed after %d of %d bytes", b.offset, b.size)
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		b.body.Close()
+		b.body = nil
+		if !b.retry(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retry returns whether reading should be retried after err, waiting for
+// the retry delay if so.
+func (b *resumableBody) retry(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) || b.attempts >= b.retries {
+		return false
+	}
+	b.attempts++
+	b.log.Info("retrying download", "url", b.url, "offset", b.offset, "attempt", b.attempts, "error", err.Error())
+	time.Sleep(b.retryDelay)
+	return true
+}
+
+// open requests the tarball from the current offset.
+func (b *resumableBody) open() error {
+	req, err := http.NewRequest(http.MethodGet, b.url, nil)
+	if err != nil {
+		return &permanentError{err}
+	}
+	if b.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case b.offset == 0 && resp.StatusCode == http.StatusOK:
+		if resp.ContentLength >= 0 {
+			if b.expected && resp.ContentLength != b.size {
+				resp.Body.Close()
+				return &permanentError{fmt.Errorf("expected %d bytes, the server has %d", b.size, resp.ContentLength)}
+			}
+			b.size = resp.ContentLength
+		}
+	case b.offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		b.log.Info("resuming download", "url", b.url, "offset", b.offset)
+	case b.offset > 0 && resp.StatusCode == http.StatusOK:
+		resp.Body.Close()
+		return &permanentError{fmt.Errorf("the server doesn't resume downloads")}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		resp.Body.Close()
+		return fmt.Errorf("couldn't fetch %s: %s", b.url, resp.Status)
+	default:
+		resp.Body.Close()
+		return &permanentError{fmt.Errorf("couldn't fetch %s: %s", b.url, resp.Status)}
+	}
+	b.body = resp.Body
+	return nil
+}
+
+// verifySize returns an error unless the whole tarball was read. The body
+// must have been read to the end.
+func (b *resumableBody) verifySize() error {
+	if b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	if b.size >= 0 && b.offset != b.size {
+		return fmt.Errorf("read %d of %d bytes", b.offset, b.size)
+	}
+	return nil
+}
+
+func (b *resumableBody) logProgress() {
+	now := time.Now()
+	if now.Sub(b.lastProgress) < fetcherProgressInterval {
+		return
+	}
+	b.lastProgress = now
+	b.log.Info("downloading", "url", b.url, "bytes", b.offset, "size", b.size)
+}
+
+// permanentError is an error retrying won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,151 @@
+package operator
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	logging "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestRunFetcher(t *testing.T) {
+	out := &bytes.Buffer{}
+	gz := gzip.NewWriter(out)
+	archive := tar.NewWriter(gz)
+	for name, content := range map[string]string{"01EXAMPLE/meta.json": "{}", "wal/00000000": strings.Repeat("wal", 4096)} {
+		archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		archive.Write([]byte(content))
+	}
+	archive.Close()
+	gz.Close()
+	tarball := out.Bytes()
+	sum := sha256.Sum256(tarball)
+	digest := hex.EncodeToString(sum[:])
+
+	// The server breaks off the first download halfway, and ignores range
+	// requests unless resumable.
+	var requests int
+	resumable := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(tarball)))
+			w.Write(tarball[:len(tarball)/2])
+			return
+		}
+		if !resumable {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "prometheus.tar", time.Time{}, bytes.NewReader(tarball))
+	}))
+	defer server.Close()
+
+	tempDir := func() string {
+		dir, err := ioutil.TempDir("", "fetcher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	options := func(dir string) fetcherOptions {
+		return fetcherOptions{URL: server.URL + "/prometheus.tar", Dir: dir, Retries: 2}
+	}
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	message, err := runFetcher(options(dir), server.Client(), logging.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != checksumDigestPrefix+digest {
+		t.Errorf("expected the digest reported, got %q", message)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "01EXAMPLE", "meta.json"))
+	if err != nil || string(content) != "{}" {
+		t.Errorf("expected the block extracted, got %q: %v", content, err)
+	}
+	if requests != 2 {
+		t.Errorf("expected the download resumed once, got %d requests", requests)
+	}
+
+	// A restarted setup container reports the data already fetched.
+	message, err = runFetcher(options(dir), server.Client(), logging.Log)
+	if err != nil || message != checksumDigestPrefix+digest || requests != 2 {
+		t.Errorf("expected the data not fetched again, got %q after %d requests: %v", message, requests, err)
+	}
+
+	requests = 0
+	resumable = false
+	dir = tempDir()
+	defer os.RemoveAll(dir)
+	if _, err := runFetcher(options(dir), server.Client(), logging.Log); err == nil {
+		t.Errorf("expected a download the server can't resume to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, fetchedMarker)); err == nil {
+		t.Errorf("expected a failed fetch not to be marked complete")
+	}
+	resumable = true
+
+	// With a cache, the tarball is downloaded once and refused from the
+	// cache too on a digest mismatch.
+	cache := tempDir()
+	defer os.RemoveAll(cache)
+	requests = 1
+	dir = tempDir()
+	defer os.RemoveAll(dir)
+	cached := options(dir)
+	cached.Cache = cache
+	cached.CacheTTL = time.Hour
+	if _, err := runFetcher(cached, server.Client(), logging.Log); err != nil {
+		t.Fatal(err)
+	}
+	dir = tempDir()
+	defer os.RemoveAll(dir)
+	cached.Dir = dir
+	message, err = runFetcher(cached, server.Client(), logging.Log)
+	if err != nil || message != checksumDigestPrefix+digest || requests != 2 {
+		t.Errorf("expected the cached tarball loaded, got %q after %d requests: %v", message, requests, err)
+	}
+
+	dir = tempDir()
+	defer os.RemoveAll(dir)
+	cached.Dir = dir
+	cached.SHA256 = strings.Repeat("0", 64)
+	_, err = runFetcher(cached, server.Client(), logging.Log)
+	if err == nil || len(checksumMismatch(err.Error())) == 0 {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("expected the refused data removed, got %d entries", len(entries))
+	}
+	if entries, _ := ioutil.ReadDir(cache); len(entries) > 0 {
+		t.Errorf("expected the refused tarball removed from the cache, got %d entries", len(entries))
+	}
+
+	// The configuration of the replica is written from the job's metadata.
+	dir = tempDir()
+	defer os.RemoveAll(dir)
+	configured := options(dir)
+	configured.ConfigFile = filepath.Join(dir, prometheusConfigKey)
+	configured.Replica = "prometheus-example"
+	configured.JobURL = "https://prow.example.com/view/gs/bucket/logs/e2e/1234"
+	configured.JobName = "e2e"
+	if err := writeReplicaConfig(configured); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ioutil.ReadFile(configured.ConfigFile)
+	if err != nil || !strings.Contains(string(config), "cluster_name: prometheus-example") || !strings.Contains(string(config), "cluster_job: e2e") {
+		t.Errorf("expected the replica's configuration written, got %q: %v", config, err)
+	}
+}
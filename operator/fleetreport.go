@@ -0,0 +1,139 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// The index shows people what the operator serves; automation reads the
+// same overview from a MetricsClusterReport. Each instance keeps a single
+// report in its namespace, whose status counts the clusters by phase, their
+// sources and the failed ones by reason, the Prometheus replicas, and the
+// resources requested by all of them. The report is refreshed every
+// ReportInterval, and created if it's gone.
+
+// reportName returns the name of the report of an operator instance.
+func reportName(instance string) string {
+	if len(instance) == 0 {
+		return "dowser"
+	}
+	return "dowser-" + instance
+}
+
+func (o *Operator) reportFleet(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if err := o.updateFleetReport(time.Now()); err != nil {
+			o.log.Error(err, "couldn't update fleet report")
+		}
+	}, o.ReportInterval, stop)
+	return nil
+}
+
+// updateFleetReport refreshes the status of the instance's report.
+func (o *Operator) updateFleetReport(now time.Time) error {
+	clusters := &api.MetricsClusterList{}
+	if err := o.client.List(context.TODO(), clusters, client.InNamespace(o.Namespace)); err != nil {
+		return fmt.Errorf("couldn't list metricsclusters: %w", err)
+	}
+	deployments := &appsv1.DeploymentList{}
+	if err := o.client.List(context.TODO(), deployments, client.InNamespace(o.Namespace), client.MatchingLabels{"app": "prometheus"}); err != nil {
+		return fmt.Errorf("couldn't list deployments: %w", err)
+	}
+	pods, claimed, err := o.listFootprint()
+	if err != nil {
+		return err
+	}
+
+	var ownedClusters []api.MetricsCluster
+	for _, cluster := range clusters.Items {
+		if o.ownsObject(&cluster) {
+			ownedClusters = append(ownedClusters, cluster)
+		}
+	}
+	var replicas []appsv1.Deployment
+	for _, deployment := range deployments.Items {
+		if o.ownsObject(&deployment) {
+			replicas = append(replicas, deployment)
+		}
+	}
+	var managedPods []corev1.Pod
+	for _, pod := range pods {
+		if o.ownsObject(&pod) && isManagedPod(&pod) {
+			managedPods = append(managedPods, pod)
+		}
+	}
+
+	status := summarizeFleet(ownedClusters, replicas)
+	status.Footprint = podFootprint(managedPods, claimed)
+	status.Footprint.HourlyCost = o.hourlyCost(status.Footprint)
+	status.LastUpdateTime = &metav1.Time{Time: now}
+
+	report := &api.MetricsClusterReport{}
+	name := types.NamespacedName{Namespace: o.Namespace, Name: reportName(o.Instance)}
+	if err := o.client.Get(context.TODO(), name, report); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch metricsclusterreport: %w", err)
+		}
+		report = &api.MetricsClusterReport{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: name.Namespace,
+				Name:      name.Name,
+			},
+		}
+		if err := o.client.Create(context.TODO(), report); err != nil {
+			return fmt.Errorf("couldn't create metricsclusterreport: %w", err)
+		}
+		o.log.Info("created metricsclusterreport", "name", report.Name)
+	}
+	report.Status = status
+	if err := o.client.Status().Update(context.TODO(), report); err != nil {
+		return fmt.Errorf("couldn't update metricsclusterreport status: %w", err)
+	}
+	return nil
+}
+
+// summarizeFleet counts the clusters, their sources and the replicas serving
+// them.
+func summarizeFleet(clusters []api.MetricsCluster, replicas []appsv1.Deployment) api.MetricsClusterReportStatus {
+	status := api.MetricsClusterReportStatus{
+		Clusters: int32(len(clusters)),
+		Replicas: int32(len(replicas)),
+	}
+	for _, cluster := range clusters {
+		if len(cluster.Status.Phase) > 0 {
+			if status.Phases == nil {
+				status.Phases = map[api.MetricsClusterPhase]int32{}
+			}
+			status.Phases[cluster.Status.Phase]++
+		}
+		for _, job := range cluster.Status.Jobs {
+			status.Jobs++
+			switch {
+			case job.Ready:
+				status.ReadyJobs++
+			case len(job.Reason) > 0:
+				if status.Failures == nil {
+					status.Failures = map[api.FailureReason]int32{}
+				}
+				status.Failures[job.Reason]++
+			}
+		}
+	}
+	for _, replica := range replicas {
+		if replica.Status.AvailableReplicas > 0 {
+			status.AvailableReplicas++
+		}
+	}
+	return status
+}
@@ -0,0 +1,60 @@
+package operator
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestSummarizeFleet(t *testing.T) {
+	cluster := func(phase api.MetricsClusterPhase, jobs ...api.JobStatus) api.MetricsCluster {
+		return api.MetricsCluster{Status: api.MetricsClusterStatus{Phase: phase, Jobs: jobs}}
+	}
+	replica := func(available int32) appsv1.Deployment {
+		return appsv1.Deployment{Status: appsv1.DeploymentStatus{AvailableReplicas: available}}
+	}
+	clusters := []api.MetricsCluster{
+		cluster(api.PhaseReady, api.JobStatus{Ready: true}, api.JobStatus{Ready: true}),
+		cluster(api.PhaseDegraded, api.JobStatus{Ready: true}, api.JobStatus{Reason: api.FailureArtifactMissing}),
+		cluster(api.PhaseDegraded, api.JobStatus{Reason: api.FailureArtifactMissing}, api.JobStatus{Reason: api.FailureTSDBCorrupt}),
+		cluster(api.PhasePending, api.JobStatus{}),
+		cluster(""),
+	}
+	replicas := []appsv1.Deployment{replica(1), replica(1), replica(0)}
+
+	expected := api.MetricsClusterReportStatus{
+		Clusters: 5,
+		Phases: map[api.MetricsClusterPhase]int32{
+			api.PhaseReady:    1,
+			api.PhaseDegraded: 2,
+			api.PhasePending:  1,
+		},
+		Jobs:              7,
+		ReadyJobs:         3,
+		Replicas:          3,
+		AvailableReplicas: 2,
+		Failures: map[api.FailureReason]int32{
+			api.FailureArtifactMissing: 2,
+			api.FailureTSDBCorrupt:     1,
+		},
+	}
+	if status := summarizeFleet(clusters, replicas); !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+
+	if status := summarizeFleet(nil, nil); status.Phases != nil || status.Failures != nil {
+		t.Errorf("expected an empty fleet to have no counts, got %+v", status)
+	}
+}
+
+func TestReportName(t *testing.T) {
+	if name := reportName(""); name != "dowser" {
+		t.Errorf("expected the default instance's report to be dowser, got %q", name)
+	}
+	if name := reportName("ci"); name != "dowser-ci" {
+		t.Errorf("expected instance ci's report to be dowser-ci, got %q", name)
+	}
+}
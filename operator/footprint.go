@@ -0,0 +1,139 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+var (
+	clusterRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dowser_cluster_requested_resource",
+		Help: "Resources requested by a cluster's pods, in cores or bytes. Replicas shared between clusters are counted by each.",
+	}, []string{"cluster", "resource"})
+	namespaceRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dowser_namespace_requested_resource",
+		Help: "Resources requested by the pods of all clusters and the warm pool, in cores or bytes.",
+	}, []string{"resource"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(clusterRequests, namespaceRequests)
+}
+
+// updateFootprint records the resources requested by the cluster's running
+// pods: its Prometheus replicas and the components serving its queries. It
+// also updates the totals of the namespace.
+func (o *Operator) updateFootprint(cluster *api.MetricsCluster) error {
+	pods, claimed, err := o.listFootprint()
+	if err != nil {
+		return err
+	}
+
+	var clusterPods, managedPods []corev1.Pod
+	for _, pod := range pods {
+		_, isReplica := pod.Labels[cluster.Name]
+		if (pod.Labels["app"] == "prometheus" && isReplica) || pod.Labels["cluster"] == cluster.Name {
+			clusterPods = append(clusterPods, pod)
+		}
+		if isManagedPod(&pod) {
+			managedPods = append(managedPods, pod)
+		}
+	}
+
+	footprint := podFootprint(clusterPods, claimed)
+	footprint.HourlyCost = o.hourlyCost(footprint)
+	cluster.Status.Footprint = footprint
+	setRequestGauges(clusterRequests.MustCurryWith(prometheus.Labels{"cluster": cluster.Name}), footprint)
+	setRequestGauges(namespaceRequests, podFootprint(managedPods, claimed))
+	return nil
+}
+
+// listFootprint returns the pods of the namespace and the storage requested
+// by its claims, by name.
+func (o *Operator) listFootprint() ([]corev1.Pod, map[string]resource.Quantity, error) {
+	pods := &corev1.PodList{}
+	if err := o.client.List(context.TODO(), pods, client.InNamespace(o.Namespace)); err != nil {
+		return nil, nil, fmt.Errorf("couldn't list pods: %w", err)
+	}
+	claims := &corev1.PersistentVolumeClaimList{}
+	if err := o.client.List(context.TODO(), claims, client.InNamespace(o.Namespace)); err != nil {
+		return nil, nil, fmt.Errorf("couldn't list persistent volume claims: %w", err)
+	}
+	claimed := map[string]resource.Quantity{}
+	for _, claim := range claims.Items {
+		claimed[claim.Name] = claim.Spec.Resources.Requests[corev1.ResourceStorage]
+	}
+	return pods.Items, claimed, nil
+}
+
+// isManagedPod returns whether the pod is a replica, in the warm pool or
+// serving a cluster's queries.
+func isManagedPod(pod *corev1.Pod) bool {
+	app := pod.Labels["app"]
+	return app == "prometheus" || app == "prometheus-pool" || len(pod.Labels["cluster"]) > 0
+}
+
+// forgetFootprint drops the metrics of a deleted cluster.
+func forgetFootprint(clusterName string) {
+	for _, resource := range []string{"cpu", "memory", "storage"} {
+		clusterRequests.DeleteLabelValues(clusterName, resource)
+	}
+}
+
+func setRequestGauges(gauges *prometheus.GaugeVec, footprint *api.ResourceFootprint) {
+	gauges.WithLabelValues("cpu").Set(float64(footprint.CPU.MilliValue()) / 1000)
+	gauges.WithLabelValues("memory").Set(float64(footprint.Memory.Value()))
+	gauges.WithLabelValues("storage").Set(float64(footprint.Storage.Value()))
+}
+
+// podFootprint sums the requests of the pods which are running or about to,
+// and of the claims named in claimed which they mount.
+func podFootprint(pods []corev1.Pod, claimed map[string]resource.Quantity) *api.ResourceFootprint {
+	footprint := &api.ResourceFootprint{}
+	counted := map[string]bool{}
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		footprint.Pods++
+		for _, container := range pod.Spec.Containers {
+			if cpu, hasCPU := container.Resources.Requests[corev1.ResourceCPU]; hasCPU {
+				footprint.CPU.Add(cpu)
+			}
+			if memory, hasMemory := container.Resources.Requests[corev1.ResourceMemory]; hasMemory {
+				footprint.Memory.Add(memory)
+			}
+			if storage, hasStorage := container.Resources.Requests[corev1.ResourceEphemeralStorage]; hasStorage {
+				footprint.Storage.Add(storage)
+			}
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil || counted[volume.PersistentVolumeClaim.ClaimName] {
+				continue
+			}
+			counted[volume.PersistentVolumeClaim.ClaimName] = true
+			footprint.Storage.Add(claimed[volume.PersistentVolumeClaim.ClaimName])
+		}
+	}
+	return footprint
+}
+
+// hourlyCost prices the footprint with the configured rates, or returns an
+// empty string if there are none.
+func (o *Operator) hourlyCost(footprint *api.ResourceFootprint) string {
+	if o.CPUHourlyCost <= 0 && o.MemoryHourlyCost <= 0 {
+		return ""
+	}
+	cores := float64(footprint.CPU.MilliValue()) / 1000
+	gibibytes := float64(footprint.Memory.Value()) / (1 << 30)
+	return fmt.Sprintf("%.2f", cores*o.CPUHourlyCost+gibibytes*o.MemoryHourlyCost)
+}
@@ -0,0 +1,116 @@
+package operator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// grafanaTag tags every annotation the operator creates, so dashboards can
+// show them all with a single annotation query.
+const grafanaTag = "dowser"
+
+// grafanaAnnotation is the payload of Grafana's annotation API. Annotations
+// without a dashboard are shown by the annotation queries matching their
+// tags.
+type grafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd,omitempty"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+// annotateRun creates the Grafana annotation spanning the run of a source's
+// prow job, from its start to its completion, and returns its ID. It returns
+// 0 when Grafana isn't configured, the job hasn't completed, or the
+// annotation couldn't be created, which is logged and retried on the next
+// reconcile.
+func (o *Operator) annotateRun(cluster *api.MetricsCluster, job *Job) int64 {
+	if len(o.GrafanaURL) == 0 || job.Status.StartTime.IsZero() || job.Status.CompletionTime == nil {
+		return 0
+	}
+	log := o.log.WithValues("cluster", cluster.Name, "url", job.Status.URL)
+	tags := []string{grafanaTag, "cluster:" + cluster.Name}
+	if source := sourceLabel(job); len(source) > 0 {
+		tags = append(tags, "source:"+source)
+	}
+	annotation := grafanaAnnotation{
+		Time:    timestampMillis(job.Status.StartTime.Time),
+		TimeEnd: timestampMillis(job.Status.CompletionTime.Time),
+		Tags:    tags,
+		Text:    fmt.Sprintf("%s %s: %s", job.Spec.Job, job.Status.BuildID, job.Status.State),
+	}
+	body, err := json.Marshal(annotation)
+	if err != nil {
+		log.Error(err, "couldn't encode annotation")
+		return 0
+	}
+	resp, err := o.grafanaRequest(http.MethodPost, "/api/annotations", body)
+	if err != nil {
+		log.Error(err, "couldn't create annotation")
+		return 0
+	}
+	defer resp.Body.Close()
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		log.Error(err, "couldn't decode created annotation")
+		return 0
+	}
+	o.log.Info("created annotation", "id", created.ID, "cluster", cluster.Name, "url", job.Status.URL)
+	return created.ID
+}
+
+// deleteAnnotation deletes a Grafana annotation created by annotateRun, if
+// any. Failures are logged and otherwise ignored, since the annotation of a
+// source which is gone can't be retried.
+func (o *Operator) deleteAnnotation(id int64) {
+	if len(o.GrafanaURL) == 0 || id == 0 {
+		return
+	}
+	resp, err := o.grafanaRequest(http.MethodDelete, fmt.Sprintf("/api/annotations/%d", id), nil)
+	if err != nil {
+		o.log.Error(err, "couldn't delete annotation", "id", id)
+		return
+	}
+	resp.Body.Close()
+	o.log.Info("deleted annotation", "id", id)
+}
+
+// grafanaRequest sends a request to Grafana's API with the key in
+// GrafanaKeyFile, which is read for each request so it can be rotated.
+func (o *Operator) grafanaRequest(method, path string, body []byte) (*http.Response, error) {
+	key, err := ioutil.ReadFile(o.GrafanaKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read grafana api key: %w", err)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(o.GrafanaURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(key)))
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// timestampMillis returns the time in milliseconds since the epoch, as
+// Grafana expects.
+func timestampMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,96 @@
+package operator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestAnnotateRun(t *testing.T) {
+	var received grafanaAnnotation
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"id":7,"message":"Annotation added"}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "grafana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o := &Operator{GrafanaURL: server.URL + "/", GrafanaKeyFile: keyFile, log: log.NullLogger{}}
+
+	started := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	completed := metav1.NewTime(started.Add(time.Hour))
+	job := &Job{ProwJob: prowapi.ProwJob{
+		Spec: prowapi.ProwJobSpec{Job: "release-openshift-ocp-installer-e2e-aws-4.6"},
+		Status: prowapi.ProwJobStatus{
+			URL:            "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/release-openshift-ocp-installer-e2e-aws-4.6/1301",
+			BuildID:        "1301",
+			State:          prowapi.SuccessState,
+			StartTime:      metav1.NewTime(started),
+			CompletionTime: &completed,
+		},
+	}}
+	cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: "blocking-46"}}
+
+	if id := o.annotateRun(cluster, job); id != 7 {
+		t.Errorf("expected annotation 7, got %d", id)
+	}
+	if received.Time != started.Unix()*1000 || received.TimeEnd != completed.Unix()*1000 {
+		t.Errorf("unexpected span %d-%d", received.Time, received.TimeEnd)
+	}
+	expectedTags := []string{"dowser", "cluster:blocking-46", "source:1301"}
+	if len(received.Tags) != len(expectedTags) {
+		t.Fatalf("expected tags %v, got %v", expectedTags, received.Tags)
+	}
+	for i := range expectedTags {
+		if received.Tags[i] != expectedTags[i] {
+			t.Errorf("expected tags %v, got %v", expectedTags, received.Tags)
+		}
+	}
+
+	job.Status.CompletionTime = nil
+	if id := o.annotateRun(cluster, job); id != 0 {
+		t.Errorf("expected running jobs not to be annotated, got %d", id)
+	}
+}
+
+func TestDashboardUID(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "blocking-46", expected: "dowser-blocking-46"},
+		{name: "release-openshift-ocp-installer-e2e-aws-4-6-x7k2p"},
+	}
+	for _, test := range tests {
+		uid := dashboardUID(&api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: test.name}})
+		if len(uid) > maxDashboardUIDLength {
+			t.Errorf("%s: uid %q is too long", test.name, uid)
+		}
+		if len(test.expected) > 0 && uid != test.expected {
+			t.Errorf("%s: expected uid %q, got %q", test.name, test.expected, uid)
+		}
+	}
+}
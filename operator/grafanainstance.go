@@ -0,0 +1,358 @@
+package operator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters may have a Grafana of their own rather than sharing one: it's
+// provisioned from files, with the cluster's query as its default data source
+// and its overview dashboard as its home dashboard, and restarted when they
+// change. Anyone reaching it may view dashboards; editing them takes logging
+// in as admin, with the password generated into its Secret.
+
+// grafanaPort is where Grafana listens.
+const grafanaPort = 3000
+
+// grafanaConfigHashAnnotation restarts Grafana when its provisioning files
+// change.
+const grafanaConfigHashAnnotation = "dowser.dowser/config-hash"
+
+// grafanaAdminPasswordKey holds the admin password in the Grafana's Secret.
+const grafanaAdminPasswordKey = "admin-password"
+
+func hasGrafana(cluster *api.MetricsCluster) bool {
+	return cluster.Spec.Grafana != nil && cluster.Spec.Grafana.Enabled
+}
+
+func (o *Operator) grafanaName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: "grafana-" + cluster.Name}
+}
+
+// queryServicePort returns the HTTP port of the cluster's query service.
+func queryServicePort(cluster *api.MetricsCluster) int {
+	if cluster.Spec.Backend == api.BackendVictoriaMetrics {
+		return victoriaMetricsPort
+	}
+	return 10902
+}
+
+// grafanaProvisioning returns the provisioning files of the cluster's Grafana,
+// keyed by their path under its provisioning directory.
+func (o *Operator) grafanaProvisioning(cluster *api.MetricsCluster, queryServiceName string) (map[string]string, error) {
+	dataSource := dashboardDataSourceName(cluster)
+	dataSources, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": 1,
+		"datasources": []interface{}{
+			map[string]interface{}{
+				"name":      dataSource,
+				"type":      "prometheus",
+				"access":    "proxy",
+				"url":       fmt.Sprintf("http://%s.%s.svc:%d", queryServiceName, o.Namespace, queryServicePort(cluster)),
+				"isDefault": true,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode grafana data sources: %w", err)
+	}
+	dashboards, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": 1,
+		"providers": []interface{}{
+			map[string]interface{}{
+				"name":    "dowser",
+				"type":    "file",
+				"options": map[string]string{"path": "/etc/grafana/provisioning/dashboards"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode grafana dashboard providers: %w", err)
+	}
+	overview, err := json.Marshal(overviewDashboard(cluster, dataSource))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode dashboard: %w", err)
+	}
+	return map[string]string{
+		"datasources/dowser.yaml":  string(dataSources),
+		"dashboards/dowser.yaml":   string(dashboards),
+		"dashboards/overview.json": string(overview),
+	}, nil
+}
+
+// grafanaConfigMapManifest returns the ConfigMap holding the provisioning
+// files, whose keys can't have slashes.
+func (o *Operator) grafanaConfigMapManifest(cluster *api.MetricsCluster, files map[string]string) *corev1.ConfigMap {
+	name := o.grafanaName(cluster)
+	data := map[string]string{}
+	for path, content := range files {
+		data[grafanaConfigKey(path)] = content
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Data: data,
+	}
+}
+
+func grafanaConfigKey(path string) string {
+	return strings.ReplaceAll(path, "/", "_")
+}
+
+// generatePassword returns a random password.
+func generatePassword() (string, error) {
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return "", fmt.Errorf("couldn't generate password: %w", err)
+	}
+	return hex.EncodeToString(password), nil
+}
+
+// grafanaSecretManifest returns the Secret holding the Grafana's admin
+// password, which is only set when it's created.
+func (o *Operator) grafanaSecretManifest(cluster *api.MetricsCluster, password string) *corev1.Secret {
+	name := o.grafanaName(cluster)
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		StringData: map[string]string{
+			grafanaAdminPasswordKey: password,
+		},
+	}
+}
+
+func (o *Operator) grafanaDeploymentManifest(cluster *api.MetricsCluster, files map[string]string) *appsv1.Deployment {
+	name := o.grafanaName(cluster)
+	var replicas int32 = 1
+	labels := map[string]string{
+		"app":     "grafana",
+		"cluster": cluster.Name,
+	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var items []corev1.KeyToPath
+	hash := sha256.New()
+	for _, path := range paths {
+		items = append(items, corev1.KeyToPath{Key: grafanaConfigKey(path), Path: path})
+		hash.Write([]byte(path))
+		hash.Write([]byte(files[path]))
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+					Annotations: map[string]string{
+						grafanaConfigHashAnnotation: fmt.Sprintf("%x", hash.Sum(nil)[:8]),
+					},
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						{
+							Name: "provisioning",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: name.Name},
+									Items:                items,
+								},
+							},
+						},
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:  "grafana",
+							Image: o.GrafanaImage,
+							Env: []corev1.EnvVar{
+								{Name: "GF_AUTH_ANONYMOUS_ENABLED", Value: "true"},
+								{Name: "GF_AUTH_ANONYMOUS_ORG_ROLE", Value: "Viewer"},
+								{Name: "GF_DASHBOARDS_DEFAULT_HOME_DASHBOARD_PATH", Value: "/etc/grafana/provisioning/dashboards/overview.json"},
+								{
+									Name: "GF_SECURITY_ADMIN_PASSWORD",
+									ValueFrom: &corev1.EnvVarSource{
+										SecretKeyRef: &corev1.SecretKeySelector{
+											LocalObjectReference: corev1.LocalObjectReference{Name: name.Name},
+											Key:                  grafanaAdminPasswordKey,
+										},
+									},
+								},
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: grafanaPort,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "provisioning",
+									MountPath: "/etc/grafana/provisioning/",
+									ReadOnly:  true,
+								},
+								{
+									Name:      "data",
+									MountPath: "/var/lib/grafana",
+								},
+							},
+							ReadinessProbe: readinessProbe("/api/health", grafanaPort),
+							LivenessProbe:  livenessProbe("/api/health", grafanaPort),
+						},
+					},
+				},
+			},
+		},
+	}
+	o.hardenPodSpec(&deployment.Spec.Template.Spec)
+	return deployment
+}
+
+func (o *Operator) grafanaServiceManifest(cluster *api.MetricsCluster) *corev1.Service {
+	name := o.grafanaName(cluster)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port:     grafanaPort,
+					Protocol: corev1.ProtocolTCP,
+					Name:     "http",
+				},
+			},
+			Selector: map[string]string{
+				"app":     "grafana",
+				"cluster": cluster.Name,
+			},
+		},
+	}
+}
+
+// ensureGrafana creates, updates or removes the cluster's Grafana, and
+// returns where it's exposed.
+func (o *Operator) ensureGrafana(cluster *api.MetricsCluster, queryServiceName string) (string, error) {
+	enabled := hasGrafana(cluster)
+	name := o.grafanaName(cluster)
+	var files map[string]string
+	var password string
+	if enabled {
+		var err error
+		if files, err = o.grafanaProvisioning(cluster, queryServiceName); err != nil {
+			return "", err
+		}
+		if password, err = generatePassword(); err != nil {
+			return "", err
+		}
+	}
+	resources := []managedResource{
+		{"secret", &corev1.Secret{}, func() runtime.Object { return o.grafanaSecretManifest(cluster, password) }},
+		{"configmap", &corev1.ConfigMap{}, func() runtime.Object { return o.grafanaConfigMapManifest(cluster, files) }},
+		{"deployment", &appsv1.Deployment{}, func() runtime.Object { return o.grafanaDeploymentManifest(cluster, files) }},
+		{"service", &corev1.Service{}, func() runtime.Object { return o.grafanaServiceManifest(cluster) }},
+	}
+	resources = append(resources, o.exposureResources(name, name.Name, clusterOwner(cluster))...)
+	url := ""
+	for _, resource := range resources {
+		err := o.client.Get(context.TODO(), name, resource.current)
+		exists := true
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return "", fmt.Errorf("couldn't fetch grafana %s: %w", resource.kind, err)
+			}
+			exists = false
+		}
+		switch {
+		case enabled && !exists:
+			manifest := resource.manifest()
+			if err := o.client.Create(context.TODO(), manifest); err != nil {
+				return "", fmt.Errorf("couldn't create grafana %s: %w", resource.kind, err)
+			}
+			o.log.Info("created grafana "+resource.kind, "name", name.Name)
+			resource.current = manifest
+		case enabled && exists:
+			if updated := updateGrafana(resource.current, resource.manifest()); updated {
+				if err := o.client.Update(context.TODO(), resource.current); err != nil {
+					return "", fmt.Errorf("couldn't update grafana %s: %w", resource.kind, err)
+				}
+				o.log.Info("updated grafana "+resource.kind, "name", name.Name)
+			}
+		case !enabled && exists:
+			if err := o.client.Delete(context.TODO(), resource.current); err != nil && !errors.IsNotFound(err) {
+				return "", fmt.Errorf("couldn't delete grafana %s: %w", resource.kind, err)
+			}
+			o.log.Info("deleted grafana "+resource.kind, "name", name.Name)
+		}
+		if enabled && resource.kind == o.exposeMode {
+			url = exposureURL(resource.current)
+		}
+	}
+	return url, nil
+}
+
+// updateGrafana copies the parts of a Grafana resource which follow the
+// cluster into current, reporting whether anything changed. The admin
+// password is kept.
+func updateGrafana(current, desired runtime.Object) bool {
+	switch current := current.(type) {
+	case *corev1.ConfigMap:
+		desired := desired.(*corev1.ConfigMap)
+		if equality.Semantic.DeepEqual(current.Data, desired.Data) {
+			return false
+		}
+		current.Data = desired.Data
+		return true
+	case *appsv1.Deployment:
+		desired := desired.(*appsv1.Deployment)
+		if hasEntries(current.Spec.Template.Annotations, desired.Spec.Template.Annotations) &&
+			current.Spec.Template.Spec.Containers[0].Image == desired.Spec.Template.Spec.Containers[0].Image {
+			return false
+		}
+		current.Spec.Template = desired.Spec.Template
+		return true
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestGrafanaProvisioning(t *testing.T) {
+	o := &Operator{Namespace: "dowser", GrafanaImage: "grafana"}
+	cluster := &api.MetricsCluster{}
+	cluster.Name = "cluster"
+	files, err := o.grafanaProvisioning(cluster, "query-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataSources := files["datasources/dowser.yaml"]; !strings.Contains(dataSources, "url: http://query-cluster.dowser.svc:10902") {
+		t.Errorf("expected the query as data source, got:\n%s", dataSources)
+	}
+	if overview := files["dashboards/overview.json"]; !strings.Contains(overview, `"uid":"dowser-cluster"`) {
+		t.Errorf("expected the overview dashboard, got:\n%s", overview)
+	}
+
+	deployment := o.grafanaDeploymentManifest(cluster, files)
+	items := deployment.Spec.Template.Spec.Volumes[0].ConfigMap.Items
+	if len(items) != 3 || items[0].Key != "dashboards_dowser.yaml" || items[0].Path != "dashboards/dowser.yaml" {
+		t.Errorf("expected the files projected to their paths, got %v", items)
+	}
+
+	cluster.Spec.Backend = api.BackendVictoriaMetrics
+	changed, err := o.grafanaProvisioning(cluster, "victoriametrics-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := deployment.DeepCopy()
+	if !updateGrafana(current, o.grafanaDeploymentManifest(cluster, changed)) {
+		t.Errorf("expected a new data source to restart grafana")
+	}
+	if updateGrafana(current, o.grafanaDeploymentManifest(cluster, changed)) {
+		t.Errorf("expected an updated deployment to be left alone")
+	}
+}
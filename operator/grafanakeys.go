@@ -0,0 +1,172 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Tools generating reports from a cluster's Grafana get a read-only API key
+// rather than its admin password: once the Grafana serves, a viewer key is
+// created with the admin password and kept in the grafana-<cluster>-viewer
+// Secret, along with the Grafana's in-cluster URL. Grafana keeps its keys in
+// its database, which is lost when its pod is recreated, so keys which
+// stopped working are replaced.
+
+const (
+	grafanaKeySecretKey = "key"
+	grafanaURLSecretKey = "url"
+)
+
+func (o *Operator) grafanaKeySecretName(cluster *api.MetricsCluster) types.NamespacedName {
+	name := o.grafanaName(cluster)
+	name.Name += "-viewer"
+	return name
+}
+
+// grafanaServiceURL returns the in-cluster URL of the cluster's Grafana.
+func (o *Operator) grafanaServiceURL(cluster *api.MetricsCluster) string {
+	name := o.grafanaName(cluster)
+	return fmt.Sprintf("http://%s.%s.svc:%d", name.Name, name.Namespace, grafanaPort)
+}
+
+// ensureGrafanaKey keeps a working viewer key of the cluster's Grafana in its
+// Secret, and returns the Secret's name, or "" while there's no key. Grafanas
+// which don't serve yet are retried on later reconciles; the Secret is
+// deleted along with the Grafana.
+func (o *Operator) ensureGrafanaKey(cluster *api.MetricsCluster) (string, error) {
+	name := o.grafanaKeySecretName(cluster)
+	secret := &corev1.Secret{}
+	err := o.client.Get(context.TODO(), name, secret)
+	exists := true
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return "", fmt.Errorf("couldn't fetch grafana key secret: %w", err)
+		}
+		exists = false
+	}
+	if !hasGrafana(cluster) {
+		if exists {
+			if err := o.client.Delete(context.TODO(), secret); err != nil && !errors.IsNotFound(err) {
+				return "", fmt.Errorf("couldn't delete grafana key secret: %w", err)
+			}
+			o.log.Info("deleted grafana key secret", "name", name.Name)
+		}
+		return "", nil
+	}
+
+	log := o.log.WithValues("cluster", cluster.Name)
+	grafanaURL := o.grafanaServiceURL(cluster)
+	if exists {
+		valid, err := grafanaKeyValid(grafanaURL, string(secret.Data[grafanaKeySecretKey]))
+		if err != nil {
+			log.Info("couldn't check grafana key", "error", err.Error())
+			return name.Name, nil
+		}
+		if valid {
+			return name.Name, nil
+		}
+		log.Info("replacing grafana key which stopped working")
+	}
+
+	admin := &corev1.Secret{}
+	if err := o.client.Get(context.TODO(), o.grafanaName(cluster), admin); err != nil {
+		return "", fmt.Errorf("couldn't fetch grafana secret: %w", err)
+	}
+	key, err := createGrafanaKey(grafanaURL, string(admin.Data[grafanaAdminPasswordKey]), time.Now())
+	if err != nil {
+		log.Info("couldn't create grafana key", "error", err.Error())
+		return "", nil
+	}
+	data := map[string][]byte{
+		grafanaKeySecretKey: []byte(key),
+		grafanaURLSecretKey: []byte(grafanaURL),
+	}
+	if exists {
+		secret.Data = data
+		if err := o.client.Update(context.TODO(), secret); err != nil {
+			return "", fmt.Errorf("couldn't update grafana key secret: %w", err)
+		}
+		o.log.Info("updated grafana key secret", "name", name.Name)
+		return name.Name, nil
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Data: data,
+	}
+	if err := o.client.Create(context.TODO(), secret); err != nil {
+		return "", fmt.Errorf("couldn't create grafana key secret: %w", err)
+	}
+	o.log.Info("created grafana key secret", "name", name.Name)
+	return name.Name, nil
+}
+
+// grafanaKeyValid returns whether the Grafana at grafanaURL accepts key.
+func grafanaKeyValid(grafanaURL, key string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, grafanaURL+"/api/org", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return false, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return true, nil
+}
+
+// createGrafanaKey creates a viewer API key in the Grafana at grafanaURL as
+// its admin, named after now since names must be unique.
+func createGrafanaKey(grafanaURL, adminPassword string, now time.Time) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"name": fmt.Sprintf("dowser-viewer-%d", now.Unix()),
+		"role": "Viewer",
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, grafanaURL+"/api/auth/keys", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth("admin", adminPassword)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("couldn't decode grafana key: %w", err)
+	}
+	return created.Key, nil
+}
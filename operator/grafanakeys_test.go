@@ -0,0 +1,48 @@
+package operator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGrafanaKeys(t *testing.T) {
+	keys := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/keys":
+			if user, password, _ := r.BasicAuth(); user != "admin" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var request map[string]string
+			json.NewDecoder(r.Body).Decode(&request)
+			if request["role"] != "Viewer" {
+				t.Errorf("expected a viewer key, got %v", request)
+			}
+			keys["viewer"] = true
+			json.NewEncoder(w).Encode(map[string]string{"name": request["name"], "key": "viewer"})
+		case "/api/org":
+			if !keys[r.Header.Get("Authorization")[len("Bearer "):]] {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer server.Close()
+
+	if valid, err := grafanaKeyValid(server.URL, "viewer"); err != nil || valid {
+		t.Errorf("expected a key which wasn't created to be invalid, got %t: %v", valid, err)
+	}
+	if _, err := createGrafanaKey(server.URL, "wrong", time.Now()); err == nil {
+		t.Errorf("expected a wrong admin password to be refused")
+	}
+	key, err := createGrafanaKey(server.URL, "secret", time.Now())
+	if err != nil || key != "viewer" {
+		t.Fatalf("expected a viewer key, got %q: %v", key, err)
+	}
+	if valid, err := grafanaKeyValid(server.URL, key); err != nil || !valid {
+		t.Errorf("expected the created key to be valid, got %t: %v", valid, err)
+	}
+}
@@ -0,0 +1,80 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/history"
+)
+
+// recordHistory adds the cluster to the history ledger, or updates its sources
+// and readiness.
+func (o *Operator) recordHistory(cluster *api.MetricsCluster, now time.Time) error {
+	observed := history.Entry{
+		Name:        cluster.Name,
+		UID:         string(cluster.UID),
+		RequestedBy: cluster.Annotations[history.RequestedByAnnotation],
+		URLs:        desiredURLs(cluster),
+		Created:     cluster.CreationTimestamp.Time,
+	}
+	ready := cluster.Status.Phase == api.PhaseReady
+	return o.updateHistory(func(ledger *history.Ledger) bool {
+		return ledger.Observe(observed, ready, now)
+	})
+}
+
+// recordHistoryDeletion marks the named cluster deleted in the history ledger.
+func (o *Operator) recordHistoryDeletion(name string, now time.Time) error {
+	return o.updateHistory(func(ledger *history.Ledger) bool {
+		return ledger.Delete(name, now)
+	})
+}
+
+// updateHistory applies the change to the history ledger, saving it if it
+// changed.
+func (o *Operator) updateHistory(change func(*history.Ledger) bool) error {
+	name := types.NamespacedName{Namespace: o.Namespace, Name: history.ConfigMapName}
+	configMap := &corev1.ConfigMap{}
+	hasConfigMap := true
+	if err := o.client.Get(context.TODO(), name, configMap); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch history configmap: %w", err)
+		}
+		hasConfigMap = false
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name},
+		}
+	}
+	ledger, err := history.Decode(configMap)
+	if err != nil {
+		return err
+	}
+	changed := change(&ledger)
+	if ledger.Prune(o.HistoryLimit) {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if err := ledger.Encode(configMap); err != nil {
+		return err
+	}
+	if !hasConfigMap {
+		if err := o.client.Create(context.TODO(), configMap); err != nil {
+			return fmt.Errorf("couldn't create history configmap: %w", err)
+		}
+		o.log.Info("created history configmap", "name", configMap.Name)
+		return nil
+	}
+	if err := o.client.Update(context.TODO(), configMap); err != nil {
+		return fmt.Errorf("couldn't update history configmap: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"sigs.k8s.io/yaml"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/prow"
+)
+
+// With ServeHooks, the operator receives notifications of finished builds and
+// adds the builds matching the rules of its hook policy to clusters, creating
+// them as needed, e.g. so every failed payload job gets a cluster without
+// anyone asking. Builds are reported by Prow's Pub/Sub reporter, posted to
+// prowHookPath or pushed through a Pub/Sub subscription to pubsubHookPath,
+// which also takes the notifications of a GCS bucket's finished.json
+// uploads. Builds are added idempotently, so notifications delivered more
+// than once are harmless.
+
+const (
+	prowHookPath   = "/hooks/prow"
+	pubsubHookPath = "/hooks/pubsub"
+
+	// defaultHookCluster names the cluster of each build after the build.
+	defaultHookCluster = "{{.Hint}}-{{.BuildID}}"
+
+	// hookAttempts is how many times a build is added to a cluster which
+	// changes meanwhile.
+	hookAttempts = 3
+)
+
+// finishedStates are the states of finished Prow jobs, which are the results
+// rules match.
+var finishedStates = map[string]bool{
+	string(prowapi.SuccessState): true,
+	string(prowapi.FailureState): true,
+	string(prowapi.ErrorState):   true,
+	string(prowapi.AbortedState): true,
+}
+
+// hookPolicy is the YAML policy of the builds added to clusters.
+type hookPolicy struct {
+	Rules []*hookRule `json:"rules"`
+}
+
+// hookRule adds the finished builds of jobs whose name matches any of Jobs,
+// with any of Results, to the cluster named by the Cluster template. Clusters
+// it creates expire after TTL and carry Labels.
+type hookRule struct {
+	Name    string            `json:"name"`
+	Jobs    []string          `json:"jobs,omitempty"`
+	Results []string          `json:"results,omitempty"`
+	Cluster string            `json:"cluster,omitempty"`
+	TTL     *metav1.Duration  `json:"ttl,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+
+	jobs    []*regexp.Regexp
+	cluster *template.Template
+}
+
+// hookBuild is a finished build, and what cluster templates are rendered
+// with.
+type hookBuild struct {
+	URL     string
+	Job     string
+	BuildID string
+	Pull    string
+	Result  string
+
+	// Hint is the short name of the build, e.g. pr12345 or the last words
+	// of its job's name, and Date the day it was reported, as 20060102.
+	Hint string
+	Date string
+}
+
+// parseHookPolicy parses and validates a hook policy.
+func parseHookPolicy(data []byte) (*hookPolicy, error) {
+	policy := &hookPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("couldn't parse hook policy: %w", err)
+	}
+	names := map[string]bool{}
+	for i, rule := range policy.Rules {
+		if len(rule.Name) == 0 {
+			return nil, fmt.Errorf("rule %d of the hook policy has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("hook policy has several rules named %s", rule.Name)
+		}
+		names[rule.Name] = true
+		for _, pattern := range rule.Jobs {
+			job, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid job pattern of hook rule %s: %w", rule.Name, err)
+			}
+			rule.jobs = append(rule.jobs, job)
+		}
+		for _, result := range rule.Results {
+			if !finishedStates[result] {
+				return nil, fmt.Errorf("invalid result %q of hook rule %s: not one of success, failure, error or aborted", result, rule.Name)
+			}
+		}
+		cluster := rule.Cluster
+		if len(cluster) == 0 {
+			cluster = defaultHookCluster
+		}
+		var err error
+		if rule.cluster, err = template.New(rule.Name).Option("missingkey=error").Parse(cluster); err != nil {
+			return nil, fmt.Errorf("invalid cluster of hook rule %s: %w", rule.Name, err)
+		}
+	}
+	return policy, nil
+}
+
+// matches returns whether the rule adds the build. Rules without jobs or
+// results match any.
+func (r *hookRule) matches(build hookBuild) bool {
+	if len(r.Results) > 0 && !containsString(r.Results, build.Result) {
+		return false
+	}
+	if len(r.jobs) == 0 {
+		return true
+	}
+	for _, job := range r.jobs {
+		if job.MatchString(build.Job) {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterName returns the name of the cluster the rule adds the build to: its
+// rendered cluster template, made a valid name.
+func (r *hookRule) clusterName(build hookBuild) (string, error) {
+	var rendered bytes.Buffer
+	if err := r.cluster.Execute(&rendered, build); err != nil {
+		return "", fmt.Errorf("couldn't render cluster of hook rule %s: %w", r.Name, err)
+	}
+	name := strings.Trim(nonNameCharacters.ReplaceAllString(strings.ToLower(rendered.String()), "-"), "-")
+	if len(name) > maxHostLabel {
+		name = strings.TrimRight(name[:maxHostLabel], "-")
+	}
+	if len(name) == 0 {
+		return "", fmt.Errorf("hook rule %s names no cluster for %s", r.Name, build.URL)
+	}
+	return name, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// prowReport is the message Prow's Pub/Sub reporter publishes as a job's
+// state changes.
+type prowReport struct {
+	Status  prowapi.ProwJobState `json:"status"`
+	URL     string               `json:"url"`
+	GCSPath string               `json:"gcs_path"`
+	JobName string               `json:"job_name"`
+}
+
+// pubsubPush is the body of a message pushed by a Pub/Sub subscription. GCS
+// notifications describe their object in the message's attributes.
+type pubsubPush struct {
+	Message struct {
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// newHookBuild returns the build viewed at url, which finished with result.
+func newHookBuild(url, job, result string, now time.Time) hookBuild {
+	pull, parsedJob, buildID := parseBuildURL(url)
+	if len(job) == 0 {
+		job = parsedJob
+	}
+	return hookBuild{
+		URL:     url,
+		Job:     job,
+		BuildID: buildID,
+		Pull:    pull,
+		Result:  result,
+		Hint:    sourceNameHint(url),
+		Date:    now.UTC().Format("20060102"),
+	}
+}
+
+// reportedBuild returns the build of a Prow report, and false if the job
+// hasn't finished.
+func (o *Operator) reportedBuild(report prowReport, now time.Time) (hookBuild, bool) {
+	if !finishedStates[string(report.Status)] {
+		return hookBuild{}, false
+	}
+	url := report.URL
+	if len(report.GCSPath) > 0 {
+		url = o.viewURL(report.GCSPath)
+	}
+	if len(url) == 0 {
+		return hookBuild{}, false
+	}
+	return newHookBuild(url, report.JobName, string(report.Status), now), true
+}
+
+// notifiedBuild returns the build whose finished.json a GCS notification
+// reports the upload of, and false if it's about another object.
+func (o *Operator) notifiedBuild(ctx context.Context, attributes map[string]string, now time.Time) (hookBuild, bool, error) {
+	bucket, object := attributes["bucketId"], attributes["objectId"]
+	if attributes["eventType"] != "OBJECT_FINALIZE" || path.Base(object) != "finished.json" {
+		return hookBuild{}, false, nil
+	}
+	dir := path.Dir(object)
+	finished, err := prow.ReadFinished(ctx, o.storageOpener, bucket, dir)
+	if err != nil {
+		return hookBuild{}, false, err
+	}
+	result := strings.ToLower(finished.Result)
+	if !finishedStates[result] {
+		result = string(prowapi.FailureState)
+		if finished.Passed != nil && *finished.Passed {
+			result = string(prowapi.SuccessState)
+		}
+	}
+	return newHookBuild(o.viewURL(fmt.Sprintf("gs://%s/%s", bucket, dir)), "", result, now), true, nil
+}
+
+// viewURL returns the Prow view URL of the build at a gs:// path.
+func (o *Operator) viewURL(gsPath string) string {
+	return (&clusterDefaulter{prowBaseURL: o.ProwBaseURL}).canonicalURL(gsPath)
+}
+
+// serveHooks receives build notifications until stop is closed.
+func (o *Operator) serveHooks(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle(prowHookPath, o.authenticateHook(http.HandlerFunc(o.serveProwHook)))
+	mux.Handle(pubsubHookPath, o.authenticateHook(http.HandlerFunc(o.servePubsubHook)))
+	server := &http.Server{Addr: o.HooksBindAddress, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		o.log.Info("serving hooks", "address", o.HooksBindAddress, "rules", len(o.hookPolicy.Rules))
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("couldn't serve hooks: %w", err)
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+}
+
+// authenticateHook admits POSTs bearing the token in HooksTokenFile, either
+// as a bearer token or, as Pub/Sub push endpoints are given it, in the token
+// query parameter.
+func (o *Operator) authenticateHook(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		content, err := ioutil.ReadFile(o.HooksTokenFile)
+		if err != nil {
+			o.log.Error(err, "couldn't read hooks token")
+			http.Error(w, "couldn't authenticate request", http.StatusInternalServerError)
+			return
+		}
+		token := strings.TrimSpace(string(content))
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(given) == 0 {
+			given = r.URL.Query().Get("token")
+		}
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveProwHook adds the build of a Prow report posted as is.
+func (o *Operator) serveProwHook(w http.ResponseWriter, r *http.Request) {
+	report := prowReport{}
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, fmt.Sprintf("invalid prow report: %v", err), http.StatusBadRequest)
+		return
+	}
+	build, finished := o.reportedBuild(report, time.Now())
+	if !finished {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	o.respondHook(w, o.addHookBuild(r.Context(), build))
+}
+
+// servePubsubHook adds the build of a pushed Prow report or GCS notification.
+func (o *Operator) servePubsubHook(w http.ResponseWriter, r *http.Request) {
+	push := pubsubPush{}
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		http.Error(w, fmt.Sprintf("invalid pubsub message: %v", err), http.StatusBadRequest)
+		return
+	}
+	var build hookBuild
+	var relevant bool
+	if _, isNotification := push.Message.Attributes["eventType"]; isNotification {
+		var err error
+		build, relevant, err = o.notifiedBuild(r.Context(), push.Message.Attributes, time.Now())
+		if err != nil {
+			o.log.Error(err, "couldn't read finished build", "message", push.Message.MessageID)
+			http.Error(w, "couldn't read finished build", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		report := prowReport{}
+		if err := json.Unmarshal(push.Message.Data, &report); err != nil {
+			// Redelivering a message which can't be read is pointless, so
+			// it's acknowledged.
+			o.log.Error(err, "ignoring unreadable pubsub message", "message", push.Message.MessageID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		build, relevant = o.reportedBuild(report, time.Now())
+	}
+	if !relevant {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	o.respondHook(w, o.addHookBuild(r.Context(), build))
+}
+
+// respondHook reports a failure to add a build as a server error, so its
+// notification is delivered again.
+func (o *Operator) respondHook(w http.ResponseWriter, err error) {
+	if err != nil {
+		o.log.Error(err, "couldn't add hook build")
+		http.Error(w, "couldn't add build", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addHookBuild adds the build to the cluster of each rule matching it.
+func (o *Operator) addHookBuild(ctx context.Context, build hookBuild) error {
+	for _, rule := range o.hookPolicy.Rules {
+		if !rule.matches(build) {
+			continue
+		}
+		name, err := rule.clusterName(build)
+		if err != nil {
+			o.log.Error(err, "couldn't name hook cluster", "rule", rule.Name, "url", build.URL)
+			continue
+		}
+		if err := o.addHookSource(ctx, rule, name, build); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookClusterManifest returns the cluster a rule creates for a build.
+func hookClusterManifest(namespace, name string, rule *hookRule, build hookBuild) *api.MetricsCluster {
+	labels := map[string]string{}
+	for key, value := range rule.Labels {
+		labels[key] = value
+	}
+	labels[api.HookRuleLabel] = rule.Name
+	return &api.MetricsCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec: api.MetricsClusterSpec{
+			URLs: []string{build.URL},
+			TTL:  rule.TTL,
+		},
+	}
+}
+
+// addHookSource adds the build to the named cluster, creating it if it doesn't
+// exist. Clusters of other instances and clusters being deleted are left
+// alone.
+func (o *Operator) addHookSource(ctx context.Context, rule *hookRule, name string, build hookBuild) error {
+	log := o.log.WithValues("rule", rule.Name, "name", name, "url", build.URL)
+	for attempt := 1; ; attempt++ {
+		cluster := &api.MetricsCluster{}
+		err := o.client.Get(ctx, types.NamespacedName{Namespace: o.Namespace, Name: name}, cluster)
+		switch {
+		case errors.IsNotFound(err):
+			cluster = hookClusterManifest(o.Namespace, name, rule, build)
+			if err = o.client.Create(ctx, cluster); err == nil {
+				log.Info("created metricscluster for hook build")
+				o.recorder.Eventf(cluster, corev1.EventTypeNormal, eventHookSourceAdded, "created for %s (%s) by hook rule %s", build.URL, build.Result, rule.Name)
+				return nil
+			}
+		case err != nil:
+			return fmt.Errorf("couldn't fetch metricscluster %s: %w", name, err)
+		case !o.ownsObject(cluster):
+			log.Info("not adding hook build to metricscluster of another instance")
+			return nil
+		case cluster.DeletionTimestamp != nil:
+			log.Info("not adding hook build to deleted metricscluster")
+			return nil
+		case containsString(desiredURLs(cluster), build.URL):
+			return nil
+		default:
+			cluster.Spec.URLs = append(cluster.Spec.URLs, build.URL)
+			if err = o.client.Update(ctx, cluster); err == nil {
+				log.Info("added hook build to metricscluster")
+				o.recorder.Eventf(cluster, corev1.EventTypeNormal, eventHookSourceAdded, "added %s (%s) by hook rule %s", build.URL, build.Result, rule.Name)
+				return nil
+			}
+		}
+		// Another notification may have created or changed the cluster
+		// meanwhile.
+		if attempt == hookAttempts || !(errors.IsConflict(err) || errors.IsAlreadyExists(err)) {
+			return fmt.Errorf("couldn't add %s to metricscluster %s: %w", build.URL, name, err)
+		}
+	}
+}
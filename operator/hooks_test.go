@@ -0,0 +1,152 @@
+package operator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	logging "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestParseHookPolicy(t *testing.T) {
+	policy, err := parseHookPolicy([]byte(`
+rules:
+- name: failed-nightlies
+  jobs: ['^periodic-ci-openshift-release-master-nightly-']
+  results: [failure, error]
+  cluster: 'nightly-failures-{{.Date}}'
+  ttl: 72h
+  labels:
+    team: release
+- name: every-build
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 2 || policy.Rules[0].TTL.Duration != 72*time.Hour {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+
+	invalid := map[string]string{
+		"unnamed rule":    "rules:\n- jobs: [e2e]\n",
+		"duplicate rule":  "rules:\n- name: a\n- name: a\n",
+		"invalid pattern": "rules:\n- name: a\n  jobs: ['(']\n",
+		"invalid result":  "rules:\n- name: a\n  results: [failed]\n",
+		"invalid cluster": "rules:\n- name: a\n  cluster: '{{.Job'\n",
+		"unknown field":   "rules:\n- name: a\n  job: e2e\n",
+	}
+	for name, policy := range invalid {
+		if _, err := parseHookPolicy([]byte(policy)); err == nil {
+			t.Errorf("%s: expected the policy to be refused", name)
+		}
+	}
+}
+
+func TestHookRule(t *testing.T) {
+	policy, err := parseHookPolicy([]byte(`
+rules:
+- name: failed-nightlies
+  jobs: ['^periodic-ci-openshift-release-master-nightly-']
+  results: [failure, error]
+  cluster: 'nightly-failures-{{.Date}}'
+- name: every-build
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures, every := policy.Rules[0], policy.Rules[1]
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	nightly := newHookBuild("https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/periodic-ci-openshift-release-master-nightly-4.6-e2e-aws/1234", "", "failure", now)
+	if !failures.matches(nightly) {
+		t.Errorf("expected a failed nightly to match")
+	}
+	if name, err := failures.clusterName(nightly); err != nil || name != "nightly-failures-20200601" {
+		t.Errorf("expected the nightly added to the day's cluster, got %q (%v)", name, err)
+	}
+	nightly.Result = "success"
+	if failures.matches(nightly) {
+		t.Errorf("expected a passing nightly not to match")
+	}
+
+	pull := newHookBuild("https://prow.ci.openshift.org/view/gs/origin-ci-test/pr-logs/pull/openshift_origin/25000/pull-ci-openshift-origin-master-e2e-aws/5678", "", "success", now)
+	if failures.matches(pull) || !every.matches(pull) {
+		t.Errorf("expected only the rule without jobs or results to match a passing pull")
+	}
+	if name, err := every.clusterName(pull); err != nil || name != "pr25000-5678" {
+		t.Errorf("expected the build's own cluster, got %q (%v)", name, err)
+	}
+}
+
+func TestReportedBuild(t *testing.T) {
+	o := &Operator{ProwBaseURL: "https://prow.ci.openshift.org/view/gs/origin-ci-test"}
+	now := time.Now()
+
+	build, finished := o.reportedBuild(prowReport{
+		Status:  "failure",
+		URL:     "https://prow.svc.ci.openshift.org/view/gcs/origin-ci-test/logs/e2e/1",
+		GCSPath: "gs://origin-ci-test/logs/e2e/1",
+		JobName: "e2e",
+	}, now)
+	if !finished || build.URL != "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/e2e/1" || build.Job != "e2e" || build.BuildID != "1" {
+		t.Errorf("expected the build viewed under the operator's prow, got %+v", build)
+	}
+	if _, finished := o.reportedBuild(prowReport{Status: "pending", GCSPath: "gs://origin-ci-test/logs/e2e/2"}, now); finished {
+		t.Errorf("expected a pending job to be ignored")
+	}
+}
+
+func TestServeHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o := &Operator{
+		ProwBaseURL:    "https://prow.ci.openshift.org/view/gs/origin-ci-test",
+		HooksTokenFile: tokenFile,
+		hookPolicy:     &hookPolicy{},
+		log:            logging.Log,
+	}
+	mux := http.NewServeMux()
+	mux.Handle(prowHookPath, o.authenticateHook(http.HandlerFunc(o.serveProwHook)))
+	mux.Handle(pubsubHookPath, o.authenticateHook(http.HandlerFunc(o.servePubsubHook)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	report, _ := json.Marshal(prowReport{Status: "failure", GCSPath: "gs://origin-ci-test/logs/e2e/1"})
+	push, _ := json.Marshal(map[string]interface{}{"message": map[string]interface{}{"data": report, "messageId": "1"}})
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		expected int
+	}{
+		{name: "prow report", path: prowHookPath + "?token=secret", body: string(report), expected: http.StatusNoContent},
+		{name: "pushed prow report", path: pubsubHookPath + "?token=secret", body: string(push), expected: http.StatusNoContent},
+		{name: "unrelated notification", path: pubsubHookPath + "?token=secret", body: `{"message":{"attributes":{"eventType":"OBJECT_FINALIZE","bucketId":"origin-ci-test","objectId":"logs/e2e/1/build-log.txt"}}}`, expected: http.StatusNoContent},
+		{name: "malformed report", path: prowHookPath + "?token=secret", body: "{", expected: http.StatusBadRequest},
+		{name: "wrong token", path: prowHookPath + "?token=guess", body: string(report), expected: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(server.URL+test.path, "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, resp.StatusCode)
+		}
+	}
+}
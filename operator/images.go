@@ -0,0 +1,55 @@
+package operator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters may run images of their own, e.g. a Prometheus release with a fix
+// their sources need. Replicas only take a cluster's Prometheus image in place
+// of the operator's default one, since an image selected for the format of
+// their data's blocks is the one able to read it.
+
+// clusterPrometheusImage returns the Prometheus image the cluster sets, if
+// any.
+func clusterPrometheusImage(cluster *api.MetricsCluster) string {
+	if cluster.Spec.Images == nil {
+		return ""
+	}
+	return cluster.Spec.Images.Prometheus
+}
+
+// sharedPrometheusImage returns the Prometheus image of a shared replica: the
+// first set by the clusters referencing it.
+func sharedPrometheusImage(referencing []*api.MetricsCluster) string {
+	for _, cluster := range referencing {
+		if image := clusterPrometheusImage(cluster); len(image) > 0 {
+			return image
+		}
+	}
+	return ""
+}
+
+// applyPrometheusImage runs the Prometheus container of a replica's pod with
+// the image of the clusters referencing it, if it would run the default one.
+func (o *Operator) applyPrometheusImage(podSpec *corev1.PodSpec, referencing []*api.MetricsCluster) {
+	image := sharedPrometheusImage(referencing)
+	if len(image) == 0 {
+		return
+	}
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container.Name == "prometheus" && container.Image == o.PrometheusImage {
+			container.Image = image
+		}
+	}
+}
+
+// thanosQueryImage returns the image of the cluster's Thanos query.
+func (o *Operator) thanosQueryImage(cluster *api.MetricsCluster) string {
+	if cluster.Spec.Images != nil && len(cluster.Spec.Images.Thanos) > 0 {
+		return cluster.Spec.Images.Thanos
+	}
+	return o.ThanosImage
+}
@@ -0,0 +1,102 @@
+package operator
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// The index lists the clusters served by Thanos, each with a query form
+// whose drop-down scopes the query to the store of a single source through
+// the storeMatch[] parameter, matching the source label of its replica. It
+// only links to the clusters' own query URLs, so it needs no credential.
+
+// indexClusterSource is an option of a cluster's source drop-down.
+type indexClusterSource struct {
+	Label      string
+	StoreMatch string
+}
+
+// indexCluster is a cluster listed by the index.
+type indexCluster struct {
+	Name     string
+	QueryURL string
+	Sources  []indexClusterSource
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>dowser</title></head>
+<body>
+<h1>Clusters</h1>
+{{- range .}}
+<h2>{{.Name}}</h2>
+<form method="get" action="{{.QueryURL}}/api/v1/query">
+<input type="text" name="query" size="80" placeholder="up">
+<select name="storeMatch[]">
+<option value="">all sources</option>
+{{- range .Sources}}
+<option value="{{.StoreMatch}}">{{.Label}}</option>
+{{- end}}
+</select>
+<input type="submit" value="Query">
+</form>
+{{- else}}
+<p>No clusters are being served.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// serveIndex renders the index of clusters.
+func (o *Operator) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	list := &api.MetricsClusterList{}
+	if err := o.client.List(r.Context(), list, client.InNamespace(o.Namespace)); err != nil {
+		o.log.Error(err, "couldn't list metricsclusters")
+		http.Error(w, "couldn't list clusters", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	var clusters []indexCluster
+	for i := range list.Items {
+		cluster := &list.Items[i]
+		if cluster.Spec.Backend != api.BackendThanos || len(cluster.Status.QueryURL) == 0 {
+			continue
+		}
+		clusters = append(clusters, indexCluster{
+			Name:     cluster.Name,
+			QueryURL: cluster.Status.QueryURL,
+			Sources:  indexSources(cluster),
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, clusters); err != nil {
+		o.log.Error(err, "couldn't render index")
+	}
+}
+
+// indexSources returns the drop-down options of the cluster's sources which
+// have a source label.
+func indexSources(cluster *api.MetricsCluster) []indexClusterSource {
+	var sources []indexClusterSource
+	for _, job := range cluster.Status.Jobs {
+		if len(job.Source) == 0 {
+			continue
+		}
+		sources = append(sources, indexClusterSource{
+			Label:      fmt.Sprintf("%s (%s)", job.Source, job.URL),
+			StoreMatch: fmt.Sprintf("{source=%q}", job.Source),
+		})
+	}
+	return sources
+}
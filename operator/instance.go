@@ -0,0 +1,229 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Several operator instances, e.g. a development and a production one, may
+// share a namespace when each is given its own Instance name. An instance
+// labels the objects it creates, and their pod templates, with its name, and
+// only lists objects labeled with it, the unnamed instance taking unlabeled
+// ones. Since garbage collection and adoption work from what's listed, an
+// instance never deletes or adopts another's objects. Objects fetched by name
+// may be another's, so patches, deletions and status writes of objects not
+// labeled with the instance are refused, as are updates of objects labeled
+// with another; unlabeled objects an instance updates become its own. Its
+// writes are also recorded under its own field manager.
+//
+// Resources controlled by a cluster are labeled with its name as they're
+// written, by any instance, for pruning them once the cluster is gone.
+
+// instanceClient scopes a client to an operator instance.
+type instanceClient struct {
+	client.Client
+	instance string
+}
+
+func newInstanceClient(c client.Client, instance string) client.Client {
+	return &instanceClient{Client: c, instance: instance}
+}
+
+// fieldOwner is the field manager of the instance's writes.
+func (c *instanceClient) fieldOwner() client.FieldOwner {
+	if len(c.instance) == 0 {
+		return "dowser"
+	}
+	return client.FieldOwner("dowser-" + c.instance)
+}
+
+func (c *instanceClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	c.label(obj)
+	return c.Client.Create(ctx, obj, append(opts, c.fieldOwner())...)
+}
+
+// Update labels the object too, since updates may replace pod templates.
+func (c *instanceClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	if instance, labeled := object.GetLabels()[api.InstanceLabel]; labeled && instance != c.instance {
+		return c.otherInstanceError(object)
+	}
+	c.label(obj)
+	return c.Client.Update(ctx, obj, append(opts, c.fieldOwner())...)
+}
+
+func (c *instanceClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.checkOwned(obj); err != nil {
+		return err
+	}
+	c.label(obj)
+	return c.Client.Patch(ctx, obj, patch, append(opts, c.fieldOwner())...)
+}
+
+func (c *instanceClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	if err := c.checkOwned(obj); err != nil {
+		return err
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+// DeleteAllOf only deletes the instance's objects among those selected.
+func (c *instanceClient) DeleteAllOf(ctx context.Context, obj runtime.Object, opts ...client.DeleteAllOfOption) error {
+	options := (&client.DeleteAllOfOptions{}).ApplyOptions(opts)
+	selector := options.LabelSelector
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	operator, values := selection.Equals, []string{c.instance}
+	if len(c.instance) == 0 {
+		operator, values = selection.DoesNotExist, nil
+	}
+	requirement, err := labels.NewRequirement(api.InstanceLabel, operator, values)
+	if err != nil {
+		return err
+	}
+	return c.Client.DeleteAllOf(ctx, obj, append(opts, client.MatchingLabelsSelector{Selector: selector.Add(*requirement)})...)
+}
+
+func (c *instanceClient) Status() client.StatusWriter {
+	return &instanceStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+// instanceStatusWriter scopes status writes to an operator instance.
+type instanceStatusWriter struct {
+	client.StatusWriter
+	client *instanceClient
+}
+
+func (w *instanceStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if err := w.client.checkOwned(obj); err != nil {
+		return err
+	}
+	return w.StatusWriter.Update(ctx, obj, append(opts, w.client.fieldOwner())...)
+}
+
+func (w *instanceStatusWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := w.client.checkOwned(obj); err != nil {
+		return err
+	}
+	return w.StatusWriter.Patch(ctx, obj, patch, append(opts, w.client.fieldOwner())...)
+}
+
+// checkOwned returns an error unless the object is labeled with the
+// instance, or unlabeled for the unnamed instance.
+func (c *instanceClient) checkOwned(obj runtime.Object) error {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	if object.GetLabels()[api.InstanceLabel] != c.instance {
+		return c.otherInstanceError(object)
+	}
+	return nil
+}
+
+func (c *instanceClient) otherInstanceError(object metav1.Object) error {
+	instance := object.GetLabels()[api.InstanceLabel]
+	if len(instance) == 0 {
+		return fmt.Errorf("%s belongs to the unnamed operator instance", object.GetName())
+	}
+	return fmt.Errorf("%s belongs to operator instance %s", object.GetName(), instance)
+}
+
+// List drops the objects of other instances from the list.
+func (c *instanceClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	var owned []runtime.Object
+	for _, item := range items {
+		object, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		if object.GetLabels()[api.InstanceLabel] == c.instance {
+			owned = append(owned, item)
+		}
+	}
+	return meta.SetList(list, owned)
+}
+
+// label adds the instance's label to the object and its pod template, unless
+// the instance is unnamed or the object is already labeled, e.g. a cluster.
+// Objects controlled by a cluster are labeled with its name.
+func (c *instanceClient) label(obj runtime.Object) {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	if owner := metav1.GetControllerOf(object); owner != nil && isClusterReference(*owner) && object.GetLabels()[api.ClusterLabel] != owner.Name {
+		labels := object.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[api.ClusterLabel] = owner.Name
+		object.SetLabels(labels)
+	}
+	if len(c.instance) == 0 {
+		return
+	}
+	setInstanceLabel(object, c.instance)
+	switch typed := obj.(type) {
+	case *appsv1.Deployment:
+		setInstanceLabel(&typed.Spec.Template.ObjectMeta, c.instance)
+	case *batchv1.Job:
+		setInstanceLabel(&typed.Spec.Template.ObjectMeta, c.instance)
+	}
+}
+
+func setInstanceLabel(object metav1.Object, instance string) {
+	labels := object.GetLabels()
+	if _, hasInstance := labels[api.InstanceLabel]; hasInstance {
+		return
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[api.InstanceLabel] = instance
+	object.SetLabels(labels)
+}
+
+// leaderElectionID returns the name of the lock the replicas of an instance
+// elect their leader with.
+func leaderElectionID(instance string) string {
+	if len(instance) == 0 {
+		return "dowser-operator"
+	}
+	return "dowser-operator-" + instance
+}
+
+// ownsObject returns whether the object belongs to this operator instance.
+func (o *Operator) ownsObject(object metav1.Object) bool {
+	return object.GetLabels()[api.InstanceLabel] == o.Instance
+}
+
+// instanceObjects filters watched objects to those of this operator instance.
+func (o *Operator) instanceObjects() predicate.Funcs {
+	return predicate.NewPredicateFuncs(func(object metav1.Object, _ runtime.Object) bool {
+		return o.ownsObject(object)
+	})
+}
@@ -0,0 +1,219 @@
+package operator
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// listClient lists a fixed set of pods.
+type listClient struct {
+	client.Client
+	pods []corev1.Pod
+}
+
+func (c *listClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	list.(*corev1.PodList).Items = append([]corev1.Pod{}, c.pods...)
+	return nil
+}
+
+func TestInstanceClientList(t *testing.T) {
+	pod := func(name, instance string) corev1.Pod {
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"app": "prometheus"}}}
+		if len(instance) > 0 {
+			pod.Labels[api.InstanceLabel] = instance
+		}
+		return pod
+	}
+	backing := &listClient{pods: []corev1.Pod{pod("default", ""), pod("dev", "dev"), pod("prod", "prod")}}
+	tests := map[string]string{"": "default", "dev": "dev", "prod": "prod"}
+	for instance, expected := range tests {
+		pods := &corev1.PodList{}
+		if err := newInstanceClient(backing, instance).List(context.TODO(), pods); err != nil {
+			t.Fatal(err)
+		}
+		if len(pods.Items) != 1 || pods.Items[0].Name != expected {
+			t.Errorf("instance %q: expected only pod %s, got %v", instance, expected, pods.Items)
+		}
+	}
+}
+
+func TestInstanceClientLabel(t *testing.T) {
+	c := &instanceClient{instance: "dev"}
+	deployment := &appsv1.Deployment{}
+	c.label(deployment)
+	if deployment.Labels[api.InstanceLabel] != "dev" || deployment.Spec.Template.Labels[api.InstanceLabel] != "dev" {
+		t.Errorf("expected the deployment and its template labeled, got %v and %v", deployment.Labels, deployment.Spec.Template.Labels)
+	}
+
+	cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{api.InstanceLabel: "prod"}}}
+	c.label(cluster)
+	if cluster.Labels[api.InstanceLabel] != "prod" {
+		t.Errorf("expected an existing label to be kept, got %v", cluster.Labels)
+	}
+
+	unnamed := &instanceClient{}
+	deployment = &appsv1.Deployment{}
+	unnamed.label(deployment)
+	if len(deployment.Labels) > 0 {
+		t.Errorf("expected the unnamed instance not to label objects, got %v", deployment.Labels)
+	}
+
+	cluster = &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: "ci", UID: "1"}}
+	deployment = &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{OwnerReferences: clusterOwner(cluster)}}
+	unnamed.label(deployment)
+	if deployment.Labels[api.ClusterLabel] != "ci" {
+		t.Errorf("expected a deployment a cluster controls labeled with it, got %v", deployment.Labels)
+	}
+}
+
+// writeClient records the writes it's given.
+type writeClient struct {
+	client.Client
+	writes   []string
+	owner    client.FieldOwner
+	selector labels.Selector
+}
+
+func (c *writeClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	c.writes = append(c.writes, "update")
+	return nil
+}
+
+func (c *writeClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	options := (&client.PatchOptions{}).ApplyOptions(opts)
+	c.writes = append(c.writes, "patch")
+	c.owner = client.FieldOwner(options.FieldManager)
+	return nil
+}
+
+func (c *writeClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	c.writes = append(c.writes, "delete")
+	return nil
+}
+
+func (c *writeClient) DeleteAllOf(ctx context.Context, obj runtime.Object, opts ...client.DeleteAllOfOption) error {
+	c.writes = append(c.writes, "deleteallof")
+	c.selector = (&client.DeleteAllOfOptions{}).ApplyOptions(opts).LabelSelector
+	return nil
+}
+
+func (c *writeClient) Status() client.StatusWriter {
+	return &writeStatusWriter{c}
+}
+
+type writeStatusWriter struct {
+	client *writeClient
+}
+
+func (w *writeStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	options := (&client.UpdateOptions{}).ApplyOptions(opts)
+	w.client.writes = append(w.client.writes, "status update")
+	w.client.owner = client.FieldOwner(options.FieldManager)
+	return nil
+}
+
+func (w *writeStatusWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	w.client.writes = append(w.client.writes, "status patch")
+	return nil
+}
+
+func TestInstanceClientWrites(t *testing.T) {
+	cluster := func(instance string) *api.MetricsCluster {
+		cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: "ci"}}
+		if len(instance) > 0 {
+			cluster.Labels = map[string]string{api.InstanceLabel: instance}
+		}
+		return cluster
+	}
+	writes := map[string]func(client.Client, *api.MetricsCluster) error{
+		"update": func(c client.Client, cluster *api.MetricsCluster) error {
+			return c.Update(context.TODO(), cluster)
+		},
+		"patch": func(c client.Client, cluster *api.MetricsCluster) error {
+			return c.Patch(context.TODO(), cluster, client.MergeFrom(cluster.DeepCopy()))
+		},
+		"delete": func(c client.Client, cluster *api.MetricsCluster) error {
+			return c.Delete(context.TODO(), cluster)
+		},
+		"status update": func(c client.Client, cluster *api.MetricsCluster) error {
+			return c.Status().Update(context.TODO(), cluster)
+		},
+		"status patch": func(c client.Client, cluster *api.MetricsCluster) error {
+			return c.Status().Patch(context.TODO(), cluster, client.MergeFrom(cluster.DeepCopy()))
+		},
+	}
+	tests := []struct {
+		instance string
+		object   string
+		allowed  map[string]bool
+	}{
+		{instance: "dev", object: "dev", allowed: map[string]bool{"update": true, "patch": true, "delete": true, "status update": true, "status patch": true}},
+		{instance: "dev", object: "prod"},
+		// Updates adopt unlabeled objects.
+		{instance: "dev", object: "", allowed: map[string]bool{"update": true}},
+		{instance: "", object: "", allowed: map[string]bool{"update": true, "patch": true, "delete": true, "status update": true, "status patch": true}},
+		{instance: "", object: "dev"},
+	}
+	for _, test := range tests {
+		for write, do := range writes {
+			backing := &writeClient{}
+			err := do(newInstanceClient(backing, test.instance), cluster(test.object))
+			made := len(backing.writes) == 1 && backing.writes[0] == write
+			if test.allowed[write] != made || test.allowed[write] != (err == nil) {
+				t.Errorf("instance %q, object of %q: expected %s allowed %t, got writes %v and error %v", test.instance, test.object, write, test.allowed[write], backing.writes, err)
+			}
+		}
+	}
+
+	backing := &writeClient{}
+	c := newInstanceClient(backing, "dev")
+	if err := c.Patch(context.TODO(), cluster("dev"), client.MergeFrom(cluster("dev"))); err != nil || backing.owner != "dowser-dev" {
+		t.Errorf("expected a patch under the instance's field manager, got %q: %v", backing.owner, err)
+	}
+	if err := c.Status().Update(context.TODO(), cluster("dev")); err != nil || backing.owner != "dowser-dev" {
+		t.Errorf("expected a status update under the instance's field manager, got %q: %v", backing.owner, err)
+	}
+}
+
+func TestInstanceClientDeleteAllOf(t *testing.T) {
+	tests := []struct {
+		instance string
+		matched  labels.Set
+		spared   []labels.Set
+	}{
+		{
+			instance: "dev",
+			matched:  labels.Set{"app": "prometheus", api.InstanceLabel: "dev"},
+			spared:   []labels.Set{{"app": "prometheus", api.InstanceLabel: "prod"}, {"app": "prometheus"}, {"app": "thanos-query", api.InstanceLabel: "dev"}},
+		},
+		{
+			instance: "",
+			matched:  labels.Set{"app": "prometheus"},
+			spared:   []labels.Set{{"app": "prometheus", api.InstanceLabel: "dev"}, {"app": "thanos-query"}},
+		},
+	}
+	for _, test := range tests {
+		backing := &writeClient{}
+		err := newInstanceClient(backing, test.instance).DeleteAllOf(context.TODO(), &corev1.Pod{}, client.InNamespace("dowser"), client.MatchingLabels{"app": "prometheus"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !backing.selector.Matches(test.matched) {
+			t.Errorf("instance %q: expected %v deleted by %v", test.instance, test.matched, backing.selector)
+		}
+		for _, spared := range test.spared {
+			if backing.selector.Matches(spared) {
+				t.Errorf("instance %q: expected %v spared by %v", test.instance, spared, backing.selector)
+			}
+		}
+	}
+}
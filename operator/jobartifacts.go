@@ -0,0 +1,102 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ironcladlou/dowser/prow"
+)
+
+// Besides their Prometheus data, builds archive artifacts which help making
+// sense of it, e.g. the alerts which fired or the intervals of the e2e tests.
+// Those matching JobArtifacts are fetched along with the data into the
+// replica's artifacts volume, mounted at /artifacts/<kind>/ in its Prometheus
+// container and, with an ArtifactServerImage, served by an adjacent web
+// server. Their URLs are listed in the deployment's artifacts annotation for
+// other tools.
+
+// artifactsAnnotation lists the URLs of a replica's artifacts by kind, as
+// JSON.
+const artifactsAnnotation = "dowser.dowser/artifacts"
+
+// artifactsPort is where the artifact server of replicas listens.
+const artifactsPort = 8080
+
+// artifactsScript fetches the artifacts listed in ARTIFACTS, one
+// "<kind>/<file> <url>" per line. Artifacts are optional: those which can't
+// be fetched are skipped.
+const artifactsScript = `while read -r name url; do
+  mkdir -p "/artifacts/$(dirname "${name}")"
+  curl -sfL --retry 5 --retry-delay 10 -o "/artifacts/${name}" "${url}" || echo "couldn't fetch ${url}"
+done <<< "${ARTIFACTS}"
+`
+
+// findJobArtifacts returns the URLs of the artifacts of the job at jobURL
+// matching JobArtifacts, by kind.
+func (o *Operator) findJobArtifacts(jobURL string) (map[string][]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	return prow.FindArtifacts(ctx, o.storageOpener, jobURL, o.JobArtifacts)
+}
+
+// addJobArtifacts has the replica fetch the job's artifacts and lists them in
+// its annotation.
+func (o *Operator) addJobArtifacts(deployment *appsv1.Deployment, job *Job) {
+	if len(job.Artifacts) == 0 {
+		return
+	}
+	annotation, _ := json.Marshal(job.Artifacts)
+	deployment.Annotations[artifactsAnnotation] = string(annotation)
+
+	var kinds, files []string
+	for kind := range job.Artifacts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		for _, url := range job.Artifacts[kind] {
+			files = append(files, fmt.Sprintf("%s/%s %s", kind, path.Base(url), url))
+		}
+	}
+
+	podSpec := &deployment.Spec.Template.Spec
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name:         "artifacts",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	mount := corev1.VolumeMount{Name: "artifacts", MountPath: "/artifacts/"}
+	setup := &podSpec.InitContainers[0]
+	setup.Command[len(setup.Command)-1] += artifactsScript
+	setup.Env = append(setup.Env, corev1.EnvVar{Name: "ARTIFACTS", Value: strings.Join(files, "\n")})
+	setup.VolumeMounts = append(setup.VolumeMounts, mount)
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == "prometheus" {
+			readOnly := mount
+			readOnly.ReadOnly = true
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, readOnly)
+		}
+	}
+	if len(o.ArtifactServerImage) > 0 {
+		podSpec.Containers = append(podSpec.Containers, corev1.Container{
+			Name:  "artifacts",
+			Image: o.ArtifactServerImage,
+			Ports: []corev1.ContainerPort{
+				{
+					Name:          "artifacts",
+					Protocol:      corev1.ProtocolTCP,
+					ContainerPort: artifactsPort,
+				},
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "artifacts", MountPath: "/usr/share/nginx/html/", ReadOnly: true},
+			},
+		})
+	}
+}
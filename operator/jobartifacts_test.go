@@ -0,0 +1,47 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestAddJobArtifacts(t *testing.T) {
+	o := &Operator{Namespace: "dowser", PrometheusMemory: "350Mi", ArtifactServerImage: "nginx"}
+	cluster := &api.MetricsCluster{}
+	cluster.Name = "cluster"
+	completed := metav1.Date(2020, 10, 1, 13, 0, 0, 0, time.UTC)
+	job := &Job{
+		ProwJob: prowapi.ProwJob{
+			Status: prowapi.ProwJobStatus{URL: "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1", StartTime: completed, CompletionTime: &completed},
+		},
+		PrometheusImage: "prometheus",
+	}
+	for _, volume := range o.prometheusDeploymentManifest(cluster, job).Spec.Template.Spec.Volumes {
+		if volume.Name == "artifacts" {
+			t.Errorf("expected no artifacts volume without artifacts")
+		}
+	}
+
+	job.Artifacts = map[string][]string{
+		"alerts": {"https://storage.googleapis.com/origin-ci-test/logs/job/1/artifacts/e2e/alerts.json"},
+	}
+	deployment := o.prometheusDeploymentManifest(cluster, job)
+	if annotation := deployment.Annotations[artifactsAnnotation]; !strings.Contains(annotation, "alerts.json") {
+		t.Errorf("expected the artifacts annotated, got %q", annotation)
+	}
+	setup := deployment.Spec.Template.Spec.InitContainers[0]
+	expected := "alerts/alerts.json https://storage.googleapis.com/origin-ci-test/logs/job/1/artifacts/e2e/alerts.json"
+	if env := setup.Env[len(setup.Env)-1]; env.Name != "ARTIFACTS" || env.Value != expected {
+		t.Errorf("expected the artifacts fetched, got %v", env)
+	}
+	containers := deployment.Spec.Template.Spec.Containers
+	if server := containers[len(containers)-1]; server.Name != "artifacts" || server.Image != "nginx" {
+		t.Errorf("expected the artifacts served, got %s", server.Name)
+	}
+}
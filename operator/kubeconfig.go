@@ -0,0 +1,28 @@
+package operator
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// restConfig returns the configuration for talking to the cluster. Without a
+// kubeconfig or context, the in-cluster configuration is used when running in
+// a pod, and otherwise $KUBECONFIG or ~/.kube/config.
+func restConfig(kubeconfig, context string) (*rest.Config, error) {
+	if len(kubeconfig) == 0 && len(context) == 0 {
+		return clientconfig.GetConfig()
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if len(kubeconfig) > 0 {
+		rules.ExplicitPath = kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	return config, nil
+}
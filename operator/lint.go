@@ -0,0 +1,131 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/query"
+)
+
+// There's no PromQL parser to hand, so expressions are checked by the parser
+// of the cluster's Thanos query, by evaluating them at a time no store has
+// data for. Parse errors are reported as bad_data before any evaluation.
+// Verdicts are cached by expression; expressions which can't be checked, e.g.
+// because the query frontend isn't up yet, are assumed valid and checked
+// again on the next reconcile.
+var exprVerdicts map[string]string
+var exprVerdictLock sync.Mutex
+
+// lintTimeout bounds how long a reconcile spends checking expressions.
+const lintTimeout = 10 * time.Second
+
+// lintExpression returns the parse error of expr, if any, and whether the
+// expression could be checked at all.
+func lintExpression(ctx context.Context, client *query.Client, expr string) (string, bool) {
+	exprVerdictLock.Lock()
+	defer exprVerdictLock.Unlock()
+	if exprVerdicts == nil {
+		exprVerdicts = map[string]string{}
+	}
+	if verdict, found := exprVerdicts[expr]; found {
+		return verdict, true
+	}
+	_, err := client.Instant(ctx, expr, time.Unix(1, 0), nil)
+	var apiErr *query.Error
+	switch {
+	case err == nil:
+		exprVerdicts[expr] = ""
+	case errors.As(err, &apiErr) && apiErr.Type == "bad_data":
+		exprVerdicts[expr] = apiErr.Message
+	default:
+		return "", false
+	}
+	return exprVerdicts[expr], true
+}
+
+// ruleExpressions returns the expressions of a rule group's rules.
+func ruleExpressions(group interface{}) []string {
+	fields, _ := group.(map[string]interface{})
+	rules, _ := fields["rules"].([]interface{})
+	var exprs []string
+	for _, rule := range rules {
+		ruleFields, _ := rule.(map[string]interface{})
+		if expr, isString := ruleFields["expr"].(string); isString {
+			exprs = append(exprs, expr)
+		}
+	}
+	return exprs
+}
+
+// lintExpressions checks the expressions of the cluster's rule groups and
+// queries. Rule groups with invalid expressions are dropped from every
+// cluster's additions, as a rule file Prometheus can't parse keeps it from
+// starting. The problems with the cluster's own expressions are recorded in
+// its ExpressionsValid condition.
+func (o *Operator) lintExpressions(cluster *api.MetricsCluster, additions map[string]*additionalConfig) {
+	if cluster.Spec.Backend == api.BackendVictoriaMetrics {
+		removeCondition(cluster, api.ConditionExpressionsValid)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), lintTimeout)
+	defer cancel()
+	client := query.NewClient(o.queryEndpoint(cluster))
+
+	var problems []string
+	unchecked := false
+	// check returns whether expr is valid, recording what's wrong with it
+	// if it's one of the cluster's own.
+	check := func(what, expr string, own bool) bool {
+		verdict, checked := lintExpression(ctx, client, expr)
+		if !checked {
+			unchecked = unchecked || own
+			return true
+		}
+		if len(verdict) > 0 && own {
+			problems = append(problems, fmt.Sprintf("%s: %s", what, verdict))
+		}
+		return len(verdict) == 0
+	}
+
+	for name, addition := range additions {
+		var groups []interface{}
+		for _, group := range addition.RuleGroups {
+			fields, _ := group.(map[string]interface{})
+			groupName, _ := fields["name"].(string)
+			valid := true
+			for _, expr := range ruleExpressions(group) {
+				if !check(fmt.Sprintf("rule group %s", groupName), expr, name == cluster.Name) {
+					valid = false
+				}
+			}
+			if valid {
+				groups = append(groups, group)
+			} else {
+				o.log.Info("leaving out rule group with invalid expressions", "cluster", name, "group", groupName)
+			}
+		}
+		addition.RuleGroups = groups
+	}
+	if len(cluster.Spec.SmokeTestQuery) > 0 {
+		check("smoke test query", cluster.Spec.SmokeTestQuery, true)
+	}
+	for _, q := range cluster.Spec.PostMortemQueries {
+		check(fmt.Sprintf("postmortem query %s", q.Name), q.Query, true)
+	}
+
+	switch {
+	case len(problems) > 0:
+		setCondition(cluster, api.ConditionExpressionsValid, corev1.ConditionFalse, "InvalidExpressions", strings.Join(problems, "; "))
+	case unchecked:
+		setCondition(cluster, api.ConditionExpressionsValid, corev1.ConditionUnknown, "QueryUnavailable", "expressions can't be checked until the query frontend is available")
+	default:
+		setCondition(cluster, api.ConditionExpressionsValid, corev1.ConditionTrue, "ExpressionsValid", "")
+	}
+}
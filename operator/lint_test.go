@@ -0,0 +1,64 @@
+package operator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ironcladlou/dowser/query"
+)
+
+func TestLintExpression(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch expr := r.Form.Get("query"); {
+		case strings.Contains(expr, "("):
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		case strings.Contains(expr, "broken"):
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"1:7: parse error: unexpected end of input"}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"status":"error","errorType":"unavailable","error":"no stores"}`))
+		}
+	}))
+	defer server.Close()
+	client := query.NewClient(server.URL)
+
+	tests := []struct {
+		expr    string
+		verdict string
+		checked bool
+	}{
+		{expr: "lint_test_valid(up)", checked: true},
+		{expr: "lint_test_broken", verdict: "1:7: parse error: unexpected end of input", checked: true},
+		{expr: "lint_test_unavailable", checked: false},
+	}
+	for _, test := range tests {
+		verdict, checked := lintExpression(context.TODO(), client, test.expr)
+		if verdict != test.verdict || checked != test.checked {
+			t.Errorf("%s: expected (%q, %v), got (%q, %v)", test.expr, test.verdict, test.checked, verdict, checked)
+		}
+	}
+	if _, cached := exprVerdicts["lint_test_unavailable"]; cached {
+		t.Errorf("expressions which couldn't be checked shouldn't be cached")
+	}
+}
+
+func TestRuleExpressions(t *testing.T) {
+	group := map[string]interface{}{
+		"name": "example",
+		"rules": []interface{}{
+			map[string]interface{}{"record": "a", "expr": "sum(up)"},
+			map[string]interface{}{"alert": "b", "expr": "up == 0"},
+		},
+	}
+	exprs := ruleExpressions(group)
+	if len(exprs) != 2 || exprs[0] != "sum(up)" || exprs[1] != "up == 0" {
+		t.Errorf("unexpected expressions %v", exprs)
+	}
+	if exprs := ruleExpressions("not a group"); len(exprs) != 0 {
+		t.Errorf("expected no expressions, got %v", exprs)
+	}
+}
@@ -0,0 +1,366 @@
+package operator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/query"
+)
+
+// MetricsQueries are range queries evaluated against a cluster, e.g. kept in
+// Git and applied by a GitOps tool. Range queries over large clusters are
+// expensive and syncs may recreate queries which didn't change, so results
+// are cached in a ConfigMap per cluster, queryresults-<cluster>, keyed by the
+// query's expression and range. The cache holds results for one version of
+// the cluster's data and is emptied when it changes. Queries are only
+// evaluated once their cluster is ready, as their results would lack the
+// sources not served yet. When the cache is full, the results least recently
+// evaluated are evicted, those no query refers to first; queries whose result
+// was evicted are evaluated again as they're next reconciled.
+
+// queryResultsVersionAnnotation is the version of the cluster's data the
+// cached results were evaluated against.
+const queryResultsVersionAnnotation = "dowser.dowser/data-version"
+
+// maxQueryResultsBytes bounds the results a cache holds, leaving room under
+// the 1MiB a ConfigMap may hold.
+const maxQueryResultsBytes = 768 << 10
+
+// metricsQueryTimeout bounds how long a query is evaluated.
+const metricsQueryTimeout = 2 * time.Minute
+
+// metricsQueryRetryInterval is how soon queries which couldn't be evaluated,
+// e.g. because the cluster's query didn't answer, are evaluated again.
+const metricsQueryRetryInterval = time.Minute
+
+// queryResultsLock serializes writes to the caches, which are read from the
+// API server rather than the operator's cache before they're updated.
+var queryResultsLock sync.Mutex
+
+// cachedQueryResult is a result in the cache.
+type cachedQueryResult struct {
+	Query     string          `json:"query"`
+	Start     metav1.Time     `json:"start"`
+	End       metav1.Time     `json:"end"`
+	Step      metav1.Duration `json:"step"`
+	Evaluated metav1.Time     `json:"evaluated"`
+	Samples   int32           `json:"samples"`
+	Result    json.RawMessage `json:"result"`
+}
+
+func (o *Operator) queryResultsName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("queryresults-%s", cluster.Name)}
+}
+
+// queryResultKey returns the key of a query's result in its cluster's cache.
+func queryResultKey(spec api.MetricsQuerySpec) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%d\x00%d\x00%d", spec.Query, spec.Start.Unix(), spec.End.Unix(), spec.Step.Duration)
+	return hex.EncodeToString(hash.Sum(nil))[:16] + ".json"
+}
+
+// clusterDataVersion returns the version of the data the cluster serves: its
+// generation, and for clusters listing their sources in a ConfigMap, which
+// don't change generation as the list does, a hash of the sources read.
+func clusterDataVersion(cluster *api.MetricsCluster) string {
+	version := strconv.FormatInt(cluster.Generation, 10)
+	if from := cluster.Status.SourcesFrom; from != nil {
+		hash := sha256.Sum256([]byte(strings.Join(from.URLs, "\n")))
+		version += "-" + hex.EncodeToString(hash[:])[:8]
+	}
+	return version
+}
+
+// validateMetricsQuery returns why the query can't be evaluated, if it can't.
+func validateMetricsQuery(spec api.MetricsQuerySpec) string {
+	switch {
+	case len(spec.Query) == 0:
+		return "spec.query is empty"
+	case spec.Step.Duration <= 0:
+		return "spec.step must be positive"
+	case !spec.End.After(spec.Start.Time):
+		return "spec.end must be after spec.start"
+	}
+	return ""
+}
+
+func (o *Operator) reconcileMetricsQuery(request reconcile.Request) (reconcile.Result, error) {
+	metricsQuery := &api.MetricsQuery{}
+	if err := o.client.Get(context.TODO(), request.NamespacedName, metricsQuery); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, fmt.Errorf("couldn't fetch metricsquery: %w", err)
+	}
+	if !o.ownsObject(metricsQuery) {
+		return reconcile.Result{}, nil
+	}
+
+	status, result, err := o.evaluateMetricsQuery(metricsQuery)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	status.ObservedGeneration = metricsQuery.Generation
+	if equality.Semantic.DeepEqual(status, metricsQuery.Status) {
+		return result, nil
+	}
+	metricsQuery.Status = status
+	if err := o.client.Status().Update(context.TODO(), metricsQuery); err != nil {
+		return reconcile.Result{}, fmt.Errorf("couldn't update metricsquery status: %w", err)
+	}
+	return result, nil
+}
+
+// evaluateMetricsQuery returns the status of the query, reading its result
+// from the cache or else evaluating it against the cluster and caching it.
+func (o *Operator) evaluateMetricsQuery(metricsQuery *api.MetricsQuery) (api.MetricsQueryStatus, reconcile.Result, error) {
+	if invalid := validateMetricsQuery(metricsQuery.Spec); len(invalid) > 0 {
+		return api.MetricsQueryStatus{Error: invalid}, reconcile.Result{}, nil
+	}
+	cluster := &api.MetricsCluster{}
+	err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: metricsQuery.Namespace, Name: metricsQuery.Spec.Cluster}, cluster)
+	if apierrors.IsNotFound(err) || (err == nil && !o.ownsObject(cluster)) {
+		// The cluster's watch requeues the query once it exists.
+		return api.MetricsQueryStatus{Error: fmt.Sprintf("metricscluster %s doesn't exist", metricsQuery.Spec.Cluster)}, reconcile.Result{}, nil
+	}
+	if err != nil {
+		return api.MetricsQueryStatus{}, reconcile.Result{}, fmt.Errorf("couldn't fetch metricscluster: %w", err)
+	}
+
+	previous := metricsQuery.Status
+	version := clusterDataVersion(cluster)
+	key := queryResultKey(metricsQuery.Spec)
+	cacheName := o.queryResultsName(cluster)
+	cache := &corev1.ConfigMap{}
+	if err := o.client.Get(context.TODO(), cacheName, cache); err != nil && !apierrors.IsNotFound(err) {
+		return api.MetricsQueryStatus{}, reconcile.Result{}, fmt.Errorf("couldn't fetch query result cache: %w", err)
+	}
+	if cache.Annotations[queryResultsVersionAnnotation] == version {
+		if content, cached := cache.Data[key]; cached {
+			entry := cachedQueryResult{}
+			if err := json.Unmarshal([]byte(content), &entry); err == nil {
+				status := api.MetricsQueryStatus{
+					DataVersion:        version,
+					ResultConfigMap:    cacheName.Name,
+					ResultKey:          key,
+					Samples:            entry.Samples,
+					Cached:             true,
+					LastEvaluationTime: &entry.Evaluated,
+				}
+				// A result this query evaluated itself isn't reported as
+				// cached as it's read again.
+				if previous.ResultKey == key && previous.DataVersion == version && previous.LastEvaluationTime != nil && previous.LastEvaluationTime.Equal(&entry.Evaluated) {
+					status.Cached = previous.Cached
+				}
+				return status, reconcile.Result{}, nil
+			}
+		}
+	}
+
+	// Queries which failed for good, e.g. on a bad expression, aren't
+	// evaluated again until they or their cluster's data change.
+	if len(previous.Error) > 0 && previous.LastEvaluationTime != nil && previous.ObservedGeneration == metricsQuery.Generation && previous.DataVersion == version {
+		return previous, reconcile.Result{}, nil
+	}
+	if cluster.Status.Phase != api.PhaseReady {
+		// The cluster's watch requeues the query once it's ready.
+		return api.MetricsQueryStatus{DataVersion: version, Error: fmt.Sprintf("metricscluster %s isn't ready", cluster.Name)}, reconcile.Result{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), metricsQueryTimeout)
+	defer cancel()
+	spec := metricsQuery.Spec
+	value, err := query.NewClient(o.queryEndpoint(cluster)).Range(ctx, spec.Query, spec.Start.Time, spec.End.Time, spec.Step.Duration, nil)
+	evaluated := metav1.Now().Rfc3339Copy()
+	var apiErr *query.Error
+	switch {
+	case errors.As(err, &apiErr):
+		return api.MetricsQueryStatus{DataVersion: version, LastEvaluationTime: &evaluated, Error: err.Error()}, reconcile.Result{}, nil
+	case err != nil:
+		o.log.Error(err, "couldn't evaluate metricsquery", "name", metricsQuery.Name, "cluster", cluster.Name)
+		return api.MetricsQueryStatus{DataVersion: version, Error: err.Error()}, reconcile.Result{RequeueAfter: metricsQueryRetryInterval}, nil
+	}
+	result, err := json.Marshal(value)
+	if err != nil {
+		return api.MetricsQueryStatus{}, reconcile.Result{}, fmt.Errorf("couldn't encode the result of metricsquery %s: %w", metricsQuery.Name, err)
+	}
+	entry := cachedQueryResult{
+		Query:     spec.Query,
+		Start:     spec.Start,
+		End:       spec.End,
+		Step:      spec.Step,
+		Evaluated: evaluated,
+		Samples:   int32(query.SampleCount(value)),
+		Result:    result,
+	}
+	status := api.MetricsQueryStatus{
+		DataVersion:        version,
+		Samples:            entry.Samples,
+		LastEvaluationTime: &evaluated,
+	}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return api.MetricsQueryStatus{}, reconcile.Result{}, fmt.Errorf("couldn't encode the result of metricsquery %s: %w", metricsQuery.Name, err)
+	}
+	if len(content) > maxQueryResultsBytes {
+		status.Error = fmt.Sprintf("the result's %d bytes are more than the %d the cache holds", len(content), maxQueryResultsBytes)
+		return status, reconcile.Result{}, nil
+	}
+	if err := o.cacheQueryResult(cluster, version, key, string(content)); err != nil {
+		return api.MetricsQueryStatus{}, reconcile.Result{}, err
+	}
+	status.ResultConfigMap = cacheName.Name
+	status.ResultKey = key
+	return status, reconcile.Result{}, nil
+}
+
+// cacheQueryResult adds a result to the cluster's cache, emptying it if it
+// holds results for another version of the cluster's data and evicting
+// results to make room.
+func (o *Operator) cacheQueryResult(cluster *api.MetricsCluster, version, key, content string) error {
+	queryResultsLock.Lock()
+	defer queryResultsLock.Unlock()
+
+	name := o.queryResultsName(cluster)
+	cache := &corev1.ConfigMap{}
+	exists := true
+	if err := o.apiReader.Get(context.TODO(), name, cache); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch query result cache: %w", err)
+		}
+		exists = false
+		cache = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: name.Namespace,
+				Name:      name.Name,
+				Labels: map[string]string{
+					"app":     "queryresults",
+					"cluster": cluster.Name,
+				},
+				OwnerReferences: clusterOwner(cluster),
+			},
+		}
+	}
+	if cache.Annotations[queryResultsVersionAnnotation] != version {
+		if cache.Annotations == nil {
+			cache.Annotations = map[string]string{}
+		}
+		cache.Annotations[queryResultsVersionAnnotation] = version
+		cache.Data = nil
+	}
+	if cache.Data == nil {
+		cache.Data = map[string]string{}
+	}
+
+	referenced, err := o.referencedQueryResults(cluster)
+	if err != nil {
+		return err
+	}
+	for _, evicted := range queryResultsToEvict(cache.Data, referenced, len(content), maxQueryResultsBytes) {
+		delete(cache.Data, evicted)
+		o.log.Info("evicted query result", "cluster", cluster.Name, "key", evicted)
+	}
+	cache.Data[key] = content
+
+	if !exists {
+		if err := o.client.Create(context.TODO(), cache); err != nil {
+			return fmt.Errorf("couldn't create query result cache: %w", err)
+		}
+		o.log.Info("created query result cache", "name", cache.Name)
+		return nil
+	}
+	if err := o.client.Update(context.TODO(), cache); err != nil {
+		return fmt.Errorf("couldn't update query result cache: %w", err)
+	}
+	return nil
+}
+
+// referencedQueryResults returns the keys of the cached results the
+// cluster's queries report.
+func (o *Operator) referencedQueryResults(cluster *api.MetricsCluster) (map[string]bool, error) {
+	queries := &api.MetricsQueryList{}
+	if err := o.client.List(context.TODO(), queries, client.InNamespace(cluster.Namespace)); err != nil {
+		return nil, fmt.Errorf("couldn't list metricsqueries: %w", err)
+	}
+	referenced := map[string]bool{}
+	for _, metricsQuery := range queries.Items {
+		if metricsQuery.Spec.Cluster == cluster.Name && len(metricsQuery.Status.ResultKey) > 0 {
+			referenced[metricsQuery.Status.ResultKey] = true
+		}
+	}
+	return referenced, nil
+}
+
+// queryResultsToEvict returns the keys of the results to evict from a cache
+// holding data so a result of the given size fits within max bytes: the
+// results no query refers to, then the others, each least recently evaluated
+// first.
+func queryResultsToEvict(data map[string]string, referenced map[string]bool, size, max int) []string {
+	total := size
+	keys := make([]string, 0, len(data))
+	evaluated := map[string]time.Time{}
+	for key, content := range data {
+		total += len(content)
+		keys = append(keys, key)
+		entry := cachedQueryResult{}
+		if err := json.Unmarshal([]byte(content), &entry); err == nil {
+			evaluated[key] = entry.Evaluated.Time
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if referenced[keys[i]] != referenced[keys[j]] {
+			return !referenced[keys[i]]
+		}
+		if !evaluated[keys[i]].Equal(evaluated[keys[j]]) {
+			return evaluated[keys[i]].Before(evaluated[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+	var evicted []string
+	for _, key := range keys {
+		if total <= max {
+			break
+		}
+		total -= len(data[key])
+		evicted = append(evicted, key)
+	}
+	return evicted
+}
+
+// queriesOfCluster maps a cluster to the queries evaluated against it, so
+// they're evaluated once it's ready and again as its data changes.
+func (o *Operator) queriesOfCluster() handler.ToRequestsFunc {
+	return func(object handler.MapObject) []reconcile.Request {
+		queries := &api.MetricsQueryList{}
+		if err := o.client.List(context.TODO(), queries, client.InNamespace(object.Meta.GetNamespace())); err != nil {
+			o.log.Error(err, "couldn't list metricsqueries")
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, metricsQuery := range queries.Items {
+			if metricsQuery.Spec.Cluster == object.Meta.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: metricsQuery.Namespace, Name: metricsQuery.Name}})
+			}
+		}
+		return requests
+	}
+}
@@ -0,0 +1,187 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestQueryResultKey(t *testing.T) {
+	start := metav1.NewTime(time.Unix(1600000000, 0))
+	end := metav1.NewTime(start.Add(time.Hour))
+	spec := api.MetricsQuerySpec{Cluster: "a", Query: "up", Start: start, End: end, Step: metav1.Duration{Duration: time.Minute}}
+
+	changed := map[string]func(*api.MetricsQuerySpec){
+		"query": func(s *api.MetricsQuerySpec) { s.Query = "up == 0" },
+		"start": func(s *api.MetricsQuerySpec) { s.Start = metav1.NewTime(start.Add(time.Minute)) },
+		"end":   func(s *api.MetricsQuerySpec) { s.End = metav1.NewTime(end.Add(time.Minute)) },
+		"step":  func(s *api.MetricsQuerySpec) { s.Step.Duration = time.Second },
+	}
+	for field, change := range changed {
+		other := spec
+		change(&other)
+		if queryResultKey(other) == queryResultKey(spec) {
+			t.Errorf("expected a query with another %s to have another key", field)
+		}
+	}
+	other := spec
+	other.Cluster = "b"
+	if queryResultKey(other) != queryResultKey(spec) {
+		t.Errorf("expected the key not to depend on the cluster, whose cache holds it")
+	}
+}
+
+func TestClusterDataVersion(t *testing.T) {
+	cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Generation: 3}}
+	if version := clusterDataVersion(cluster); version != "3" {
+		t.Errorf("expected version 3, got %s", version)
+	}
+	cluster.Status.SourcesFrom = &api.SourcesFromStatus{URLs: []string{"https://example.com/a.tar"}}
+	listed := clusterDataVersion(cluster)
+	if !strings.HasPrefix(listed, "3-") {
+		t.Errorf("expected the version of a cluster listing its sources to start with its generation, got %s", listed)
+	}
+	cluster.Status.SourcesFrom.URLs = append(cluster.Status.SourcesFrom.URLs, "https://example.com/b.tar")
+	if version := clusterDataVersion(cluster); version == listed {
+		t.Errorf("expected the version to change with the sources listed, got %s", version)
+	}
+}
+
+func TestValidateMetricsQuery(t *testing.T) {
+	start := metav1.NewTime(time.Unix(1600000000, 0))
+	valid := api.MetricsQuerySpec{Query: "up", Start: start, End: metav1.NewTime(start.Add(time.Hour)), Step: metav1.Duration{Duration: time.Minute}}
+	if invalid := validateMetricsQuery(valid); len(invalid) > 0 {
+		t.Errorf("expected a valid query, got %s", invalid)
+	}
+	tests := map[string]func(*api.MetricsQuerySpec){
+		"no query":      func(s *api.MetricsQuerySpec) { s.Query = "" },
+		"no step":       func(s *api.MetricsQuerySpec) { s.Step.Duration = 0 },
+		"reverse range": func(s *api.MetricsQuerySpec) { s.End = metav1.NewTime(start.Add(-time.Hour)) },
+	}
+	for name, change := range tests {
+		spec := valid
+		change(&spec)
+		if invalid := validateMetricsQuery(spec); len(invalid) == 0 {
+			t.Errorf("%s: expected the query to be refused", name)
+		}
+	}
+}
+
+func TestQueryResultsToEvict(t *testing.T) {
+	entry := func(minute int, size int) string {
+		content, _ := json.Marshal(cachedQueryResult{
+			Evaluated: metav1.NewTime(time.Unix(int64(minute)*60, 0)),
+			Result:    json.RawMessage(`"` + strings.Repeat("x", size) + `"`),
+		})
+		return string(content)
+	}
+	data := map[string]string{
+		"old": entry(1, 100),
+		"new": entry(3, 100),
+		"mid": entry(2, 100),
+	}
+	size := len(data["old"])
+
+	tests := []struct {
+		name       string
+		referenced map[string]bool
+		max        int
+		expected   []string
+	}{
+		{name: "room left", max: 4 * size},
+		{name: "least recently evaluated", max: 3 * size, expected: []string{"old"}},
+		{name: "unreferenced first", referenced: map[string]bool{"old": true}, max: 3 * size, expected: []string{"mid"}},
+		{name: "referenced when needed", referenced: map[string]bool{"old": true, "mid": true, "new": true}, max: 2 * size, expected: []string{"old", "mid"}},
+	}
+	for _, test := range tests {
+		evicted := queryResultsToEvict(data, test.referenced, size, test.max)
+		if strings.Join(evicted, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v evicted, got %v", test.name, test.expected, evicted)
+		}
+	}
+}
+
+// objectClient gets a fixed set of clusters and configmaps.
+type objectClient struct {
+	client.Client
+	clusters   map[string]*api.MetricsCluster
+	configMaps map[string]*corev1.ConfigMap
+}
+
+func (c *objectClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	switch typed := obj.(type) {
+	case *api.MetricsCluster:
+		if cluster, found := c.clusters[key.Name]; found {
+			cluster.DeepCopyInto(typed)
+			return nil
+		}
+	case *corev1.ConfigMap:
+		if configMap, found := c.configMaps[key.Name]; found {
+			configMap.DeepCopyInto(typed)
+			return nil
+		}
+	}
+	return apierrors.NewNotFound(schema.GroupResource{}, key.Name)
+}
+
+func TestEvaluateMetricsQueryFromCache(t *testing.T) {
+	start := metav1.NewTime(time.Unix(1600000000, 0))
+	metricsQuery := &api.MetricsQuery{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: "q", Generation: 1},
+		Spec:       api.MetricsQuerySpec{Cluster: "a", Query: "up", Start: start, End: metav1.NewTime(start.Add(time.Hour)), Step: metav1.Duration{Duration: time.Minute}},
+	}
+	// The cluster isn't ready, so the query would fail if it were
+	// evaluated.
+	cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: "a", Generation: 2}}
+	evaluated := metav1.NewTime(time.Unix(1600010000, 0))
+	content, _ := json.Marshal(cachedQueryResult{Query: "up", Evaluated: evaluated, Samples: 60, Result: json.RawMessage(`[]`)})
+	key := queryResultKey(metricsQuery.Spec)
+	cache := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: "queryresults-a", Annotations: map[string]string{queryResultsVersionAnnotation: "2"}},
+		Data:       map[string]string{key: string(content)},
+	}
+	o := &Operator{
+		Namespace: "dowser",
+		client: &objectClient{
+			clusters:   map[string]*api.MetricsCluster{"a": cluster},
+			configMaps: map[string]*corev1.ConfigMap{"queryresults-a": cache},
+		},
+	}
+
+	status, _, err := o.evaluateMetricsQuery(metricsQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Cached || status.ResultConfigMap != "queryresults-a" || status.ResultKey != key || status.Samples != 60 || len(status.Error) > 0 {
+		t.Errorf("expected the cached result, got %+v", status)
+	}
+
+	// The query evaluated the result itself, so it isn't reported as
+	// cached.
+	metricsQuery.Status = status
+	metricsQuery.Status.Cached = false
+	if status, _, _ := o.evaluateMetricsQuery(metricsQuery); status.Cached {
+		t.Errorf("expected the query's own result not to be reported as cached")
+	}
+
+	// Results for another version of the cluster's data aren't used.
+	cluster.Generation = 3
+	status, _, err = o.evaluateMetricsQuery(metricsQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Cached || len(status.ResultKey) > 0 || !strings.Contains(status.Error, "isn't ready") {
+		t.Errorf("expected a stale result to be ignored, got %+v", status)
+	}
+}
@@ -0,0 +1,101 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/common/model"
+
+	"github.com/ironcladlou/dowser/prow"
+)
+
+// With a MirrorBucket, sources' tarballs are copied into it once their build
+// completes, and replicas load the copy. Clusters kept around longer than CI
+// keeps its artifacts can then still recreate their replicas. The bucket must
+// be publicly readable, as CI's are. With a MirrorRetention, the operator
+// sets the bucket's lifecycle rules to delete copies after it at startup;
+// without one it reads the age after which they already delete copies, and
+// warns if they never do. Either way the age is the retention sources report
+// the expiry of mirrored tarballs with.
+
+// mirrorTimeout bounds the copy of a tarball, which may be several GB.
+const mirrorTimeout = time.Hour
+
+// mirrorLifecycleTimeout bounds reading and updating the mirror bucket's
+// lifecycle rules at startup.
+const mirrorLifecycleTimeout = time.Minute
+
+// parseMirrorRetention parses the retention of the mirror bucket, e.g. 90d,
+// into the days of its lifecycle rule, rounded up, or zero if none is given.
+func parseMirrorRetention(retention string) (int64, error) {
+	if len(retention) == 0 {
+		return 0, nil
+	}
+	duration, err := model.ParseDuration(retention)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mirror retention %q: %w", retention, err)
+	}
+	if time.Duration(duration) < 24*time.Hour {
+		return 0, fmt.Errorf("invalid mirror retention %q: lifecycle rules count whole days", retention)
+	}
+	day := int64(24 * time.Hour)
+	return (int64(duration) + day - 1) / day, nil
+}
+
+// ensureMirrorExpiry sets the mirror bucket's lifecycle rules to delete
+// copies after the mirror retention, or reads the age after which they
+// already do, and records it as the bucket's artifact retention unless one
+// was given.
+func (o *Operator) ensureMirrorExpiry(log logr.Logger) error {
+	if len(o.MirrorBucket) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorLifecycleTimeout)
+	defer cancel()
+
+	days := o.mirrorRetentionDays
+	if days > 0 {
+		changed, err := prow.EnsureMirrorExpiry(ctx, o.GCSCredentialsFile, o.MirrorBucket, days)
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Info("set the mirror bucket to delete copies by age", "bucket", o.MirrorBucket, "days", days)
+		}
+	} else {
+		var err error
+		days, err = prow.MirrorExpiryDays(ctx, o.GCSCredentialsFile, o.MirrorBucket)
+		if err != nil {
+			log.Error(err, "couldn't check how long the mirror bucket keeps copies", "bucket", o.MirrorBucket)
+			return nil
+		}
+		if days == 0 {
+			log.Info("the mirror bucket keeps copies forever, set --mirror-retention to have them deleted", "bucket", o.MirrorBucket)
+			return nil
+		}
+		log.Info("the mirror bucket deletes copies by age", "bucket", o.MirrorBucket, "days", days)
+	}
+
+	bucket := prow.ObjectBucket(o.MirrorBucket)
+	if _, given := o.artifactRetention[bucket]; !given {
+		o.artifactRetention[bucket] = time.Duration(days) * 24 * time.Hour
+	}
+	return nil
+}
+
+// mirrorTarball copies the tarball at tarURL into the mirror bucket, unless
+// it's already there, and returns the URL serving the copy.
+func (o *Operator) mirrorTarball(tarURL string) (string, error) {
+	mirroredURL, err := prow.MirrorObjectURL(o.MirrorBucket, tarURL)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+	if err := prow.MirrorObject(ctx, o.storageOpener, tarURL, mirroredURL); err != nil {
+		return "", err
+	}
+	return prow.PublicObjectURL(mirroredURL)
+}
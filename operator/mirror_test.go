@@ -0,0 +1,28 @@
+package operator
+
+import "testing"
+
+func TestParseMirrorRetention(t *testing.T) {
+	tests := []struct {
+		retention string
+		days      int64
+		invalid   bool
+	}{
+		{retention: ""},
+		{retention: "90d", days: 90},
+		{retention: "2w", days: 14},
+		{retention: "36h", days: 2},
+		{retention: "12h", invalid: true},
+		{retention: "forever", invalid: true},
+	}
+	for _, test := range tests {
+		days, err := parseMirrorRetention(test.retention)
+		if test.invalid != (err != nil) {
+			t.Errorf("%q: expected invalid %t, got error %v", test.retention, test.invalid, err)
+			continue
+		}
+		if days != test.days {
+			t.Errorf("%q: expected %d days, got %d", test.retention, test.days, days)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// With BootstrapNamespace, the operator prepares its namespace itself rather
+// than relying on it being prepared by hand: it creates the namespace if
+// it's missing, along with a ResourceQuota, a LimitRange and a NetworkPolicy
+// built from the operator's flags. They're checked again every sync period,
+// so they're restored when deleted and updated when the flags change.
+
+const (
+	namespaceQuotaName  = "dowser-quota"
+	namespaceLimitsName = "dowser-limits"
+	namespacePolicyName = "dowser-baseline"
+)
+
+// parseResourceList parses a list of resource quantities by name.
+func parseResourceList(values map[string]string) (corev1.ResourceList, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	resources := corev1.ResourceList{}
+	for name, value := range values {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity of %s: %w", name, err)
+		}
+		resources[corev1.ResourceName(name)] = quantity
+	}
+	return resources, nil
+}
+
+// namespaceQuotaManifest returns the namespace's quota, or nil without one.
+func (o *Operator) namespaceQuotaManifest() *corev1.ResourceQuota {
+	if len(o.namespaceQuota) == 0 {
+		return nil
+	}
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Namespace: o.Namespace, Name: namespaceQuotaName},
+		Spec:       corev1.ResourceQuotaSpec{Hard: o.namespaceQuota},
+	}
+}
+
+// namespaceLimitsManifest returns the namespace's default container
+// resources, or nil without any.
+func (o *Operator) namespaceLimitsManifest() *corev1.LimitRange {
+	if len(o.namespaceDefaultRequest) == 0 && len(o.namespaceDefaultLimit) == 0 {
+		return nil
+	}
+	return &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{Namespace: o.Namespace, Name: namespaceLimitsName},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{
+				{
+					Type:           corev1.LimitTypeContainer,
+					DefaultRequest: o.namespaceDefaultRequest,
+					Default:        o.namespaceDefaultLimit,
+				},
+			},
+		},
+	}
+}
+
+// namespacePolicyManifest returns the namespace's baseline network policy,
+// only admitting traffic from within the namespace and from the namespaces
+// matching NamespaceIngressFrom, such as the ingress controller's.
+func (o *Operator) namespacePolicyManifest() (*networkingv1.NetworkPolicy, error) {
+	peers := []networkingv1.NetworkPolicyPeer{
+		{PodSelector: &metav1.LabelSelector{}},
+	}
+	for _, selector := range o.NamespaceIngressFrom {
+		namespaceSelector, err := metav1.ParseToLabelSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector %q: %w", selector, err)
+		}
+		peers = append(peers, networkingv1.NetworkPolicyPeer{NamespaceSelector: namespaceSelector})
+	}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: o.Namespace, Name: namespacePolicyName},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress:     []networkingv1.NetworkPolicyIngressRule{{From: peers}},
+		},
+	}, nil
+}
+
+// bootstrapNamespace prepares the operator's namespace every sync period
+// until stop is closed. Failures are logged and retried.
+func (o *Operator) bootstrapNamespace(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if err := o.ensureNamespace(); err != nil {
+			o.log.Error(err, "couldn't bootstrap namespace", "namespace", o.Namespace)
+		}
+	}, o.SyncPeriod, stop)
+	return nil
+}
+
+// ensureNamespace creates the operator's namespace and its baseline
+// resources if they're missing, and updates the baseline resources which
+// drifted.
+func (o *Operator) ensureNamespace() error {
+	namespace := &corev1.Namespace{}
+	if err := o.apiReader.Get(context.TODO(), types.NamespacedName{Name: o.Namespace}, namespace); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch namespace: %w", err)
+		}
+		namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: o.Namespace}}
+		if err := o.client.Create(context.TODO(), namespace); err != nil {
+			return fmt.Errorf("couldn't create namespace: %w", err)
+		}
+		o.log.Info("created namespace", "name", o.Namespace)
+	}
+
+	if quota := o.namespaceQuotaManifest(); quota != nil {
+		current := &corev1.ResourceQuota{}
+		if err := o.ensureNamespaceObject("resourcequota", current, quota, func() bool {
+			if equality.Semantic.DeepEqual(current.Spec.Hard, quota.Spec.Hard) {
+				return false
+			}
+			current.Spec.Hard = quota.Spec.Hard
+			return true
+		}); err != nil {
+			return err
+		}
+	}
+	if limits := o.namespaceLimitsManifest(); limits != nil {
+		current := &corev1.LimitRange{}
+		if err := o.ensureNamespaceObject("limitrange", current, limits, func() bool {
+			if equality.Semantic.DeepEqual(current.Spec, limits.Spec) {
+				return false
+			}
+			current.Spec = limits.Spec
+			return true
+		}); err != nil {
+			return err
+		}
+	}
+	policy, err := o.namespacePolicyManifest()
+	if err != nil {
+		return err
+	}
+	current := &networkingv1.NetworkPolicy{}
+	return o.ensureNamespaceObject("networkpolicy", current, policy, func() bool {
+		if equality.Semantic.DeepEqual(current.Spec, policy.Spec) {
+			return false
+		}
+		current.Spec = policy.Spec
+		return true
+	})
+}
+
+// ensureNamespaceObject creates the desired object if it's missing, and
+// otherwise updates it if sync, which copies the desired spec into current,
+// reports a change.
+func (o *Operator) ensureNamespaceObject(kind string, current, desired runtime.Object, sync func() bool) error {
+	key, err := client.ObjectKeyFromObject(desired)
+	if err != nil {
+		return err
+	}
+	if err := o.apiReader.Get(context.TODO(), key, current); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch %s: %w", kind, err)
+		}
+		if err := o.client.Create(context.TODO(), desired); err != nil {
+			return fmt.Errorf("couldn't create %s: %w", kind, err)
+		}
+		o.log.Info("created "+kind, "name", key.Name)
+		return nil
+	}
+	if !sync() {
+		return nil
+	}
+	if err := o.client.Update(context.TODO(), current); err != nil {
+		return fmt.Errorf("couldn't update %s: %w", kind, err)
+	}
+	o.log.Info("updated "+kind, "name", key.Name)
+	return nil
+}
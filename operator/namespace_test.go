@@ -0,0 +1,55 @@
+package operator
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestNamespaceManifests(t *testing.T) {
+	quota, err := parseResourceList(map[string]string{"requests.cpu": "40", "pods": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseResourceList(map[string]string{"requests.cpu": "lots"}); err == nil {
+		t.Errorf("expected an invalid quantity to be rejected")
+	}
+
+	o := &Operator{Namespace: "dowser", namespaceQuota: quota}
+	if got := o.namespaceQuotaManifest(); got == nil || !got.Spec.Hard[corev1.ResourcePods].Equal(resource.MustParse("100")) {
+		t.Errorf("expected a quota of 100 pods, got %+v", got)
+	}
+	if got := o.namespaceLimitsManifest(); got != nil {
+		t.Errorf("expected no limit range without defaults, got %+v", got)
+	}
+
+	tests := []struct {
+		name  string
+		from  []string
+		peers int
+		valid bool
+	}{
+		{name: "namespace only", peers: 1, valid: true},
+		{name: "ingress", from: []string{"network.openshift.io/policy-group=ingress"}, peers: 2, valid: true},
+		{name: "invalid selector", from: []string{"=="}, valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o.NamespaceIngressFrom = test.from
+			policy, err := o.namespacePolicyManifest()
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if peers := policy.Spec.Ingress[0].From; len(peers) != test.peers {
+				t.Errorf("expected %d peers, got %+v", test.peers, peers)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+const (
+	mutateClusterPath = "/mutate-metricscluster"
+
+	// maxGenerateNameLength leaves room for the random suffix within the 63
+	// characters a cluster name may have, since it's used as a label key.
+	maxGenerateNameLength = 58
+
+	// jobNameWords is how many trailing words of a job's name identify it,
+	// e.g. e2e-aws-4-6 of release-openshift-ocp-installer-e2e-aws-4.6.
+	jobNameWords = 4
+)
+
+var nonNameCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+// generateNameDeriver extends the generateName of clusters being created with
+// a hint naming their first source, so generated names say what a cluster
+// holds, e.g. mc-pr12345-x7k2p. The API server appends the random suffix
+// after admission.
+type generateNameDeriver struct {
+	decoder *admission.Decoder
+}
+
+func (d *generateNameDeriver) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+func (d *generateNameDeriver) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Create {
+		return admission.Allowed("")
+	}
+	cluster := &api.MetricsCluster{}
+	if err := d.decoder.Decode(req, cluster); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if len(cluster.Name) > 0 || len(cluster.GenerateName) == 0 {
+		return admission.Allowed("")
+	}
+	generateName := derivedGenerateName(cluster)
+	if generateName == cluster.GenerateName {
+		return admission.Allowed("")
+	}
+	cluster.GenerateName = generateName
+	derived, err := json.Marshal(cluster)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, derived)
+}
+
+// derivedGenerateName returns the cluster's generateName followed by the hint
+// of its first listed source, or the generateName as is if there's none.
+func derivedGenerateName(cluster *api.MetricsCluster) string {
+	urls := desiredURLs(cluster)
+	if len(urls) == 0 {
+		return cluster.GenerateName
+	}
+	hint := sourceNameHint(urls[0])
+	if len(hint) == 0 {
+		return cluster.GenerateName
+	}
+	prefix := cluster.GenerateName
+	if !strings.HasSuffix(prefix, "-") {
+		prefix += "-"
+	}
+	// Hints which don't fit lose their leading words, the job's words being
+	// the most specific at its end.
+	for len(prefix)+len(hint)+1 > maxGenerateNameLength {
+		word := strings.Index(hint, "-")
+		if word < 0 {
+			return cluster.GenerateName
+		}
+		hint = hint[word+1:]
+	}
+	return prefix + hint + "-"
+}
+
+// sourceNameHint returns a short name for the build at a view or artifact
+// URL: pr<number> for builds of pull requests, and the last words of the job's
+// name otherwise.
+func sourceNameHint(sourceURL string) string {
+	pull, job, _ := parseBuildURL(sourceURL)
+	switch {
+	case len(pull) > 0:
+		return "pr" + nonNameCharacters.ReplaceAllString(pull, "")
+	case len(job) > 0:
+		words := strings.Split(strings.Trim(nonNameCharacters.ReplaceAllString(strings.ToLower(job), "-"), "-"), "-")
+		if len(words) > jobNameWords {
+			words = words[len(words)-jobNameWords:]
+		}
+		return strings.Join(words, "-")
+	}
+	return ""
+}
+
+// parseBuildURL returns the pull request number, if any, the job name and the
+// build ID of the build at a view or artifact URL, as far as they're given.
+func parseBuildURL(sourceURL string) (pull, job, build string) {
+	parsed, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", "", ""
+	}
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	at := func(i int) string {
+		if i < len(segments) {
+			return segments[i]
+		}
+		return ""
+	}
+	for i, segment := range segments {
+		switch {
+		case segment == "pr-logs" && at(i+1) == "pull" && len(at(i+3)) > 0:
+			return at(i + 3), at(i + 4), at(i + 5)
+		case segment == "logs" && len(at(i+1)) > 0:
+			return "", at(i + 1), at(i + 2)
+		}
+	}
+	return "", "", ""
+}
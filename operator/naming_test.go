@@ -0,0 +1,111 @@
+package operator
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestDerivedGenerateName(t *testing.T) {
+	tests := []struct {
+		name         string
+		generateName string
+		url          string
+		expected     string
+	}{
+		{
+			name:         "pull request",
+			generateName: "mc-",
+			url:          "https://prow.ci.openshift.org/view/gs/origin-ci-test/pr-logs/pull/openshift_origin/12345/pull-ci-openshift-origin-master-e2e-aws/1",
+			expected:     "mc-pr12345-",
+		},
+		{
+			name:         "periodic",
+			generateName: "mc",
+			url:          "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/release-openshift-ocp-installer-e2e-aws-4.6/1",
+			expected:     "mc-e2e-aws-4-6-",
+		},
+		{
+			name:         "tarball",
+			generateName: "mc-",
+			url:          "https://storage.googleapis.com/origin-ci-test/pr-logs/pull/27/678/job/1/artifacts/metrics/prometheus.tar",
+			expected:     "mc-pr678-",
+		},
+		{
+			name:         "unrecognized",
+			generateName: "mc-",
+			url:          "https://example.com/prometheus.tar",
+			expected:     "mc-",
+		},
+		{
+			name:         "shortened",
+			generateName: "a-long-generate-name-for-clusters-of-this-importer-",
+			url:          "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/release-openshift-ocp-installer-e2e-aws-4.6/1",
+			expected:     "a-long-generate-name-for-clusters-of-this-importer-4-6-",
+		},
+		{
+			name:         "too long",
+			generateName: "a-very-long-generate-name-for-clusters-of-this-importer-",
+			url:          "https://prow.ci.openshift.org/view/gs/origin-ci-test/pr-logs/pull/openshift_origin/12345/job/1",
+			expected:     "a-very-long-generate-name-for-clusters-of-this-importer-",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := &api.MetricsCluster{
+				ObjectMeta: metav1.ObjectMeta{GenerateName: test.generateName},
+				Spec:       api.MetricsClusterSpec{URLs: []string{test.url}},
+			}
+			generateName := derivedGenerateName(cluster)
+			if generateName != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, generateName)
+			}
+			if len(generateName) > maxGenerateNameLength {
+				t.Errorf("%q is longer than %d characters", generateName, maxGenerateNameLength)
+			}
+		})
+	}
+}
+
+func TestParseBuildURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		pull  string
+		job   string
+		build string
+	}{
+		{
+			name:  "pull request",
+			url:   "https://prow.ci.openshift.org/view/gs/origin-ci-test/pr-logs/pull/openshift_origin/12345/pull-ci-openshift-origin-master-e2e-aws/1300",
+			pull:  "12345",
+			job:   "pull-ci-openshift-origin-master-e2e-aws",
+			build: "1300",
+		},
+		{
+			name:  "periodic tarball",
+			url:   "https://storage.googleapis.com/origin-ci-test/logs/release-openshift-ocp-installer-e2e-aws-4.6/1301/artifacts/metrics/prometheus.tar",
+			job:   "release-openshift-ocp-installer-e2e-aws-4.6",
+			build: "1301",
+		},
+		{
+			name: "job only",
+			url:  "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/periodic-ci-e2e",
+			job:  "periodic-ci-e2e",
+		},
+		{
+			name: "elsewhere",
+			url:  "https://example.com/prometheus.tar",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pull, job, build := parseBuildURL(test.url)
+			if pull != test.pull || job != test.job || build != test.build {
+				t.Errorf("expected %q, %q, %q, got %q, %q, %q", test.pull, test.job, test.build, pull, job, build)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package operator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	notificationCreated           = "Created"
+	notificationReady             = "Ready"
+	notificationDegraded          = "Degraded"
+	notificationDeleted           = "Deleted"
+	notificationExpired           = "Expired"
+	notificationArtifactsExpiring = "ArtifactsExpiring"
+)
+
+// notification is the payload POSTed to the notification webhook.
+type notification struct {
+	Cluster   string    `json:"cluster"`
+	Namespace string    `json:"namespace"`
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message,omitempty"`
+}
+
+func newNotification(namespace, name, event, message string) notification {
+	return notification{
+		Cluster:   name,
+		Namespace: namespace,
+		Event:     event,
+		Time:      time.Now().UTC(),
+		Message:   message,
+	}
+}
+
+// notify asynchronously delivers a lifecycle notification to the configured
+// webhook, if any. Delivery failures are logged and otherwise ignored.
+func (o *Operator) notify(n notification) {
+	if len(o.NotificationWebhookURL) == 0 {
+		return
+	}
+	log := o.log.WithValues("cluster", n.Cluster, "event", n.Event)
+	go func() {
+		body, err := json.Marshal(n)
+		if err != nil {
+			log.Error(err, "couldn't encode notification")
+			return
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(o.NotificationWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Error(err, "couldn't send notification")
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			log.Error(fmt.Errorf("unexpected status %s", resp.Status), "notification rejected")
+		}
+	}()
+}
@@ -3,12 +3,12 @@ package operator
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"regexp"
+	"io/ioutil"
+	"os"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -17,11 +17,14 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logging "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -29,8 +32,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -38,8 +43,10 @@ import (
 	routev1 "github.com/openshift/api/route/v1"
 
 	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowio "k8s.io/test-infra/prow/io"
 
 	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/prow"
 )
 
 func init() {
@@ -49,39 +56,353 @@ func init() {
 type Operator struct {
 	Namespace string
 
-	FetcherImage    string
+	// Instance names the operator when several share the namespace. It only
+	// reconciles clusters labeled with its name, and only manages the
+	// objects it created, the unnamed instance taking unlabeled ones.
+	Instance string
+
+	// FetcherImage runs the setup containers of replicas, which load their
+	// data with the fetcher subcommand of this binary.
+	FetcherImage string
+
 	PrometheusImage string
 	ThanosImage     string
 
-	// Stuff for grepping prometheus.tar; can be replaced with gcloud
-	// CLI at some point but incorporating that into an image is a bit
-	// more work for now. Or a new recursive client search (which I think
-	// is what the gcloud CLI does.)
-	GCSStorageBaseURL string
-	ProwBaseURL       string
-	GCSPrefix         string
+	// GrafanaImage runs the Grafana of clusters enabling theirs.
+	GrafanaImage string
+
+	// VictoriaMetricsImage runs the store of clusters using the
+	// VictoriaMetrics backend.
+	VictoriaMetricsImage string
+
+	// With StoragePreflight, replicas request ephemeral storage for their
+	// data, estimated as ExtractionSizeFactor times the tarball's size, and
+	// sources whose data doesn't fit on any node fail without being
+	// scheduled.
+	StoragePreflight     bool
+	ExtractionSizeFactor float64
+
+	// With StoreReadinessGate, replicas are only added to their clusters'
+	// query views once their data is loaded.
+	StoreReadinessGate bool
+
+	// MaxURLsPerCluster, if positive, is the most sources a cluster may list,
+	// enforced by a validating webhook served on WebhookPort with the
+	// certificate in WebhookCertDir. Members of URLLimitAdminGroups may
+	// exempt clusters with the override annotation.
+	MaxURLsPerCluster   int
+	URLLimitAdminGroups []string
+	WebhookPort         int
+	WebhookCertDir      string
+
+	// DeriveGeneratedNames has the mutating webhook extend the generateName
+	// of clusters being created with a hint naming their first source, e.g.
+	// the pull request of its build.
+	DeriveGeneratedNames bool
+
+	// NormalizeClusters has a mutating webhook canonicalize and de-duplicate
+	// the sources of clusters, and fill the defaults of clusters being
+	// created.
+	NormalizeClusters bool
+
+	// APIBindAddress, if set, is the address serving the aggregation API,
+	// which proxies queries to each cluster for clients presenting the
+	// bearer token in APITokenFile.
+	APIBindAddress string
+	APITokenFile   string
+
+	// ServeHooks has the operator receive notifications of finished builds
+	// on HooksBindAddress from clients presenting the token in
+	// HooksTokenFile, adding builds to clusters per the policy in
+	// HooksPolicyFile.
+	ServeHooks       bool
+	HooksBindAddress string
+	HooksTokenFile   string
+	HooksPolicyFile  string
+
+	hookPolicy *hookPolicy
+
+	// Sources' artifacts are discovered by ArtifactFetchWorkers workers,
+	// making at most ArtifactFetchRate requests per second to each host, or
+	// any number if it's zero.
+	ArtifactFetchWorkers int
+	ArtifactFetchRate    float64
+
+	artifacts *artifactFetcher
+
+	// localSources means file:// sources can be read, as by commands run
+	// next to the files rather than in a cluster.
+	localSources bool
+
+	// GrafanaURL, if set, is the Grafana in which each source's run is
+	// marked by an annotation, created with the API key in GrafanaKeyFile.
+	GrafanaURL     string
+	GrafanaKeyFile string
+
+	// TracingEndpoint, if set, is the Jaeger collector endpoint the Thanos
+	// components of clusters send the spans of TracingSampleRatio of their
+	// requests to.
+	TracingEndpoint    string
+	TracingSampleRatio float64
+
+	// BootstrapNamespace has the operator create its namespace along with a
+	// ResourceQuota of NamespaceQuota, a LimitRange defaulting containers to
+	// NamespaceDefaultRequest and NamespaceDefaultLimit, and a NetworkPolicy
+	// admitting traffic from within it and from the namespaces matching the
+	// NamespaceIngressFrom selectors.
+	BootstrapNamespace      bool
+	NamespaceQuota          map[string]string
+	NamespaceDefaultRequest map[string]string
+	NamespaceDefaultLimit   map[string]string
+	NamespaceIngressFrom    []string
+
+	namespaceQuota          corev1.ResourceList
+	namespaceDefaultRequest corev1.ResourceList
+	namespaceDefaultLimit   corev1.ResourceList
+
+	// RunAsUser, if positive, is the user generated pods run as. Otherwise
+	// the platform must assign a non-root user, as OpenShift does.
+	RunAsUser int64
+
+	// OperatorImage is the image of the operator itself, which also runs
+	// remote write replays.
+	OperatorImage string
+
+	// ThanosVersion overrides the Thanos version detected from ThanosImage's
+	// tag, which selects the flags passed to Thanos components.
+	ThanosVersion string
+
+	thanosVersion string
+
+	// Sources are viewed under ProwBaseURL, and their artifacts read from
+	// GCSStorageBaseURL. Artifacts are listed with the service account in
+	// GCSCredentialsFile, or the default credentials if it's empty, falling
+	// back to anonymous access.
+	GCSStorageBaseURL  string
+	ProwBaseURL        string
+	GCSCredentialsFile string
+
+	storageOpener prowio.Opener
+
+	// ArtifactPathTemplates, if set, render globs of the path of builds'
+	// tarballs, for builds laid out differently than in the OpenShift CI.
+	ArtifactPathTemplates []string
+
+	artifactPathTemplates []*template.Template
+
+	// JobArtifacts are the patterns of the file names of the artifacts
+	// fetched into replicas along with their data, by kind, and
+	// ArtifactServerImage, if set, the web server image serving them.
+	JobArtifacts        map[string]string
+	ArtifactServerImage string
+
+	// MirrorBucket, if set, is a gs://<bucket>/<prefix> URL sources'
+	// tarballs are copied under, and loaded from, once their builds
+	// complete. MirrorRetention, if set, is how long the bucket keeps
+	// them, e.g. 90d, enforced by its lifecycle rules.
+	MirrorBucket    string
+	MirrorRetention string
+
+	mirrorRetentionDays int64
+
+	// ArtifactCacheSize, if set, is the size of the claim replicas fetch
+	// tarballs through, of ArtifactCacheStorageClass if set. Tarballs unused
+	// for ArtifactCacheTTL are removed from it.
+	ArtifactCacheSize         string
+	ArtifactCacheStorageClass string
+	ArtifactCacheTTL          time.Duration
+	artifactCacheSize         *resource.Quantity
+
+	// FetchBandwidthPerPod and FetchBandwidth, if set, are the bytes per
+	// second, as quantities, each replica's setup container and all of them
+	// together may download at.
+	FetchBandwidthPerPod string
+	FetchBandwidth       string
+	fetchBandwidthPerPod int64
+	fetchBandwidth       int64
+
+	// TrimWALOver, if set, is the size, as a quantity, over which setup
+	// containers drop the WAL of tarballs holding blocks.
+	TrimWALOver string
+	trimWALOver int64
 
 	PrometheusMemory string
 
-	log    logr.Logger
-	client client.Client
+	// Default resources of the Thanos sidecar, and how long it waits for
+	// Prometheus to become ready before giving up.
+	SidecarCPU          string
+	SidecarMemory       string
+	SidecarMemoryLimit  string
+	SidecarReadyTimeout time.Duration
+
+	sidecarResources corev1.ResourceRequirements
+
+	// PrometheusImages maps TSDB block format versions to images able to
+	// read them. Tarballs are inspected to select an image only when set.
+	PrometheusImages map[string]string
+
+	prometheusImages map[int]string
+
+	// Scheduling constraints applied to replicas of clusters using the spot
+	// schedule profile. Tolerations are given as key[=value][:effect].
+	SpotNodeSelector map[string]string
+	SpotTolerations  []string
+
+	spotTolerations []corev1.Toleration
+
+	// Default cron schedules for scaling replicas down and up, evaluated in
+	// ScheduleTimeZone.
+	ScaleDownSchedule string
+	ScaleUpSchedule   string
+	ScheduleTimeZone  string
+
+	scheduleLocation *time.Location
+
+	// NotificationWebhookURL receives a JSON POST for each cluster lifecycle
+	// transition when set.
+	NotificationWebhookURL string
+
+	// SmokeTestQuery is the default query evaluated against each replica
+	// after it becomes ready. Empty disables smoke tests.
+	SmokeTestQuery string
+
+	// WarmPoolSize is the number of idle replicas kept scheduled and ready
+	// to be claimed by new sources. Zero disables the pool.
+	WarmPoolSize int32
+
+	// New Prometheus deployments are created at most CreationBatchSize at a
+	// time, rechecking every CreationBatchDelay, and not at all while nodes
+	// report disk or network pressure if HoldOnNodePressure is set. A batch
+	// size of zero disables batching.
+	CreationBatchSize  int
+	CreationBatchDelay time.Duration
+	HoldOnNodePressure bool
+
+	// Clusters which aren't ready are reconciled every StatusRefreshInterval
+	// to pick up changes in the availability of their sources, and every
+	// cluster is reconciled at least every SyncPeriod.
+	StatusRefreshInterval time.Duration
+	SyncPeriod            time.Duration
+
+	// CPUHourlyCost and MemoryHourlyCost are the cost per hour of a requested
+	// core and GiB of memory, used to estimate what each cluster costs.
+	CPUHourlyCost    float64
+	MemoryHourlyCost float64
+
+	// The instance's MetricsClusterReport is refreshed every ReportInterval,
+	// or never if it's zero.
+	ReportInterval time.Duration
+
+	// HistoryLimit is how many clusters the history ledger keeps. The oldest
+	// deleted clusters are dropped first.
+	HistoryLimit int
+
+	// MaxPinDuration bounds how far ahead clusters may be pinned.
+	MaxPinDuration time.Duration
+
+	// ArtifactRetention is how long each bucket, or host, keeps the
+	// tarballs of sources, e.g. origin-ci-test=90d. Clusters are warned
+	// ArtifactExpiryWarning before the tarballs of their sources expire.
+	ArtifactRetention     map[string]string
+	ArtifactExpiryWarning time.Duration
+
+	artifactRetention map[string]time.Duration
+
+	// DefaultTTL is how long clusters without a TTL of their own last before
+	// expiring. Zero keeps them until they're deleted.
+	DefaultTTL time.Duration
+
+	// SoftDeleteGracePeriod is how long deleted and expired clusters are
+	// kept, without their replicas, so they can be undeleted. Zero deletes
+	// them right away and keeps expired clusters until they're deleted.
+	SoftDeleteGracePeriod time.Duration
+
+	// LeaderElection lets the operator run with several replicas, only the
+	// one holding the leader lease reconciling clusters. The lease lasts
+	// LeaseDuration, the leader gives it up when it can't renew it within
+	// RenewDeadline, and the other replicas try to acquire it every
+	// RetryPeriod.
+	LeaderElection bool
+	LeaseDuration  time.Duration
+	RenewDeadline  time.Duration
+	RetryPeriod    time.Duration
+
+	// MetricsBindAddress serves the operator's metrics, including the
+	// resources requested by each cluster and the namespace, and the
+	// statistics of reconciles and artifact discovery.
+	MetricsBindAddress string
+
+	// ExposeMode selects how services are reached from outside the cluster:
+	// route, ingress or none. Routes are used when the route API is served
+	// unless set. Ingresses are hosted under IngressDomain, with the
+	// certificate in IngressTLSSecret (the ingress controller's default if
+	// empty) and the class IngressClass if set.
+	ExposeMode       string
+	IngressDomain    string
+	IngressTLSSecret string
+	IngressClass     string
+
+	exposeMode string
+
+	// capabilities are the optional APIs detected at startup.
+	capabilities capabilities
+
+	// setupLogs reads the logs of failed setup containers, if set.
+	setupLogs *setupLogs
+
+	log       logr.Logger
+	client    client.Client
+	apiReader client.Reader
+	recorder  record.EventRecorder
 }
 
 type Job struct {
 	prowapi.ProwJob
 	PrometheusTarURL string
+
+	// PrometheusImage is the image able to read the job's TSDB blocks.
+	PrometheusImage string
+
+	// ExtractedSize is the estimated disk space needed by the job's data,
+	// or 0 if it isn't known.
+	ExtractedSize int64
+
+	// DisplayName is the run label of the job's series, if any.
+	DisplayName string
+
+	// SHA256 is the digest the job's tarball is pinned to, if any.
+	SHA256 string
+
+	// Artifacts are the URLs of the job's artifacts matching JobArtifacts,
+	// by kind.
+	Artifacts map[string][]string
 }
 
 func NewStartCommand() *cobra.Command {
 	operator := &Operator{}
+	var kubeconfig, kubeContext, gcsPrefix string
 
 	var command = &cobra.Command{
 		Use:   "start",
 		Short: "Starts the operator.",
 		Run: func(cmd *cobra.Command, args []string) {
-			mgr, err := manager.New(clientconfig.GetConfigOrDie(), manager.Options{
+			config, err := restConfig(kubeconfig, kubeContext)
+			if err != nil {
+				panic(err)
+			}
+			mgr, err := manager.New(config, manager.Options{
 				Namespace:          operator.Namespace,
-				MetricsBindAddress: "0",
+				MetricsBindAddress: operator.MetricsBindAddress,
+				Port:               operator.WebhookPort,
+				CertDir:            operator.WebhookCertDir,
+				SyncPeriod:         &operator.SyncPeriod,
+
+				LeaderElection:          operator.LeaderElection,
+				LeaderElectionID:        leaderElectionID(operator.Instance),
+				LeaderElectionNamespace: operator.Namespace,
+				LeaseDuration:           &operator.LeaseDuration,
+				RenewDeadline:           &operator.RenewDeadline,
+				RetryPeriod:             &operator.RetryPeriod,
 			})
 			if err != nil {
 				panic(err)
@@ -95,7 +416,14 @@ func NewStartCommand() *cobra.Command {
 				panic(err)
 			}
 			operator.log = logging.Log.WithName("operator")
-			operator.client = mgr.GetClient()
+			operator.client = newInstanceClient(mgr.GetClient(), operator.Instance)
+			operator.apiReader = mgr.GetAPIReader()
+			operator.recorder = mgr.GetEventRecorderFor("dowser")
+			pods, err := corev1client.NewForConfig(config)
+			if err != nil {
+				panic(err)
+			}
+			operator.setupLogs = newSetupLogs(pods)
 
 			if err := operator.Start(mgr); err != nil {
 				panic(err)
@@ -103,37 +431,341 @@ func NewStartCommand() *cobra.Command {
 		},
 	}
 
-	command.Flags().StringVarP(&operator.FetcherImage, "fetcher-image", "", "quay.io/fedora/fedora:31-x86_64", "")
-	command.Flags().StringVarP(&operator.PrometheusImage, "prometheus-image", "", "quay.io/prometheus/prometheus:v2.17.2", "")
-	command.Flags().StringVarP(&operator.ThanosImage, "thanos-image", "", "quay.io/thanos/thanos:v0.14.0", "")
-	command.Flags().StringVarP(&operator.Namespace, "namespace", "", "dowser", "")
-	command.Flags().StringVarP(&operator.GCSStorageBaseURL, "gcs-storage-base-url", "", "https://storage.googleapis.com/origin-ci-test", "")
-	command.Flags().StringVarP(&operator.ProwBaseURL, "prow-base-url", "", "https://prow.ci.openshift.org/view/gs/origin-ci-test", "")
-	command.Flags().StringVarP(&operator.GCSPrefix, "gcs-prefix", "", "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com", "")
-	command.Flags().StringVarP(&operator.PrometheusMemory, "prometheus-memory", "", "350Mi", "")
+	command.Flags().StringVarP(&kubeconfig, "kubeconfig", "", "", "kubeconfig to run against out of cluster (defaults to the in-cluster config, then $KUBECONFIG or ~/.kube/config)")
+	command.Flags().StringVarP(&kubeContext, "context", "", "", "kubeconfig context to use")
+	command.Flags().StringVarP(&gcsPrefix, "gcs-prefix", "", "", "")
+	command.Flags().MarkDeprecated("gcs-prefix", "artifacts are listed from GCS directly")
+	operator.addFlags(command)
 
 	return command
 }
 
+// addFlags adds the flags configuring the operator to the command, so the
+// commands rendering what the operator creates are configured the same way.
+func (o *Operator) addFlags(command *cobra.Command) {
+	flags := command.Flags()
+	flags.StringVarP(&o.FetcherImage, "fetcher-image", "", "quay.io/dmace/dowser:latest", "image of the setup containers fetching the data of replicas, which must provide dowser, bash and curl")
+	flags.StringVarP(&o.PrometheusImage, "prometheus-image", "", "quay.io/prometheus/prometheus:v2.17.2", "")
+	flags.StringVarP(&o.ThanosImage, "thanos-image", "", "quay.io/thanos/thanos:v0.14.0", "")
+	flags.StringVarP(&o.GrafanaImage, "grafana-image", "", "docker.io/grafana/grafana:7.2.1", "image of the Grafana deployed for clusters enabling it")
+	flags.StringVarP(&o.VictoriaMetricsImage, "victoriametrics-image", "", "victoriametrics/victoria-metrics:v1.40.0", "image of the store of clusters using the victoriametrics backend")
+	flags.BoolVarP(&o.StoragePreflight, "storage-preflight", "", false, "check each source's data fits on a node before creating its replica")
+	flags.Float64VarP(&o.ExtractionSizeFactor, "extraction-size-factor", "", 2, "estimated ratio of extracted data to tarball size")
+	flags.BoolVarP(&o.StoreReadinessGate, "store-readiness-gate", "", true, "only query replicas once their data is loaded")
+	flags.StringVarP(&o.OperatorImage, "operator-image", "", "quay.io/dmace/dowser:latest", "image of the operator, used to replay sources to remote write endpoints")
+	flags.StringVarP(&o.ThanosVersion, "thanos-version", "", "", "version of the thanos image, when its tag doesn't name one")
+	flags.StringVarP(&o.Namespace, "namespace", "", "dowser", "")
+	flags.StringVarP(&o.Instance, "instance", "", "", "name of this operator instance, when several share the namespace; it only reconciles clusters labeled "+api.InstanceLabel+"=<name>")
+	flags.StringVarP(&o.GCSStorageBaseURL, "gcs-storage-base-url", "", "https://storage.googleapis.com/origin-ci-test", "")
+	flags.StringVarP(&o.ProwBaseURL, "prow-base-url", "", "https://prow.ci.openshift.org/view/gs/origin-ci-test", "")
+	flags.IntVarP(&o.ArtifactFetchWorkers, "artifact-fetch-workers", "", 4, "number of sources whose artifacts are discovered at once")
+	flags.Float64VarP(&o.ArtifactFetchRate, "artifact-fetch-rate", "", 10, "most requests per second made to each host discovering artifacts (0 for no limit)")
+	flags.StringVarP(&o.GCSCredentialsFile, "gcs-credentials-file", "", "", "service account key used to list artifacts (empty for the default credentials, or anonymous access)")
+	flags.StringArrayVarP(&o.ArtifactPathTemplates, "artifact-path-template", "", nil, "Go template of a glob of the path of builds' prometheus tarball relative to their directory, e.g. artifacts/{{.Job}}/*/prometheus.tar, repeated to try several in order (none to find any metrics/prometheus.tar)")
+	flags.StringToStringVarP(&o.JobArtifacts, "job-artifacts", "", nil, "file name patterns of the artifacts fetched into replicas along with their data, by kind, e.g. alerts=alerts.json")
+	flags.StringVarP(&o.ArtifactServerImage, "artifact-server-image", "", "", "nginx image serving replicas' artifacts on port 8080, e.g. nginxinc/nginx-unprivileged (empty for none)")
+	flags.StringVarP(&o.ArtifactCacheSize, "artifact-cache-size", "", "", "size of the shared claim replicas fetch tarballs through (empty for no cache)")
+	flags.StringVarP(&o.ArtifactCacheStorageClass, "artifact-cache-storage-class", "", "", "storage class of the artifact cache, which must support ReadWriteMany")
+	flags.DurationVarP(&o.ArtifactCacheTTL, "artifact-cache-ttl", "", 7*24*time.Hour, "how long tarballs unused by any replica stay in the artifact cache")
+	flags.StringVarP(&o.FetchBandwidthPerPod, "fetch-bandwidth-per-pod", "", "", "bytes per second each replica may download its tarball at, e.g. 50Mi (empty for no limit)")
+	flags.StringVarP(&o.FetchBandwidth, "fetch-bandwidth", "", "", "bytes per second the replicas of the namespace may download their tarballs at together, e.g. 200Mi (empty for no limit)")
+	flags.StringVarP(&o.TrimWALOver, "trim-wal-over", "", "", "size over which the WAL of tarballs holding blocks is dropped before Prometheus starts, e.g. 1Gi (empty to keep WALs)")
+	flags.StringVarP(&o.MirrorBucket, "mirror-bucket", "", "", "gs:// URL of a public bucket and prefix sources' tarballs are copied to and loaded from (empty to load them from CI)")
+	flags.StringVarP(&o.MirrorRetention, "mirror-retention", "", "", "how long the mirror bucket keeps copies, in days, e.g. 90d, set as a lifecycle rule of the whole bucket at startup (empty to keep the bucket's rules)")
+	flags.StringVarP(&o.PrometheusMemory, "prometheus-memory", "", "350Mi", "")
+	flags.StringVarP(&o.SidecarCPU, "sidecar-cpu", "", "50m", "default CPU request of the thanos sidecar")
+	flags.StringVarP(&o.SidecarMemory, "sidecar-memory", "", "128Mi", "default memory request of the thanos sidecar")
+	flags.StringVarP(&o.SidecarMemoryLimit, "sidecar-memory-limit", "", "", "default memory limit of the thanos sidecar (empty for none)")
+	flags.DurationVarP(&o.SidecarReadyTimeout, "sidecar-ready-timeout", "", 10*time.Minute, "how long the thanos sidecar waits for prometheus to become ready")
+	flags.StringToStringVarP(&o.PrometheusImages, "prometheus-image-for-block-version", "", nil, "prometheus image to use for data in each TSDB block format version (version=image)")
+	flags.StringToStringVarP(&o.SpotNodeSelector, "spot-node-selector", "", map[string]string{"machine.openshift.io/interruptible-instance": ""}, "node selector for replicas using the spot schedule")
+	flags.StringVarP(&o.ScaleDownSchedule, "scale-down-schedule", "", "", "default cron schedule for scaling replicas to zero")
+	flags.StringVarP(&o.ScaleUpSchedule, "scale-up-schedule", "", "", "default cron schedule for scaling replicas back up")
+	flags.StringVarP(&o.ScheduleTimeZone, "schedule-time-zone", "", "UTC", "time zone for scale and refresh schedules")
+	flags.StringVarP(&o.NotificationWebhookURL, "notification-webhook-url", "", "", "URL to POST cluster lifecycle notifications to")
+	flags.StringVarP(&o.SmokeTestQuery, "smoke-test-query", "", "count(up)", "default query used to check each replica has data")
+	flags.Int32VarP(&o.WarmPoolSize, "warm-pool-size", "", 0, "number of idle replicas kept ready to serve new sources")
+	flags.IntVarP(&o.CreationBatchSize, "creation-batch-size", "", 0, "maximum number of replicas fetching data at once per cluster (0 for no limit)")
+	flags.DurationVarP(&o.CreationBatchDelay, "creation-batch-delay", "", 30*time.Second, "how often to check whether the next batch of replicas can be created")
+	flags.DurationVarP(&o.StatusRefreshInterval, "status-refresh-interval", "", 30*time.Second, "how often clusters which aren't ready are rechecked")
+	flags.DurationVarP(&o.SyncPeriod, "sync-period", "", 10*time.Hour, "how often every cluster is reconciled regardless of changes")
+	flags.Float64VarP(&o.CPUHourlyCost, "cpu-hourly-cost", "", 0, "cost per hour of a requested core, to estimate what clusters cost")
+	flags.Float64VarP(&o.MemoryHourlyCost, "memory-hourly-cost", "", 0, "cost per hour of a requested GiB of memory, to estimate what clusters cost")
+	flags.DurationVarP(&o.ReportInterval, "report-interval", "", time.Minute, "how often the fleet's metricsclusterreport is refreshed (0 to disable)")
+	flags.IntVarP(&o.HistoryLimit, "history-limit", "", 200, "number of clusters kept in the history ledger")
+	flags.DurationVarP(&o.MaxPinDuration, "max-pin-duration", "", 7*24*time.Hour, "how far ahead clusters may be pinned (0 for no limit)")
+	flags.StringToStringVarP(&o.ArtifactRetention, "artifact-retention", "", nil, "how long buckets (or hosts) keep sources' tarballs, e.g. origin-ci-test=90d")
+	flags.DurationVarP(&o.ArtifactExpiryWarning, "artifact-expiry-warning", "", 7*24*time.Hour, "how long before sources' tarballs expire their clusters are warned")
+	flags.DurationVarP(&o.DefaultTTL, "default-cluster-ttl", "", 0, "how long clusters without a ttl last before their replicas are released (0 for no limit)")
+	flags.DurationVarP(&o.SoftDeleteGracePeriod, "soft-delete-grace-period", "", 0, "how long deleted and expired clusters are kept without their replicas so they can be undeleted (0 to delete them right away)")
+	flags.BoolVarP(&o.LeaderElection, "enable-leader-election", "", false, "elect a leader among the operator's replicas, so only one reconciles clusters")
+	flags.DurationVarP(&o.LeaseDuration, "leader-election-lease-duration", "", 15*time.Second, "how long the leader lease lasts before other replicas may take it")
+	flags.DurationVarP(&o.RenewDeadline, "leader-election-renew-deadline", "", 10*time.Second, "how long the leader tries to renew its lease before giving it up")
+	flags.DurationVarP(&o.RetryPeriod, "leader-election-retry-period", "", 2*time.Second, "how often replicas try to acquire or renew the lease")
+	flags.StringVarP(&o.MetricsBindAddress, "metrics-bind-address", "", ":8080", "address serving the operator's metrics (0 to disable)")
+	flags.StringVarP(&o.ExposeMode, "expose-mode", "", "", "how services are exposed: route, ingress or none (detected from the route API if empty)")
+	flags.StringVarP(&o.IngressDomain, "ingress-domain", "", "", "domain ingresses are hosted under, required when exposing with ingresses")
+	flags.StringVarP(&o.IngressTLSSecret, "ingress-tls-secret", "", "", "secret holding the certificate of ingresses (empty for the ingress controller's default)")
+	flags.StringVarP(&o.IngressClass, "ingress-class", "", "", "class of generated ingresses (empty for the cluster's default)")
+	flags.BoolVarP(&o.HoldOnNodePressure, "hold-on-node-pressure", "", false, "don't create replicas while nodes report disk or network pressure")
+	flags.IntVarP(&o.MaxURLsPerCluster, "max-urls-per-cluster", "", 0, "maximum number of urls a cluster may list, enforced by the admission webhook (0 for no limit)")
+	flags.StringSliceVarP(&o.URLLimitAdminGroups, "url-limit-admin-group", "", []string{"system:masters", "system:cluster-admins"}, "groups allowed to exempt clusters from the url limit")
+	flags.BoolVarP(&o.DeriveGeneratedNames, "derive-generated-names", "", false, "add a hint naming the first source to the generateName of clusters, served by the admission webhook")
+	flags.BoolVarP(&o.NormalizeClusters, "normalize-clusters", "", false, "canonicalize and de-duplicate the source urls of clusters and fill their defaults, served by the admission webhook")
+	flags.IntVarP(&o.WebhookPort, "webhook-port", "", 9443, "port of the admission webhook server")
+	flags.StringVarP(&o.WebhookCertDir, "webhook-cert-dir", "", "/var/run/secrets/webhook", "directory holding the admission webhook's tls.crt and tls.key")
+	flags.StringVarP(&o.APIBindAddress, "api-bind-address", "", "", "address serving the cluster query aggregation api (empty to disable)")
+	flags.StringVarP(&o.APITokenFile, "api-token-file", "", "/var/run/secrets/api/token", "file holding the bearer token clients of the aggregation api must present")
+	flags.BoolVarP(&o.ServeHooks, "serve-hooks", "", false, "add finished builds reported by prow or gcs notifications to clusters per the hook policy")
+	flags.StringVarP(&o.HooksBindAddress, "hooks-bind-address", "", ":8090", "address serving build notifications")
+	flags.StringVarP(&o.HooksTokenFile, "hooks-token-file", "", "/var/run/secrets/hooks/token", "file holding the token senders of build notifications must present")
+	flags.StringVarP(&o.HooksPolicyFile, "hooks-policy-file", "", "/etc/dowser/hooks/policy.yaml", "file holding the rules adding finished builds to clusters")
+	flags.StringVarP(&o.GrafanaURL, "grafana-url", "", "", "grafana in which the runs of sources are annotated (empty to disable)")
+	flags.StringVarP(&o.GrafanaKeyFile, "grafana-key-file", "", "/var/run/secrets/grafana/key", "file holding the grafana api key annotations are created with")
+	flags.StringVarP(&o.TracingEndpoint, "tracing-endpoint", "", "", "jaeger collector endpoint thanos components send their spans to, e.g. http://jaeger-collector:14268/api/traces (empty to disable)")
+	flags.Float64VarP(&o.TracingSampleRatio, "tracing-sample-ratio", "", 0.1, "ratio of thanos requests traced")
+	flags.BoolVarP(&o.BootstrapNamespace, "bootstrap-namespace", "", false, "create the operator's namespace with its quota, limit range and network policy")
+	flags.StringToStringVarP(&o.NamespaceQuota, "namespace-quota", "", nil, "hard limits of the bootstrapped namespace's quota, e.g. requests.cpu=40,requests.memory=256Gi")
+	flags.StringToStringVarP(&o.NamespaceDefaultRequest, "namespace-default-request", "", nil, "default resource requests of containers in the bootstrapped namespace")
+	flags.StringToStringVarP(&o.NamespaceDefaultLimit, "namespace-default-limit", "", nil, "default resource limits of containers in the bootstrapped namespace")
+	flags.StringArrayVarP(&o.NamespaceIngressFrom, "namespace-ingress-from", "", []string{"network.openshift.io/policy-group=ingress"}, "selector of namespaces the bootstrapped namespace admits traffic from, besides itself")
+	flags.Int64VarP(&o.RunAsUser, "run-as-user", "", 0, "non-root user generated pods run as (0 to let the platform assign one)")
+	flags.StringArrayVarP(&o.SpotTolerations, "spot-toleration", "", []string{"machine.openshift.io/interruptible-instance"}, "toleration (key[=value][:effect]) for replicas using the spot schedule")
+}
+
+// parseOptions parses and validates the operator's flags, and prepares what
+// they configure.
+func (o *Operator) parseOptions(log logr.Logger) error {
+	spotTolerations, err := parseTolerations(o.SpotTolerations)
+	if err != nil {
+		return fmt.Errorf("invalid spot tolerations: %w", err)
+	}
+	o.spotTolerations = spotTolerations
+
+	o.scheduleLocation, err = time.LoadLocation(o.ScheduleTimeZone)
+	if err != nil {
+		return fmt.Errorf("invalid schedule time zone: %w", err)
+	}
+
+	o.sidecarResources, err = parseSidecarResources(o.SidecarCPU, o.SidecarMemory, o.SidecarMemoryLimit)
+	if err != nil {
+		return fmt.Errorf("invalid sidecar resources: %w", err)
+	}
+
+	if o.namespaceQuota, err = parseResourceList(o.NamespaceQuota); err != nil {
+		return fmt.Errorf("invalid namespace quota: %w", err)
+	}
+	if o.namespaceDefaultRequest, err = parseResourceList(o.NamespaceDefaultRequest); err != nil {
+		return fmt.Errorf("invalid namespace default request: %w", err)
+	}
+	if o.namespaceDefaultLimit, err = parseResourceList(o.NamespaceDefaultLimit); err != nil {
+		return fmt.Errorf("invalid namespace default limit: %w", err)
+	}
+
+	o.artifactRetention, err = parseArtifactRetention(o.ArtifactRetention)
+	if err != nil {
+		return err
+	}
+
+	o.artifactPathTemplates, err = parseArtifactPathTemplates(o.ArtifactPathTemplates)
+	if err != nil {
+		return err
+	}
+
+	o.prometheusImages, err = parsePrometheusImages(o.PrometheusImages)
+	if err != nil {
+		return err
+	}
+
+	o.thanosVersion, err = resolveThanosVersion(o.ThanosImage, o.ThanosVersion)
+	if err != nil {
+		return err
+	}
+	if len(o.thanosVersion) == 0 {
+		log.Info("couldn't determine thanos version, assuming a recent release", "image", o.ThanosImage)
+	}
+
+	o.storageOpener, err = prow.NewStorageOpener(context.Background(), o.GCSCredentialsFile)
+	if err != nil {
+		return err
+	}
+	if len(o.MirrorBucket) > 0 && !strings.HasPrefix(o.MirrorBucket, "gs://") {
+		return fmt.Errorf("invalid mirror bucket %s: not a gs:// url", o.MirrorBucket)
+	}
+	if o.mirrorRetentionDays, err = parseMirrorRetention(o.MirrorRetention); err != nil {
+		return err
+	}
+	if o.mirrorRetentionDays > 0 && len(o.MirrorBucket) == 0 {
+		return fmt.Errorf("--mirror-retention requires --mirror-bucket")
+	}
+	o.artifactCacheSize, err = parseArtifactCacheSize(o.ArtifactCacheSize)
+	if err != nil {
+		return err
+	}
+	if o.artifactCacheSize != nil && o.ArtifactCacheTTL < time.Minute {
+		return fmt.Errorf("invalid artifact cache ttl %s: less than a minute", o.ArtifactCacheTTL)
+	}
+	if o.fetchBandwidthPerPod, err = parseBandwidth("fetch bandwidth per pod", o.FetchBandwidthPerPod); err != nil {
+		return err
+	}
+	if o.fetchBandwidth, err = parseBandwidth("fetch bandwidth", o.FetchBandwidth); err != nil {
+		return err
+	}
+	if o.trimWALOver, err = parseWALTrimming(o.TrimWALOver); err != nil {
+		return err
+	}
+	if o.ServeHooks {
+		data, err := ioutil.ReadFile(o.HooksPolicyFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read hook policy: %w", err)
+		}
+		if o.hookPolicy, err = parseHookPolicy(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (o *Operator) Start(mgr manager.Manager) error {
 	log := o.log.WithName("entrypoint")
 
+	if err := o.parseOptions(log); err != nil {
+		return err
+	}
+
+	o.capabilities = detectCapabilities(mgr.GetRESTMapper(), log)
+	o.capabilities.report(log)
+
+	if err := o.ensureMirrorExpiry(log); err != nil {
+		return err
+	}
+
+	exposeMode, err := resolveExposeMode(o.ExposeMode, o.capabilities)
+	if err != nil {
+		return err
+	}
+	o.exposeMode = exposeMode
+	if o.exposeMode == exposeIngress && len(o.IngressDomain) == 0 {
+		return fmt.Errorf("--ingress-domain is required to expose services with ingresses")
+	}
+	log.Info("exposing services", "mode", o.exposeMode)
+
 	clusterController, err := controller.New("metricscluster-controller", mgr, controller.Options{
-		Reconciler: reconcile.Func(func(request reconcile.Request) (reconcile.Result, error) {
-			return o.reconcileMetricsCluster(request)
-		}),
+		Reconciler: countReconcileErrors("metricscluster-controller", o.reconcileMetricsCluster),
 	})
 	if err != nil {
 		return fmt.Errorf("unable to set up metricscluster controller: %w", err)
 	}
-	if err := clusterController.Watch(&source.Kind{Type: &api.MetricsCluster{}}, &handler.EnqueueRequestForObject{}); err != nil {
+	if err := clusterController.Watch(&source.Kind{Type: &api.MetricsCluster{}}, &handler.EnqueueRequestForObject{}, o.instanceObjects()); err != nil {
 		return fmt.Errorf("unable to watch metricsclusters: %w", err)
 	}
+	// Reconciles of deleted clusters can't tell a deletion from a requeue,
+	// so deletions are notified from the watch.
+	if err := clusterController.Watch(&source.Kind{Type: &api.MetricsCluster{}}, handler.Funcs{
+		DeleteFunc: func(e event.DeleteEvent, _ workqueue.RateLimitingInterface) {
+			o.notify(newNotification(e.Meta.GetNamespace(), e.Meta.GetName(), notificationDeleted, ""))
+		},
+	}, o.instanceObjects()); err != nil {
+		return fmt.Errorf("unable to watch metricscluster deletions: %w", err)
+	}
+	// Additional scrape configs and rule files are picked up as they change.
+	if err := clusterController.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: o.clustersReferencingConfig(false),
+	}); err != nil {
+		return fmt.Errorf("unable to watch configmaps: %w", err)
+	}
+	if err := clusterController.Watch(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: o.clustersReferencingConfig(true),
+	}); err != nil {
+		return fmt.Errorf("unable to watch secrets: %w", err)
+	}
+	if err := clusterController.Watch(&source.Kind{Type: &api.MetricsClusterTemplate{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: o.clustersReferencingTemplate(),
+	}); err != nil {
+		return fmt.Errorf("unable to watch metricsclustertemplates: %w", err)
+	}
+	if o.BootstrapNamespace {
+		if err := mgr.Add(manager.RunnableFunc(o.bootstrapNamespace)); err != nil {
+			return fmt.Errorf("unable to set up namespace bootstrap: %w", err)
+		}
+	}
+	if err := mgr.Add(manager.RunnableFunc(o.pruneOrphans)); err != nil {
+		return fmt.Errorf("unable to set up orphan pruning: %w", err)
+	}
+	if err := mgr.Add(manager.RunnableFunc(o.deleteRenamedResources)); err != nil {
+		return fmt.Errorf("unable to set up renamed resource cleanup: %w", err)
+	}
+	if err := mgr.Add(manager.RunnableFunc(o.adoptResources)); err != nil {
+		return fmt.Errorf("unable to set up cluster resource adoption: %w", err)
+	}
+	if o.ReportInterval > 0 {
+		if err := mgr.Add(manager.RunnableFunc(o.reportFleet)); err != nil {
+			return fmt.Errorf("unable to set up fleet report: %w", err)
+		}
+	}
+	if o.fetchBandwidth > 0 {
+		if err := mgr.Add(manager.RunnableFunc(o.balanceFetchBandwidth)); err != nil {
+			return fmt.Errorf("unable to set up fetch bandwidth balancing: %w", err)
+		}
+	}
+	o.artifacts = newArtifactFetcher(o)
+	if err := mgr.Add(manager.RunnableFunc(o.artifacts.run)); err != nil {
+		return fmt.Errorf("unable to set up artifact discovery: %w", err)
+	}
+	if err := clusterController.Watch(&source.Channel{Source: o.artifacts.events}, &handler.EnqueueRequestForObject{}); err != nil {
+		return fmt.Errorf("unable to watch artifact discovery: %w", err)
+	}
+	if err := clusterController.Watch(&source.Kind{Type: &batchv1.Job{}}, &handler.EnqueueRequestForOwner{
+		OwnerType:    &api.MetricsCluster{},
+		IsController: true,
+	}); err != nil {
+		return fmt.Errorf("unable to watch jobs: %w", err)
+	}
+
+	// The webhook server only runs when there's something to enforce or
+	// derive, so the operator doesn't otherwise need a serving certificate.
+	if o.MaxURLsPerCluster > 0 {
+		mgr.GetWebhookServer().Register(validateClusterPath, &webhook.Admission{Handler: &urlLimitValidator{
+			maxURLs:     o.MaxURLsPerCluster,
+			adminGroups: o.URLLimitAdminGroups,
+		}})
+	}
+	if o.DeriveGeneratedNames {
+		mgr.GetWebhookServer().Register(mutateClusterPath, &webhook.Admission{Handler: &generateNameDeriver{}})
+	}
+	if o.NormalizeClusters {
+		mgr.GetWebhookServer().Register(defaultClusterPath, &webhook.Admission{Handler: &clusterDefaulter{
+			prowBaseURL:      o.ProwBaseURL,
+			ttl:              o.DefaultTTL,
+			sidecarResources: o.sidecarResources,
+		}})
+	}
+
+	if err := clusterController.Watch(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: o.clustersReferencingReplica(),
+	}, replicaReadinessChanged); err != nil {
+		return fmt.Errorf("unable to watch pods: %w", err)
+	}
+	if err := clusterController.Watch(&source.Kind{Type: &appsv1.Deployment{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: o.clustersReferencingReplica(),
+	}, replicaAvailabilityChanged); err != nil {
+		return fmt.Errorf("unable to watch deployments: %w", err)
+	}
+
+	if o.StoreReadinessGate {
+		storeReadinessController, err := controller.New("store-readiness-controller", mgr, controller.Options{
+			Reconciler: countReconcileErrors("store-readiness-controller", o.reconcileStoreReadiness),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set up store readiness controller: %w", err)
+		}
+		if err := storeReadinessController.Watch(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestForObject{}, o.instanceObjects()); err != nil {
+			return fmt.Errorf("unable to watch pods: %w", err)
+		}
+	}
 
 	deploymentController, err := controller.New("deployment-controller", mgr, controller.Options{
-		Reconciler: reconcile.Func(func(request reconcile.Request) (reconcile.Result, error) {
-			return o.reconcileDeployment(request)
-		}),
+		Reconciler: countReconcileErrors("deployment-controller", o.reconcileDeployment),
 	})
 	if err != nil {
 		return fmt.Errorf("unable to set up deployment controller: %w", err)
@@ -142,6 +774,42 @@ func (o *Operator) Start(mgr manager.Manager) error {
 		return fmt.Errorf("unable to watch deployment: %w", err)
 	}
 
+	queryController, err := controller.New("metricsquery-controller", mgr, controller.Options{
+		Reconciler: countReconcileErrors("metricsquery-controller", o.reconcileMetricsQuery),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set up metricsquery controller: %w", err)
+	}
+	if err := queryController.Watch(&source.Kind{Type: &api.MetricsQuery{}}, &handler.EnqueueRequestForObject{}, o.instanceObjects()); err != nil {
+		return fmt.Errorf("unable to watch metricsqueries: %w", err)
+	}
+	if err := queryController.Watch(&source.Kind{Type: &api.MetricsCluster{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: o.queriesOfCluster(),
+	}, o.instanceObjects()); err != nil {
+		return fmt.Errorf("unable to watch metricsclusters: %w", err)
+	}
+
+	if len(o.APIBindAddress) > 0 {
+		if _, err := os.Stat(o.APITokenFile); err != nil {
+			return fmt.Errorf("aggregation api needs a token: %w", err)
+		}
+		// Every replica serves the API, reading clusters from its cache.
+		if err := mgr.Add(everyReplica(o.serveAPI)); err != nil {
+			return fmt.Errorf("unable to set up aggregation api: %w", err)
+		}
+	}
+
+	if o.ServeHooks {
+		if _, err := os.Stat(o.HooksTokenFile); err != nil {
+			return fmt.Errorf("hooks need a token: %w", err)
+		}
+		// Every replica receives notifications, so they're received
+		// during leader elections too.
+		if err := mgr.Add(everyReplica(o.serveHooks)); err != nil {
+			return fmt.Errorf("unable to set up hooks: %w", err)
+		}
+	}
+
 	log.Info("starting operator")
 	return mgr.Start(signals.SetupSignalHandler())
 }
@@ -160,6 +828,9 @@ func (o *Operator) reconcileDeployment(request reconcile.Request) (reconcile.Res
 		return reconcile.Result{}, fmt.Errorf("couldn't fetch deployment: %w", err)
 	}
 
+	if !o.ownsObject(deployment) {
+		return reconcile.Result{}, nil
+	}
 	if value, hasValue := deployment.Labels["app"]; hasValue && value == "prometheus" {
 		return o.reconcilePrometheusDeployment(deployment)
 	}
@@ -167,23 +838,35 @@ func (o *Operator) reconcileDeployment(request reconcile.Request) (reconcile.Res
 	return reconcile.Result{}, nil
 }
 
+// reconcilePrometheusDeployment keeps a replica's deployment referenced by
+// the clusters owning it: references of clusters which are gone are removed,
+// and deployments no cluster owns are deleted. Deployments created before
+// replicas were owned are adopted by the clusters their labels reference.
 func (o *Operator) reconcilePrometheusDeployment(deployment *appsv1.Deployment) (reconcile.Result, error) {
 	log := o.log.WithValues("controller", "prometheus-deployment-controller", "deployment", deployment.Name)
 	log.Info("reconciling prometheus deployment")
 
-	clusters := &api.MetricsClusterList{}
-	err := o.client.List(context.TODO(), clusters, &client.ListOptions{Namespace: o.Namespace})
-	if err != nil {
-		return reconcile.Result{}, fmt.Errorf("couldn't fetch metricsclusters: %w", err)
-	}
-	isReferenced := false
-	for _, cluster := range clusters.Items {
-		if _, hasReference := deployment.Spec.Template.Labels[cluster.Name]; hasReference {
-			isReferenced = true
-			break
+	changed := false
+	owners := ownerClusters(deployment)
+	if len(owners) == 0 {
+		clusters := &api.MetricsClusterList{}
+		err := o.client.List(context.TODO(), clusters, &client.ListOptions{Namespace: o.Namespace})
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("couldn't fetch metricsclusters: %w", err)
+		}
+		for i := range clusters.Items {
+			cluster := &clusters.Items[i]
+			if _, hasReference := deployment.Spec.Template.Labels[cluster.Name]; hasReference {
+				addOwner(deployment, cluster)
+				changed = true
+			}
 		}
+		owners = ownerClusters(deployment)
 	}
-	if !isReferenced {
+	if len(owners) == 0 {
+		if err := o.releaseClaimedPod(deployment); err != nil {
+			return reconcile.Result{}, err
+		}
 		err := o.client.Delete(context.TODO(), deployment)
 		if err != nil {
 			if errors.IsNotFound(err) {
@@ -193,12 +876,43 @@ func (o *Operator) reconcilePrometheusDeployment(deployment *appsv1.Deployment)
 			return reconcile.Result{}, fmt.Errorf("couldn't delete deployment: %w", err)
 		}
 		log.Info("deleted deployment with no references", "deployment", deployment.Name)
+		return reconcile.Result{}, nil
 	}
 
+	for label, value := range deployment.Spec.Template.Labels {
+		if (value != "true" && value != excludedReferenceValue) || owners[label] {
+			continue
+		}
+		if err := o.unreferenceClaimedPod(deployment, label); err != nil {
+			return reconcile.Result{}, err
+		}
+		delete(deployment.Spec.Template.Labels, label)
+		changed = true
+		log.Info("removed reference of deleted cluster", "cluster", label)
+	}
+	if changed {
+		if err := o.client.Update(context.TODO(), deployment); err != nil {
+			return reconcile.Result{}, fmt.Errorf("couldn't update deployment references: %w", err)
+		}
+	}
 	return reconcile.Result{}, nil
 }
 
-func (o *Operator) reconcileMetricsCluster(request reconcile.Request) (reconcile.Result, error) {
+// reconcileMetricsCluster reconciles a cluster, recovering from panics and
+// counting them against the source being processed, if any.
+func (o *Operator) reconcileMetricsCluster(request reconcile.Request) (result reconcile.Result, err error) {
+	var processing string
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result, err = o.recoverReconcile(request, processing, recovered)
+		}
+	}()
+	return o.reconcileCluster(request, &processing)
+}
+
+// reconcileCluster reconciles a cluster, setting processing to the URL of
+// each source while it's being processed.
+func (o *Operator) reconcileCluster(request reconcile.Request, processing *string) (reconcile.Result, error) {
 	log := o.log.WithValues("controller", "metricscluster-controller", "request", request)
 
 	cluster := &api.MetricsCluster{}
@@ -206,51 +920,202 @@ func (o *Operator) reconcileMetricsCluster(request reconcile.Request) (reconcile
 	if err != nil {
 		if errors.IsNotFound(err) {
 			log.Error(err, "couldn't find metricscluster")
-			deploymentList := appsv1.DeploymentList{}
-			err := o.client.List(context.TODO(), &deploymentList, &client.ListOptions{Namespace: o.Namespace})
-			if err != nil {
-				return reconcile.Result{}, fmt.Errorf("couldn't list deployments: %w", err)
-			}
-			for _, deployment := range deploymentList.Items {
-				if _, hasReference := deployment.Spec.Template.Labels[cluster.Name]; hasReference {
-					delete(deployment.Spec.Template.Labels, cluster.Name)
-					err := o.client.Update(context.TODO(), &deployment)
-					if err != nil {
-						log.Error(err, "couldn't update deployment to remove reference", "deployment", deployment.Name)
-					} else {
-						log.Info("removed reference from deployment", "deployment", deployment.Name)
-					}
-				}
+			// The garbage collector removes the cluster's resources and its
+			// references to shared replicas.
+			forgetFootprint(request.Name)
+			forgetFailureReasons(request.Name)
+			forgetJobCounts(request.Name)
+			if err := o.recordHistoryDeletion(request.Name, time.Now()); err != nil {
+				return reconcile.Result{}, err
 			}
-			return reconcile.Result{}, nil
+			return reconcile.Result{}, o.restoreUndeleted(request.NamespacedName)
 		}
 		return reconcile.Result{}, fmt.Errorf("couldn't fetch metricscluster: %w", err)
 	}
+	if !o.ownsObject(cluster) {
+		return reconcile.Result{}, nil
+	}
+
+	if cluster.DeletionTimestamp != nil {
+		// Post-mortem queries run first, while the replicas still serve.
+		if err := o.finalizePostMortem(cluster); err != nil {
+			return reconcile.Result{}, err
+		}
+		if held, result, err := o.softDelete(cluster, time.Now()); err != nil || held {
+			return result, err
+		}
+		return o.finalizeTeardown(cluster)
+	}
+	if err := o.ensurePostMortemFinalizer(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := o.ensureTeardownFinalizer(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := o.ensurePool(); err != nil {
+		return reconcile.Result{}, err
+	}
 
-	for _, url := range cluster.Spec.URLs {
-		prowInfoURL := strings.ReplaceAll(url, o.ProwBaseURL, o.GCSStorageBaseURL) + "/prowjob.json"
+	// The template is applied before anything reads the cluster's
+	// settings; a missing one is reported, and the cluster's own settings
+	// used meanwhile.
+	templateErr := o.applyClusterTemplate(cluster)
 
-		var prowJob prowapi.ProwJob
-		resp, err := http.Get(prowInfoURL)
-		if err != nil {
-			log.Error(err, "couldn't get prow info", "url", url, "prowInfoURL", prowInfoURL)
+	result := reconcile.Result{}
+	originalStatus := cluster.Status.DeepCopy()
+
+	now := time.Now()
+	var scheduleErrors []string
+	replicas, nextScale, err := o.scheduledReplicas(cluster, now)
+	// An invalid scale schedule leaves replicas as they are rather than
+	// guessing whether the user meant them up or down.
+	keepReplicas := err != nil
+	if err != nil {
+		log.Error(err, "ignoring invalid scale schedule")
+		scheduleErrors = append(scheduleErrors, fmt.Sprintf("invalid scale schedule: %v", err))
+	}
+	requeueAt(&result, now, nextScale)
+
+	o.readSourcesFrom(cluster)
+	requeueAt(&result, now, o.discoverJobs(cluster, now))
+	nextRefresh, err := o.refreshURLs(cluster, now)
+	if err != nil {
+		log.Error(err, "ignoring invalid refresh schedule")
+		scheduleErrors = append(scheduleErrors, fmt.Sprintf("invalid refresh schedule: %v", err))
+		nextRefresh = time.Time{}
+		o.setRefreshedURLs(cluster, desiredURLs(cluster), now)
+	}
+	requeueAt(&result, now, nextRefresh)
+	cluster.Status.ScheduleError = strings.Join(scheduleErrors, "; ")
+	requeueAt(&result, now, o.updatePinnedCondition(cluster, now))
+	expired, expiration := o.checkExpiration(cluster, now)
+	if expired {
+		return o.expireCluster(cluster, originalStatus)
+	}
+	requeueAt(&result, now, expiration)
+
+	// Replicas may be shared with other clusters, so they're configured with
+	// the additions of every cluster referencing them.
+	clusters, err := o.namespaceClusters(cluster)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	additions := o.loadSharedAdditionalConfig(cluster, clusters)
+	var configErrors []string
+	if templateErr != nil {
+		configErrors = append(configErrors, templateErr.Error())
+	}
+	if _, err := parseExternalQueriers(cluster); err != nil {
+		configErrors = append(configErrors, err.Error())
+	}
+	if addition, err := o.loadAdditionalConfig(cluster); err != nil {
+		log.Error(err, "ignoring invalid additional config")
+		configErrors = append(configErrors, err.Error())
+	} else {
+		additions[cluster.Name] = addition
+	}
+	o.lintExpressions(cluster, additions)
+	if err := o.ensureArtifactCache(); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// Track how many sources are usable for the cluster's phase.
+	failed, unavailable, restoring := 0, 0, 0
+
+	previousJobs := map[string]api.JobStatus{}
+	for _, job := range cluster.Status.Jobs {
+		previousJobs[job.URL] = job
+	}
+	var jobStatuses []api.JobStatus
+	readyJobs := map[string]*Job{}
+	fetchedJobs := map[string]*Job{}
+
+	// How many more deployments may be created, computed on first use; -1
+	// means no limit.
+	allowance, checkedAllowance, holdReason := 0, false, ""
+
+	// The sources needing more storage than any node offers.
+	fit := &storageFit{o: o}
+	var insufficientStorage []string
+	// The errors of replicas refused by quotas, retried on later reconciles.
+	var quotaErrors []string
+	// The last panic of each quarantined source.
+	quarantined := map[string]string{}
+
+	for _, url := range cluster.Status.URLs {
+		*processing = url
+		if lastPanic, isQuarantined := quarantinedSource(url); isQuarantined {
+			failed++
+			quarantined[url] = lastPanic
+			jobStatuses = append(jobStatuses, api.JobStatus{URL: url, Deployment: previousJobs[url].Deployment, Reason: api.FailureQuarantined, Message: "quarantined after panicking: " + lastPanic})
 			continue
 		}
-		err = json.NewDecoder(resp.Body).Decode(&prowJob)
-		if err != nil {
-			log.Error(err, "couldn't decode prow info", "url", url)
+		artifacts, discovered := o.artifacts.artifacts(cluster, url)
+		if !discovered {
+			restoring++
+			jobStatuses = append(jobStatuses, api.JobStatus{URL: url, Deployment: previousJobs[url].Deployment, Message: "discovering the source's artifacts"})
+			continue
 		}
-		prometheusTarURL, err := findPrometheusTarURL(url, o.GCSPrefix)
-		if err != nil {
-			log.Error(err, "no prometheus tar URL defined for build", "url", url)
+		if artifacts.err != nil {
+			failed++
+			jobStatuses = append(jobStatuses, api.JobStatus{URL: url, Deployment: previousJobs[url].Deployment, Reason: artifacts.reason, Message: artifacts.err.Error()})
 			continue
 		}
 
 		job := &Job{
-			ProwJob:          prowJob,
-			PrometheusTarURL: prometheusTarURL,
+			ProwJob:          artifacts.prowJob,
+			PrometheusTarURL: artifacts.tarURL,
+			PrometheusImage:  artifacts.image,
+			DisplayName:      sourceDisplayName(cluster, url),
+			SHA256:           sourceSHA256(cluster, url),
+			Artifacts:        artifacts.artifacts,
+		}
+		fetchedJobs[url] = job
+
+		if o.StoragePreflight && cluster.Spec.Backend != api.BackendVictoriaMetrics && cluster.Spec.Storage == nil {
+			job.ExtractedSize = artifacts.extractedSize
+			message, err := fit.check(job.ExtractedSize)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if len(message) > 0 {
+				log.Info("source doesn't fit on any node", "url", url, "reason", message)
+				failed++
+				insufficientStorage = append(insufficientStorage, url)
+				jobStatuses = append(jobStatuses, api.JobStatus{URL: url, Deployment: previousJobs[url].Deployment, Reason: api.FailureInsufficientStorage, Message: message})
+				continue
+			}
 		}
 		prometheusDeploymentName := o.prometheusDeploymentName(job)
+		excluded, exclusionReason, err := storeExclusion(cluster, url, previousJobs[url], prometheusDeploymentName.Name, now)
+		if err != nil {
+			log.Error(err, "not evicting unhealthy stores")
+		}
+
+		// Sources imported into VictoriaMetrics or uploaded to the bucket
+		// are served without a replica.
+		if cluster.Spec.Backend == api.BackendVictoriaMetrics || sourceMode(cluster, url) == api.SourceModeBlocksOnly {
+			var jobStatus api.JobStatus
+			var jobFailed bool
+			if cluster.Spec.Backend == api.BackendVictoriaMetrics {
+				jobStatus, jobFailed, err = o.importSource(cluster, job, url, prometheusDeploymentName.Name)
+			} else {
+				jobStatus, jobFailed, err = o.uploadSourceBlocks(cluster, job, url, prometheusDeploymentName.Name)
+			}
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			switch {
+			case jobFailed:
+				failed++
+			case !jobStatus.Ready:
+				restoring++
+			}
+			jobStatuses = append(jobStatuses, jobStatus)
+			continue
+		}
+
 		prometheusDeployment := &appsv1.Deployment{}
 		hasPrometheusDeployment := true
 		err = o.client.Get(context.TODO(), prometheusDeploymentName, prometheusDeployment)
@@ -261,13 +1126,90 @@ func (o *Operator) reconcileMetricsCluster(request reconcile.Request) (reconcile
 				return reconcile.Result{}, fmt.Errorf("couldn't fetch deployment: %w", err)
 			}
 		}
-		desiredPrometheusDeployment := o.prometheusDeploymentManifest(job)
+		// A paused source's replica isn't created until it's resumed.
+		sourceReplicas := replicas
+		if sourcePaused(cluster, url) {
+			sourceReplicas = 0
+		}
+		if !hasPrometheusDeployment && sourceReplicas > 0 {
+			if !checkedAllowance {
+				allowance, holdReason, err = o.creationAllowance(cluster)
+				if err != nil {
+					return reconcile.Result{}, err
+				}
+				checkedAllowance = true
+			}
+			if allowance == 0 {
+				log.Info("holding deployment creation", "url", url, "reason", holdReason)
+				restoring++
+				jobStatuses = append(jobStatuses, api.JobStatus{URL: url, Message: holdReason})
+				requeueAt(&result, now, now.Add(o.CreationBatchDelay))
+				continue
+			}
+			if allowance > 0 {
+				allowance--
+			}
+		}
+		desiredPrometheusDeployment := o.prometheusDeploymentManifest(cluster, job)
+		desiredPrometheusDeployment.Spec.Replicas = &replicas
+		if keepReplicas && hasPrometheusDeployment && prometheusDeployment.Spec.Replicas != nil {
+			desiredPrometheusDeployment.Spec.Replicas = prometheusDeployment.Spec.Replicas
+		}
+		desiredPrometheusDeployment.Spec.Template.Labels[cluster.Name] = "true"
+		if hasPrometheusDeployment {
+			// Keep the references of other clusters sharing the deployment.
+			for key, value := range prometheusDeployment.Spec.Template.Labels {
+				if _, hasLabel := desiredPrometheusDeployment.Spec.Template.Labels[key]; !hasLabel {
+					desiredPrometheusDeployment.Spec.Template.Labels[key] = value
+				}
+			}
+		}
+		referencing := referencingClusters(desiredPrometheusDeployment, clusters)
+		job.DisplayName = sharedDisplayName(referencing, url)
+		job.SHA256 = sharedSHA256(referencing, url)
+		applyChecksumPin(&desiredPrometheusDeployment.Spec.Template.Spec, job.SHA256)
+		paused := sharedPaused(referencing, url)
+		if paused {
+			var none int32
+			desiredPrometheusDeployment.Spec.Replicas = &none
+		}
+		storage, features := o.configureReplica(desiredPrometheusDeployment, referencing)
+		prometheusConfig, err := renderPrometheusConfig(prometheusDeploymentName.Name, job, deploymentAdditions(referencing, additions))
+		if err != nil {
+			// Conflicting additions are left out rather than keeping the
+			// source from being served.
+			log.Error(err, "ignoring additional config", "url", url)
+			configErrors = append(configErrors, fmt.Sprintf("%s: %v", prometheusDeploymentName.Name, err))
+			prometheusConfig, err = renderPrometheusConfig(prometheusDeploymentName.Name, job, nil)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+
+		var existing *appsv1.Deployment
 		if hasPrometheusDeployment {
-			prometheusDeployment.Spec = desiredPrometheusDeployment.Spec
-			prometheusDeployment.Spec.Template.Labels[cluster.Name] = "true"
-			if !equality.Semantic.DeepEqual(prometheusDeployment.Spec, desiredPrometheusDeployment.Spec) ||
-				!equality.Semantic.DeepEqual(prometheusDeployment.Labels, desiredPrometheusDeployment.Labels) ||
-				!equality.Semantic.DeepEqual(prometheusDeployment.Annotations, desiredPrometheusDeployment.Annotations) {
+			existing = prometheusDeployment
+		}
+		claimedPod, poolPod, err := o.poolPods(cluster, job, features, existing, desiredPrometheusDeployment, sourceReplicas, prometheusConfig)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		setTemplateHash(desiredPrometheusDeployment)
+		if hasPrometheusDeployment {
+			_, hasClaim := prometheusDeployment.Annotations[claimedPodAnnotation]
+			if specChanged(prometheusDeployment, desiredPrometheusDeployment) ||
+				(hasClaim && claimedPod == nil) ||
+				!isOwnedBy(prometheusDeployment, cluster) ||
+				!hasEntries(prometheusDeployment.Labels, desiredPrometheusDeployment.Labels) ||
+				!hasEntries(prometheusDeployment.Annotations, desiredPrometheusDeployment.Annotations) {
+				prometheusDeployment.Spec = desiredPrometheusDeployment.Spec
+				addOwner(prometheusDeployment, cluster)
+				prometheusDeployment.Labels = mergeEntries(prometheusDeployment.Labels, desiredPrometheusDeployment.Labels)
+				prometheusDeployment.Annotations = mergeEntries(prometheusDeployment.Annotations, desiredPrometheusDeployment.Annotations)
+				if claimedPod == nil {
+					delete(prometheusDeployment.Annotations, claimedPodAnnotation)
+				}
 				err := o.client.Update(context.TODO(), prometheusDeployment)
 				if err != nil {
 					return reconcile.Result{}, fmt.Errorf("couldn't update deployment for url %s: %w", url, err)
@@ -276,35 +1218,291 @@ func (o *Operator) reconcileMetricsCluster(request reconcile.Request) (reconcile
 				}
 			}
 		} else {
-			desiredPrometheusDeployment.Spec.Template.Labels[cluster.Name] = "true"
 			err := o.client.Create(context.TODO(), desiredPrometheusDeployment)
+			if isQuotaError(err) {
+				log.Info("quota exceeded creating deployment", "name", desiredPrometheusDeployment.Name, "url", url, "message", err.Error())
+				quotaErrors = append(quotaErrors, err.Error())
+				restoring++
+				jobStatuses = append(jobStatuses, api.JobStatus{URL: url, Deployment: prometheusDeploymentName.Name, Message: "waiting for quota: " + err.Error()})
+				continue
+			}
 			if err != nil {
 				return reconcile.Result{}, fmt.Errorf("couldn't create deployment for url %s: %w", url, err)
 			} else {
-				log.Info("updated deployment", "name", prometheusDeployment.Name, "url", url)
+				log.Info("created deployment", "name", desiredPrometheusDeployment.Name, "url", url)
+				o.recorder.Eventf(cluster, corev1.EventTypeNormal, eventPrometheusCreated, "created replica %s for %s", desiredPrometheusDeployment.Name, url)
+			}
+			// The deployment records the claim first, so the pod is never
+			// left serving without an owner.
+			if poolPod != nil {
+				if err := o.claimPoolPod(poolPod, cluster, job, desiredPrometheusDeployment, prometheusConfig); err != nil {
+					log.Error(err, "couldn't claim pool pod", "url", url)
+				} else {
+					log.Info("claimed pool pod", "pod", poolPod.Name, "url", url)
+					claimedPod = poolPod
+				}
+			}
+			prometheusDeployment = desiredPrometheusDeployment
+		}
+		if storage != nil {
+			if err := o.ensureStorageClaim(prometheusDeployment, storage); err != nil {
+				return reconcile.Result{}, err
 			}
 		}
+		if err := o.ensurePrometheusConfig(prometheusDeployment, prometheusConfig); err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := o.labelStoreExclusion(cluster, prometheusDeployment, claimedPod, excluded); err != nil {
+			return reconcile.Result{}, err
+		}
+		prometheusURL, err := o.ensurePrometheusExposure(prometheusDeployment, job, claimedPod, sharedExposePrometheus(referencing))
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		available := hasPrometheusDeployment && prometheusDeployment.Status.AvailableReplicas > 0
+		if claimedPod != nil {
+			available = isPodReady(claimedPod)
+		}
+		unhealthy := false
+		var failure api.FailureReason
+		var failureMessage string
+		switch {
+		case available && excluded:
+			failed++
+		case available:
+			readyJobs[url] = job
+			previousSmokeTest := previousJobs[url].SmokeTest
+			unhealthy = previousSmokeTest != nil && !previousSmokeTest.Succeeded
+		case claimedPod != nil || poolPod != nil:
+			restoring++
+		case *desiredPrometheusDeployment.Spec.Replicas == 0:
+		case !hasPrometheusDeployment:
+			restoring++
+		default:
+			failure, failureMessage, err = o.replicaFailure(prometheusDeployment)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if len(failure) > 0 {
+				failed++
+				unhealthy = true
+				break
+			}
+			isRestoring, err := o.isRestoring(prometheusDeployment)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if isRestoring {
+				restoring++
+			} else {
+				unavailable++
+				unhealthy = true
+			}
+		}
+
+		jobStatus := previousJobs[url]
+		jobStatus.URL = url
+		jobStatus.Message = ""
+		if jobStatus.Deployment != prometheusDeploymentName.Name {
+			jobStatus.Deployment = prometheusDeploymentName.Name
+			jobStatus.SmokeTest = nil
+			jobStatus.UnhealthySince = nil
+		}
+		_, jobStatus.Ready = readyJobs[url]
+		jobStatus.Excluded = excluded
+		jobStatus.ArtifactExpirationTime = o.artifactExpiration(job)
+		jobStatus.PrometheusURL = prometheusURL
+		if hasPrometheusDeployment {
+			digest, err := o.replicaDigest(prometheusDeployment, claimedPod)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if len(digest) > 0 {
+				jobStatus.SHA256 = digest
+			}
+		}
+		updateUnhealthySince(&jobStatus, unhealthy, now)
+		jobStatus.Reason = failure
+		if len(failure) > 0 {
+			jobStatus.Message = failureMessage
+		}
+		if excluded {
+			jobStatus.Message = "excluded from the query view: " + exclusionReason
+		}
+		switch {
+		case paused:
+			jobStatus.Message = "paused"
+		case sourcePaused(cluster, url):
+			jobStatus.Message = "paused, but kept running for the other clusters sharing it"
+		}
+		if _, isReady := readyJobs[url]; !isReady {
+			// A replica coming back (rescheduled, scaled up) starts from an
+			// empty volume and has to pass again.
+			jobStatus.SmokeTest = nil
+		}
+		jobStatus.Replay = ""
+		if cluster.Spec.RemoteWrite != nil {
+			replayJobName := o.replayJobName("replay", cluster, prometheusDeploymentName.Name)
+			jobStatus.Replay, err = o.ensureReplay(replayJobName, cluster, job, prometheusDeploymentName.Name, remoteWriteEndpoint(cluster))
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+		jobStatuses = append(jobStatuses, jobStatus)
+	}
+	*processing = ""
+	for i := range jobStatuses {
+		url := jobStatuses[i].URL
+		jobStatuses[i].DisplayName = sourceDisplayName(cluster, url)
+		jobStatuses[i].Resolver = resolverName(url)
+		jobStatuses[i].Annotation = previousJobs[url].Annotation
+		o.recordSourceFailure(cluster, previousJobs[url], jobStatuses[i])
+		if job, fetched := fetchedJobs[url]; fetched {
+			jobStatuses[i].Source = sourceLabel(job)
+			if jobStatuses[i].Annotation == 0 {
+				jobStatuses[i].Annotation = o.annotateRun(cluster, job)
+			}
+		}
+		delete(previousJobs, url)
+	}
+	for _, removed := range previousJobs {
+		o.deleteAnnotation(removed.Annotation)
+	}
+	cluster.Status.Jobs = jobStatuses
+	updateFailureReasons(cluster)
+	cluster.Status.RequestedJobs = int32(len(cluster.Status.URLs))
+	cluster.Status.ReadyJobs = 0
+	for _, job := range jobStatuses {
+		if job.Ready {
+			cluster.Status.ReadyJobs++
+		}
+	}
+	o.updateStorageCondition(cluster, insufficientStorage)
+	o.updateQuotaCondition(cluster, quotaErrors)
+	o.updateQuarantineCondition(cluster, quarantined)
+	cluster.Status.ConfigError = strings.Join(configErrors, "; ")
+
+	if err := o.releaseRemovedJobs(cluster, previousJobs); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := o.ensureBucketWeb(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := o.ensureCompactor(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := o.ensureRemoteRead(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+	gatewayAvailable, err := o.ensureStoreGateway(cluster)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if hasStoreGateway(cluster) && !gatewayAvailable {
+		unavailable++
+	}
+
+	var queryServiceName string
+	var queryAvailable bool
+	if cluster.Spec.Backend == api.BackendVictoriaMetrics {
+		queryServiceName, queryAvailable, err = o.ensureVictoriaMetrics(cluster)
+	} else {
+		queryServiceName, queryAvailable, err = o.ensureThanosQuery(cluster)
+		if err == nil {
+			queryServiceName, queryAvailable, err = o.ensureQueryFrontend(cluster, queryServiceName, queryAvailable)
+		}
+	}
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
+	cluster.Status.QueryURL, err = o.ensureQueryExposure(cluster, queryServiceName)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	o.ensureDashboard(cluster)
+	cluster.Status.GrafanaURL, err = o.ensureGrafana(cluster, queryServiceName)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	cluster.Status.GrafanaKeySecret, err = o.ensureGrafanaKey(cluster)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if hasGrafana(cluster) && len(cluster.Status.GrafanaKeySecret) == 0 {
+		// Nothing watches the Grafana coming up.
+		requeueAt(&result, now, now.Add(o.StatusRefreshInterval))
+	}
+
+	if !queryAvailable {
+		unavailable++
+	} else if cluster.Spec.Backend != api.BackendVictoriaMetrics {
+		failed += o.smokeTestJobs(cluster, readyJobs)
+	}
+	notifications := updatePhase(cluster, failed, unavailable, restoring)
+	if n := o.updateArtifactsExpiring(cluster, now); n != nil {
+		notifications = append(notifications, *n)
+	}
+	requeueAt(&result, now, nextArtifactWarning(cluster, o.ArtifactExpiryWarning, now))
+	if err := o.verifyBucket(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := o.updateFootprint(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+	updateJobCounts(cluster)
+	if err := o.recordHistory(cluster, now); err != nil {
+		return reconcile.Result{}, err
+	}
+	if cluster.Status.Phase != api.PhaseReady {
+		requeueAt(&result, now, now.Add(o.StatusRefreshInterval))
+	}
+
+	if !equality.Semantic.DeepEqual(*originalStatus, cluster.Status) {
+		err := o.client.Status().Update(context.TODO(), cluster)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("couldn't update metricscluster status: %w", err)
+		}
+	}
+	for _, n := range notifications {
+		o.notify(n)
+		o.recordPhaseChange(cluster, n)
+	}
+
+	return result, nil
+}
+
+// ensureThanosQuery creates the cluster's store service and Thanos query, and
+// returns the query service and whether query is available.
+func (o *Operator) ensureThanosQuery(cluster *api.MetricsCluster) (string, bool, error) {
 	storeService := &corev1.Service{}
 	storeServiceName := o.thanosStoreServiceName(cluster)
 	hasStoreService := true
-	err = o.client.Get(context.TODO(), storeServiceName, storeService)
+	err := o.client.Get(context.TODO(), storeServiceName, storeService)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			hasStoreService = false
 		} else {
-			return reconcile.Result{}, fmt.Errorf("couldn't fetch service: %w", err)
+			return "", false, fmt.Errorf("couldn't fetch service: %w", err)
 		}
 	}
 	if !hasStoreService {
 		storeService = o.thanosStoreServiceManifest(cluster)
 		err = o.client.Create(context.TODO(), storeService)
 		if err != nil {
-			return reconcile.Result{}, fmt.Errorf("couldn't create service: %w", err)
+			return "", false, fmt.Errorf("couldn't create service: %w", err)
 		} else {
-			log.Info("created service", "name", storeService.Name)
+			o.log.Info("created service", "name", storeService.Name)
+		}
+	} else if selector := o.storeSelector(cluster); !equality.Semantic.DeepEqual(storeService.Spec.Selector, selector) {
+		// Stores are gated on their readiness, or not, as the operator's
+		// flags change.
+		storeService.Spec.Selector = selector
+		if err := o.client.Update(context.TODO(), storeService); err != nil {
+			return "", false, fmt.Errorf("couldn't update service: %w", err)
 		}
+		o.log.Info("updated service", "name", storeService.Name)
 	}
 
 	queryDeployment := &appsv1.Deployment{}
@@ -315,17 +1513,38 @@ func (o *Operator) reconcileMetricsCluster(request reconcile.Request) (reconcile
 		if errors.IsNotFound(err) {
 			hasQueryDeployment = false
 		} else {
-			return reconcile.Result{}, fmt.Errorf("couldn't fetch deployment: %w", err)
+			return "", false, fmt.Errorf("couldn't fetch deployment: %w", err)
 		}
 	}
+	desiredQueryDeployment := o.thanosQueryDeploymentManifest(cluster)
+	if hasQueryDeployment && hasQueryAutoscaling(cluster) {
+		// The autoscaler owns the replica count.
+		desiredQueryDeployment.Spec.Replicas = queryDeployment.Spec.Replicas
+	}
 	if !hasQueryDeployment {
-		queryDeployment = o.thanosQueryDeploymentManifest(cluster)
+		queryDeployment = desiredQueryDeployment
 		err = o.client.Create(context.TODO(), queryDeployment)
 		if err != nil {
-			return reconcile.Result{}, fmt.Errorf("couldn't create deployment: %w", err)
+			return "", false, fmt.Errorf("couldn't create deployment: %w", err)
 		} else {
-			log.Info("created deployment", "name", queryDeployment.Name)
+			o.log.Info("created deployment", "name", queryDeployment.Name)
+			o.recorder.Eventf(cluster, corev1.EventTypeNormal, eventQueryCreated, "created query %s", queryDeployment.Name)
+		}
+	} else if queryDeployment.Spec.Replicas == nil || *queryDeployment.Spec.Replicas != *desiredQueryDeployment.Spec.Replicas ||
+		!equality.Semantic.DeepEqual(queryDeployment.Spec.Template.Spec.Containers[0].Command, desiredQueryDeployment.Spec.Template.Spec.Containers[0].Command) ||
+		!equality.Semantic.DeepEqual(queryDeployment.Spec.Template.Spec.Containers[0].Resources, desiredQueryDeployment.Spec.Template.Spec.Containers[0].Resources) {
+		// The query's stores change as the cluster gains or loses its store
+		// gateway.
+		queryDeployment.Spec.Replicas = desiredQueryDeployment.Spec.Replicas
+		queryDeployment.Spec.Template.Spec.Containers[0].Command = desiredQueryDeployment.Spec.Template.Spec.Containers[0].Command
+		queryDeployment.Spec.Template.Spec.Containers[0].Resources = desiredQueryDeployment.Spec.Template.Spec.Containers[0].Resources
+		if err := o.client.Update(context.TODO(), queryDeployment); err != nil {
+			return "", false, fmt.Errorf("couldn't update deployment: %w", err)
 		}
+		o.log.Info("updated deployment", "name", queryDeployment.Name, "replicas", *queryDeployment.Spec.Replicas)
+	}
+	if err := o.ensureQueryAutoscaler(cluster); err != nil {
+		return "", false, err
 	}
 
 	queryService := &corev1.Service{}
@@ -336,61 +1555,101 @@ func (o *Operator) reconcileMetricsCluster(request reconcile.Request) (reconcile
 		if errors.IsNotFound(err) {
 			hasQueryService = false
 		} else {
-			return reconcile.Result{}, fmt.Errorf("couldn't fetch service: %w", err)
+			return "", false, fmt.Errorf("couldn't fetch service: %w", err)
 		}
 	}
 	if !hasQueryService {
 		queryService = o.thanosQueryServiceManifest(cluster)
 		err = o.client.Create(context.TODO(), queryService)
 		if err != nil {
-			return reconcile.Result{}, fmt.Errorf("couldn't create service: %w", err)
+			return "", false, fmt.Errorf("couldn't create service: %w", err)
 		} else {
-			log.Info("created service", "name", queryService.Name)
+			o.log.Info("created service", "name", queryService.Name)
 		}
 	}
 
-	queryRoute := &routev1.Route{}
-	queryRouteName := o.thanosQueryRouteName(cluster)
-	hasQueryRoute := true
-	err = o.client.Get(context.TODO(), queryRouteName, queryRoute)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			hasQueryRoute = false
-		} else {
-			return reconcile.Result{}, fmt.Errorf("couldn't fetch route: %w", err)
+	return queryServiceName.Name, queryDeployment.Status.AvailableReplicas > 0, nil
+}
+
+// hasEntries returns whether actual contains every entry of desired.
+func hasEntries(actual, desired map[string]string) bool {
+	for key, value := range desired {
+		if current, ok := actual[key]; !ok || current != value {
+			return false
 		}
 	}
-	if !hasQueryRoute {
-		queryRoute = o.thanosQueryRouteManifest(cluster)
-		err = o.client.Create(context.TODO(), queryRoute)
-		if err != nil {
-			return reconcile.Result{}, fmt.Errorf("couldn't create route: %w", err)
-		} else {
-			log.Info("created route", "name", queryRoute.Name)
-		}
+	return true
+}
+
+// mergeEntries sets the entries of desired on actual, keeping entries set by
+// others (such as the deployment controller's revision annotation).
+func mergeEntries(actual, desired map[string]string) map[string]string {
+	if actual == nil {
+		actual = map[string]string{}
 	}
+	for key, value := range desired {
+		actual[key] = value
+	}
+	return actual
+}
 
-	return reconcile.Result{}, nil
+// requeueAt shortens the result's requeue interval so that reconciliation
+// happens again no later than t. A zero t leaves the result unchanged.
+func requeueAt(result *reconcile.Result, now time.Time, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	after := t.Sub(now)
+	if after <= 0 {
+		after = time.Second
+	}
+	if result.RequeueAfter == 0 || after < result.RequeueAfter {
+		result.RequeueAfter = after
+	}
 }
 
 func (o *Operator) prometheusDeploymentName(job *Job) types.NamespacedName {
-	hash := sha256.Sum256([]byte(job.Status.URL))
+	// Instances sharing the namespace have replicas of their own, even of
+	// the same sources.
+	key := job.Status.URL
+	if len(o.Instance) > 0 {
+		key = o.Instance + "/" + key
+	}
+	hash := sha256.Sum256([]byte(key))
 	name := fmt.Sprintf("prometheus-%x", hash[:6])
 	return types.NamespacedName{Namespace: o.Namespace, Name: name}
 }
 
-func (o *Operator) prometheusDeploymentManifest(job *Job) *appsv1.Deployment {
+// configureReplica applies the settings of the clusters referencing a replica
+// to its deployment, returning the storage and Prometheus features they
+// settle on.
+func (o *Operator) configureReplica(deployment *appsv1.Deployment, referencing []*api.MetricsCluster) (*api.StorageSpec, []string) {
+	applySidecarResources(deployment, referencing)
+	applyPrometheusResources(&deployment.Spec.Template.Spec, referencing)
+	o.applyPrometheusImage(&deployment.Spec.Template.Spec, referencing)
+	applyReplicaArchive(deployment, referencing)
+	o.applyTracing(&deployment.Spec.Template.Spec, "thanos-sidecar", "thanos-sidecar")
+	storage := sharedStorage(referencing)
+	if storage != nil {
+		applyPersistentStorage(deployment)
+	}
+	features := prometheusFeatures(referencing)
+	enablePrometheusFeatures(&deployment.Spec.Template.Spec, features)
+	return storage, features
+}
+
+func (o *Operator) prometheusDeploymentManifest(cluster *api.MetricsCluster, job *Job) *appsv1.Deployment {
 	name := o.prometheusDeploymentName(job)
-	sharePIDNamespace := true
 	var replicas int32 = 1
 
-	return &appsv1.Deployment{
+	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: name.Namespace,
 			Name:      name.Name,
 			Labels: map[string]string{
 				"app": "prometheus",
 			},
+			OwnerReferences: []metav1.OwnerReference{referenceOwner(cluster)},
 			Annotations: map[string]string{
 				"url":       job.Status.URL,
 				"started":   job.Status.StartTime.UTC().Format(time.RFC3339),
@@ -417,138 +1676,189 @@ func (o *Operator) prometheusDeploymentManifest(job *Job) *appsv1.Deployment {
 						"completed": job.Status.CompletionTime.UTC().Format(time.RFC3339),
 					},
 				},
-				Spec: corev1.PodSpec{
-					ShareProcessNamespace: &sharePIDNamespace,
-					Volumes: []corev1.Volume{
-						{
-							Name: "prometheus-storage-volume",
-							VolumeSource: corev1.VolumeSource{
-								EmptyDir: &corev1.EmptyDirVolumeSource{},
-							},
-						},
+				Spec: o.prometheusPodSpec(job.PrometheusImage, deploymentInitScript(), []corev1.EnvVar{
+					{
+						Name:  "PROMTAR",
+						Value: job.PrometheusTarURL,
 					},
-					InitContainers: []corev1.Container{
-						{
-							Name:       "setup",
-							Image:      o.FetcherImage,
-							Command:    []string{"/bin/bash", "-c", deploymentInitScript()},
-							WorkingDir: "/prometheus/",
-							Env: []corev1.EnvVar{
-								{
-									Name:  "PROMTAR",
-									Value: job.PrometheusTarURL,
-								},
-								{
-									Name:  "DEPLOYMENT_NAME",
-									Value: name.Name,
-								},
-								{
-									Name:  "PROW_URL",
-									Value: job.Status.URL,
-								},
-								{
-									Name:  "PROW_JOB",
-									Value: job.Spec.Job,
-								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "prometheus-storage-volume",
-									MountPath: "/prometheus/",
-								},
-							},
+				}, corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: o.prometheusConfigMapName(name.Name).Name,
 						},
 					},
-					Containers: []corev1.Container{
-						{
-							Name: "prometheus",
-							Command: []string{
-								"/bin/prometheus",
-								"--storage.tsdb.max-block-duration=2h",
-								"--storage.tsdb.min-block-duration=2h",
-								"--web.enable-lifecycle",
-								"--storage.tsdb.path=/prometheus",
-								"--config.file=/prometheus/prometheus.yml",
-							},
-							Image: o.PrometheusImage,
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "webui",
-									Protocol:      corev1.ProtocolTCP,
-									ContainerPort: 9090,
-								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "prometheus-storage-volume",
-									MountPath: "/prometheus/",
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									"cpu":    resource.MustParse("100m"),
-									"memory": resource.MustParse(o.PrometheusMemory),
-								},
-							},
-							ReadinessProbe: &corev1.Probe{
-								TimeoutSeconds:   1,
-								PeriodSeconds:    10,
-								SuccessThreshold: 1,
-								FailureThreshold: 3,
-								Handler: corev1.Handler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path:   "/",
-										Port:   intstr.FromInt(9090),
-										Scheme: "HTTP",
-									},
-								},
-							},
-						},
-						{
-							Name: "thanos-sidecar",
-							Command: []string{
-								"/bin/thanos",
-								"sidecar",
-								"--tsdb.path=/prometheus",
-								"--prometheus.url=http://localhost:9090",
-								"--shipper.upload-compacted",
-							},
-							Image: o.ThanosImage,
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "prometheus-storage-volume",
-									MountPath: "/prometheus/",
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									//"cpu":    resource.MustParse("100m"),
-									//"memory": resource.MustParse("500Mi"),
-								},
-							},
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "webui",
-									Protocol:      corev1.ProtocolTCP,
-									ContainerPort: 9090,
-								},
-							},
-							ReadinessProbe: &corev1.Probe{
-								TimeoutSeconds:   1,
-								PeriodSeconds:    10,
-								SuccessThreshold: 1,
-								FailureThreshold: 3,
-								Handler: corev1.Handler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path:   "/",
-										Port:   intstr.FromInt(9090),
-										Scheme: "HTTP",
-									},
-								},
-							},
-						},
+				}),
+			},
+		},
+	}
+
+	if job.ExtractedSize > 0 {
+		requestStorage(&deployment.Spec.Template.Spec, job.ExtractedSize)
+	}
+	if cluster.Spec.Schedule == api.ScheduleSpot {
+		o.applySpotProfile(deployment)
+	}
+	o.addJobArtifacts(deployment, job)
+
+	return deployment
+}
+
+// prometheusPodSpec returns the spec of a Prometheus replica pod running the
+// Prometheus image, whose init container runs initScript with the given
+// environment to fetch its data. Prometheus reads its configuration from the
+// config volume.
+func (o *Operator) prometheusPodSpec(image string, initScript string, env []corev1.EnvVar, config corev1.VolumeSource) corev1.PodSpec {
+	sharePIDNamespace := true
+	podSpec := corev1.PodSpec{
+		ShareProcessNamespace: &sharePIDNamespace,
+		Volumes: []corev1.Volume{
+			{
+				Name: "prometheus-storage-volume",
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			},
+			{
+				Name:         "prometheus-config",
+				VolumeSource: config,
+			},
+		},
+		InitContainers: []corev1.Container{
+			{
+				Name:       "setup",
+				Image:      o.FetcherImage,
+				Command:    []string{"/bin/bash", "-c", initScript},
+				WorkingDir: "/prometheus/",
+				Env:        env,
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      "prometheus-storage-volume",
+						MountPath: "/prometheus/",
+					},
+				},
+			},
+		},
+		Containers: []corev1.Container{
+			{
+				Name: "prometheus",
+				Command: []string{
+					"/bin/prometheus",
+					"--storage.tsdb.max-block-duration=2h",
+					"--storage.tsdb.min-block-duration=2h",
+					"--web.enable-lifecycle",
+					"--storage.tsdb.path=/prometheus",
+					"--config.file=/etc/prometheus/" + prometheusConfigKey,
+				},
+				Image: image,
+				Ports: []corev1.ContainerPort{
+					{
+						Name:          "webui",
+						Protocol:      corev1.ProtocolTCP,
+						ContainerPort: 9090,
+					},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      "prometheus-storage-volume",
+						MountPath: "/prometheus/",
+					},
+					{
+						Name:      "prometheus-config",
+						MountPath: "/etc/prometheus/",
+						ReadOnly:  true,
+					},
+				},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						"cpu":    resource.MustParse("100m"),
+						"memory": resource.MustParse(o.PrometheusMemory),
+					},
+				},
+				ReadinessProbe: readinessProbe("/-/ready", 9090),
+				LivenessProbe:  livenessProbe("/-/healthy", 9090),
+			},
+			{
+				Name: "thanos-sidecar",
+				Command: []string{
+					"/bin/thanos",
+					"sidecar",
+					"--tsdb.path=/prometheus",
+					"--prometheus.url=http://localhost:9090",
+					"--shipper.upload-compacted",
+					// Reload Prometheus through its lifecycle endpoint when
+					// the generated configuration changes, rather than
+					// recreating the pod and fetching the data again.
+					"--reloader.config-file=/etc/prometheus/" + prometheusConfigKey,
+					"--reloader.rule-dir=/etc/prometheus/",
+					"--prometheus.ready_timeout=" + o.SidecarReadyTimeout.String(),
+				},
+				Image: o.ThanosImage,
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      "prometheus-storage-volume",
+						MountPath: "/prometheus/",
+					},
+					{
+						Name:      "prometheus-config",
+						MountPath: "/etc/prometheus/",
+						ReadOnly:  true,
 					},
 				},
+				Resources: *o.sidecarResources.DeepCopy(),
+				Ports: []corev1.ContainerPort{
+					{
+						Name:          "grpc",
+						Protocol:      corev1.ProtocolTCP,
+						ContainerPort: 10901,
+					},
+					{
+						Name:          "http",
+						Protocol:      corev1.ProtocolTCP,
+						ContainerPort: 10902,
+					},
+				},
+				ReadinessProbe: readinessProbe("/-/ready", 10902),
+				LivenessProbe:  livenessProbe("/-/healthy", 10902),
+			},
+		},
+	}
+	o.applyArtifactCache(&podSpec)
+	o.applyFetchBandwidth(&podSpec)
+	o.applyWALTrimming(&podSpec)
+	o.hardenPodSpec(&podSpec)
+	return podSpec
+}
+
+// readinessProbe checks an HTTP endpoint of a container.
+func readinessProbe(path string, port int) *corev1.Probe {
+	return &corev1.Probe{
+		TimeoutSeconds:   1,
+		PeriodSeconds:    10,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   path,
+				Port:   intstr.FromInt(port),
+				Scheme: "HTTP",
+			},
+		},
+	}
+}
+
+// livenessProbe restarts a container whose HTTP endpoint stops responding.
+// It's lenient, as restarting Prometheus means replaying its WAL.
+func livenessProbe(path string, port int) *corev1.Probe {
+	return &corev1.Probe{
+		TimeoutSeconds:   5,
+		PeriodSeconds:    30,
+		SuccessThreshold: 1,
+		FailureThreshold: 5,
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   path,
+				Port:   intstr.FromInt(port),
+				Scheme: "HTTP",
 			},
 		},
 	}
@@ -563,8 +1873,9 @@ func (o *Operator) thanosStoreServiceManifest(cluster *api.MetricsCluster) *core
 	name := o.thanosStoreServiceName(cluster)
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: name.Namespace,
-			Name:      name.Name,
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
 		},
 		Spec: corev1.ServiceSpec{
 			ClusterIP: corev1.ClusterIPNone,
@@ -580,10 +1891,7 @@ func (o *Operator) thanosStoreServiceManifest(cluster *api.MetricsCluster) *core
 					Protocol: corev1.ProtocolTCP,
 				},
 			},
-			Selector: map[string]string{
-				"app":        "prometheus",
-				cluster.Name: "true",
-			},
+			Selector: o.storeSelector(cluster),
 		},
 	}
 }
@@ -596,14 +1904,15 @@ func (o *Operator) thanosQueryDeploymentName(cluster *api.MetricsCluster) types.
 func (o *Operator) thanosQueryDeploymentManifest(cluster *api.MetricsCluster) *appsv1.Deployment {
 	name := o.thanosQueryDeploymentName(cluster)
 	storeServiceName := o.thanosStoreServiceName(cluster)
-	var replicas int32 = 1
-	return &appsv1.Deployment{
+	replicas := queryReplicas(cluster)
+	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: name.Namespace,
 			Name:      name.Name,
 			Labels: map[string]string{
 				"app": "thanos-query",
 			},
+			OwnerReferences: clusterOwner(cluster),
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &replicas,
@@ -624,13 +1933,13 @@ func (o *Operator) thanosQueryDeploymentManifest(cluster *api.MetricsCluster) *a
 					Containers: []corev1.Container{
 						{
 							Name:  "query",
-							Image: o.ThanosImage,
+							Image: o.thanosQueryImage(cluster),
 							Command: []string{
 								"/bin/thanos",
 								"query",
 								"--http-address=0.0.0.0:19192",
 								"--store.sd-dns-interval=10s",
-								fmt.Sprintf("--store=dnssrv+_grpc._tcp.%s.%s.svc", storeServiceName.Name, storeServiceName.Namespace),
+								o.thanosStoreFlag(fmt.Sprintf("dnssrv+_grpc._tcp.%s.%s.svc", storeServiceName.Name, storeServiceName.Namespace)),
 							},
 							Ports: []corev1.ContainerPort{
 								{
@@ -645,25 +1954,24 @@ func (o *Operator) thanosQueryDeploymentManifest(cluster *api.MetricsCluster) *a
 									//"memory": resource.MustParse("500Mi"),
 								},
 							},
-							ReadinessProbe: &corev1.Probe{
-								TimeoutSeconds:   1,
-								PeriodSeconds:    10,
-								SuccessThreshold: 1,
-								FailureThreshold: 3,
-								Handler: corev1.Handler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path:   "/",
-										Port:   intstr.FromInt(19192),
-										Scheme: "HTTP",
-									},
-								},
-							},
+							ReadinessProbe: readinessProbe("/-/ready", 19192),
+							LivenessProbe:  livenessProbe("/-/healthy", 19192),
 						},
 					},
 				},
 			},
 		},
 	}
+	query := &deployment.Spec.Template.Spec.Containers[0]
+	if hasStoreGateway(cluster) {
+		gatewayName := o.storeGatewayName(cluster)
+		query.Command = append(query.Command, o.thanosStoreFlag(fmt.Sprintf("dnssrv+_grpc._tcp.%s.%s.svc", gatewayName.Name, gatewayName.Namespace)))
+	}
+	query.Command = append(query.Command, queryReplicaLabelFlags(cluster)...)
+	applyThanosResources(&deployment.Spec.Template.Spec, cluster)
+	o.applyTracing(&deployment.Spec.Template.Spec, "query", "thanos-query")
+	o.hardenPodSpec(&deployment.Spec.Template.Spec)
+	return deployment
 }
 
 func (o *Operator) thanosQueryServiceName(cluster *api.MetricsCluster) types.NamespacedName {
@@ -675,8 +1983,9 @@ func (o *Operator) thanosQueryServiceManifest(cluster *api.MetricsCluster) *core
 	name := o.thanosQueryServiceName(cluster)
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: name.Namespace,
-			Name:      name.Name,
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
 		},
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
@@ -704,57 +2013,26 @@ func (o *Operator) thanosQueryRouteName(cluster *api.MetricsCluster) types.Names
 	return types.NamespacedName{Namespace: o.Namespace, Name: name}
 }
 
-func (o *Operator) thanosQueryRouteManifest(cluster *api.MetricsCluster) *routev1.Route {
-	name := o.thanosQueryRouteName(cluster)
-	queryServiceName := o.thanosQueryServiceName(cluster)
-	return &routev1.Route{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: name.Namespace,
-			Name:      name.Name,
-		},
-		Spec: routev1.RouteSpec{
-			To: routev1.RouteTargetReference{
-				Kind: "Service",
-				Name: queryServiceName.Name,
-			},
-			Port: &routev1.RoutePort{
-				TargetPort: intstr.FromString("http"),
-			},
-			TLS: &routev1.TLSConfig{
-				Termination:                   routev1.TLSTerminationEdge,
-				InsecureEdgeTerminationPolicy: routev1.InsecureEdgeTerminationPolicyRedirect,
-			},
-		},
-	}
-}
-
+// deploymentInitScript is the script of setup containers, which load the
+// source's data with the fetcher.
 func deploymentInitScript() string {
-	return `set -uxo pipefail
-umask 0000
-curl -sL ${PROMTAR} | tar xvz -m
-chown -R 65534:65534 /prometheus
-
-cat >/prometheus/prometheus.yml <<EOL
-# my global config
-global:
-  external_labels:
-    cluster_name: '${DEPLOYMENT_NAME}'
-    cluster_url: '${PROW_URL}'
-    cluster_job: '${PROW_JOB}'
-
-scrape_configs:
-  - job_name: 'prometheus'
-    static_configs:
-    - targets: ['localhost:9090']
-EOL
+	return `set -uo pipefail
+# A failed fetch fails the init container so the kubelet retries it rather
+# than starting Prometheus on an empty TSDB.
+dowser fetcher || exit 1
 `
 }
 
-var storagePattern = regexp.MustCompile(`.*/(origin-ci-test/.*)`)
 var prometheusURLs map[string]string
 var prometheusLock sync.Mutex
 
-func findPrometheusTarURL(jobURL string, gcsPrefix string) (string, error) {
+// findPrometheusTarURL returns the URL of the Prometheus tarball archived by
+// the job, which may also be given as the tarball's URL itself. Tarballs are
+// looked up once per job.
+func (o *Operator) findPrometheusTarURL(jobURL string, job prowapi.ProwJob) (string, error) {
+	if strings.HasSuffix(jobURL, "metrics/prometheus.tar") {
+		return jobURL, nil
+	}
 	prometheusLock.Lock()
 	defer prometheusLock.Unlock()
 	if prometheusURLs == nil {
@@ -763,7 +2041,13 @@ func findPrometheusTarURL(jobURL string, gcsPrefix string) (string, error) {
 	if prometheusURL, found := prometheusURLs[jobURL]; found {
 		return prometheusURL, nil
 	}
-	tarURL, err := getTarURLFromProw(jobURL, gcsPrefix)
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	patterns, err := o.artifactPaths(job)
+	if err != nil {
+		return "", err
+	}
+	tarURL, err := prow.FindPrometheusTar(ctx, o.storageOpener, jobURL, patterns)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,209 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Resources serving a single cluster are controlled by it, so the garbage
+// collector removes them along with the cluster. Replicas may be shared, so
+// their deployments instead have an owner reference for each cluster
+// referencing them: the garbage collector deletes a deployment once all of
+// its clusters are gone, and otherwise only drops the references of those
+// which are. The deployment controller follows by removing the labels of
+// clusters which no longer own a deployment, and deletes deployments left
+// without owners when sources are removed.
+
+// clusterOwner returns the owner references of a resource controlled by the
+// cluster.
+func clusterOwner(cluster *api.MetricsCluster) []metav1.OwnerReference {
+	isController := true
+	return []metav1.OwnerReference{
+		{
+			APIVersion: api.GroupVersion.String(),
+			Kind:       "MetricsCluster",
+			Name:       cluster.Name,
+			UID:        cluster.UID,
+			Controller: &isController,
+		},
+	}
+}
+
+// referenceOwner returns the owner reference of a cluster on a replica's
+// deployment it shares with other clusters.
+func referenceOwner(cluster *api.MetricsCluster) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: api.GroupVersion.String(),
+		Kind:       "MetricsCluster",
+		Name:       cluster.Name,
+		UID:        cluster.UID,
+	}
+}
+
+// isClusterReference returns whether the owner reference is to a cluster.
+func isClusterReference(owner metav1.OwnerReference) bool {
+	return owner.APIVersion == api.GroupVersion.String() && owner.Kind == "MetricsCluster"
+}
+
+// ownerClusters returns the names of the clusters owning the object.
+func ownerClusters(object metav1.Object) map[string]bool {
+	owners := map[string]bool{}
+	for _, owner := range object.GetOwnerReferences() {
+		if isClusterReference(owner) {
+			owners[owner.Name] = true
+		}
+	}
+	return owners
+}
+
+// isOwnedBy returns whether the cluster is one of the object's owners.
+func isOwnedBy(object metav1.Object, cluster *api.MetricsCluster) bool {
+	for _, owner := range object.GetOwnerReferences() {
+		if isClusterReference(owner) && owner.UID == cluster.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// addOwner adds the cluster's reference to the object's owners.
+func addOwner(object metav1.Object, cluster *api.MetricsCluster) {
+	if isOwnedBy(object, cluster) {
+		return
+	}
+	object.SetOwnerReferences(append(object.GetOwnerReferences(), referenceOwner(cluster)))
+}
+
+// removeOwner removes the named cluster from the object's owners, and returns
+// whether it was one.
+func removeOwner(object metav1.Object, clusterName string) bool {
+	var owners []metav1.OwnerReference
+	removed := false
+	for _, owner := range object.GetOwnerReferences() {
+		if isClusterReference(owner) && owner.Name == clusterName {
+			removed = true
+			continue
+		}
+		owners = append(owners, owner)
+	}
+	object.SetOwnerReferences(owners)
+	return removed
+}
+
+// ownedResource is a resource controlled by a cluster.
+type ownedResource struct {
+	kind   string
+	name   types.NamespacedName
+	object runtime.Object
+}
+
+// clusterResources returns the resources the cluster may control, other than
+// its Jobs.
+func (o *Operator) clusterResources(cluster *api.MetricsCluster) []ownedResource {
+	resources := []ownedResource{
+		{"store service", o.thanosStoreServiceName(cluster), &corev1.Service{}},
+		{"query deployment", o.thanosQueryDeploymentName(cluster), &appsv1.Deployment{}},
+		{"query service", o.thanosQueryServiceName(cluster), &corev1.Service{}},
+		{"query frontend deployment", o.queryFrontendName(cluster), &appsv1.Deployment{}},
+		{"query frontend service", o.queryFrontendName(cluster), &corev1.Service{}},
+		{"store gateway deployment", o.storeGatewayName(cluster), &appsv1.Deployment{}},
+		{"store gateway service", o.storeGatewayName(cluster), &corev1.Service{}},
+		{"bucket web deployment", o.bucketWebName(cluster), &appsv1.Deployment{}},
+		{"bucket web service", o.bucketWebName(cluster), &corev1.Service{}},
+		{"compactor deployment", o.compactorName(cluster), &appsv1.Deployment{}},
+		{"remote read configmap", o.remoteReadName(cluster), &corev1.ConfigMap{}},
+		{"remote read deployment", o.remoteReadName(cluster), &appsv1.Deployment{}},
+		{"remote read service", o.remoteReadName(cluster), &corev1.Service{}},
+		{"query result cache", o.queryResultsName(cluster), &corev1.ConfigMap{}},
+		{"victoriametrics deployment", o.victoriaMetricsName(cluster), &appsv1.Deployment{}},
+		{"victoriametrics service", o.victoriaMetricsName(cluster), &corev1.Service{}},
+	}
+	if o.exposeMode != exposeNone {
+		resources = append(resources,
+			ownedResource{"query " + o.exposeMode, o.thanosQueryRouteName(cluster), o.newExposure()},
+			ownedResource{"bucket web " + o.exposeMode, o.bucketWebName(cluster), o.newExposure()},
+			ownedResource{"remote read " + o.exposeMode, o.remoteReadName(cluster), o.newExposure()},
+		)
+	}
+	return resources
+}
+
+// adoptionRetryInterval is how often adopting clusters' resources is retried
+// after failing.
+const adoptionRetryInterval = time.Minute
+
+// adoptResources makes clusters the controllers of their resources created
+// before resources were owned, retrying until it succeeds or stop is closed.
+// It runs once at startup: resources created since are owned from the start.
+func (o *Operator) adoptResources(stop <-chan struct{}) error {
+	err := wait.PollImmediateUntil(adoptionRetryInterval, func() (bool, error) {
+		if err := o.adoptAllClusterResources(); err != nil {
+			o.log.Error(err, "couldn't adopt cluster resources")
+			return false, nil
+		}
+		return true, nil
+	}, stop)
+	if err == wait.ErrWaitTimeout {
+		return nil
+	}
+	return err
+}
+
+// adoptAllClusterResources adopts the resources of this instance's clusters.
+func (o *Operator) adoptAllClusterResources() error {
+	clusters := &api.MetricsClusterList{}
+	if err := o.client.List(context.TODO(), clusters, client.InNamespace(o.Namespace)); err != nil {
+		return fmt.Errorf("couldn't list metricsclusters: %w", err)
+	}
+	for i := range clusters.Items {
+		cluster := &clusters.Items[i]
+		if !o.ownsObject(cluster) {
+			continue
+		}
+		if err := o.adoptClusterResources(cluster); err != nil {
+			return fmt.Errorf("couldn't adopt the resources of %s: %w", cluster.Name, err)
+		}
+	}
+	return nil
+}
+
+// adoptClusterResources makes the cluster the controller of its resources
+// which were created before they were owned, so they're garbage collected
+// with it too.
+func (o *Operator) adoptClusterResources(cluster *api.MetricsCluster) error {
+	resources := o.clusterResources(cluster)
+	for _, resource := range resources {
+		if err := o.client.Get(context.TODO(), resource.name, resource.object); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("couldn't fetch %s: %w", resource.kind, err)
+		}
+		object, err := meta.Accessor(resource.object)
+		if err != nil {
+			return err
+		}
+		if metav1.GetControllerOf(object) != nil || !o.ownsObject(object) {
+			continue
+		}
+		object.SetOwnerReferences(append(object.GetOwnerReferences(), clusterOwner(cluster)...))
+		if err := o.client.Update(context.TODO(), resource.object); err != nil {
+			return fmt.Errorf("couldn't adopt %s: %w", resource.kind, err)
+		}
+		o.log.Info("adopted "+resource.kind, "name", resource.name.Name, "cluster", cluster.Name)
+	}
+	return nil
+}
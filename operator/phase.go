@@ -0,0 +1,89 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// updatePhase recomputes the cluster's phase from the number of sources which
+// failed, are unavailable, or are still being (re)created and fetching their
+// data. It returns the notifications due for the transition, which should be
+// sent once the new status is persisted.
+func updatePhase(cluster *api.MetricsCluster, failed, unavailable, restoring int) []notification {
+	previous := cluster.Status.Phase
+	phase := api.PhaseReady
+	switch {
+	case failed > 0:
+		phase = api.PhaseDegraded
+	case unavailable > 0 && (previous == api.PhaseReady || previous == api.PhaseDegraded):
+		phase = api.PhaseDegraded
+	case unavailable > 0 || restoring > 0:
+		phase = api.PhasePending
+	}
+	updatePhaseConditions(cluster, phase, failed, unavailable, restoring)
+	if phase == previous {
+		return nil
+	}
+	cluster.Status.Phase = phase
+
+	var notifications []notification
+	if len(previous) == 0 {
+		notifications = append(notifications, newNotification(cluster.Namespace, cluster.Name, notificationCreated, ""))
+	}
+	switch phase {
+	case api.PhaseReady:
+		notifications = append(notifications, newNotification(cluster.Namespace, cluster.Name, notificationReady, ""))
+	case api.PhaseDegraded:
+		notifications = append(notifications, newNotification(cluster.Namespace, cluster.Name, notificationDegraded, fmt.Sprintf("%d sources failed, %d unavailable", failed, unavailable)))
+	}
+	return notifications
+}
+
+// updatePhaseConditions sets the Available, Progressing and Degraded
+// conditions of a cluster entering phase.
+func updatePhaseConditions(cluster *api.MetricsCluster, phase api.MetricsClusterPhase, failed, unavailable, restoring int) {
+	switch {
+	case phase == api.PhaseReady:
+		setCondition(cluster, api.ConditionAvailable, corev1.ConditionTrue, "AllSourcesReady", fmt.Sprintf("%d sources ready", cluster.Status.ReadyJobs))
+	case phase == api.PhaseDegraded && cluster.Status.ReadyJobs > 0:
+		setCondition(cluster, api.ConditionAvailable, corev1.ConditionTrue, "SomeSourcesReady", fmt.Sprintf("%d of %d sources ready", cluster.Status.ReadyJobs, cluster.Status.RequestedJobs))
+	default:
+		setCondition(cluster, api.ConditionAvailable, corev1.ConditionFalse, string(phase), fmt.Sprintf("%d of %d sources ready", cluster.Status.ReadyJobs, cluster.Status.RequestedJobs))
+	}
+	if restoring > 0 {
+		setCondition(cluster, api.ConditionProgressing, corev1.ConditionTrue, "LoadingSources", fmt.Sprintf("%d sources being loaded", restoring))
+	} else {
+		setCondition(cluster, api.ConditionProgressing, corev1.ConditionFalse, "AsExpected", "")
+	}
+	if phase == api.PhaseDegraded {
+		setCondition(cluster, api.ConditionDegraded, corev1.ConditionTrue, "SourcesFailing", fmt.Sprintf("%d sources failed, %d unavailable", failed, unavailable))
+	} else {
+		setCondition(cluster, api.ConditionDegraded, corev1.ConditionFalse, "AsExpected", "")
+	}
+}
+
+// isRestoring returns whether an unavailable Prometheus deployment is just
+// being brought up, e.g. after a scheduled scale up or a preemption, and its
+// replica hasn't finished fetching its data yet.
+func (o *Operator) isRestoring(deployment *appsv1.Deployment) (bool, error) {
+	pods := &corev1.PodList{}
+	err := o.client.List(context.TODO(), pods, client.InNamespace(deployment.Namespace), client.MatchingLabels(deployment.Spec.Selector.MatchLabels))
+	if err != nil {
+		return false, fmt.Errorf("couldn't list pods: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		return true, nil
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodPending {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,42 @@
+package operator
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestUpdatePhaseConditions(t *testing.T) {
+	tests := []struct {
+		name                             string
+		readyJobs                        int32
+		failed, unavailable, restoring   int
+		phase                            api.MetricsClusterPhase
+		available, progressing, degraded corev1.ConditionStatus
+	}{
+		{name: "loading", restoring: 2, phase: api.PhasePending, available: corev1.ConditionFalse, progressing: corev1.ConditionTrue, degraded: corev1.ConditionFalse},
+		{name: "ready", readyJobs: 2, phase: api.PhaseReady, available: corev1.ConditionTrue, progressing: corev1.ConditionFalse, degraded: corev1.ConditionFalse},
+		{name: "partly failed", readyJobs: 1, failed: 1, phase: api.PhaseDegraded, available: corev1.ConditionTrue, progressing: corev1.ConditionFalse, degraded: corev1.ConditionTrue},
+		{name: "all failed", failed: 2, phase: api.PhaseDegraded, available: corev1.ConditionFalse, progressing: corev1.ConditionFalse, degraded: corev1.ConditionTrue},
+	}
+	for _, test := range tests {
+		cluster := &api.MetricsCluster{}
+		cluster.Status.RequestedJobs = 2
+		cluster.Status.ReadyJobs = test.readyJobs
+		updatePhase(cluster, test.failed, test.unavailable, test.restoring)
+		if cluster.Status.Phase != test.phase {
+			t.Errorf("%s: expected phase %s, got %s", test.name, test.phase, cluster.Status.Phase)
+		}
+		for conditionType, expected := range map[api.ClusterConditionType]corev1.ConditionStatus{
+			api.ConditionAvailable:   test.available,
+			api.ConditionProgressing: test.progressing,
+			api.ConditionDegraded:    test.degraded,
+		} {
+			if condition := findCondition(cluster, conditionType); condition == nil || condition.Status != expected {
+				t.Errorf("%s: expected %s to be %s, got %+v", test.name, conditionType, expected, condition)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package operator
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// pinnedUntil returns when the cluster's pin runs out, or the zero time if the
+// cluster isn't pinned. Pins further out than MaxPinDuration are rejected, so
+// clusters can only be kept around a bounded time at once.
+func (o *Operator) pinnedUntil(cluster *api.MetricsCluster, now time.Time) (time.Time, error) {
+	value, hasPin := cluster.Annotations[api.PinnedUntilAnnotation]
+	if !hasPin {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s annotation: %w", api.PinnedUntilAnnotation, err)
+	}
+	if o.MaxPinDuration > 0 && until.Sub(now) > o.MaxPinDuration {
+		return time.Time{}, fmt.Errorf("pinned until %s, more than %s from now", until.UTC().Format(time.RFC3339), o.MaxPinDuration)
+	}
+	if !until.After(now) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// updatePinnedCondition reports the cluster's pin, returning when it runs out
+// so its condition can be updated then.
+func (o *Operator) updatePinnedCondition(cluster *api.MetricsCluster, now time.Time) time.Time {
+	_, hasPin := cluster.Annotations[api.PinnedUntilAnnotation]
+	if !hasPin {
+		removeCondition(cluster, api.ConditionPinned)
+		return time.Time{}
+	}
+	until, err := o.pinnedUntil(cluster, now)
+	switch {
+	case err != nil:
+		setCondition(cluster, api.ConditionPinned, corev1.ConditionFalse, "InvalidPin", err.Error())
+	case until.IsZero():
+		setCondition(cluster, api.ConditionPinned, corev1.ConditionFalse, "PinExpired",
+			fmt.Sprintf("pin by %s ran out at %s", pinnedBy(cluster), cluster.Annotations[api.PinnedUntilAnnotation]))
+	default:
+		setCondition(cluster, api.ConditionPinned, corev1.ConditionTrue, "Pinned",
+			fmt.Sprintf("pinned by %s until %s", pinnedBy(cluster), until.UTC().Format(time.RFC3339)))
+	}
+	return until
+}
+
+func pinnedBy(cluster *api.MetricsCluster) string {
+	if by := cluster.Annotations[api.PinnedByAnnotation]; len(by) > 0 {
+		return by
+	}
+	return "unknown"
+}
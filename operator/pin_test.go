@@ -0,0 +1,52 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestUpdatePinnedCondition(t *testing.T) {
+	o := &Operator{MaxPinDuration: 7 * 24 * time.Hour}
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		until   string
+		pinned  bool
+		reason  string
+		message string
+	}{
+		{until: "", reason: ""},
+		{until: "2020-06-04T00:00:00Z", pinned: true, reason: "Pinned", message: "pinned by alice until 2020-06-04T00:00:00Z"},
+		{until: "2020-05-31T00:00:00Z", reason: "PinExpired", message: "pin by alice ran out at 2020-05-31T00:00:00Z"},
+		{until: "2020-07-01T00:00:00Z", reason: "InvalidPin", message: "pinned until 2020-07-01T00:00:00Z, more than 168h0m0s from now"},
+		{until: "tomorrow", reason: "InvalidPin"},
+	}
+	for _, test := range tests {
+		cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{api.PinnedByAnnotation: "alice"}}}
+		if len(test.until) > 0 {
+			cluster.Annotations[api.PinnedUntilAnnotation] = test.until
+		}
+		until := o.updatePinnedCondition(cluster, now)
+		if until.IsZero() == test.pinned {
+			t.Errorf("%q: expected pinned %v, got until %v", test.until, test.pinned, until)
+		}
+		if len(test.reason) == 0 {
+			if len(cluster.Status.Conditions) > 0 {
+				t.Errorf("%q: expected no condition, got %+v", test.until, cluster.Status.Conditions)
+			}
+			continue
+		}
+		condition := cluster.Status.Conditions[0]
+		status := corev1.ConditionFalse
+		if test.pinned {
+			status = corev1.ConditionTrue
+		}
+		if condition.Status != status || condition.Reason != test.reason || (len(test.message) > 0 && condition.Message != test.message) {
+			t.Errorf("%q: unexpected condition %+v", test.until, condition)
+		}
+	}
+}
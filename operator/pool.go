@@ -0,0 +1,403 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Warm pool pods are started with an init container that waits for the
+// operator to claim the pod and annotate it with the job to load. Claimed pods
+// leave the pool deployment's selector, so the pool is refilled, and serve in
+// place of their Prometheus deployment, which is held at zero replicas until
+// the claimed pod goes away. The deployment records the claim before the pod
+// is relabelled, so a claimed pod is never left without an owner.
+const (
+	poolPromTarAnnotation = "dowser.dowser/promtar"
+
+	// claimedPodAnnotation on a Prometheus deployment names the pool pod
+	// serving it.
+	claimedPodAnnotation = "dowser.dowser/claimed-pod"
+)
+
+func (o *Operator) poolDeploymentName() types.NamespacedName {
+	name := "prometheus-pool"
+	if len(o.Instance) > 0 {
+		name += "-" + o.Instance
+	}
+	return types.NamespacedName{Namespace: o.Namespace, Name: name}
+}
+
+func (o *Operator) poolDeploymentManifest() *appsv1.Deployment {
+	name := o.poolDeploymentName()
+	replicas := o.WarmPoolSize
+
+	podSpec := o.prometheusPodSpec(o.PrometheusImage, poolInitScript(), nil, corev1.VolumeSource{
+		DownwardAPI: &corev1.DownwardAPIVolumeSource{
+			Items: []corev1.DownwardAPIVolumeFile{
+				{
+					Path:     prometheusConfigKey,
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", prometheusConfigAnnotation)},
+				},
+				{
+					Path:     prometheusRulesKey,
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", prometheusRulesAnnotation)},
+				},
+			},
+		},
+	})
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "podinfo",
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{
+						Path:     "promtar",
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", poolPromTarAnnotation)},
+					},
+				},
+			},
+		},
+	})
+	podSpec.InitContainers[0].VolumeMounts = append(podSpec.InitContainers[0].VolumeMounts,
+		corev1.VolumeMount{
+			Name:      "podinfo",
+			MountPath: "/etc/podinfo/",
+		},
+		corev1.VolumeMount{
+			Name:      "prometheus-config",
+			MountPath: "/etc/prometheus/",
+			ReadOnly:  true,
+		},
+	)
+
+	// The pods of pools of several instances are told apart by their
+	// instance's label, which is also set here so it's part of the desired
+	// spec.
+	podLabels := map[string]string{
+		"app":  "prometheus-pool",
+		"pool": "idle",
+	}
+	if len(o.Instance) > 0 {
+		podLabels[api.InstanceLabel] = o.Instance
+	}
+	selector := map[string]string{}
+	for key, value := range podLabels {
+		selector[key] = value
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: name.Namespace,
+			Name:      name.Name,
+			Labels: map[string]string{
+				"app": "prometheus-pool",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: selector,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: podLabels,
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+}
+
+// ensurePool creates, updates or removes the warm pool deployment, and deletes
+// claimed pods whose deployment no longer records the claim.
+func (o *Operator) ensurePool() error {
+	pool := &appsv1.Deployment{}
+	hasPool := true
+	err := o.client.Get(context.TODO(), o.poolDeploymentName(), pool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			hasPool = false
+		} else {
+			return fmt.Errorf("couldn't fetch pool deployment: %w", err)
+		}
+	}
+	desired := o.poolDeploymentManifest()
+	setTemplateHash(desired)
+	switch {
+	case o.WarmPoolSize <= 0 && hasPool:
+		if err := o.client.Delete(context.TODO(), pool); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete pool deployment: %w", err)
+		}
+		o.log.Info("deleted pool deployment", "name", pool.Name)
+	case o.WarmPoolSize > 0 && !hasPool:
+		if err := o.client.Create(context.TODO(), desired); err != nil {
+			return fmt.Errorf("couldn't create pool deployment: %w", err)
+		}
+		o.log.Info("created pool deployment", "name", desired.Name)
+	case o.WarmPoolSize > 0 && specChanged(pool, desired):
+		pool.Spec = desired.Spec
+		pool.Annotations = mergeEntries(pool.Annotations, desired.Annotations)
+		if err := o.client.Update(context.TODO(), pool); err != nil {
+			return fmt.Errorf("couldn't update pool deployment: %w", err)
+		}
+		o.log.Info("updated pool deployment", "name", pool.Name, "replicas", o.WarmPoolSize)
+	}
+
+	pods := &corev1.PodList{}
+	err = o.client.List(context.TODO(), pods, client.InNamespace(o.Namespace), client.MatchingLabels{"pool": "claimed"})
+	if err != nil {
+		return fmt.Errorf("couldn't list claimed pods: %w", err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		deployment := &appsv1.Deployment{}
+		err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: pod.Namespace, Name: pod.Labels["claimed-by"]}, deployment)
+		if err == nil && deployment.Annotations[claimedPodAnnotation] == pod.Name {
+			continue
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch deployment: %w", err)
+		}
+		if err := o.client.Delete(context.TODO(), pod); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete orphaned claimed pod %s: %w", pod.Name, err)
+		}
+		o.log.Info("deleted orphaned claimed pod", "pod", pod.Name)
+	}
+	return nil
+}
+
+// findPoolPod returns an idle pool pod to claim, or nil if none is scheduled
+// yet. Pods which have pulled their images and are waiting in their init
+// container are preferred.
+func (o *Operator) findPoolPod() (*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	err := o.client.List(context.TODO(), pods, client.InNamespace(o.Namespace), client.MatchingLabels{"app": "prometheus-pool", "pool": "idle"})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list pool pods: %w", err)
+	}
+	var candidate *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || len(pod.Spec.NodeName) == 0 {
+			continue
+		}
+		if isWaitingForClaim(pod) {
+			return pod, nil
+		}
+		if candidate == nil {
+			candidate = pod
+		}
+	}
+	return candidate, nil
+}
+
+// canClaimFromPool returns whether a new replica of the job may be served by
+// a pool pod. Pool pods run on regular nodes with the default image and
+// resources, no storage request and no feature flags, and don't verify
+// digests, so spot clusters, clusters overriding Prometheus's resources or
+// image, with persistent storage or archiving replicas, and sources needing
+// another image, sized storage, artifacts or features, or pinned, don't use
+// them.
+func (o *Operator) canClaimFromPool(cluster *api.MetricsCluster, job *Job, features []string) bool {
+	switch {
+	case o.WarmPoolSize == 0:
+		return false
+	case cluster.Spec.Schedule == api.ScheduleSpot,
+		cluster.Spec.PrometheusResources != nil,
+		len(clusterPrometheusImage(cluster)) > 0,
+		cluster.Spec.Storage != nil,
+		cluster.Spec.ObjectStorage != nil && cluster.Spec.ObjectStorage.ArchiveReplicas:
+		return false
+	case job.PrometheusImage != o.PrometheusImage,
+		job.ExtractedSize > 0,
+		len(job.Artifacts) > 0,
+		len(features) > 0,
+		len(job.SHA256) > 0:
+		return false
+	}
+	return true
+}
+
+// poolPods returns the pool pod serving the existing deployment, if it claimed
+// one and the source isn't scaled down, or the pool pod a deployment about to
+// be created may claim. While either serves the source, the desired
+// deployment is held at zero replicas and records the claim.
+func (o *Operator) poolPods(cluster *api.MetricsCluster, job *Job, features []string, existing, desired *appsv1.Deployment, replicas int32, config map[string]string) (*corev1.Pod, *corev1.Pod, error) {
+	var claimed, pool *corev1.Pod
+	var err error
+	if existing != nil {
+		claimed, err = o.claimedPod(existing)
+		if err != nil {
+			return nil, nil, err
+		}
+		if claimed != nil && *desired.Spec.Replicas == 0 {
+			if err := o.releaseClaimedPod(existing); err != nil {
+				return nil, nil, err
+			}
+			claimed = nil
+		}
+	} else if replicas > 0 && o.canClaimFromPool(cluster, job, features) {
+		pool, err = o.findPoolPod()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	serving := claimed
+	if claimed != nil {
+		if err := o.syncClaimedPod(claimed, cluster, config); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		serving = pool
+	}
+	if serving != nil {
+		var none int32
+		desired.Spec.Replicas = &none
+		desired.Annotations[claimedPodAnnotation] = serving.Name
+	}
+	return claimed, pool, nil
+}
+
+// claimPoolPod hands a pool pod the job to serve for the deployment, which
+// must already record the claim, along with its configuration. The pod is
+// owned by the deployment so it's removed along with it.
+func (o *Operator) claimPoolPod(pod *corev1.Pod, cluster *api.MetricsCluster, job *Job, deployment *appsv1.Deployment, config map[string]string) error {
+	pod.Labels = map[string]string{
+		"app":        "prometheus",
+		"pool":       "claimed",
+		"claimed-by": deployment.Name,
+		cluster.Name: "true",
+	}
+	pod.OwnerReferences = append(pod.OwnerReferences, metav1.OwnerReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       deployment.Name,
+		UID:        deployment.UID,
+	})
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[poolPromTarAnnotation] = job.PrometheusTarURL
+	setConfigAnnotations(pod, config)
+	pod.Annotations["url"] = job.Status.URL
+	if err := o.client.Update(context.TODO(), pod); err != nil {
+		return fmt.Errorf("couldn't claim pool pod %s: %w", pod.Name, err)
+	}
+	return nil
+}
+
+func isWaitingForClaim(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name == "setup" && status.State.Running != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// claimedPod returns the live pool pod serving the deployment, or nil if there
+// is none.
+func (o *Operator) claimedPod(deployment *appsv1.Deployment) (*corev1.Pod, error) {
+	podName, hasClaim := deployment.Annotations[claimedPodAnnotation]
+	if !hasClaim {
+		return nil, nil
+	}
+	pod := &corev1.Pod{}
+	err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: deployment.Namespace, Name: podName}, pod)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't fetch claimed pod: %w", err)
+	}
+	if pod.DeletionTimestamp != nil || pod.Labels["claimed-by"] != deployment.Name {
+		return nil, nil
+	}
+	return pod, nil
+}
+
+// syncClaimedPod adds the cluster's reference to a claimed pod, so the
+// cluster's store service selects it, and updates its configuration.
+func (o *Operator) syncClaimedPod(pod *corev1.Pod, cluster *api.MetricsCluster, config map[string]string) error {
+	if _, hasReference := pod.Labels[cluster.Name]; hasReference &&
+		pod.Annotations[prometheusConfigAnnotation] == config[prometheusConfigKey] &&
+		pod.Annotations[prometheusRulesAnnotation] == config[prometheusRulesKey] {
+		return nil
+	}
+	pod.Labels[cluster.Name] = "true"
+	setConfigAnnotations(pod, config)
+	if err := o.client.Update(context.TODO(), pod); err != nil {
+		return fmt.Errorf("couldn't update claimed pod %s: %w", pod.Name, err)
+	}
+	return nil
+}
+
+// setConfigAnnotations records the replica's configuration files on a pool
+// pod, which projects them into its config volume.
+func setConfigAnnotations(pod *corev1.Pod, config map[string]string) {
+	pod.Annotations[prometheusConfigAnnotation] = config[prometheusConfigKey]
+	if rules, hasRules := config[prometheusRulesKey]; hasRules {
+		pod.Annotations[prometheusRulesAnnotation] = rules
+	} else {
+		delete(pod.Annotations, prometheusRulesAnnotation)
+	}
+}
+
+// unreferenceClaimedPod removes the cluster's reference from the pool pod
+// serving the deployment, if any.
+func (o *Operator) unreferenceClaimedPod(deployment *appsv1.Deployment, clusterName string) error {
+	pod, err := o.claimedPod(deployment)
+	if err != nil || pod == nil {
+		return err
+	}
+	if _, hasReference := pod.Labels[clusterName]; !hasReference {
+		return nil
+	}
+	delete(pod.Labels, clusterName)
+	if err := o.client.Update(context.TODO(), pod); err != nil {
+		return fmt.Errorf("couldn't update claimed pod %s: %w", pod.Name, err)
+	}
+	return nil
+}
+
+// releaseClaimedPod deletes the pool pod serving the deployment, if any.
+func (o *Operator) releaseClaimedPod(deployment *appsv1.Deployment) error {
+	pod, err := o.claimedPod(deployment)
+	if err != nil || pod == nil {
+		return err
+	}
+	if err := o.client.Delete(context.TODO(), pod); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't delete claimed pod %s: %w", pod.Name, err)
+	}
+	o.log.Info("deleted claimed pod", "pod", pod.Name, "deployment", deployment.Name)
+	return nil
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// poolInitScript waits for the pod to be claimed, then fetches the claimed
+// job's data like a regular replica would.
+func poolInitScript() string {
+	return `set -uo pipefail
+until [ -s /etc/podinfo/promtar ] && [ -s /etc/prometheus/prometheus.yml ]; do
+  sleep 1
+done
+export PROMTAR="$(cat /etc/podinfo/promtar)"
+` + deploymentInitScript()
+}
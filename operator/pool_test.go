@@ -0,0 +1,49 @@
+package operator
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestCanClaimFromPool(t *testing.T) {
+	const image = "quay.io/prometheus/prometheus:v2.17.2"
+	tests := []struct {
+		name     string
+		poolSize int32
+		spec     api.MetricsClusterSpec
+		job      Job
+		features []string
+		expected bool
+	}{
+		{name: "eligible", poolSize: 2, expected: true},
+		{name: "no pool"},
+		{name: "spot", poolSize: 2, spec: api.MetricsClusterSpec{Schedule: api.ScheduleSpot}},
+		{name: "prometheus resources", poolSize: 2, spec: api.MetricsClusterSpec{PrometheusResources: &corev1.ResourceRequirements{}}},
+		{name: "prometheus image", poolSize: 2, spec: api.MetricsClusterSpec{Images: &api.ImagesSpec{Prometheus: "quay.io/prometheus/prometheus:v2.22.0"}}},
+		{name: "thanos image", poolSize: 2, spec: api.MetricsClusterSpec{Images: &api.ImagesSpec{Thanos: "quay.io/thanos/thanos:v0.17.0"}}, expected: true},
+		{name: "persistent storage", poolSize: 2, spec: api.MetricsClusterSpec{Storage: &api.StorageSpec{}}},
+		{name: "archived replicas", poolSize: 2, spec: api.MetricsClusterSpec{ObjectStorage: &api.ObjectStorageSpec{ArchiveReplicas: true}}},
+		{name: "bucket without archiving", poolSize: 2, spec: api.MetricsClusterSpec{ObjectStorage: &api.ObjectStorageSpec{}}, expected: true},
+		{name: "older block format", poolSize: 2, job: Job{PrometheusImage: "quay.io/prometheus/prometheus:v2.1.0"}},
+		{name: "sized storage", poolSize: 2, job: Job{ExtractedSize: 1 << 30}},
+		{name: "artifacts", poolSize: 2, job: Job{Artifacts: map[string][]string{"alerts": {"https://example.com/alerts.json"}}}},
+		{name: "features", poolSize: 2, features: []string{"memory-snapshot-on-shutdown"}},
+		{name: "pinned", poolSize: 2, job: Job{SHA256: "0123abcd"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := &Operator{WarmPoolSize: test.poolSize, PrometheusImage: image}
+			job := test.job
+			if len(job.PrometheusImage) == 0 {
+				job.PrometheusImage = image
+			}
+			cluster := &api.MetricsCluster{Spec: test.spec}
+			if claimable := o.canClaimFromPool(cluster, &job, test.features); claimable != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, claimable)
+			}
+		})
+	}
+}
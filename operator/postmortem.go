@@ -0,0 +1,200 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/query"
+)
+
+// Clusters with post-mortem queries carry a finalizer, so their replicas are
+// still serving when the cluster is deleted and the queries can be evaluated
+// before the replicas go away.
+const postMortemFinalizer = "dowser.dowser/postmortem"
+
+// postMortemTimeout bounds how long deletion waits for post-mortem queries.
+// Queries which don't finish in time are recorded as failed rather than
+// holding up the deletion.
+const postMortemTimeout = time.Minute
+
+// postMortemResult is the result of a post-mortem query against one source.
+type postMortemResult struct {
+	URL    string          `json:"url"`
+	Time   time.Time       `json:"time"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+func postMortemConfigMapName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: cluster.Namespace, Name: fmt.Sprintf("%s-postmortem", cluster.Name)}
+}
+
+func hasFinalizer(cluster *api.MetricsCluster, finalizer string) bool {
+	for _, f := range cluster.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(cluster *api.MetricsCluster, finalizer string) {
+	var finalizers []string
+	for _, f := range cluster.Finalizers {
+		if f != finalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	cluster.Finalizers = finalizers
+}
+
+// ensurePostMortemFinalizer adds or removes the post-mortem finalizer as the
+// cluster's queries are configured or dropped.
+func (o *Operator) ensurePostMortemFinalizer(cluster *api.MetricsCluster) error {
+	wanted := len(cluster.Spec.PostMortemQueries) > 0
+	if wanted == hasFinalizer(cluster, postMortemFinalizer) {
+		return nil
+	}
+	if wanted {
+		cluster.Finalizers = append(cluster.Finalizers, postMortemFinalizer)
+	} else {
+		removeFinalizer(cluster, postMortemFinalizer)
+	}
+	if err := o.client.Update(context.TODO(), cluster); err != nil {
+		return fmt.Errorf("couldn't update metricscluster finalizers: %w", err)
+	}
+	return nil
+}
+
+// finalizePostMortem snapshots the post-mortem query results of a cluster
+// being deleted into a ConfigMap, then lets the deletion proceed.
+func (o *Operator) finalizePostMortem(cluster *api.MetricsCluster) error {
+	if !hasFinalizer(cluster, postMortemFinalizer) {
+		return nil
+	}
+	data, err := o.evaluatePostMortemQueries(cluster)
+	if err != nil {
+		return err
+	}
+
+	name := postMortemConfigMapName(cluster)
+	configMap := &corev1.ConfigMap{}
+	hasConfigMap := true
+	err = o.client.Get(context.TODO(), name, configMap)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			hasConfigMap = false
+		} else {
+			return fmt.Errorf("couldn't fetch postmortem configmap: %w", err)
+		}
+	}
+	if hasConfigMap {
+		configMap.Data = data
+		if err := o.client.Update(context.TODO(), configMap); err != nil {
+			return fmt.Errorf("couldn't update postmortem configmap: %w", err)
+		}
+		o.log.Info("updated postmortem configmap", "name", configMap.Name)
+	} else {
+		// The ConfigMap has no owner, so it outlives the cluster.
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: name.Namespace,
+				Name:      name.Name,
+				Labels: map[string]string{
+					"app":     "postmortem",
+					"cluster": cluster.Name,
+				},
+			},
+			Data: data,
+		}
+		if err := o.client.Create(context.TODO(), configMap); err != nil {
+			return fmt.Errorf("couldn't create postmortem configmap: %w", err)
+		}
+		o.log.Info("created postmortem configmap", "name", configMap.Name)
+	}
+
+	removeFinalizer(cluster, postMortemFinalizer)
+	if err := o.client.Update(context.TODO(), cluster); err != nil {
+		return fmt.Errorf("couldn't remove postmortem finalizer: %w", err)
+	}
+	return nil
+}
+
+// evaluatePostMortemQueries evaluates each query against each source at the
+// time its job completed, returning the results as JSON keyed by query name.
+// Thanos clusters query each source's replica alone; VictoriaMetrics holds
+// every source together, so its queries should select sources by their
+// cluster_url label.
+func (o *Operator) evaluatePostMortemQueries(cluster *api.MetricsCluster) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), postMortemTimeout)
+	defer cancel()
+
+	client := query.NewClient(o.queryEndpoint(cluster))
+	results := map[string][]postMortemResult{}
+	for _, status := range cluster.Status.Jobs {
+		at, err := o.jobCompletionTime(status.URL)
+		if err != nil {
+			o.log.Error(err, "couldn't find job completion time, using the current time", "url", status.URL)
+			at = time.Now()
+		}
+		params := url.Values{}
+		if cluster.Spec.Backend != api.BackendVictoriaMetrics && len(status.Deployment) > 0 {
+			params.Set("storeMatch[]", fmt.Sprintf(`{cluster_name=%q}`, status.Deployment))
+		}
+		for _, q := range cluster.Spec.PostMortemQueries {
+			result := postMortemResult{URL: status.URL, Time: at.UTC()}
+			value, err := client.Instant(ctx, q.Query, at, params)
+			if err == nil {
+				result.Result, err = json.Marshal(value)
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results[q.Name] = append(results[q.Name], result)
+		}
+	}
+
+	data := map[string]string{}
+	for _, q := range cluster.Spec.PostMortemQueries {
+		content, err := json.MarshalIndent(map[string]interface{}{
+			"query":   q.Query,
+			"results": results[q.Name],
+		}, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode results of postmortem query %s: %w", q.Name, err)
+		}
+		data[q.Name+".json"] = string(content)
+	}
+	return data, nil
+}
+
+// jobCompletionTime returns the time the prow job at jobURL completed.
+func (o *Operator) jobCompletionTime(jobURL string) (time.Time, error) {
+	prowInfoURL := strings.ReplaceAll(jobURL, o.ProwBaseURL, o.GCSStorageBaseURL) + "/prowjob.json"
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(prowInfoURL)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("couldn't get prow info: %w", err)
+	}
+	defer resp.Body.Close()
+	var prowJob prowapi.ProwJob
+	if err := json.NewDecoder(resp.Body).Decode(&prowJob); err != nil {
+		return time.Time{}, fmt.Errorf("couldn't decode prow info: %w", err)
+	}
+	if prowJob.Status.CompletionTime == nil {
+		return time.Time{}, fmt.Errorf("job hasn't completed")
+	}
+	return prowJob.Status.CompletionTime.Time, nil
+}
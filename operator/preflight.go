@@ -0,0 +1,134 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+var tarSizes map[string]int64
+var tarSizeLock sync.Mutex
+
+// findTarSize returns the size of the tarball from a HEAD request, or 0 if
+// the server doesn't report it. Results are cached as tarballs don't change.
+func findTarSize(tarURL string) (int64, error) {
+	tarSizeLock.Lock()
+	defer tarSizeLock.Unlock()
+	if tarSizes == nil {
+		tarSizes = map[string]int64{}
+	}
+	if size, found := tarSizes[tarURL]; found {
+		return size, nil
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Head(tarURL)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't fetch %s: %w", tarURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("couldn't fetch %s: %s", tarURL, resp.Status)
+	}
+	size := resp.ContentLength
+	if size < 0 {
+		size = 0
+	} else {
+		tarballBytes.Observe(float64(size))
+	}
+	tarSizes[tarURL] = size
+	return size, nil
+}
+
+// extractedSize estimates the disk space the tarball's data needs once
+// extracted, or returns 0 if its size is unknown.
+func (o *Operator) extractedSize(tarURL string) (int64, error) {
+	size, err := findTarSize(tarURL)
+	if err != nil {
+		return 0, err
+	}
+	return int64(float64(size) * o.ExtractionSizeFactor), nil
+}
+
+// largestNodeStorage returns the most ephemeral storage allocatable on any
+// schedulable node, or 0 if no node reports it.
+func (o *Operator) largestNodeStorage() (int64, error) {
+	nodes := &corev1.NodeList{}
+	if err := o.apiReader.List(context.TODO(), nodes); err != nil {
+		return 0, fmt.Errorf("couldn't list nodes: %w", err)
+	}
+	var largest int64
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		if storage, hasStorage := node.Status.Allocatable[corev1.ResourceEphemeralStorage]; hasStorage && storage.Value() > largest {
+			largest = storage.Value()
+		}
+	}
+	return largest, nil
+}
+
+// requestStorage makes the scheduler place the replica on a node with room
+// for its data, so the kubelet doesn't evict it partway through extraction.
+func requestStorage(podSpec *corev1.PodSpec, size int64) {
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container.Name != "prometheus" {
+			continue
+		}
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		container.Resources.Requests[corev1.ResourceEphemeralStorage] = *resource.NewQuantity(size, resource.BinarySI)
+	}
+}
+
+// storageFit checks sources' extracted size against the storage of the
+// largest schedulable node, which is looked up on first use.
+type storageFit struct {
+	o       *Operator
+	largest int64
+	checked bool
+}
+
+// check returns why data of the given extracted size doesn't fit on any node,
+// or an empty string if it fits or its size isn't known.
+func (f *storageFit) check(size int64) (string, error) {
+	if size == 0 {
+		return "", nil
+	}
+	if !f.checked {
+		largest, err := f.o.largestNodeStorage()
+		if err != nil {
+			return "", err
+		}
+		f.largest, f.checked = largest, true
+	}
+	if f.largest == 0 || size <= f.largest {
+		return "", nil
+	}
+	return fmt.Sprintf("needs about %s of storage but nodes have at most %s",
+		resource.NewQuantity(size, resource.BinarySI), resource.NewQuantity(f.largest, resource.BinarySI)), nil
+}
+
+// updateStorageCondition reports the sources too large for any node in the
+// cluster's StorageAvailable condition, when storage preflight is enabled.
+func (o *Operator) updateStorageCondition(cluster *api.MetricsCluster, insufficient []string) {
+	switch {
+	case !o.StoragePreflight:
+		removeCondition(cluster, api.ConditionStorageAvailable)
+	case len(insufficient) > 0:
+		setCondition(cluster, api.ConditionStorageAvailable, corev1.ConditionFalse, "InsufficientStorage",
+			fmt.Sprintf("sources too large for any node: %s", strings.Join(insufficient, ", ")))
+	default:
+		setCondition(cluster, api.ConditionStorageAvailable, corev1.ConditionTrue, "StorageAvailable", "")
+	}
+}
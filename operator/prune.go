@@ -0,0 +1,127 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// The garbage collector removes the resources a cluster controls along with
+// it, but not those it doesn't know belong to it: resources created before
+// clusters owned them and never adopted, e.g. because the operator was down
+// when their cluster was deleted, or whose owner references were dropped.
+// Every SyncPeriod, the query, store, exposure and other resources controlled
+// by or labeled for a cluster which no longer exists are deleted. Replicas are
+// shared, so they are left to reconciles to release.
+
+// orphanGracePeriod spares resources just created, whose cluster may not be
+// listed yet.
+const orphanGracePeriod = 5 * time.Minute
+
+// pruneOrphans deletes orphaned resources every sync period until stop is
+// closed. Failures are logged and retried.
+func (o *Operator) pruneOrphans(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if err := o.pruneOrphanedResources(time.Now()); err != nil {
+			o.log.Error(err, "couldn't prune orphaned resources")
+		}
+	}, o.SyncPeriod, stop)
+	return nil
+}
+
+// prunedKind is a kind of resource clusters control.
+type prunedKind struct {
+	kind string
+	list runtime.Object
+}
+
+// pruneOrphanedResources deletes the resources of clusters which are gone.
+func (o *Operator) pruneOrphanedResources(now time.Time) error {
+	kinds := []prunedKind{
+		{"deployment", &appsv1.DeploymentList{}},
+		{"service", &corev1.ServiceList{}},
+		{"configmap", &corev1.ConfigMapList{}},
+		{"secret", &corev1.SecretList{}},
+	}
+	switch o.exposeMode {
+	case exposeRoute:
+		kinds = append(kinds, prunedKind{exposeRoute, &routev1.RouteList{}})
+	case exposeIngress:
+		kinds = append(kinds, prunedKind{exposeIngress, &networkingv1beta1.IngressList{}})
+	}
+
+	// Resources are listed before clusters, so that the clusters of any
+	// resource listed are too.
+	var candidates []ownedResource
+	for _, kind := range kinds {
+		if err := o.client.List(context.TODO(), kind.list, client.InNamespace(o.Namespace)); err != nil {
+			return fmt.Errorf("couldn't list %ss: %w", kind.kind, err)
+		}
+		items, err := meta.ExtractList(kind.list)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			candidates = append(candidates, ownedResource{kind: kind.kind, object: item})
+		}
+	}
+	clusterList := &api.MetricsClusterList{}
+	if err := o.client.List(context.TODO(), clusterList, client.InNamespace(o.Namespace)); err != nil {
+		return fmt.Errorf("couldn't list metricsclusters: %w", err)
+	}
+	clusters := map[string]types.UID{}
+	for _, cluster := range clusterList.Items {
+		clusters[cluster.Name] = cluster.UID
+	}
+
+	for _, candidate := range candidates {
+		object, err := meta.Accessor(candidate.object)
+		if err != nil {
+			return err
+		}
+		if now.Sub(object.GetCreationTimestamp().Time) < orphanGracePeriod {
+			continue
+		}
+		cluster, orphaned := orphanedCluster(object, clusters)
+		if !orphaned {
+			continue
+		}
+		if err := o.client.Delete(context.TODO(), candidate.object); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete orphaned %s %s: %w", candidate.kind, object.GetName(), err)
+		}
+		o.log.Info("deleted orphaned "+candidate.kind, "name", object.GetName(), "cluster", cluster)
+	}
+	return nil
+}
+
+// orphanedCluster returns the cluster controlling or labeled on the object,
+// and whether it no longer exists, given the UIDs of the existing clusters by
+// name.
+func orphanedCluster(object metav1.Object, clusters map[string]types.UID) (string, bool) {
+	if object.GetLabels()["app"] == "prometheus" {
+		return "", false
+	}
+	if owner := metav1.GetControllerOf(object); owner != nil && isClusterReference(*owner) {
+		uid, exists := clusters[owner.Name]
+		return owner.Name, !exists || uid != owner.UID
+	}
+	if name, labeled := object.GetLabels()[api.ClusterLabel]; labeled {
+		_, exists := clusters[name]
+		return name, !exists
+	}
+	return "", false
+}
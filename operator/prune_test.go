@@ -0,0 +1,42 @@
+package operator
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestOrphanedCluster(t *testing.T) {
+	controlled := func(name string, uid types.UID) metav1.ObjectMeta {
+		cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: name, UID: uid}}
+		return metav1.ObjectMeta{OwnerReferences: clusterOwner(cluster)}
+	}
+	labeled := func(labels map[string]string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Labels: labels}
+	}
+	clusters := map[string]types.UID{"live": "1"}
+
+	tests := map[string]struct {
+		object   metav1.ObjectMeta
+		cluster  string
+		orphaned bool
+	}{
+		"live controller":    {controlled("live", "1"), "live", false},
+		"deleted controller": {controlled("gone", "2"), "gone", true},
+		"recreated cluster":  {controlled("live", "0"), "live", true},
+		"live label":         {labeled(map[string]string{api.ClusterLabel: "live"}), "live", false},
+		"deleted label":      {labeled(map[string]string{api.ClusterLabel: "gone"}), "gone", true},
+		"unrelated":          {labeled(map[string]string{"app": "thanos-query"}), "", false},
+		"replica":            {labeled(map[string]string{"app": "prometheus", api.ClusterLabel: "gone"}), "", false},
+	}
+	for name, test := range tests {
+		object := test.object
+		cluster, orphaned := orphanedCluster(&object, clusters)
+		if cluster != test.cluster || orphaned != test.orphaned {
+			t.Errorf("%s: expected %q orphaned %t, got %q orphaned %t", name, test.cluster, test.orphaned, cluster, orphaned)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package operator
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Processing a source, discovering its artifacts or reconciling its replica,
+// may panic on input nobody anticipated, e.g. a malformed prowjob.json.
+// Panics are recovered and counted against the source rather than crashing
+// the operator: the discovery or reconcile fails and is retried, and after
+// sourcePanicBudget panics the source is quarantined. Clusters skip
+// quarantined sources, reporting them as failed and with the
+// SourcesQuarantined condition, and serve the others. Quarantines last until
+// no cluster lists the source anymore, or the operator restarts.
+
+// sourcePanicBudget is how many panics a source may cause before it's
+// quarantined.
+const sourcePanicBudget = 3
+
+// sourcePanics are the panics each source caused, and the last one.
+var sourcePanics = map[string]*sourcePanic{}
+var sourcePanicLock sync.Mutex
+
+type sourcePanic struct {
+	count int
+	last  string
+}
+
+// recordSourcePanic logs a panic processing the source at url, with its
+// stack, and counts it. It returns whether the source is now quarantined.
+func (o *Operator) recordSourcePanic(url string, recovered interface{}) bool {
+	o.log.Error(fmt.Errorf("%v", recovered), "recovered from panic processing source", "url", url, "stack", string(debug.Stack()))
+	sourcePanicLock.Lock()
+	defer sourcePanicLock.Unlock()
+	panics, found := sourcePanics[url]
+	if !found {
+		panics = &sourcePanic{}
+		sourcePanics[url] = panics
+	}
+	panics.count++
+	panics.last = fmt.Sprint(recovered)
+	return panics.count >= sourcePanicBudget
+}
+
+// quarantinedSource returns the last panic of the source at url, and whether
+// it's quarantined.
+func quarantinedSource(url string) (string, bool) {
+	sourcePanicLock.Lock()
+	defer sourcePanicLock.Unlock()
+	panics, found := sourcePanics[url]
+	if !found || panics.count < sourcePanicBudget {
+		return "", false
+	}
+	return panics.last, true
+}
+
+// forgetSourcePanics lifts the quarantine of a source no cluster lists.
+func forgetSourcePanics(url string) {
+	sourcePanicLock.Lock()
+	defer sourcePanicLock.Unlock()
+	delete(sourcePanics, url)
+}
+
+// recoverReconcile turns a panic reconciling the cluster into an error,
+// counting it against the source being processed if any, so the reconcile is
+// retried with backoff.
+func (o *Operator) recoverReconcile(request reconcile.Request, url string, recovered interface{}) (reconcile.Result, error) {
+	if len(url) == 0 {
+		o.log.Error(fmt.Errorf("%v", recovered), "recovered from panic reconciling cluster", "request", request, "stack", string(debug.Stack()))
+		return reconcile.Result{}, fmt.Errorf("panicked reconciling %s: %v", request.Name, recovered)
+	}
+	if o.recordSourcePanic(url, recovered) {
+		return reconcile.Result{}, fmt.Errorf("quarantined %s after panicking: %v", url, recovered)
+	}
+	return reconcile.Result{}, fmt.Errorf("panicked processing %s: %v", url, recovered)
+}
+
+// discoverRecovering discovers the source at url like discover, turning a
+// panic into a failed discovery, which is final once the source is
+// quarantined.
+func (f *artifactFetcher) discoverRecovering(url string) (result *sourceArtifacts) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result = &sourceArtifacts{fetched: time.Now(), err: fmt.Errorf("panicked discovering artifacts: %v", recovered)}
+			if f.operator.recordSourcePanic(url, recovered) {
+				result.reason = api.FailureQuarantined
+				result.quarantined = true
+			}
+		}
+	}()
+	return f.discover(url)
+}
+
+// updateQuarantineCondition reports the cluster's quarantined sources, with
+// their last panic by URL.
+func (o *Operator) updateQuarantineCondition(cluster *api.MetricsCluster, quarantined map[string]string) {
+	if len(quarantined) == 0 {
+		removeCondition(cluster, api.ConditionSourcesQuarantined)
+		return
+	}
+	var urls []string
+	for url := range quarantined {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	var messages []string
+	for _, url := range urls {
+		messages = append(messages, fmt.Sprintf("%s: %s", url, quarantined[url]))
+	}
+	setCondition(cluster, api.ConditionSourcesQuarantined, corev1.ConditionTrue, "PanicBudgetExhausted", strings.Join(messages, "; "))
+}
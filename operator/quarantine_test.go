@@ -0,0 +1,86 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// panickingResolver panics resolving any source of its scheme.
+type panickingResolver struct{}
+
+func (panickingResolver) name() string { return "poison" }
+
+func (panickingResolver) matches(url string) bool { return strings.HasPrefix(url, "poison://") }
+
+func (panickingResolver) resolve(f *artifactFetcher, url string, result *sourceArtifacts) {
+	panic("malformed prowjob.json")
+}
+
+func TestDiscoverRecovering(t *testing.T) {
+	defer func(registered []resolver) { resolvers = registered }(resolvers)
+	resolvers = append([]resolver{panickingResolver{}}, resolvers...)
+	url := "poison://job/1"
+	defer forgetSourcePanics(url)
+
+	f := newArtifactFetcher(&Operator{log: log.NullLogger{}})
+	for i := 1; i <= sourcePanicBudget; i++ {
+		result := f.discoverRecovering(url)
+		if result.err == nil || !strings.Contains(result.err.Error(), "malformed prowjob.json") {
+			t.Fatalf("expected the panic as the discovery's error, got %v", result.err)
+		}
+		if quarantined := i == sourcePanicBudget; result.isFinal() != quarantined || result.quarantined != quarantined {
+			t.Errorf("panic %d: expected quarantined %t, got %t", i, quarantined, result.quarantined)
+		}
+	}
+	if lastPanic, quarantined := quarantinedSource(url); !quarantined || lastPanic != "malformed prowjob.json" {
+		t.Errorf("expected the source quarantined, got %t (%q)", quarantined, lastPanic)
+	}
+
+	forgetSourcePanics(url)
+	if _, quarantined := quarantinedSource(url); quarantined {
+		t.Errorf("expected the quarantine lifted")
+	}
+}
+
+func TestRecoverReconcile(t *testing.T) {
+	o := &Operator{log: log.NullLogger{}}
+	request := reconcile.Request{}
+	request.Name = "ci"
+	url := "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1"
+	defer forgetSourcePanics(url)
+
+	if _, err := o.recoverReconcile(request, "", "nil map"); err == nil || !strings.Contains(err.Error(), "reconciling ci") {
+		t.Errorf("expected a panic outside of sources to fail the reconcile, got %v", err)
+	}
+	for i := 1; i < sourcePanicBudget; i++ {
+		if _, err := o.recoverReconcile(request, url, "nil map"); err == nil || !strings.Contains(err.Error(), "panicked processing") {
+			t.Errorf("expected the reconcile to fail, got %v", err)
+		}
+	}
+	if _, quarantined := quarantinedSource(url); quarantined {
+		t.Errorf("expected the source quarantined only once its budget is spent")
+	}
+	if _, err := o.recoverReconcile(request, url, "nil map"); err == nil || !strings.Contains(err.Error(), "quarantined") {
+		t.Errorf("expected the source quarantined, got %v", err)
+	}
+}
+
+func TestUpdateQuarantineCondition(t *testing.T) {
+	o := &Operator{}
+	cluster := &api.MetricsCluster{}
+	o.updateQuarantineCondition(cluster, map[string]string{"b": "index out of range", "a": "nil map"})
+	condition := findCondition(cluster, api.ConditionSourcesQuarantined)
+	if condition == nil || condition.Status != corev1.ConditionTrue || condition.Message != "a: nil map; b: index out of range" {
+		t.Errorf("expected the quarantined sources listed, got %+v", condition)
+	}
+	o.updateQuarantineCondition(cluster, nil)
+	if findCondition(cluster, api.ConditionSourcesQuarantined) != nil {
+		t.Errorf("expected the condition removed")
+	}
+}
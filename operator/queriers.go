@@ -0,0 +1,218 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	routev1 "github.com/openshift/api/route/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters listing allowed external queriers are only queried by them. Their
+// address blocks are set as the source allow-list of the route or ingress
+// exposing the cluster's query, and admitted to the pods serving it by a
+// NetworkPolicy, which matters where the namespace's pods are otherwise
+// isolated, e.g. by the baseline policy of a bootstrapped namespace. Their
+// service accounts authenticate to the aggregation API with their own tokens,
+// reviewed by the API server, and are only proxied to the clusters listing
+// them. A cluster allowing service accounts but no addresses isn't exposed.
+
+// Annotations restricting the source addresses of routes and of ingresses
+// served by the NGINX ingress controller.
+const (
+	routeAllowListAnnotation   = "haproxy.router.openshift.io/ip_whitelist"
+	ingressAllowListAnnotation = "nginx.ingress.kubernetes.io/whitelist-source-range"
+)
+
+// externalQueriers are the valid allowed external queriers of a cluster.
+type externalQueriers struct {
+	// restricted means the cluster lists allowed queriers.
+	restricted      bool
+	cidrs           []string
+	serviceAccounts map[string]bool
+}
+
+// exposed returns whether the cluster's query may be exposed: unless only
+// service accounts may query it.
+func (q externalQueriers) exposed() bool {
+	return !q.restricted || len(q.cidrs) > 0
+}
+
+// parseExternalQueriers returns the cluster's allowed external queriers,
+// leaving out, and returning an error listing, invalid ones.
+func parseExternalQueriers(cluster *api.MetricsCluster) (externalQueriers, error) {
+	queriers := externalQueriers{
+		restricted:      len(cluster.Spec.AllowedExternalQueriers) > 0,
+		serviceAccounts: map[string]bool{},
+	}
+	var invalid []string
+	for _, querier := range cluster.Spec.AllowedExternalQueriers {
+		switch {
+		case len(querier.CIDR) > 0 && len(querier.ServiceAccount) > 0:
+			invalid = append(invalid, fmt.Sprintf("%s and %s: only one of cidr and serviceAccount may be set", querier.CIDR, querier.ServiceAccount))
+		case len(querier.CIDR) > 0:
+			_, block, err := net.ParseCIDR(querier.CIDR)
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("%s: %v", querier.CIDR, err))
+				continue
+			}
+			queriers.cidrs = append(queriers.cidrs, block.String())
+		case len(querier.ServiceAccount) > 0:
+			parts := strings.Split(querier.ServiceAccount, "/")
+			if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+				invalid = append(invalid, fmt.Sprintf("%s: not a <namespace>/<name> service account", querier.ServiceAccount))
+				continue
+			}
+			queriers.serviceAccounts[querier.ServiceAccount] = true
+		default:
+			invalid = append(invalid, "one of cidr and serviceAccount must be set")
+		}
+	}
+	if len(invalid) > 0 {
+		return queriers, fmt.Errorf("invalid allowed external queriers: %s", strings.Join(invalid, "; "))
+	}
+	return queriers, nil
+}
+
+// applyQuerierAllowList sets the address allow-list of the route or ingress
+// exposing a cluster's query, reporting whether it changed.
+func applyQuerierAllowList(exposure runtime.Object, queriers externalQueriers) bool {
+	var object metav1.Object
+	var key, value string
+	switch exposure := exposure.(type) {
+	case *routev1.Route:
+		object, key, value = exposure, routeAllowListAnnotation, strings.Join(queriers.cidrs, " ")
+	case *networkingv1beta1.Ingress:
+		object, key, value = exposure, ingressAllowListAnnotation, strings.Join(queriers.cidrs, ",")
+	default:
+		return false
+	}
+	annotations := object.GetAnnotations()
+	current, hasCurrent := annotations[key]
+	switch {
+	case len(value) == 0 && !hasCurrent, len(value) > 0 && current == value:
+		return false
+	case len(value) == 0:
+		delete(annotations, key)
+	default:
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+	}
+	object.SetAnnotations(annotations)
+	return true
+}
+
+func (o *Operator) queriersPolicyName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: "queriers-" + cluster.Name}
+}
+
+// queriersPolicyManifest returns the policy admitting the cluster's allowed
+// address blocks to the pods selected by the service serving its query.
+func (o *Operator) queriersPolicyManifest(cluster *api.MetricsCluster, selector map[string]string, queriers externalQueriers) *networkingv1.NetworkPolicy {
+	name := o.queriersPolicyName(cluster)
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, cidr := range queriers.cidrs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+	}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: selector},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress:     []networkingv1.NetworkPolicyIngressRule{{From: peers}},
+		},
+	}
+}
+
+// ensureQueriersPolicy creates, updates or deletes the policy admitting the
+// cluster's allowed address blocks to its query, served by the named service.
+func (o *Operator) ensureQueriersPolicy(cluster *api.MetricsCluster, serviceName string, queriers externalQueriers) error {
+	name := o.queriersPolicyName(cluster)
+	current := &networkingv1.NetworkPolicy{}
+	exists := true
+	if err := o.client.Get(context.TODO(), name, current); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch networkpolicy: %w", err)
+		}
+		exists = false
+	}
+	if len(queriers.cidrs) == 0 {
+		if exists {
+			if err := o.client.Delete(context.TODO(), current); err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("couldn't delete networkpolicy: %w", err)
+			}
+			o.log.Info("deleted networkpolicy", "name", name.Name)
+		}
+		return nil
+	}
+
+	service := &corev1.Service{}
+	if err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: o.Namespace, Name: serviceName}, service); err != nil {
+		if errors.IsNotFound(err) {
+			// The policy follows once the service is created.
+			return nil
+		}
+		return fmt.Errorf("couldn't fetch service: %w", err)
+	}
+	desired := o.queriersPolicyManifest(cluster, service.Spec.Selector, queriers)
+	if !exists {
+		if err := o.client.Create(context.TODO(), desired); err != nil {
+			return fmt.Errorf("couldn't create networkpolicy: %w", err)
+		}
+		o.log.Info("created networkpolicy", "name", name.Name)
+		return nil
+	}
+	if equality.Semantic.DeepEqual(current.Spec, desired.Spec) {
+		return nil
+	}
+	current.Spec = desired.Spec
+	if err := o.client.Update(context.TODO(), current); err != nil {
+		return fmt.Errorf("couldn't update networkpolicy: %w", err)
+	}
+	o.log.Info("updated networkpolicy", "name", name.Name)
+	return nil
+}
+
+// reviewServiceAccount returns the service account the token authenticates,
+// as <namespace>/<name>, or an empty string if it authenticates none.
+func (o *Operator) reviewServiceAccount(ctx context.Context, token string) (string, error) {
+	if len(token) == 0 {
+		return "", nil
+	}
+	review := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}
+	if err := o.client.Create(ctx, review); err != nil {
+		return "", fmt.Errorf("couldn't review token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return "", nil
+	}
+	return serviceAccountName(review.Status.User.Username), nil
+}
+
+// serviceAccountName returns the <namespace>/<name> of the service account
+// with the username, or an empty string if it isn't a service account's.
+func serviceAccountName(username string) string {
+	parts := strings.Split(username, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return ""
+	}
+	return parts[2] + "/" + parts[3]
+}
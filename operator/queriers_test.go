@@ -0,0 +1,105 @@
+package operator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	routev1 "github.com/openshift/api/route/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestParseExternalQueriers(t *testing.T) {
+	cluster := &api.MetricsCluster{Spec: api.MetricsClusterSpec{AllowedExternalQueriers: []api.ExternalQuerier{
+		{CIDR: "10.0.1.7/16"},
+		{ServiceAccount: "monitoring/federate"},
+		{CIDR: "10.0.0.0/33"},
+		{ServiceAccount: "federate"},
+		{CIDR: "192.168.0.0/24", ServiceAccount: "monitoring/federate"},
+		{},
+	}}}
+	queriers, err := parseExternalQueriers(cluster)
+	if err == nil {
+		t.Fatalf("expected invalid queriers to be reported")
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "federate:", "192.168.0.0/24 and", "one of cidr and serviceAccount must be set"} {
+		if !strings.Contains(err.Error(), invalid) {
+			t.Errorf("expected %q to be reported, got %v", invalid, err)
+		}
+	}
+	if !reflect.DeepEqual(queriers.cidrs, []string{"10.0.0.0/16"}) {
+		t.Errorf("expected the valid block to be kept normalized, got %v", queriers.cidrs)
+	}
+	if !reflect.DeepEqual(queriers.serviceAccounts, map[string]bool{"monitoring/federate": true}) {
+		t.Errorf("expected the valid service account to be kept, got %v", queriers.serviceAccounts)
+	}
+
+	tests := map[string]struct {
+		queriers []api.ExternalQuerier
+		exposed  bool
+	}{
+		"unrestricted":          {exposed: true},
+		"addresses":             {queriers: []api.ExternalQuerier{{CIDR: "10.0.0.0/8"}}, exposed: true},
+		"service accounts only": {queriers: []api.ExternalQuerier{{ServiceAccount: "monitoring/federate"}}},
+		"only invalid":          {queriers: []api.ExternalQuerier{{CIDR: "everyone"}}},
+	}
+	for name, test := range tests {
+		queriers, _ := parseExternalQueriers(&api.MetricsCluster{Spec: api.MetricsClusterSpec{AllowedExternalQueriers: test.queriers}})
+		if queriers.exposed() != test.exposed {
+			t.Errorf("%s: expected exposed %t", name, test.exposed)
+		}
+	}
+}
+
+func TestApplyQuerierAllowList(t *testing.T) {
+	queriers := externalQueriers{restricted: true, cidrs: []string{"10.0.0.0/8", "192.168.0.0/24"}}
+
+	route := &routev1.Route{}
+	if !applyQuerierAllowList(route, queriers) {
+		t.Errorf("expected the route's allow-list to be set")
+	}
+	if value := route.Annotations[routeAllowListAnnotation]; value != "10.0.0.0/8 192.168.0.0/24" {
+		t.Errorf("unexpected route allow-list %q", value)
+	}
+	if applyQuerierAllowList(route, queriers) {
+		t.Errorf("expected an unchanged allow-list not to be updated")
+	}
+	if !applyQuerierAllowList(route, externalQueriers{}) || len(route.Annotations) != 0 {
+		t.Errorf("expected the allow-list to be removed, got %v", route.Annotations)
+	}
+
+	ingress := &networkingv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"other": "kept"}}}
+	applyQuerierAllowList(ingress, queriers)
+	if value := ingress.Annotations[ingressAllowListAnnotation]; value != "10.0.0.0/8,192.168.0.0/24" || ingress.Annotations["other"] != "kept" {
+		t.Errorf("unexpected ingress annotations %v", ingress.Annotations)
+	}
+}
+
+func TestQueriersPolicyManifest(t *testing.T) {
+	o := &Operator{Namespace: "dowser"}
+	cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: "a"}}
+	selector := map[string]string{"app": "thanos-query", "cluster": "a"}
+	policy := o.queriersPolicyManifest(cluster, selector, externalQueriers{cidrs: []string{"10.0.0.0/8"}})
+	if policy.Name != "queriers-a" || !reflect.DeepEqual(policy.Spec.PodSelector.MatchLabels, selector) {
+		t.Errorf("unexpected policy %s selecting %v", policy.Name, policy.Spec.PodSelector.MatchLabels)
+	}
+	if len(policy.Spec.Ingress) != 1 || len(policy.Spec.Ingress[0].From) != 1 || policy.Spec.Ingress[0].From[0].IPBlock.CIDR != "10.0.0.0/8" {
+		t.Errorf("unexpected ingress rules %+v", policy.Spec.Ingress)
+	}
+}
+
+func TestServiceAccountName(t *testing.T) {
+	tests := map[string]string{
+		"system:serviceaccount:monitoring:federate": "monitoring/federate",
+		"system:node:worker-0":                      "",
+		"alice":                                     "",
+	}
+	for username, expected := range tests {
+		if name := serviceAccountName(username); name != expected {
+			t.Errorf("%s: expected %q, got %q", username, expected, name)
+		}
+	}
+}
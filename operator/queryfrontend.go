@@ -0,0 +1,170 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func (o *Operator) queryFrontendName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("queryfrontend-%s", cluster.Name)}
+}
+
+// queryFrontendCommand returns the command running the query frontend in
+// front of the cluster's query service. Vertical sharding is only supported
+// from v0.26.0.
+func (o *Operator) queryFrontendCommand(cluster *api.MetricsCluster) []string {
+	spec := cluster.Spec.QueryFrontend
+	queryServiceName := o.thanosQueryServiceName(cluster)
+	command := []string{
+		"/bin/thanos",
+		"query-frontend",
+		"--http-address=0.0.0.0:10902",
+		fmt.Sprintf("--query-frontend.downstream-url=http://%s.%s.svc:19192", queryServiceName.Name, queryServiceName.Namespace),
+	}
+	if spec.SplitInterval != nil {
+		command = append(command, "--query-range.split-interval="+spec.SplitInterval.Duration.String())
+	}
+	if spec.VerticalShards > 1 && o.thanosAtLeast("v0.26.0") {
+		command = append(command, fmt.Sprintf("--query-frontend.vertical-shards=%d", spec.VerticalShards))
+	}
+	return command
+}
+
+func (o *Operator) queryFrontendDeploymentManifest(cluster *api.MetricsCluster) *appsv1.Deployment {
+	name := o.queryFrontendName(cluster)
+	var replicas int32 = 1
+	labels := map[string]string{
+		"app":     "thanos-query-frontend",
+		"cluster": cluster.Name,
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "query-frontend",
+							Image:   o.ThanosImage,
+							Command: o.queryFrontendCommand(cluster),
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: 10902,
+								},
+							},
+							ReadinessProbe: readinessProbe("/-/ready", 10902),
+							LivenessProbe:  livenessProbe("/-/healthy", 10902),
+						},
+					},
+				},
+			},
+		},
+	}
+	applyThanosResources(&deployment.Spec.Template.Spec, cluster)
+	o.applyTracing(&deployment.Spec.Template.Spec, "query-frontend", "thanos-query-frontend")
+	o.hardenPodSpec(&deployment.Spec.Template.Spec)
+	return deployment
+}
+
+func (o *Operator) queryFrontendServiceManifest(cluster *api.MetricsCluster) *corev1.Service {
+	name := o.queryFrontendName(cluster)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port:     10902,
+					Protocol: corev1.ProtocolTCP,
+					Name:     "http",
+				},
+			},
+			Selector: map[string]string{
+				"app":     "thanos-query-frontend",
+				"cluster": cluster.Name,
+			},
+		},
+	}
+}
+
+// ensureQueryFrontend creates, updates or removes the cluster's query
+// frontend, which splits and shards heavy range queries across the query
+// tier. It returns the name of the service queries should be routed to, and
+// whether it's available.
+func (o *Operator) ensureQueryFrontend(cluster *api.MetricsCluster, queryServiceName string, queryAvailable bool) (string, bool, error) {
+	enabled := cluster.Spec.QueryFrontend != nil
+	name := o.queryFrontendName(cluster)
+	deployment := &appsv1.Deployment{}
+	resources := []struct {
+		kind     string
+		current  runtime.Object
+		manifest func() runtime.Object
+	}{
+		{"deployment", deployment, func() runtime.Object { return o.queryFrontendDeploymentManifest(cluster) }},
+		{"service", &corev1.Service{}, func() runtime.Object { return o.queryFrontendServiceManifest(cluster) }},
+	}
+	for _, resource := range resources {
+		err := o.client.Get(context.TODO(), name, resource.current)
+		exists := true
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return "", false, fmt.Errorf("couldn't fetch query frontend %s: %w", resource.kind, err)
+			}
+			exists = false
+		}
+		switch {
+		case enabled && !exists:
+			if err := o.client.Create(context.TODO(), resource.manifest()); err != nil {
+				return "", false, fmt.Errorf("couldn't create query frontend %s: %w", resource.kind, err)
+			}
+			o.log.Info("created query frontend "+resource.kind, "name", name.Name)
+		case enabled && exists && resource.kind == "deployment":
+			desired := resource.manifest().(*appsv1.Deployment)
+			current, wanted := &deployment.Spec.Template.Spec.Containers[0], desired.Spec.Template.Spec.Containers[0]
+			if !equality.Semantic.DeepEqual(current.Command, wanted.Command) || !equality.Semantic.DeepEqual(current.Resources, wanted.Resources) {
+				current.Command = wanted.Command
+				current.Resources = wanted.Resources
+				if err := o.client.Update(context.TODO(), deployment); err != nil {
+					return "", false, fmt.Errorf("couldn't update query frontend deployment: %w", err)
+				}
+				o.log.Info("updated query frontend deployment", "name", name.Name)
+			}
+		case !enabled && exists:
+			if err := o.client.Delete(context.TODO(), resource.current); err != nil && !errors.IsNotFound(err) {
+				return "", false, fmt.Errorf("couldn't delete query frontend %s: %w", resource.kind, err)
+			}
+			o.log.Info("deleted query frontend "+resource.kind, "name", name.Name)
+		}
+	}
+	if !enabled {
+		return queryServiceName, queryAvailable, nil
+	}
+	return name.Name, queryAvailable && deployment.Status.AvailableReplicas > 0, nil
+}
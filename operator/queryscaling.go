@@ -0,0 +1,121 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters aggregating many stores can run several query replicas behind the
+// query service, given by spec.query.replicas, or scaled on CPU utilization
+// by a HorizontalPodAutoscaler named like the query deployment. The
+// autoscaler then owns the deployment's replica count.
+
+// defaultQueryTargetCPU is the CPU utilization autoscaled queries are kept
+// at unless the cluster sets one.
+const defaultQueryTargetCPU = 80
+
+// queryReplicas returns the number of query replicas the cluster asks for,
+// or the fewest it's autoscaled to.
+func queryReplicas(cluster *api.MetricsCluster) int32 {
+	if cluster.Spec.Query != nil && cluster.Spec.Query.Replicas > 0 {
+		return cluster.Spec.Query.Replicas
+	}
+	if cluster.Spec.QueryFrontend != nil && cluster.Spec.QueryFrontend.QueryReplicas > 0 {
+		return cluster.Spec.QueryFrontend.QueryReplicas
+	}
+	return 1
+}
+
+// hasQueryAutoscaling returns whether the cluster's query is autoscaled.
+func hasQueryAutoscaling(cluster *api.MetricsCluster) bool {
+	return cluster.Spec.Query != nil && cluster.Spec.Query.Autoscaling != nil
+}
+
+// queryReplicaLabelFlags returns the query's deduplication flags.
+func queryReplicaLabelFlags(cluster *api.MetricsCluster) []string {
+	if cluster.Spec.Query == nil {
+		return nil
+	}
+	var flags []string
+	for _, label := range cluster.Spec.Query.ReplicaLabels {
+		flags = append(flags, "--query.replica-label="+label)
+	}
+	return flags
+}
+
+func (o *Operator) queryAutoscalerManifest(cluster *api.MetricsCluster) *autoscalingv1.HorizontalPodAutoscaler {
+	name := o.thanosQueryDeploymentName(cluster)
+	autoscaling := cluster.Spec.Query.Autoscaling
+	minReplicas := queryReplicas(cluster)
+	maxReplicas := autoscaling.MaxReplicas
+	if maxReplicas < minReplicas {
+		maxReplicas = minReplicas
+	}
+	targetCPU := autoscaling.TargetCPUUtilizationPercentage
+	if targetCPU <= 0 {
+		targetCPU = defaultQueryTargetCPU
+	}
+	return &autoscalingv1.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          map[string]string{"app": "thanos-query"},
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       name.Name,
+			},
+			MinReplicas:                    &minReplicas,
+			MaxReplicas:                    maxReplicas,
+			TargetCPUUtilizationPercentage: &targetCPU,
+		},
+	}
+}
+
+// ensureQueryAutoscaler creates, updates or removes the autoscaler of the
+// cluster's query.
+func (o *Operator) ensureQueryAutoscaler(cluster *api.MetricsCluster) error {
+	enabled := hasQueryAutoscaling(cluster)
+	name := o.thanosQueryDeploymentName(cluster)
+	current := &autoscalingv1.HorizontalPodAutoscaler{}
+	err := o.client.Get(context.TODO(), name, current)
+	exists := true
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't fetch query autoscaler: %w", err)
+		}
+		exists = false
+	}
+	switch {
+	case enabled && !exists:
+		if err := o.client.Create(context.TODO(), o.queryAutoscalerManifest(cluster)); err != nil {
+			return fmt.Errorf("couldn't create query autoscaler: %w", err)
+		}
+		o.log.Info("created query autoscaler", "name", name.Name)
+	case enabled && exists:
+		desired := o.queryAutoscalerManifest(cluster)
+		if !equality.Semantic.DeepEqual(current.Spec, desired.Spec) {
+			current.Spec = desired.Spec
+			if err := o.client.Update(context.TODO(), current); err != nil {
+				return fmt.Errorf("couldn't update query autoscaler: %w", err)
+			}
+			o.log.Info("updated query autoscaler", "name", name.Name)
+		}
+	case !enabled && exists:
+		if err := o.client.Delete(context.TODO(), current); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete query autoscaler: %w", err)
+		}
+		o.log.Info("deleted query autoscaler", "name", name.Name)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package operator
+
+import (
+	"reflect"
+	"testing"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestQueryReplicas(t *testing.T) {
+	cluster := &api.MetricsCluster{}
+	if replicas := queryReplicas(cluster); replicas != 1 {
+		t.Errorf("expected 1 replica by default, got %d", replicas)
+	}
+	cluster.Spec.QueryFrontend = &api.QueryFrontendSpec{QueryReplicas: 2}
+	if replicas := queryReplicas(cluster); replicas != 2 {
+		t.Errorf("expected the query frontend's replicas, got %d", replicas)
+	}
+	cluster.Spec.Query = &api.QuerySpec{Replicas: 3}
+	if replicas := queryReplicas(cluster); replicas != 3 {
+		t.Errorf("expected spec.query.replicas to win, got %d", replicas)
+	}
+}
+
+func TestQueryDeploymentScaling(t *testing.T) {
+	o := &Operator{Namespace: "dowser", ThanosImage: "thanos"}
+	cluster := &api.MetricsCluster{}
+	cluster.Name = "ci"
+	cluster.Spec.Query = &api.QuerySpec{Replicas: 3, ReplicaLabels: []string{"replica", "source_copy"}}
+
+	deployment := o.thanosQueryDeploymentManifest(cluster)
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("expected 3 replicas, got %d", *deployment.Spec.Replicas)
+	}
+	command := deployment.Spec.Template.Spec.Containers[0].Command
+	flags := command[len(command)-2:]
+	if expected := []string{"--query.replica-label=replica", "--query.replica-label=source_copy"}; !reflect.DeepEqual(flags, expected) {
+		t.Errorf("expected %v, got %v", expected, flags)
+	}
+}
+
+func TestQueryAutoscalerManifest(t *testing.T) {
+	o := &Operator{Namespace: "dowser"}
+	cluster := &api.MetricsCluster{}
+	cluster.Name = "ci"
+	cluster.Spec.Query = &api.QuerySpec{Replicas: 2, Autoscaling: &api.QueryAutoscalingSpec{MaxReplicas: 1}}
+	if !hasQueryAutoscaling(cluster) {
+		t.Fatalf("expected the query autoscaled")
+	}
+
+	autoscaler := o.queryAutoscalerManifest(cluster)
+	if autoscaler.Name != "query-ci" || autoscaler.Spec.ScaleTargetRef.Name != "query-ci" {
+		t.Errorf("expected the autoscaler to scale query-ci, got %s scaling %s", autoscaler.Name, autoscaler.Spec.ScaleTargetRef.Name)
+	}
+	if *autoscaler.Spec.MinReplicas != 2 || autoscaler.Spec.MaxReplicas != 2 {
+		t.Errorf("expected a maximum below the minimum raised to it, got %d-%d", *autoscaler.Spec.MinReplicas, autoscaler.Spec.MaxReplicas)
+	}
+	if *autoscaler.Spec.TargetCPUUtilizationPercentage != defaultQueryTargetCPU {
+		t.Errorf("expected the default CPU target, got %d", *autoscaler.Spec.TargetCPUUtilizationPercentage)
+	}
+}
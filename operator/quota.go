@@ -0,0 +1,45 @@
+package operator
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Replicas which can't be created because of the namespace's ResourceQuotas or
+// LimitRanges leave their sources pending rather than failing the reconcile,
+// which would otherwise retry them as fast as its backoff allows. They're
+// retried on the cluster's status refresh, until the quota frees up or is
+// raised.
+
+// isQuotaError returns whether err is the API server refusing an object
+// because of a ResourceQuota or a LimitRange.
+func isQuotaError(err error) bool {
+	if !errors.IsForbidden(err) {
+		return false
+	}
+	message := err.Error()
+	for _, reason := range []string{"exceeded quota", "failed quota", "usage per Container", "usage per Pod"} {
+		if strings.Contains(message, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateQuotaCondition reports the quota errors replicas couldn't be created
+// with, recording a warning when they start.
+func (o *Operator) updateQuotaCondition(cluster *api.MetricsCluster, quotaErrors []string) {
+	if len(quotaErrors) == 0 {
+		removeCondition(cluster, api.ConditionQuotaAvailable)
+		return
+	}
+	message := strings.Join(quotaErrors, "; ")
+	if condition := findCondition(cluster, api.ConditionQuotaAvailable); condition == nil || condition.Status != corev1.ConditionFalse {
+		o.recorder.Event(cluster, corev1.EventTypeWarning, eventQuotaExceeded, message)
+	}
+	setCondition(cluster, api.ConditionQuotaAvailable, corev1.ConditionFalse, "QuotaExceeded", message)
+}
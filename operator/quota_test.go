@@ -0,0 +1,53 @@
+package operator
+
+import (
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestIsQuotaError(t *testing.T) {
+	deployments := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	tests := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"quota":      {apierrors.NewForbidden(deployments, "prometheus-1", errors.New("exceeded quota: compute, requested: count/deployments.apps=1, used: count/deployments.apps=10, limited: count/deployments.apps=10")), true},
+		"limitrange": {apierrors.NewForbidden(deployments, "prometheus-1", errors.New("maximum memory usage per Container is 1Gi, but limit is 4Gi")), true},
+		"rbac":       {apierrors.NewForbidden(deployments, "prometheus-1", errors.New(`User "dowser" cannot create resource "deployments"`)), false},
+		"other":      {errors.New("exceeded quota"), false},
+		"none":       {nil, false},
+	}
+	for name, test := range tests {
+		if actual := isQuotaError(test.err); actual != test.expected {
+			t.Errorf("%s: expected %t, got %t", name, test.expected, actual)
+		}
+	}
+}
+
+func TestUpdateQuotaCondition(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	o := &Operator{recorder: recorder}
+	cluster := &api.MetricsCluster{}
+
+	o.updateQuotaCondition(cluster, []string{"exceeded quota: compute"})
+	o.updateQuotaCondition(cluster, []string{"exceeded quota: compute"})
+	condition := findCondition(cluster, api.ConditionQuotaAvailable)
+	if condition == nil || condition.Status != corev1.ConditionFalse || condition.Message != "exceeded quota: compute" {
+		t.Errorf("expected the quota condition to be false, got %+v", condition)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected a single event, got %d", len(recorder.Events))
+	}
+
+	o.updateQuotaCondition(cluster, nil)
+	if condition := findCondition(cluster, api.ConditionQuotaAvailable); condition != nil {
+		t.Errorf("expected the quota condition removed, got %+v", condition)
+	}
+}
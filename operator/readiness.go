@@ -0,0 +1,75 @@
+package operator
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters are reconciled as soon as their replicas become ready or stop
+// being so, rather than on their next periodic recheck, so their phase,
+// notifications and watchers follow promptly. A replica's deployment reports
+// it available shortly after its pod is ready, so both are watched.
+
+// replicaReadinessChanged passes pod events which may change the cluster's
+// view of a replica: pods coming and going, becoming ready or unready, and
+// changing address, which remote read endpoints are configured with.
+var replicaReadinessChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old, isPod := e.ObjectOld.(*corev1.Pod)
+		if !isPod {
+			return false
+		}
+		updated := e.ObjectNew.(*corev1.Pod)
+		return isPodReady(old) != isPodReady(updated) || old.Status.PodIP != updated.Status.PodIP
+	},
+}
+
+// replicaAvailabilityChanged passes deployment events which may change the
+// phase of the clusters referencing it.
+var replicaAvailabilityChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old, isDeployment := e.ObjectOld.(*appsv1.Deployment)
+		if !isDeployment {
+			return false
+		}
+		updated := e.ObjectNew.(*appsv1.Deployment)
+		return old.Status.AvailableReplicas != updated.Status.AvailableReplicas
+	},
+}
+
+// clustersReferencingReplica maps a replica's pod, a claimed pool pod or a
+// replica's deployment to the clusters referencing it.
+func (o *Operator) clustersReferencingReplica() handler.ToRequestsFunc {
+	return func(object handler.MapObject) []reconcile.Request {
+		labels := object.Meta.GetLabels()
+		if deployment, isDeployment := object.Object.(*appsv1.Deployment); isDeployment {
+			labels = deployment.Spec.Template.Labels
+		}
+		switch labels["app"] {
+		case "prometheus", "prometheus-pool":
+		default:
+			return nil
+		}
+		var requests []reconcile.Request
+		for label, value := range labels {
+			if value != "true" && value != excludedReferenceValue {
+				continue
+			}
+			name := types.NamespacedName{Namespace: object.Meta.GetNamespace(), Name: label}
+			if err := o.client.Get(context.TODO(), name, &api.MetricsCluster{}); err != nil {
+				continue
+			}
+			requests = append(requests, reconcile.Request{NamespacedName: name})
+		}
+		return requests
+	}
+}
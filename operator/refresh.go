@@ -0,0 +1,102 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// refreshURLs updates the cluster's materialized sources from its spec when a
+// refresh is due, and returns the time of the next scheduled refresh (zero if
+// the cluster isn't refreshed on a schedule).
+func (o *Operator) refreshURLs(cluster *api.MetricsCluster, now time.Time) (time.Time, error) {
+	if len(cluster.Spec.RefreshSchedule) == 0 {
+		o.setRefreshedURLs(cluster, desiredURLs(cluster), now)
+		return time.Time{}, nil
+	}
+
+	schedule, err := parseCron(cluster.Spec.RefreshSchedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if o.scheduleLocation != nil {
+		now = now.In(o.scheduleLocation)
+	}
+	last := cluster.Status.LastRefreshTime
+	if last == nil || schedule.prev(now).After(last.Time) {
+		o.setRefreshedURLs(cluster, desiredURLs(cluster), now)
+		if cluster.Status.LastRefreshTime == last {
+			// Nothing changed, but record that the refresh happened so it
+			// isn't repeated until the schedule next fires.
+			cluster.Status.LastRefreshTime = &metav1.Time{Time: now}
+		}
+	}
+	return schedule.next(now), nil
+}
+
+func (o *Operator) setRefreshedURLs(cluster *api.MetricsCluster, urls []string, now time.Time) {
+	if equality.Semantic.DeepEqual(cluster.Status.URLs, urls) {
+		return
+	}
+	cluster.Status.URLs = append([]string{}, urls...)
+	cluster.Status.LastRefreshTime = &metav1.Time{Time: now}
+}
+
+// releaseRemovedJobs removes the cluster's reference and ownership from the
+// deployments of sources which are no longer materialized, so they leave the
+// cluster's store service. Deployments no other cluster owns or references
+// are deleted right away rather than by the deployment controller.
+func (o *Operator) releaseRemovedJobs(cluster *api.MetricsCluster, previousJobs map[string]api.JobStatus) error {
+	current := map[string]bool{}
+	for _, job := range cluster.Status.Jobs {
+		current[job.Deployment] = true
+	}
+	for url, job := range previousJobs {
+		if len(job.Deployment) == 0 || current[job.Deployment] {
+			continue
+		}
+		deployment := &appsv1.Deployment{}
+		err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: o.Namespace, Name: job.Deployment}, deployment)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("couldn't fetch deployment: %w", err)
+		}
+		_, hasReference := deployment.Spec.Template.Labels[cluster.Name]
+		if !removeOwner(deployment, cluster.Name) && !hasReference {
+			continue
+		}
+		if deployment.DeletionTimestamp != nil {
+			continue
+		}
+		if !isShared(deployment, cluster.Name) {
+			if err := o.releaseClaimedPod(deployment); err != nil {
+				return err
+			}
+			if err := o.client.Delete(context.TODO(), deployment, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("couldn't delete deployment of removed source: %w", err)
+			}
+			o.log.Info("deleted deployment of removed source", "cluster", cluster.Name, "url", url, "deployment", deployment.Name)
+			continue
+		}
+		if err := o.unreferenceClaimedPod(deployment, cluster.Name); err != nil {
+			return err
+		}
+		delete(deployment.Spec.Template.Labels, cluster.Name)
+		if err := o.client.Update(context.TODO(), deployment); err != nil {
+			return fmt.Errorf("couldn't update deployment to remove reference: %w", err)
+		}
+		o.log.Info("released removed source", "cluster", cluster.Name, "url", url, "deployment", deployment.Name)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package operator
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// A cluster's remote read endpoint is served by a Prometheus without data of
+// its own, configured to remote read from each of the cluster's replicas.
+// Prometheus serves remote read requests from its remote read sources too, so
+// external Prometheus servers can read the cluster's series without speaking
+// the Thanos store API. Remote read has no service discovery, so the
+// configuration lists the replicas' pod addresses and the Prometheus is
+// restarted when they change.
+const remoteReadConfigHashAnnotation = "dowser.dowser/config-hash"
+
+func (o *Operator) remoteReadName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("remote-read-%s", cluster.Name)}
+}
+
+// remoteReadConfig returns the configuration reading from the cluster's ready
+// replicas.
+func (o *Operator) remoteReadConfig(cluster *api.MetricsCluster) (string, error) {
+	pods := &corev1.PodList{}
+	err := o.client.List(context.TODO(), pods, client.InNamespace(o.Namespace), client.MatchingLabels{"app": "prometheus", cluster.Name: "true"})
+	if err != nil {
+		return "", fmt.Errorf("couldn't list replica pods: %w", err)
+	}
+	var urls []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp == nil && isPodReady(pod) && len(pod.Status.PodIP) > 0 {
+			urls = append(urls, fmt.Sprintf("http://%s:9090/api/v1/read", pod.Status.PodIP))
+		}
+	}
+	sort.Strings(urls)
+
+	type remoteRead struct {
+		URL        string `json:"url"`
+		ReadRecent bool   `json:"read_recent"`
+	}
+	config := struct {
+		RemoteRead []remoteRead `json:"remote_read"`
+	}{RemoteRead: []remoteRead{}}
+	for _, url := range urls {
+		config.RemoteRead = append(config.RemoteRead, remoteRead{URL: url, ReadRecent: true})
+	}
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode remote read config: %w", err)
+	}
+	return string(out), nil
+}
+
+func (o *Operator) remoteReadConfigMapManifest(cluster *api.MetricsCluster, config string) *corev1.ConfigMap {
+	name := o.remoteReadName(cluster)
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Data: map[string]string{
+			prometheusConfigKey: config,
+		},
+	}
+}
+
+func (o *Operator) remoteReadDeploymentManifest(cluster *api.MetricsCluster, config string) *appsv1.Deployment {
+	name := o.remoteReadName(cluster)
+	var replicas int32 = 1
+	labels := map[string]string{
+		"app":     "remote-read",
+		"cluster": cluster.Name,
+	}
+	hash := sha256.Sum256([]byte(config))
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+					Annotations: map[string]string{
+						remoteReadConfigHashAnnotation: fmt.Sprintf("%x", hash[:8]),
+					},
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: name.Name},
+								},
+							},
+						},
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:  "prometheus",
+							Image: o.PrometheusImage,
+							Args: []string{
+								"--config.file=/etc/prometheus/" + prometheusConfigKey,
+								"--storage.tsdb.path=/prometheus",
+								"--storage.tsdb.retention.time=1h",
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: 9090,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "config",
+									MountPath: "/etc/prometheus/",
+									ReadOnly:  true,
+								},
+								{
+									Name:      "data",
+									MountPath: "/prometheus",
+								},
+							},
+							ReadinessProbe: readinessProbe("/-/ready", 9090),
+							LivenessProbe:  livenessProbe("/-/healthy", 9090),
+						},
+					},
+				},
+			},
+		},
+	}
+	o.hardenPodSpec(&deployment.Spec.Template.Spec)
+	return deployment
+}
+
+func (o *Operator) remoteReadServiceManifest(cluster *api.MetricsCluster) *corev1.Service {
+	name := o.remoteReadName(cluster)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port:     9090,
+					Protocol: corev1.ProtocolTCP,
+					Name:     "http",
+				},
+			},
+			Selector: map[string]string{
+				"app":     "remote-read",
+				"cluster": cluster.Name,
+			},
+		},
+	}
+}
+
+// ensureRemoteRead creates, updates or removes the cluster's remote read
+// endpoint.
+func (o *Operator) ensureRemoteRead(cluster *api.MetricsCluster) error {
+	enabled := cluster.Spec.RemoteRead && cluster.Spec.Backend != api.BackendVictoriaMetrics
+	name := o.remoteReadName(cluster)
+	config := ""
+	if enabled {
+		var err error
+		if config, err = o.remoteReadConfig(cluster); err != nil {
+			return err
+		}
+	}
+	resources := []managedResource{
+		{"configmap", &corev1.ConfigMap{}, func() runtime.Object { return o.remoteReadConfigMapManifest(cluster, config) }},
+		{"deployment", &appsv1.Deployment{}, func() runtime.Object { return o.remoteReadDeploymentManifest(cluster, config) }},
+		{"service", &corev1.Service{}, func() runtime.Object { return o.remoteReadServiceManifest(cluster) }},
+	}
+	resources = append(resources, o.exposureResources(name, name.Name, clusterOwner(cluster))...)
+	for _, resource := range resources {
+		err := o.client.Get(context.TODO(), name, resource.current)
+		exists := true
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return fmt.Errorf("couldn't fetch remote read %s: %w", resource.kind, err)
+			}
+			exists = false
+		}
+		switch {
+		case enabled && !exists:
+			if err := o.client.Create(context.TODO(), resource.manifest()); err != nil {
+				return fmt.Errorf("couldn't create remote read %s: %w", resource.kind, err)
+			}
+			o.log.Info("created remote read "+resource.kind, "name", name.Name)
+		case enabled && exists:
+			if updated := updateRemoteRead(resource.current, resource.manifest()); updated {
+				if err := o.client.Update(context.TODO(), resource.current); err != nil {
+					return fmt.Errorf("couldn't update remote read %s: %w", resource.kind, err)
+				}
+				o.log.Info("updated remote read "+resource.kind, "name", name.Name)
+			}
+		case !enabled && exists:
+			if err := o.client.Delete(context.TODO(), resource.current); err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("couldn't delete remote read %s: %w", resource.kind, err)
+			}
+			o.log.Info("deleted remote read "+resource.kind, "name", name.Name)
+		}
+	}
+	return nil
+}
+
+// updateRemoteRead copies the parts of a remote read resource which follow
+// the replicas into current, reporting whether anything changed.
+func updateRemoteRead(current, desired runtime.Object) bool {
+	switch current := current.(type) {
+	case *corev1.ConfigMap:
+		desired := desired.(*corev1.ConfigMap)
+		if equality.Semantic.DeepEqual(current.Data, desired.Data) {
+			return false
+		}
+		current.Data = desired.Data
+		return true
+	case *appsv1.Deployment:
+		desired := desired.(*appsv1.Deployment)
+		if hasEntries(current.Spec.Template.Annotations, desired.Spec.Template.Annotations) {
+			return false
+		}
+		current.Spec.Template.Annotations = mergeEntries(current.Spec.Template.Annotations, desired.Spec.Template.Annotations)
+		return true
+	}
+	return false
+}
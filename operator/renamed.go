@@ -0,0 +1,101 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Resources serving a single cluster are named with a prefix followed by the
+// cluster's name. No prefix may start another: a cluster named like the rest
+// of the longer prefix followed by another cluster's name, e.g. frontend-a
+// with query- and query-frontend-, or gateway-a with store- and
+// store-gateway-, would be given the names of that cluster's resources.
+// Resources renamed for that reason are deleted under their former names once
+// at startup, and created again under their new ones as their clusters are
+// reconciled.
+
+// renamedPrefix is the former name prefix of resources, and the app label of
+// their pods, which tells them apart from resources of other clusters which
+// happen to have the same names.
+type renamedPrefix struct {
+	prefix string
+	app    string
+}
+
+var renamedPrefixes = []renamedPrefix{
+	{prefix: "query-frontend-", app: "thanos-query-frontend"},
+	{prefix: "store-gateway-", app: "thanos-store-gateway"},
+}
+
+// renamedResourcesRetryInterval is how often deleting renamed resources is
+// retried after failing.
+const renamedResourcesRetryInterval = time.Minute
+
+// deleteRenamedResources deletes the resources left under former names,
+// retrying until it succeeds or stop is closed.
+func (o *Operator) deleteRenamedResources(stop <-chan struct{}) error {
+	err := wait.PollImmediateUntil(renamedResourcesRetryInterval, func() (bool, error) {
+		if err := o.deleteRenamed(); err != nil {
+			o.log.Error(err, "couldn't delete renamed resources")
+			return false, nil
+		}
+		return true, nil
+	}, stop)
+	if err == wait.ErrWaitTimeout {
+		return nil
+	}
+	return err
+}
+
+// deleteRenamed deletes the deployments and services of this instance named
+// with a former prefix.
+func (o *Operator) deleteRenamed() error {
+	deployments := &appsv1.DeploymentList{}
+	if err := o.client.List(context.TODO(), deployments, client.InNamespace(o.Namespace)); err != nil {
+		return fmt.Errorf("couldn't list deployments: %w", err)
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if !o.ownsObject(deployment) || !isRenamed(deployment.Name, deployment.Labels) {
+			continue
+		}
+		if err := o.client.Delete(context.TODO(), deployment); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete renamed deployment %s: %w", deployment.Name, err)
+		}
+		o.log.Info("deleted renamed deployment", "name", deployment.Name)
+	}
+	services := &corev1.ServiceList{}
+	if err := o.client.List(context.TODO(), services, client.InNamespace(o.Namespace)); err != nil {
+		return fmt.Errorf("couldn't list services: %w", err)
+	}
+	for i := range services.Items {
+		service := &services.Items[i]
+		if !o.ownsObject(service) || !isRenamed(service.Name, service.Spec.Selector) {
+			continue
+		}
+		if err := o.client.Delete(context.TODO(), service); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete renamed service %s: %w", service.Name, err)
+		}
+		o.log.Info("deleted renamed service", "name", service.Name)
+	}
+	return nil
+}
+
+// isRenamed returns whether a resource with the given name, whose pods have
+// the given labels, is named with a former prefix.
+func isRenamed(name string, podLabels map[string]string) bool {
+	for _, renamed := range renamedPrefixes {
+		if strings.HasPrefix(name, renamed.prefix) && podLabels["app"] == renamed.app && podLabels["cluster"] == strings.TrimPrefix(name, renamed.prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestClusterResourceNamesDontCollide(t *testing.T) {
+	o := &Operator{Namespace: "dowser"}
+	names := map[string]func(*api.MetricsCluster) types.NamespacedName{
+		"store service":   o.thanosStoreServiceName,
+		"store gateway":   o.storeGatewayName,
+		"query":           o.thanosQueryDeploymentName,
+		"query frontend":  o.queryFrontendName,
+		"bucket web":      o.bucketWebName,
+		"compactor":       o.compactorName,
+		"remote read":     o.remoteReadName,
+		"victoriametrics": o.victoriaMetricsName,
+		"grafana":         o.grafanaName,
+		"queriers policy": o.queriersPolicyName,
+		"query results":   o.queryResultsName,
+	}
+	cluster := func(name string) *api.MetricsCluster {
+		return &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: name}}
+	}
+
+	prefixes := map[string]string{}
+	for kind, name := range names {
+		prefix := strings.TrimSuffix(name(cluster("a")).Name, "a")
+		for otherKind, other := range prefixes {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				t.Errorf("the prefixes of %s (%s) and %s (%s) collide", kind, prefix, otherKind, other)
+			}
+		}
+		prefixes[kind] = prefix
+	}
+
+	// The query of a cluster named like the rest of the frontend's former
+	// prefix doesn't take the name of another cluster's frontend.
+	if query, frontend := o.thanosQueryDeploymentName(cluster("frontend-a")), o.queryFrontendName(cluster("a")); query == frontend {
+		t.Errorf("expected the query of frontend-a and the query frontend of a named apart, both are %s", query.Name)
+	}
+	if store, gateway := o.thanosStoreServiceName(cluster("gateway-a")), o.storeGatewayName(cluster("a")); store == gateway {
+		t.Errorf("expected the store of gateway-a and the store gateway of a named apart, both are %s", store.Name)
+	}
+}
+
+func TestIsRenamed(t *testing.T) {
+	tests := []struct {
+		name      string
+		podLabels map[string]string
+		expected  bool
+	}{
+		{name: "query-frontend-a", podLabels: map[string]string{"app": "thanos-query-frontend", "cluster": "a"}, expected: true},
+		// The query of the cluster named frontend-a.
+		{name: "query-frontend-a", podLabels: map[string]string{"app": "thanos-query", "cluster": "frontend-a"}},
+		{name: "queryfrontend-a", podLabels: map[string]string{"app": "thanos-query-frontend", "cluster": "a"}},
+		{name: "store-gateway-a", podLabels: map[string]string{"app": "thanos-store-gateway", "cluster": "a"}, expected: true},
+		// The store of the cluster named gateway-a.
+		{name: "store-gateway-a", podLabels: map[string]string{"app": "prometheus", "gateway-a": "true"}},
+		{name: "storegateway-a", podLabels: map[string]string{"app": "thanos-store-gateway", "cluster": "a"}},
+	}
+	for _, test := range tests {
+		if renamed := isRenamed(test.name, test.podLabels); renamed != test.expected {
+			t.Errorf("%s with pods labeled %v: expected renamed %t, got %t", test.name, test.podLabels, test.expected, renamed)
+		}
+	}
+}
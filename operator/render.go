@@ -0,0 +1,158 @@
+package operator
+
+import (
+	"fmt"
+	"io"
+
+	routev1 "github.com/openshift/api/route/v1"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	logging "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+type renderOptions struct {
+	URLs        []string
+	ClusterName string
+}
+
+func NewRenderCommand() *cobra.Command {
+	operator := &Operator{}
+	var options renderOptions
+
+	var command = &cobra.Command{
+		Use:   "render --url URL",
+		Short: "Prints the manifests the operator would create for sources.",
+		Long: `Prints the manifests the operator would create for sources.
+
+The artifacts of each source are discovered as the operator would, and the
+Prometheus deployment and configuration of each source, and the Thanos store
+service, query deployment and service and the query's route or ingress of a
+cluster serving them are printed as YAML, without contacting a cluster. The
+operator's flags apply, so manifests can be compared across configurations.
+Owner references are left out, since there's no cluster to own the
+manifests when they're applied by hand.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := render(operator, options, cmd.OutOrStdout())
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().StringArrayVarP(&options.URLs, "url", "", nil, "source to render the manifests of, repeated for several")
+	command.Flags().StringVarP(&options.ClusterName, "cluster", "", "render", "name of the cluster serving the sources")
+	operator.addFlags(command)
+
+	return command
+}
+
+func render(o *Operator, options renderOptions, out io.Writer) error {
+	if len(options.URLs) == 0 {
+		return fmt.Errorf("no --url given")
+	}
+	o.log = logging.Log.WithName("render")
+	if err := o.parseOptions(o.log); err != nil {
+		return err
+	}
+	// Without a cluster to detect them on, routes are assumed served, as on
+	// OpenShift.
+	exposeMode, err := resolveExposeMode(o.ExposeMode, capabilities{capabilityRoute: true})
+	if err != nil {
+		return err
+	}
+	o.exposeMode = exposeMode
+
+	cluster := &api.MetricsCluster{}
+	cluster.Name = options.ClusterName
+	cluster.Namespace = o.Namespace
+	cluster.Spec.URLs = options.URLs
+
+	fetcher := newArtifactFetcher(o)
+	var jobs []*Job
+	for _, url := range options.URLs {
+		artifacts := fetcher.discover(url)
+		if artifacts.err != nil {
+			return fmt.Errorf("couldn't discover the artifacts of %s: %w", url, artifacts.err)
+		}
+		if artifacts.prowJob.Status.CompletionTime == nil {
+			return fmt.Errorf("%s hasn't completed", url)
+		}
+		jobs = append(jobs, &Job{
+			ProwJob:          artifacts.prowJob,
+			PrometheusTarURL: artifacts.tarURL,
+			PrometheusImage:  artifacts.image,
+			ExtractedSize:    artifacts.extractedSize,
+			DisplayName:      sourceDisplayName(cluster, url),
+			Artifacts:        artifacts.artifacts,
+		})
+	}
+
+	objects, err := o.renderManifests(cluster, jobs)
+	if err != nil {
+		return err
+	}
+	return printManifests(objects, out)
+}
+
+// renderManifests returns the replicas of the cluster's jobs and the
+// components serving its queries, as reconciles would create them.
+func (o *Operator) renderManifests(cluster *api.MetricsCluster, jobs []*Job) ([]runtime.Object, error) {
+	var objects []runtime.Object
+	for _, job := range jobs {
+		deployment := o.prometheusDeploymentManifest(cluster, job)
+		deployment.Spec.Template.Labels[cluster.Name] = "true"
+		o.configureReplica(deployment, []*api.MetricsCluster{cluster})
+		setTemplateHash(deployment)
+		config, err := renderPrometheusConfig(deployment.Name, job, nil)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, deployment, o.prometheusConfigMapManifest(deployment, config))
+	}
+	objects = append(objects,
+		o.thanosStoreServiceManifest(cluster),
+		o.thanosQueryDeploymentManifest(cluster),
+		o.thanosQueryServiceManifest(cluster),
+	)
+	if o.exposeMode != exposeNone {
+		objects = append(objects, o.exposureManifest(o.thanosQueryRouteName(cluster), o.thanosQueryServiceName(cluster).Name, nil))
+	}
+	return objects, nil
+}
+
+// printManifests prints the objects as a YAML stream, with their kinds and
+// without owner references.
+func printManifests(objects []runtime.Object, out io.Writer) error {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return err
+	}
+	if err := routev1.Install(scheme); err != nil {
+		return err
+	}
+	for _, object := range objects {
+		kinds, _, err := scheme.ObjectKinds(object)
+		if err != nil {
+			return err
+		}
+		object.GetObjectKind().SetGroupVersionKind(kinds[0])
+		accessor, err := meta.Accessor(object)
+		if err != nil {
+			return err
+		}
+		accessor.SetOwnerReferences(nil)
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			return fmt.Errorf("couldn't encode %s: %w", accessor.GetName(), err)
+		}
+		if _, err := fmt.Fprintf(out, "---\n%s", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package operator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestRenderManifests(t *testing.T) {
+	o := &Operator{
+		Namespace:        "dowser",
+		PrometheusImage:  "prometheus",
+		ThanosImage:      "thanos",
+		PrometheusMemory: "350Mi",
+		exposeMode:       exposeRoute,
+	}
+	cluster := &api.MetricsCluster{}
+	cluster.Name = "render"
+	cluster.Namespace = "dowser"
+	completed := metav1.Date(2020, 10, 1, 13, 0, 0, 0, time.UTC)
+	job := &Job{
+		ProwJob: prowapi.ProwJob{
+			Spec:   prowapi.ProwJobSpec{Job: "job"},
+			Status: prowapi.ProwJobStatus{URL: "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1", BuildID: "1", StartTime: completed, CompletionTime: &completed},
+		},
+		PrometheusTarURL: "https://storage.googleapis.com/origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar",
+		PrometheusImage:  "prometheus",
+	}
+	objects, err := o.renderManifests(cluster, []*Job{job})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := printManifests(objects, out); err != nil {
+		t.Fatal(err)
+	}
+	rendered := out.String()
+
+	documents := strings.Count(rendered, "---\n")
+	if documents != 6 {
+		t.Errorf("expected 6 manifests, got %d:\n%s", documents, rendered)
+	}
+	for _, kind := range []string{"kind: Deployment", "kind: ConfigMap", "kind: Service", "kind: Route"} {
+		if !strings.Contains(rendered, kind) {
+			t.Errorf("expected a manifest of %s, got:\n%s", kind, rendered)
+		}
+	}
+	if strings.Contains(rendered, "ownerReferences") {
+		t.Errorf("expected no owner references, got:\n%s", rendered)
+	}
+}
@@ -0,0 +1,169 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Sources are replayed to a remote write endpoint by a Job per cluster,
+// endpoint and source. The Job's pod fetches the data like a replica, runs
+// Prometheus over it and streams its samples with the replay command, which
+// shuts Prometheus down once done so the pod completes.
+
+// replayJobName names the Job replaying a source; the purpose distinguishes
+// Jobs of the same source writing to different endpoints.
+func (o *Operator) replayJobName(purpose string, cluster *api.MetricsCluster, deploymentName string) types.NamespacedName {
+	name := fmt.Sprintf("%s-%s-%s", purpose, cluster.Name, strings.TrimPrefix(deploymentName, "prometheus-"))
+	return types.NamespacedName{Namespace: o.Namespace, Name: name}
+}
+
+// remoteWriteEndpoint returns the environment of the replay command writing to
+// the cluster's remote write endpoint.
+func remoteWriteEndpoint(cluster *api.MetricsCluster) []corev1.EnvVar {
+	secretKey := func(key string, optional bool) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: cluster.Spec.RemoteWrite.SecretName},
+				Key:                  key,
+				Optional:             &optional,
+			},
+		}
+	}
+	return []corev1.EnvVar{
+		{Name: "REMOTE_WRITE_URL", ValueFrom: secretKey("url", false)},
+		{Name: "REMOTE_WRITE_USERNAME", ValueFrom: secretKey("username", true)},
+		{Name: "REMOTE_WRITE_PASSWORD", ValueFrom: secretKey("password", true)},
+		{Name: "REMOTE_WRITE_BEARER_TOKEN", ValueFrom: secretKey("bearerToken", true)},
+	}
+}
+
+func (o *Operator) replayJobManifest(name types.NamespacedName, cluster *api.MetricsCluster, job *Job, deploymentName string, endpoint []corev1.EnvVar) *batchv1.Job {
+	var backoffLimit int32 = 2
+
+	// The replayed Prometheus only serves queries, so it runs with an empty
+	// configuration.
+	podSpec := o.prometheusPodSpec(job.PrometheusImage, deploymentInitScript()+": > /etc/prometheus/"+prometheusConfigKey+"\n", []corev1.EnvVar{
+		{
+			Name:  "PROMTAR",
+			Value: job.PrometheusTarURL,
+		},
+	}, corev1.VolumeSource{
+		EmptyDir: &corev1.EmptyDirVolumeSource{},
+	})
+	podSpec.InitContainers[0].VolumeMounts = append(podSpec.InitContainers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      "prometheus-config",
+		MountPath: "/etc/prometheus/",
+	})
+	applyChecksumPin(&podSpec, job.SHA256)
+	enablePrometheusFeatures(&podSpec, cluster.Spec.PrometheusFeatures)
+	applyPrometheusResources(&podSpec, []*api.MetricsCluster{cluster})
+	podSpec.RestartPolicy = corev1.RestartPolicyNever
+	replayCommand := []string{
+		"dowser",
+		"replay",
+		"--prometheus-url=http://localhost:9090",
+		"--start=" + job.Status.StartTime.UTC().Format(time.RFC3339),
+		"--end=" + job.Status.CompletionTime.UTC().Format(time.RFC3339),
+		"--label=cluster_url=" + job.Status.URL,
+		"--label=cluster_job=" + job.Spec.Job,
+		"--quit",
+	}
+	if len(job.DisplayName) > 0 {
+		replayCommand = append(replayCommand, "--label=run="+job.DisplayName)
+	}
+	if source := sourceLabel(job); len(source) > 0 {
+		replayCommand = append(replayCommand, "--label=source="+source)
+	}
+
+	// The data is served by Prometheus alone; the Thanos sidecar gives way
+	// to the replay.
+	podSpec.Containers = []corev1.Container{
+		podSpec.Containers[0],
+		{
+			Name:    "replay",
+			Image:   o.OperatorImage,
+			Command: replayCommand,
+			Env:     endpoint,
+		},
+	}
+
+	replayJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: name.Namespace,
+			Name:      name.Name,
+			Labels: map[string]string{
+				"app":        "replay",
+				"cluster":    cluster.Name,
+				"prometheus": deploymentName,
+			},
+			Annotations: map[string]string{
+				"url": job.Status.URL,
+			},
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"app":     "replay",
+						"cluster": cluster.Name,
+					},
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+	o.hardenPodSpec(&replayJob.Spec.Template.Spec)
+	return replayJob
+}
+
+// ensureReplay starts the named Job replaying the job's source to an endpoint
+// if it hasn't been yet, and returns the replay's progress. Replays run once;
+// they're not repeated when the endpoint changes. Sources of jobs still
+// running aren't replayed.
+func (o *Operator) ensureReplay(name types.NamespacedName, cluster *api.MetricsCluster, job *Job, deploymentName string, endpoint []corev1.EnvVar) (api.ReplayPhase, error) {
+	if job.Status.CompletionTime == nil {
+		return "", nil
+	}
+	replayJob := &batchv1.Job{}
+	err := o.client.Get(context.TODO(), name, replayJob)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return "", fmt.Errorf("couldn't fetch replay job: %w", err)
+		}
+		replayJob = o.replayJobManifest(name, cluster, job, deploymentName, endpoint)
+		if err := o.client.Create(context.TODO(), replayJob); err != nil {
+			return "", fmt.Errorf("couldn't create replay job: %w", err)
+		}
+		o.log.Info("created replay job", "name", replayJob.Name, "url", job.Status.URL)
+		return api.ReplayRunning, nil
+	}
+	return replayJobPhase(replayJob), nil
+}
+
+// replayJobPhase returns the progress of a Job run to completion once.
+func replayJobPhase(replayJob *batchv1.Job) api.ReplayPhase {
+	for _, condition := range replayJob.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return api.ReplaySucceeded
+		case batchv1.JobFailed:
+			return api.ReplayFailed
+		}
+	}
+	return api.ReplayRunning
+}
@@ -0,0 +1,151 @@
+package operator
+
+import (
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Sources are resolved into the prow job of their build and the URL their
+// Prometheus tarball is fetched from by the first resolver in resolvers
+// matching them, so a CI backend is supported by registering a resolver
+// rather than by changing discovery or reconciles. Clusters list which
+// resolver each of their sources went through in status.jobs[].resolver.
+
+// A resolver resolves the sources of one backend.
+type resolver interface {
+	// name identifies the resolver in clusters' status.
+	name() string
+
+	// matches returns whether the resolver handles the source at url.
+	matches(url string) bool
+
+	// resolve sets the source's prow job and the http(s) URL of its tarball
+	// on result, or its error and the reason for it, waiting on f before each
+	// request.
+	resolve(f *artifactFetcher, url string, result *sourceArtifacts)
+}
+
+// resolvers are tried in order; the last one matches every source.
+var resolvers = []resolver{
+	tarballResolver{scheme: "gs"},
+	tarballResolver{scheme: "s3"},
+	tarballResolver{scheme: "file"},
+	tarballResolver{scheme: "http"},
+	prowResolver{},
+}
+
+// resolverFor returns the resolver handling the source at url.
+func resolverFor(url string) resolver {
+	for _, resolver := range resolvers {
+		if resolver.matches(url) {
+			return resolver
+		}
+	}
+	return nil
+}
+
+// resolverName returns the name of the resolver handling the source at url,
+// or an empty string if none does.
+func resolverName(url string) string {
+	if resolver := resolverFor(url); resolver != nil {
+		return resolver.name()
+	}
+	return ""
+}
+
+// tarballResolver resolves tarball sources of a scheme, standing in a prow
+// job for them. The http resolver handles https URLs too.
+type tarballResolver struct {
+	scheme string
+}
+
+func (r tarballResolver) name() string {
+	return r.scheme
+}
+
+func (r tarballResolver) matches(url string) bool {
+	parsed, err := neturl.Parse(url)
+	if err != nil || !isTarballURL(url) {
+		return false
+	}
+	if r.scheme == "http" {
+		return parsed.Scheme == "http" || parsed.Scheme == "https"
+	}
+	return parsed.Scheme == r.scheme
+}
+
+func (r tarballResolver) resolve(f *artifactFetcher, url string, result *sourceArtifacts) {
+	if r.scheme == "file" && !f.operator.localSources {
+		result.err, result.reason = fmt.Errorf("file sources are only read by the fetch command"), api.FailureArtifactMissing
+		return
+	}
+	tarURL, err := tarballHTTPURL(url)
+	if err != nil {
+		result.err, result.reason = err, api.FailureArtifactMissing
+		return
+	}
+	f.wait(tarURL)
+	result.prowJob, err = tarballProwJob(url, tarURL)
+	if err != nil {
+		f.operator.log.Error(err, "couldn't fetch tarball", "url", url)
+		result.err, result.reason = fmt.Errorf("couldn't fetch tarball: %w", err), api.FailureArtifactMissing
+		return
+	}
+	result.tarURL = tarURL
+}
+
+// prowResolver resolves prow builds viewed under ProwBaseURL, reading their
+// prow job from GCSStorageBaseURL and finding their tarball among their
+// artifacts in GCS.
+type prowResolver struct{}
+
+func (prowResolver) name() string {
+	return "prow"
+}
+
+func (prowResolver) matches(url string) bool {
+	return true
+}
+
+func (prowResolver) resolve(f *artifactFetcher, url string, result *sourceArtifacts) {
+	o := f.operator
+	log := o.log.WithValues("url", url)
+	prowInfoURL := strings.ReplaceAll(url, o.ProwBaseURL, o.GCSStorageBaseURL) + "/prowjob.json"
+	f.wait(prowInfoURL)
+	if err := fetchProwJob(prowInfoURL, &result.prowJob); err != nil {
+		log.Error(err, "couldn't get prow info", "prowInfoURL", prowInfoURL)
+		result.err, result.reason = fmt.Errorf("couldn't fetch prow job: %w", err), api.FailureDownloadFailed
+		return
+	}
+	f.wait(url)
+	tarURL, err := o.findPrometheusTarURL(url, result.prowJob)
+	if err != nil {
+		log.Error(err, "no prometheus tar URL defined for build")
+		result.err, result.reason = fmt.Errorf("couldn't find prometheus tarball: %w", err), api.FailureArtifactMissing
+		return
+	}
+	result.tarURL = tarURL
+	if len(o.JobArtifacts) > 0 {
+		f.wait(url)
+		result.artifacts, err = o.findJobArtifacts(url)
+		if err != nil {
+			log.Error(err, "couldn't find job artifacts")
+		}
+	}
+}
+
+var registerFileTransport sync.Once
+
+// enableFileSources lets the operator's http requests read file:// URLs, so
+// local commands can be given tarballs on disk.
+func (o *Operator) enableFileSources() {
+	registerFileTransport.Do(func() {
+		http.DefaultTransport.(*http.Transport).RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	})
+	o.localSources = true
+}
@@ -0,0 +1,79 @@
+package operator
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestResolverName(t *testing.T) {
+	tests := map[string]string{
+		"https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1":                           "prow",
+		"https://storage.googleapis.com/origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar": "http",
+		"gs://dowser-uploads/snapshot":         "gs",
+		"s3://dowser-uploads/snapshot.tar.gz":  "s3",
+		"file:///tmp/must-gather/snapshot.tar": "file",
+	}
+	for url, expected := range tests {
+		if name := resolverName(url); name != expected {
+			t.Errorf("%s: expected resolver %q, got %q", url, expected, name)
+		}
+	}
+}
+
+func TestTarballHTTPURL(t *testing.T) {
+	tarURL, err := tarballHTTPURL("s3://dowser-uploads/snapshots/prometheus.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "https://dowser-uploads.s3.amazonaws.com/snapshots/prometheus.tar"; tarURL != expected {
+		t.Errorf("expected %s, got %s", expected, tarURL)
+	}
+	if _, err := tarballHTTPURL("s3://dowser-uploads"); err == nil {
+		t.Errorf("expected an error for a bucket without an object")
+	}
+}
+
+func TestResolveFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/snapshot.tar"
+	if err := ioutil.WriteFile(file, []byte("tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2020, 10, 1, 13, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Operator{log: log.NullLogger{}}
+	f := newArtifactFetcher(o)
+	url := "file://" + file
+	result := &sourceArtifacts{}
+	resolverFor(url).resolve(f, url, result)
+	if result.err == nil {
+		t.Errorf("expected file sources to be refused in a cluster")
+	}
+
+	o.enableFileSources()
+	result = &sourceArtifacts{}
+	resolverFor(url).resolve(f, url, result)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result.tarURL != url {
+		t.Errorf("expected the tarball at %s, got %s", url, result.tarURL)
+	}
+	if completed := result.prowJob.Status.CompletionTime; completed == nil || !completed.Time.Equal(modified) {
+		t.Errorf("expected the job completed at %s, got %v", modified, completed)
+	}
+	if result.prowJob.Spec.Job != "snapshot" {
+		t.Errorf("expected the job named after the tarball, got %q", result.prowJob.Spec.Job)
+	}
+}
@@ -0,0 +1,44 @@
+package operator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// applyPrometheusResources sets the resources of the Prometheus container of
+// a replica's pod from the first of the referencing clusters overriding them.
+// The storage request sized from the source's data is kept.
+func applyPrometheusResources(podSpec *corev1.PodSpec, referencing []*api.MetricsCluster) {
+	for _, cluster := range referencing {
+		if cluster.Spec.PrometheusResources == nil {
+			continue
+		}
+		for i := range podSpec.Containers {
+			container := &podSpec.Containers[i]
+			if container.Name != "prometheus" {
+				continue
+			}
+			storage, hasStorage := container.Resources.Requests[corev1.ResourceEphemeralStorage]
+			container.Resources = *cluster.Spec.PrometheusResources.DeepCopy()
+			if hasStorage {
+				if container.Resources.Requests == nil {
+					container.Resources.Requests = corev1.ResourceList{}
+				}
+				container.Resources.Requests[corev1.ResourceEphemeralStorage] = storage
+			}
+		}
+		return
+	}
+}
+
+// applyThanosResources sets the resources of the containers of one of the
+// cluster's Thanos components from the cluster's override, if any.
+func applyThanosResources(podSpec *corev1.PodSpec, cluster *api.MetricsCluster) {
+	if cluster.Spec.ThanosResources == nil {
+		return
+	}
+	for i := range podSpec.Containers {
+		podSpec.Containers[i].Resources = *cluster.Spec.ThanosResources.DeepCopy()
+	}
+}
@@ -0,0 +1,88 @@
+package operator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/prow"
+)
+
+// CI buckets delete artifacts some time after their builds, after which
+// replicas of their sources can't be recreated. With the retention of their
+// buckets given, sources report when their tarballs expire, and clusters are
+// warned ahead of it so they can be archived or their tarballs mirrored.
+
+// parseArtifactRetention parses bucket retentions, e.g. 90d.
+func parseArtifactRetention(retention map[string]string) (map[string]time.Duration, error) {
+	parsed := map[string]time.Duration{}
+	for bucket, value := range retention {
+		duration, err := model.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifact retention of %s: %w", bucket, err)
+		}
+		parsed[bucket] = time.Duration(duration)
+	}
+	return parsed, nil
+}
+
+// artifactExpiration returns when the bucket keeping the job's tarball
+// deletes it, or nil if its retention isn't known or the job hasn't
+// completed.
+func (o *Operator) artifactExpiration(job *Job) *metav1.Time {
+	retention, known := o.artifactRetention[prow.ObjectBucket(job.PrometheusTarURL)]
+	if !known || job.Status.CompletionTime == nil {
+		return nil
+	}
+	expiration := metav1.NewTime(job.Status.CompletionTime.Add(retention))
+	return &expiration
+}
+
+// updateArtifactsExpiring sets the ArtifactsExpiring condition of the cluster
+// from its sources' expiration times, recording a warning when it becomes
+// true. It returns the notification due then, if any.
+func (o *Operator) updateArtifactsExpiring(cluster *api.MetricsCluster, now time.Time) *notification {
+	var expiring []string
+	for _, job := range cluster.Status.Jobs {
+		if job.ArtifactExpirationTime != nil && now.Add(o.ArtifactExpiryWarning).After(job.ArtifactExpirationTime.Time) {
+			expiring = append(expiring, fmt.Sprintf("%s (%s)", job.URL, job.ArtifactExpirationTime.UTC().Format(time.RFC3339)))
+		}
+	}
+	if len(expiring) == 0 {
+		removeCondition(cluster, api.ConditionArtifactsExpiring)
+		return nil
+	}
+	sort.Strings(expiring)
+	message := fmt.Sprintf("tarballs expiring: %s", strings.Join(expiring, ", "))
+	condition := findCondition(cluster, api.ConditionArtifactsExpiring)
+	starting := condition == nil || condition.Status != corev1.ConditionTrue
+	setCondition(cluster, api.ConditionArtifactsExpiring, corev1.ConditionTrue, "RetentionEnding", message)
+	if !starting {
+		return nil
+	}
+	o.recorder.Event(cluster, corev1.EventTypeWarning, eventArtifactsExpiring, message)
+	n := newNotification(cluster.Namespace, cluster.Name, notificationArtifactsExpiring, message)
+	return &n
+}
+
+// nextArtifactWarning returns when the next source of the cluster starts
+// expiring, or the zero time if none will.
+func nextArtifactWarning(cluster *api.MetricsCluster, warning time.Duration, now time.Time) time.Time {
+	var next time.Time
+	for _, job := range cluster.Status.Jobs {
+		if job.ArtifactExpirationTime == nil {
+			continue
+		}
+		start := job.ArtifactExpirationTime.Add(-warning)
+		if start.After(now) && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	return next
+}
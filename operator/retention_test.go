@@ -0,0 +1,70 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestArtifactExpiration(t *testing.T) {
+	retention, err := parseArtifactRetention(map[string]string{"origin-ci-test": "90d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Operator{artifactRetention: retention}
+	completed := metav1.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	job := &Job{
+		ProwJob:          prowapi.ProwJob{Status: prowapi.ProwJobStatus{CompletionTime: &completed}},
+		PrometheusTarURL: "https://storage.googleapis.com/origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar",
+	}
+	expiration := o.artifactExpiration(job)
+	if expected := completed.Add(90 * 24 * time.Hour); expiration == nil || !expiration.Time.Equal(expected) {
+		t.Errorf("expected the tarball to expire at %s, got %v", expected, expiration)
+	}
+	job.PrometheusTarURL = "https://storage.googleapis.com/mirror/origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar"
+	if expiration := o.artifactExpiration(job); expiration != nil {
+		t.Errorf("expected no expiration for a bucket of unknown retention, got %v", expiration)
+	}
+}
+
+func TestUpdateArtifactsExpiring(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	o := &Operator{recorder: recorder, ArtifactExpiryWarning: 7 * 24 * time.Hour}
+	now := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	expiration := func(after time.Duration) *metav1.Time {
+		t := metav1.NewTime(now.Add(after))
+		return &t
+	}
+	cluster := &api.MetricsCluster{}
+	cluster.Status.Jobs = []api.JobStatus{
+		{URL: "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1", ArtifactExpirationTime: expiration(30 * 24 * time.Hour)},
+		{URL: "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/2"},
+	}
+
+	if n := o.updateArtifactsExpiring(cluster, now); n != nil || findCondition(cluster, api.ConditionArtifactsExpiring) != nil {
+		t.Errorf("expected no warning a month ahead")
+	}
+	if next := nextArtifactWarning(cluster, o.ArtifactExpiryWarning, now); !next.Equal(now.Add(23 * 24 * time.Hour)) {
+		t.Errorf("expected the next warning in 23 days, got %s", next)
+	}
+
+	cluster.Status.Jobs[0].ArtifactExpirationTime = expiration(2 * 24 * time.Hour)
+	if n := o.updateArtifactsExpiring(cluster, now); n == nil || n.Event != notificationArtifactsExpiring {
+		t.Errorf("expected a notification as the tarball starts expiring, got %v", n)
+	}
+	if n := o.updateArtifactsExpiring(cluster, now); n != nil {
+		t.Errorf("expected a single notification, got %v", n)
+	}
+	if condition := findCondition(cluster, api.ConditionArtifactsExpiring); condition == nil || condition.Status != corev1.ConditionTrue {
+		t.Errorf("expected the condition to be true, got %+v", condition)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected a single event, got %d", len(recorder.Events))
+	}
+}
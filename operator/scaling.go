@@ -0,0 +1,50 @@
+package operator
+
+import (
+	"time"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// scheduledReplicas returns the number of replicas the cluster's Prometheus
+// deployments should have at the given time according to its scale schedules,
+// along with the time that number is next due to change (zero if never).
+//
+// Replicas are down if the scale-down schedule fired more recently than the
+// scale-up schedule.
+func (o *Operator) scheduledReplicas(cluster *api.MetricsCluster, now time.Time) (int32, time.Time, error) {
+	downSpec, upSpec := cluster.Spec.ScaleDownSchedule, cluster.Spec.ScaleUpSchedule
+	if len(downSpec) == 0 && len(upSpec) == 0 {
+		downSpec, upSpec = o.ScaleDownSchedule, o.ScaleUpSchedule
+	}
+	if len(downSpec) == 0 {
+		return 1, time.Time{}, nil
+	}
+	down, err := parseCron(downSpec)
+	if err != nil {
+		return 1, time.Time{}, err
+	}
+	var up *cronSchedule
+	if len(upSpec) > 0 {
+		up, err = parseCron(upSpec)
+		if err != nil {
+			return 1, time.Time{}, err
+		}
+	}
+
+	if o.scheduleLocation != nil {
+		now = now.In(o.scheduleLocation)
+	}
+	lastDown := down.prev(now)
+	var lastUp time.Time
+	if up != nil {
+		lastUp = up.prev(now)
+	}
+	if !lastDown.IsZero() && lastDown.After(lastUp) {
+		if up == nil {
+			return 0, time.Time{}, nil
+		}
+		return 0, up.next(now), nil
+	}
+	return 1, down.next(now), nil
+}
@@ -0,0 +1,70 @@
+package operator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// hardenPodSpec makes a generated pod acceptable to hardened clusters: its
+// containers run as a non-root user with a read-only root filesystem, writing
+// only to explicit volumes. Scratch space is an emptyDir mounted at /tmp in
+// every container. The user is assigned by the platform (as on OpenShift)
+// unless RunAsUser is set.
+func (o *Operator) hardenPodSpec(podSpec *corev1.PodSpec) {
+	hasTmp := false
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == "tmp" {
+			hasTmp = true
+		}
+	}
+	if !hasTmp {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "tmp",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+
+	runAsNonRoot := true
+	if podSpec.SecurityContext == nil {
+		podSpec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	podSpec.SecurityContext.RunAsNonRoot = &runAsNonRoot
+	if o.RunAsUser > 0 {
+		runAsUser := o.RunAsUser
+		podSpec.SecurityContext.RunAsUser = &runAsUser
+		podSpec.SecurityContext.RunAsGroup = &runAsUser
+		podSpec.SecurityContext.FSGroup = &runAsUser
+	}
+
+	for i := range podSpec.InitContainers {
+		hardenContainer(&podSpec.InitContainers[i])
+	}
+	for i := range podSpec.Containers {
+		hardenContainer(&podSpec.Containers[i])
+	}
+}
+
+func hardenContainer(container *corev1.Container) {
+	hasTmp := false
+	for _, mount := range container.VolumeMounts {
+		if mount.MountPath == "/tmp" || mount.MountPath == "/tmp/" {
+			hasTmp = true
+		}
+	}
+	if !hasTmp {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "tmp",
+			MountPath: "/tmp",
+		})
+	}
+	readOnlyRootFilesystem := true
+	allowPrivilegeEscalation := false
+	container.SecurityContext = &corev1.SecurityContext{
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
@@ -0,0 +1,100 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// When fetching a replica's data keeps failing, the tail of the setup
+// container's last log is added to the source's status message, so the
+// cluster's owner learns the tarball was missing or the disk filled up
+// without access to the pods. Logs are read once per failed attempt.
+
+const (
+	// setupLogLines is how many lines are read from the end of the log, and
+	// setupLogBytes the most of their end kept in the message.
+	setupLogLines = 20
+	setupLogBytes = 1024
+
+	// setupLogCacheSize bounds the tails kept, which are dropped altogether
+	// once it's reached.
+	setupLogCacheSize = 1000
+)
+
+// setupLogs reads, and keeps, the tails of setup containers' logs.
+type setupLogs struct {
+	pods corev1client.PodsGetter
+
+	lock  sync.Mutex
+	tails map[setupLogAttempt]string
+}
+
+// setupLogAttempt identifies a failed attempt of a pod's setup container.
+type setupLogAttempt struct {
+	pod      types.UID
+	restarts int32
+}
+
+func newSetupLogs(pods corev1client.PodsGetter) *setupLogs {
+	return &setupLogs{pods: pods, tails: map[setupLogAttempt]string{}}
+}
+
+// tail returns the end of the log of the pod's last failed setup container.
+func (l *setupLogs) tail(ctx context.Context, pod *corev1.Pod, restarts int32) (string, error) {
+	attempt := setupLogAttempt{pod: pod.UID, restarts: restarts}
+	l.lock.Lock()
+	tail, cached := l.tails[attempt]
+	l.lock.Unlock()
+	if cached {
+		return tail, nil
+	}
+
+	lines := int64(setupLogLines)
+	log, err := l.pods.Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: "setup",
+		Previous:  true,
+		TailLines: &lines,
+	}).DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read setup log of pod %s: %w", pod.Name, err)
+	}
+	tail = truncateLogTail(string(log), setupLogBytes)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.tails) >= setupLogCacheSize {
+		l.tails = map[setupLogAttempt]string{}
+	}
+	l.tails[attempt] = tail
+	return tail, nil
+}
+
+// truncateLogTail returns the lines of the end of log fitting in max bytes,
+// joined with " | " to fit the single line of a status message, or the end of
+// the last line if it doesn't fit by itself.
+func truncateLogTail(log string, max int) string {
+	lines := strings.Split(strings.TrimSpace(log), "\n")
+	var kept []string
+	size := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+		if size+len(line) > max {
+			if len(kept) == 0 {
+				kept = append(kept, "..."+line[len(line)-max:])
+			}
+			break
+		}
+		kept = append([]string{line}, kept...)
+		size += len(line) + len(" | ")
+	}
+	return strings.Join(kept, " | ")
+}
@@ -0,0 +1,69 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+func TestTruncateLogTail(t *testing.T) {
+	tests := []struct {
+		log      string
+		max      int
+		expected string
+	}{
+		{log: "a\nb\n\nc\n", max: 100, expected: "a | b | c"},
+		{log: "first\nsecond\nthird\n", max: 14, expected: "second | third"},
+		{log: "no space left on device\n", max: 14, expected: "...left on device"},
+		{log: "", max: 100, expected: ""},
+	}
+	for _, test := range tests {
+		if tail := truncateLogTail(test.log, test.max); tail != test.expected {
+			t.Errorf("%q in %d bytes: expected %q, got %q", test.log, test.max, test.expected, tail)
+		}
+	}
+}
+
+func TestSetupLogTail(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		query := r.URL.Query()
+		if r.URL.Path != "/api/v1/namespaces/dowser/pods/prometheus-0/log" || query.Get("container") != "setup" || query.Get("previous") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "fetching\ncouldn't fetch tarball: 404 Not Found\n")
+	}))
+	defer server.Close()
+	pods, err := corev1client.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := newSetupLogs(pods)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "dowser", Name: "prometheus-0", UID: "uid"}}
+
+	for i := 0; i < 2; i++ {
+		tail, err := logs.tail(context.TODO(), pod, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(tail, "404 Not Found") {
+			t.Errorf("expected the end of the log, got %q", tail)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the log of a failed attempt read once, read %d times", requests)
+	}
+	if _, err := logs.tail(context.TODO(), pod, 4); err != nil || requests != 2 {
+		t.Errorf("expected the log of the next attempt read, read %d times (%v)", requests, err)
+	}
+}
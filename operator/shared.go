@@ -0,0 +1,96 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Prometheus deployments are shared by every cluster referencing the same
+// source. Settings which apply to a deployment are resolved from all of the
+// clusters referencing it, in the order of their names, so each cluster's
+// reconcile arrives at the same deployment rather than undoing the others'.
+
+// namespaceClusters returns the clusters in the namespace keyed by name, with
+// their templates applied and the cluster being reconciled in its current
+// state.
+func (o *Operator) namespaceClusters(cluster *api.MetricsCluster) (map[string]*api.MetricsCluster, error) {
+	list := &api.MetricsClusterList{}
+	if err := o.client.List(context.TODO(), list, client.InNamespace(cluster.Namespace)); err != nil {
+		return nil, fmt.Errorf("couldn't list metricsclusters: %w", err)
+	}
+	clusters := map[string]*api.MetricsCluster{}
+	for i := range list.Items {
+		other := &list.Items[i]
+		// The other clusters report their own missing templates.
+		_ = o.applyClusterTemplate(other)
+		clusters[other.Name] = other
+	}
+	clusters[cluster.Name] = cluster
+	return clusters, nil
+}
+
+// sourceDisplayName returns the display name the cluster gives the source at
+// url, if any.
+func sourceDisplayName(cluster *api.MetricsCluster, url string) string {
+	for _, source := range cluster.Spec.Sources {
+		if source.URL == url {
+			return source.DisplayName
+		}
+	}
+	return ""
+}
+
+// sourcePaused returns whether the cluster pauses the source at url.
+func sourcePaused(cluster *api.MetricsCluster, url string) bool {
+	for _, source := range cluster.Spec.Sources {
+		if source.URL == url {
+			return source.Paused
+		}
+	}
+	return false
+}
+
+// sharedPaused returns whether a shared replica serving the source at url is
+// paused: only once every cluster referencing it pauses it.
+func sharedPaused(referencing []*api.MetricsCluster, url string) bool {
+	for _, cluster := range referencing {
+		if !sourcePaused(cluster, url) {
+			return false
+		}
+	}
+	return len(referencing) > 0
+}
+
+// sharedDisplayName returns the display name of the source at url served by
+// a shared replica: the first given by the clusters referencing it.
+func sharedDisplayName(referencing []*api.MetricsCluster, url string) string {
+	for _, cluster := range referencing {
+		if name := sourceDisplayName(cluster, url); len(name) > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// referencingClusters returns the clusters referencing the deployment,
+// ordered by name.
+func referencingClusters(deployment *appsv1.Deployment, clusters map[string]*api.MetricsCluster) []*api.MetricsCluster {
+	var names []string
+	for name := range clusters {
+		if deployment.Spec.Template.Labels[name] == "true" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var referencing []*api.MetricsCluster
+	for _, name := range names {
+		referencing = append(referencing, clusters[name])
+	}
+	return referencing
+}
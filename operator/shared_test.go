@@ -0,0 +1,33 @@
+package operator
+
+import (
+	"testing"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestSharedPaused(t *testing.T) {
+	const url = "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1"
+	cluster := func(paused bool) *api.MetricsCluster {
+		return &api.MetricsCluster{Spec: api.MetricsClusterSpec{Sources: []api.Source{{URL: url, Paused: paused}}}}
+	}
+	tests := []struct {
+		name        string
+		referencing []*api.MetricsCluster
+		expected    bool
+	}{
+		{name: "unreferenced", expected: false},
+		{name: "paused", referencing: []*api.MetricsCluster{cluster(true)}, expected: true},
+		{name: "running", referencing: []*api.MetricsCluster{cluster(false)}, expected: false},
+		{name: "paused by every cluster", referencing: []*api.MetricsCluster{cluster(true), cluster(true)}, expected: true},
+		{name: "paused by one cluster", referencing: []*api.MetricsCluster{cluster(true), cluster(false)}, expected: false},
+		{name: "listed without sources", referencing: []*api.MetricsCluster{cluster(true), {Spec: api.MetricsClusterSpec{URLs: []string{url}}}}, expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if paused := sharedPaused(test.referencing, url); paused != test.expected {
+				t.Errorf("expected paused %v, got %v", test.expected, paused)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package operator
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// parseSidecarResources returns the default resources of the Thanos sidecar.
+// Empty quantities are left unset.
+func parseSidecarResources(cpu, memory, memoryLimit string) (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceRequirements{}
+	requests := map[corev1.ResourceName]string{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory}
+	for name, value := range requests {
+		if len(value) == 0 {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return resources, err
+		}
+		if resources.Requests == nil {
+			resources.Requests = corev1.ResourceList{}
+		}
+		resources.Requests[name] = quantity
+	}
+	if len(memoryLimit) > 0 {
+		quantity, err := resource.ParseQuantity(memoryLimit)
+		if err != nil {
+			return resources, err
+		}
+		resources.Limits = corev1.ResourceList{corev1.ResourceMemory: quantity}
+	}
+	return resources, nil
+}
+
+// applySidecarResources sets the sidecar resources of a Prometheus deployment
+// from the first referencing cluster overriding them.
+func applySidecarResources(deployment *appsv1.Deployment, referencing []*api.MetricsCluster) {
+	for _, cluster := range referencing {
+		if cluster.Spec.SidecarResources == nil {
+			continue
+		}
+		for i := range deployment.Spec.Template.Spec.Containers {
+			container := &deployment.Spec.Template.Spec.Containers[i]
+			if container.Name == "thanos-sidecar" {
+				container.Resources = *cluster.Spec.SidecarResources.DeepCopy()
+			}
+		}
+		return
+	}
+}
@@ -0,0 +1,106 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+	"github.com/ironcladlou/dowser/query"
+)
+
+// queryEndpoint returns the in-cluster URL of the cluster's query API, served
+// by Thanos query or VictoriaMetrics depending on its backend.
+func (o *Operator) queryEndpoint(cluster *api.MetricsCluster) string {
+	if cluster.Spec.Backend == api.BackendVictoriaMetrics {
+		name := o.victoriaMetricsName(cluster)
+		return fmt.Sprintf("http://%s.%s.svc:%d", name.Name, name.Namespace, victoriaMetricsPort)
+	}
+	name := o.thanosQueryServiceName(cluster)
+	return fmt.Sprintf("http://%s.%s.svc:19192", name.Name, name.Namespace)
+}
+
+// smokeTestTimeout bounds how long a reconcile waits for smoke test queries.
+const smokeTestTimeout = 10 * time.Second
+
+// maxConcurrentSmokeTests limits how many smoke test queries run at once.
+const maxConcurrentSmokeTests = 8
+
+// smokeTestJobs runs the smoke test query against each ready replica which
+// hasn't passed it yet, and returns the number of replicas failing it. The
+// queries run concurrently and share a single deadline so a cluster of empty
+// replicas can't stall reconciliation.
+func (o *Operator) smokeTestJobs(cluster *api.MetricsCluster, ready map[string]*Job) int {
+	expr := cluster.Spec.SmokeTestQuery
+	if len(expr) == 0 {
+		expr = o.SmokeTestQuery
+	}
+	if len(expr) == 0 {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), smokeTestTimeout)
+	defer cancel()
+
+	client := query.NewClient(o.queryEndpoint(cluster))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentSmokeTests)
+	for i := range cluster.Status.Jobs {
+		status := &cluster.Status.Jobs[i]
+		job, isReady := ready[status.URL]
+		if !isReady || (status.SmokeTest != nil && status.SmokeTest.Succeeded) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			status.SmokeTest = smokeTest(ctx, client, expr, status.Deployment, job)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, status := range cluster.Status.Jobs {
+		if _, isReady := ready[status.URL]; isReady && !status.SmokeTest.Succeeded {
+			failed++
+		}
+	}
+	return failed
+}
+
+// smokeTest evaluates expr through the query layer against only the given
+// replica's store, at the time its job completed. The query must return at
+// least one sample; scalar results don't depend on the replica's data and
+// don't count.
+func smokeTest(ctx context.Context, client *query.Client, expr string, deployment string, job *Job) *api.SmokeTestStatus {
+	at := time.Now()
+	if job.Status.CompletionTime != nil {
+		at = job.Status.CompletionTime.Time
+	}
+	params := url.Values{}
+	params.Set("storeMatch[]", fmt.Sprintf(`{cluster_name=%q}`, deployment))
+
+	status := &api.SmokeTestStatus{Time: metav1.Now()}
+	value, err := client.Instant(ctx, expr, at, params)
+	if err != nil {
+		status.Message = err.Error()
+		return status
+	}
+	status.Samples = query.SampleCount(value)
+	if vector, ok := value.(model.Vector); ok && len(vector) == 1 {
+		status.Value = vector[0].Value.String()
+	}
+	status.Succeeded = status.Samples > 0
+	if !status.Succeeded {
+		status.Message = fmt.Sprintf("%s returned no samples at %s", expr, at.UTC().Format(time.RFC3339))
+	}
+	return status
+}
@@ -0,0 +1,201 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters can take an hour to build, so with a soft delete grace period a
+// deleted cluster isn't torn down right away: its post-mortem queries run,
+// its replicas are released as when it expires, and the cluster is kept,
+// Deleted, until the grace period runs out. Expired clusters are kept for
+// the grace period after their expiration, then deleted. Annotating either
+// with the undelete annotation before then restores it: its definition is
+// saved to a ConfigMap, its deletion completes, and the cluster is created
+// again from the ConfigMap, starting over with a fresh TTL.
+
+// undeleteKey is the key of the undelete ConfigMap holding the cluster.
+const undeleteKey = "metricscluster.json"
+
+func undeleteConfigMapName(name types.NamespacedName) types.NamespacedName {
+	return types.NamespacedName{Namespace: name.Namespace, Name: fmt.Sprintf("%s-undelete", name.Name)}
+}
+
+// softDeleteDeadline returns when a deleted or expired cluster's grace period
+// runs out: after its expiration if it expired first, otherwise after its
+// deletion.
+func (o *Operator) softDeleteDeadline(cluster *api.MetricsCluster) time.Time {
+	if cluster.Status.Phase == api.PhaseExpired && cluster.Status.ExpirationTime != nil {
+		return cluster.Status.ExpirationTime.Add(o.SoftDeleteGracePeriod)
+	}
+	if cluster.DeletionTimestamp != nil {
+		return cluster.DeletionTimestamp.Add(o.SoftDeleteGracePeriod)
+	}
+	return time.Time{}
+}
+
+// softDelete holds the teardown of a deleted cluster for the grace period,
+// releasing its replicas meanwhile, and returns whether it's held. A cluster
+// to undelete is saved and torn down right away.
+func (o *Operator) softDelete(cluster *api.MetricsCluster, now time.Time) (bool, reconcile.Result, error) {
+	if o.SoftDeleteGracePeriod <= 0 || !hasFinalizer(cluster, teardownFinalizer) {
+		return false, reconcile.Result{}, nil
+	}
+	if _, undelete := cluster.Annotations[api.UndeleteAnnotation]; undelete {
+		return false, reconcile.Result{}, o.saveUndelete(cluster)
+	}
+	deadline := o.softDeleteDeadline(cluster)
+	if !now.Before(deadline) {
+		return false, reconcile.Result{}, nil
+	}
+
+	originalStatus := cluster.Status.DeepCopy()
+	phase := api.PhaseDeleted
+	if cluster.Status.Phase == api.PhaseExpired {
+		phase = api.PhaseExpired
+	}
+	released, err := o.releaseCluster(cluster, phase)
+	if err != nil {
+		return false, reconcile.Result{}, err
+	}
+	setCondition(cluster, api.ConditionTornDown, corev1.ConditionFalse, "SoftDeleted",
+		fmt.Sprintf("kept until %s; annotate with %s to restore", deadline.UTC().Format(time.RFC3339), api.UndeleteAnnotation))
+	if !equality.Semantic.DeepEqual(*originalStatus, cluster.Status) {
+		if err := o.client.Status().Update(context.TODO(), cluster); err != nil {
+			return false, reconcile.Result{}, fmt.Errorf("couldn't update metricscluster status: %w", err)
+		}
+	}
+	if originalStatus.Phase != phase {
+		message := fmt.Sprintf("deleted, released %d sources; kept until %s", released, deadline.UTC().Format(time.RFC3339))
+		o.log.Info("soft deleted metricscluster", "name", cluster.Name, "jobs", released, "until", deadline)
+		o.recorder.Event(cluster, corev1.EventTypeNormal, eventSoftDeleted, message)
+	}
+	return true, reconcile.Result{RequeueAfter: deadline.Sub(now)}, nil
+}
+
+// collectExpiredCluster deletes an expired cluster once its grace period runs
+// out, or right away, saved, to undelete it.
+func (o *Operator) collectExpiredCluster(cluster *api.MetricsCluster, now time.Time) (reconcile.Result, error) {
+	if o.SoftDeleteGracePeriod <= 0 {
+		return reconcile.Result{}, nil
+	}
+	_, undelete := cluster.Annotations[api.UndeleteAnnotation]
+	if deadline := o.softDeleteDeadline(cluster); !undelete && now.Before(deadline) {
+		return reconcile.Result{RequeueAfter: deadline.Sub(now)}, nil
+	}
+	if undelete {
+		if err := o.saveUndelete(cluster); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	if err := o.client.Delete(context.TODO(), cluster); err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, fmt.Errorf("couldn't delete expired metricscluster: %w", err)
+	}
+	o.log.Info("deleted expired metricscluster", "name", cluster.Name, "undelete", undelete)
+	return reconcile.Result{}, nil
+}
+
+// undeleteSnapshot returns the cluster as it's created again: its spec,
+// labels and annotations, without the undelete annotation.
+func undeleteSnapshot(cluster *api.MetricsCluster) *api.MetricsCluster {
+	annotations := map[string]string{}
+	for key, value := range cluster.Annotations {
+		if key != api.UndeleteAnnotation {
+			annotations[key] = value
+		}
+	}
+	return &api.MetricsCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   cluster.Namespace,
+			Name:        cluster.Name,
+			Labels:      cluster.Labels,
+			Annotations: annotations,
+		},
+		Spec: cluster.Spec,
+	}
+}
+
+// saveUndelete saves the cluster to its undelete ConfigMap, which has no
+// owner so it outlives the cluster.
+func (o *Operator) saveUndelete(cluster *api.MetricsCluster) error {
+	data, err := json.Marshal(undeleteSnapshot(cluster))
+	if err != nil {
+		return fmt.Errorf("couldn't marshal metricscluster: %w", err)
+	}
+	name := undeleteConfigMapName(types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name})
+	configMap := &corev1.ConfigMap{}
+	err = o.client.Get(context.TODO(), name, configMap)
+	if err == nil {
+		if configMap.Data[undeleteKey] == string(data) {
+			return nil
+		}
+		configMap.Data = map[string]string{undeleteKey: string(data)}
+		if err := o.client.Update(context.TODO(), configMap); err != nil {
+			return fmt.Errorf("couldn't update undelete configmap: %w", err)
+		}
+		o.log.Info("updated undelete configmap", "name", configMap.Name)
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't fetch undelete configmap: %w", err)
+	}
+	configMap = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: name.Namespace,
+			Name:      name.Name,
+			Labels: map[string]string{
+				"app":     "undelete",
+				"cluster": cluster.Name,
+			},
+		},
+		Data: map[string]string{undeleteKey: string(data)},
+	}
+	if err := o.client.Create(context.TODO(), configMap); err != nil {
+		return fmt.Errorf("couldn't create undelete configmap: %w", err)
+	}
+	o.log.Info("created undelete configmap", "name", configMap.Name)
+	return nil
+}
+
+// restoreUndeleted creates a cluster which is gone again from its undelete
+// ConfigMap, if it was saved, and removes the ConfigMap.
+func (o *Operator) restoreUndeleted(name types.NamespacedName) error {
+	configMap := &corev1.ConfigMap{}
+	err := o.client.Get(context.TODO(), undeleteConfigMapName(name), configMap)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("couldn't fetch undelete configmap: %w", err)
+	}
+	cluster := &api.MetricsCluster{}
+	if err := json.Unmarshal([]byte(configMap.Data[undeleteKey]), cluster); err != nil {
+		return fmt.Errorf("couldn't unmarshal undeleted metricscluster: %w", err)
+	}
+	if !o.ownsObject(cluster) {
+		return nil
+	}
+	err = o.client.Create(context.TODO(), cluster)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("couldn't create undeleted metricscluster: %w", err)
+	}
+	if err == nil {
+		o.log.Info("undeleted metricscluster", "name", cluster.Name)
+		o.recorder.Event(cluster, corev1.EventTypeNormal, eventUndeleted, "restored after its deletion")
+	}
+	if err := o.client.Delete(context.TODO(), configMap); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't delete undelete configmap: %w", err)
+	}
+	return nil
+}
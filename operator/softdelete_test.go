@@ -0,0 +1,71 @@
+package operator
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestSoftDeleteDeadline(t *testing.T) {
+	o := &Operator{SoftDeleteGracePeriod: time.Hour}
+	expiration := metav1.NewTime(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	deletion := metav1.NewTime(expiration.Add(30 * time.Minute))
+
+	deleted := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &deletion}}
+	deleted.Status.Phase = api.PhaseDeleted
+	deleted.Status.ExpirationTime = &expiration
+	if deadline := o.softDeleteDeadline(deleted); !deadline.Equal(deletion.Add(time.Hour)) {
+		t.Errorf("expected a deleted cluster kept for the grace period after its deletion, got %s", deadline)
+	}
+
+	// An expired cluster deleted later doesn't get another grace period.
+	expired := deleted.DeepCopy()
+	expired.Status.Phase = api.PhaseExpired
+	if deadline := o.softDeleteDeadline(expired); !deadline.Equal(expiration.Add(time.Hour)) {
+		t.Errorf("expected an expired cluster kept for the grace period after its expiration, got %s", deadline)
+	}
+}
+
+func TestUndeleteSnapshot(t *testing.T) {
+	cluster := &api.MetricsCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "dowser",
+			Name:            "example",
+			UID:             "uid",
+			ResourceVersion: "42",
+			Finalizers:      []string{teardownFinalizer},
+			Labels:          map[string]string{api.InstanceLabel: "staging"},
+			Annotations: map[string]string{
+				api.UndeleteAnnotation:    "",
+				api.PinnedUntilAnnotation: "2020-06-01T00:00:00Z",
+			},
+		},
+		Spec: api.MetricsClusterSpec{URLs: []string{"https://prow.example.com/view/gs/bucket/logs/e2e/1234"}},
+	}
+	cluster.Status.Phase = api.PhaseDeleted
+
+	data, err := json.Marshal(undeleteSnapshot(cluster))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &api.MetricsCluster{}
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Name != cluster.Name || restored.Namespace != cluster.Namespace || len(restored.Spec.URLs) != 1 {
+		t.Errorf("expected the cluster's definition restored, got %+v", restored)
+	}
+	if len(restored.UID) > 0 || len(restored.ResourceVersion) > 0 || len(restored.Finalizers) > 0 || len(restored.Status.Phase) > 0 {
+		t.Errorf("expected the cluster created anew, got %+v", restored)
+	}
+	if _, undelete := restored.Annotations[api.UndeleteAnnotation]; undelete {
+		t.Errorf("expected the undelete annotation dropped")
+	}
+	if restored.Annotations[api.PinnedUntilAnnotation] != "2020-06-01T00:00:00Z" || restored.Labels[api.InstanceLabel] != "staging" {
+		t.Errorf("expected the cluster's labels and annotations kept, got %v and %v", restored.Labels, restored.Annotations)
+	}
+}
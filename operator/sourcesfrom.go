@@ -0,0 +1,36 @@
+package operator
+
+import (
+	"k8s.io/apimachinery/pkg/api/equality"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// readSourcesFrom reads the URLs listed by the cluster's SourcesFrom into its
+// status, where desiredURLs picks them up. URLs read earlier are kept when
+// the list can't be read, so a ConfigMap deleted by mistake doesn't release
+// every replica. Like any change to the cluster's URLs, only the URLs added
+// to or removed from the list change the cluster's replicas.
+func (o *Operator) readSourcesFrom(cluster *api.MetricsCluster) {
+	if cluster.Spec.SourcesFrom == nil {
+		cluster.Status.SourcesFrom = nil
+		return
+	}
+	status := &api.SourcesFromStatus{}
+	if previous := cluster.Status.SourcesFrom; previous != nil {
+		status.URLs = previous.URLs
+	}
+	ref := cluster.Spec.SourcesFrom.ConfigMapRef
+	data, err := o.readConfigSource(cluster.Namespace, api.ConfigSource{ConfigMap: &ref})
+	if err != nil {
+		o.log.Error(err, "couldn't read sources", "cluster", cluster.Name)
+		status.Error = err.Error()
+	} else {
+		urls := api.ParseSourceList(data)
+		if !equality.Semantic.DeepEqual(urls, status.URLs) {
+			o.log.Info("read sources", "cluster", cluster.Name, "configmap", ref.Name, "count", len(urls))
+		}
+		status.URLs = urls
+	}
+	cluster.Status.SourcesFrom = status
+}
@@ -0,0 +1,58 @@
+package operator
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// applySpotProfile constrains a Prometheus deployment to interruptible nodes.
+// Preempted replicas can't be rolled gracefully, so the deployment is switched
+// to the Recreate strategy and the replacement pod re-fetches its artifacts.
+func (o *Operator) applySpotProfile(deployment *appsv1.Deployment) {
+	var gracePeriod int64 = 15
+
+	deployment.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+
+	podSpec := &deployment.Spec.Template.Spec
+	if len(o.SpotNodeSelector) > 0 {
+		podSpec.NodeSelector = map[string]string{}
+		for k, v := range o.SpotNodeSelector {
+			podSpec.NodeSelector[k] = v
+		}
+	}
+	podSpec.Tolerations = append(podSpec.Tolerations, o.spotTolerations...)
+	podSpec.TerminationGracePeriodSeconds = &gracePeriod
+}
+
+// parseTolerations parses tolerations of the form key[=value][:effect]. A
+// toleration without a value matches any value of the key.
+func parseTolerations(values []string) ([]corev1.Toleration, error) {
+	var tolerations []corev1.Toleration
+	for _, value := range values {
+		toleration := corev1.Toleration{Operator: corev1.TolerationOpExists}
+		spec := value
+		if i := strings.LastIndex(spec, ":"); i >= 0 {
+			toleration.Effect = corev1.TaintEffect(spec[i+1:])
+			spec = spec[:i]
+			switch toleration.Effect {
+			case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			default:
+				return nil, fmt.Errorf("unknown taint effect %q in toleration %q", toleration.Effect, value)
+			}
+		}
+		if i := strings.Index(spec, "="); i >= 0 {
+			toleration.Operator = corev1.TolerationOpEqual
+			toleration.Value = spec[i+1:]
+			spec = spec[:i]
+		}
+		if len(spec) == 0 {
+			return nil, fmt.Errorf("toleration %q has no key", value)
+		}
+		toleration.Key = spec
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations, nil
+}
@@ -0,0 +1,73 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// creationAllowance returns how many more Prometheus deployments the cluster
+// may create now. Replicas still fetching their data count against the batch
+// size, so big clusters are brought up a batch at a time. When nothing may be
+// created the reason is returned.
+func (o *Operator) creationAllowance(cluster *api.MetricsCluster) (int, string, error) {
+	if o.HoldOnNodePressure {
+		nodes, err := o.nodesUnderPressure()
+		if err != nil {
+			return 0, "", err
+		}
+		if len(nodes) > 0 {
+			return 0, fmt.Sprintf("waiting for node pressure to clear on %s", strings.Join(nodes, ", ")), nil
+		}
+	}
+	if o.CreationBatchSize <= 0 {
+		return -1, "", nil
+	}
+
+	pods := &corev1.PodList{}
+	err := o.client.List(context.TODO(), pods, client.InNamespace(o.Namespace), client.MatchingLabels{"app": "prometheus"}, client.HasLabels{cluster.Name})
+	if err != nil {
+		return 0, "", fmt.Errorf("couldn't list pods: %w", err)
+	}
+	inFlight := 0
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodPending {
+			inFlight++
+		}
+	}
+	if allowance := o.CreationBatchSize - inFlight; allowance > 0 {
+		return allowance, "", nil
+	}
+	return 0, fmt.Sprintf("waiting for %d replicas to finish fetching", inFlight), nil
+}
+
+// nodesUnderPressure returns the names of nodes reporting disk pressure or an
+// unavailable network.
+func (o *Operator) nodesUnderPressure() ([]string, error) {
+	// Nodes are cluster scoped and outside the manager's namespaced cache.
+	nodes := &corev1.NodeList{}
+	if err := o.apiReader.List(context.TODO(), nodes); err != nil {
+		return nil, fmt.Errorf("couldn't list nodes: %w", err)
+	}
+	var names []string
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		for _, condition := range node.Status.Conditions {
+			if (condition.Type == corev1.NodeDiskPressure || condition.Type == corev1.NodeNetworkUnavailable) &&
+				condition.Status == corev1.ConditionTrue {
+				names = append(names, node.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
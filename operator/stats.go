@@ -0,0 +1,82 @@
+package operator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// The operator's own statistics are served with controller-runtime's
+// metrics on MetricsBindAddress, so the operator can be scraped like any
+// other component.
+
+// Job states counted by the cluster jobs metric.
+const (
+	jobStateReady   = "ready"
+	jobStateFailed  = "failed"
+	jobStatePending = "pending"
+)
+
+var (
+	artifactFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dowser_artifact_fetch_duration_seconds",
+		Help:    "Time taken to discover a source's artifacts, by result.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"result"})
+	tarballBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dowser_tarball_size_bytes",
+		Help:    "Size of the Prometheus tarballs of sources, as reported by their servers.",
+		Buckets: prometheus.ExponentialBuckets(64<<20, 2, 8),
+	})
+	clusterJobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dowser_cluster_jobs",
+		Help: "Sources of a cluster, by whether they're ready, failed or pending.",
+	}, []string{"cluster", "state"})
+	reconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dowser_reconcile_errors_total",
+		Help: "Reconciles which failed with an error, by controller.",
+	}, []string{"controller"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(artifactFetchDuration, tarballBytes, clusterJobs, reconcileErrors)
+}
+
+// updateJobCounts records the cluster's sources by state.
+func updateJobCounts(cluster *api.MetricsCluster) {
+	counts := map[string]int{}
+	for _, job := range cluster.Status.Jobs {
+		switch {
+		case job.Ready:
+			counts[jobStateReady]++
+		case len(job.Reason) > 0:
+			counts[jobStateFailed]++
+		default:
+			counts[jobStatePending]++
+		}
+	}
+	for _, state := range []string{jobStateReady, jobStateFailed, jobStatePending} {
+		clusterJobs.WithLabelValues(cluster.Name, state).Set(float64(counts[state]))
+	}
+}
+
+// forgetJobCounts drops the job counts of a deleted cluster.
+func forgetJobCounts(clusterName string) {
+	for _, state := range []string{jobStateReady, jobStateFailed, jobStatePending} {
+		clusterJobs.DeleteLabelValues(clusterName, state)
+	}
+}
+
+// countReconcileErrors wraps the reconciler of the named controller to count
+// its errors.
+func countReconcileErrors(controller string, reconciler func(reconcile.Request) (reconcile.Result, error)) reconcile.Func {
+	return func(request reconcile.Request) (reconcile.Result, error) {
+		result, err := reconciler(request)
+		if err != nil {
+			reconcileErrors.WithLabelValues(controller).Inc()
+		}
+		return result, err
+	}
+}
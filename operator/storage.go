@@ -0,0 +1,107 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Replicas of clusters with storage keep their data on a claim named after
+// their deployment and owned by it, so the claim goes away with the replica.
+// A replica runs a single pod, so a deployment recreating its pod keeps the
+// rest of the replica handling as is, where a StatefulSet would need its own:
+// the setup script already skips fetching when the volume holds the data.
+
+// sharedStorage returns the storage of a replica: that of the first of the
+// referencing clusters setting one, if any.
+func sharedStorage(referencing []*api.MetricsCluster) *api.StorageSpec {
+	for _, cluster := range referencing {
+		if cluster.Spec.Storage != nil {
+			return cluster.Spec.Storage
+		}
+	}
+	return nil
+}
+
+// applyPersistentStorage mounts the replica's claim as its storage volume in
+// place of node storage, dropping the ephemeral storage request. The old pod
+// is stopped before the new one starts, as the volume can't be shared.
+func applyPersistentStorage(deployment *appsv1.Deployment) {
+	podSpec := &deployment.Spec.Template.Spec
+	for i := range podSpec.Volumes {
+		if podSpec.Volumes[i].Name == "prometheus-storage-volume" {
+			podSpec.Volumes[i].VolumeSource = corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: deployment.Name},
+			}
+		}
+	}
+	for i := range podSpec.Containers {
+		delete(podSpec.Containers[i].Resources.Requests, corev1.ResourceEphemeralStorage)
+	}
+	deployment.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+}
+
+// storageClaimManifest returns the claim holding the data of the replica of
+// the deployment.
+func storageClaimManifest(deployment *appsv1.Deployment, storage *api.StorageSpec) *corev1.PersistentVolumeClaim {
+	isController := true
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: deployment.Namespace,
+			Name:      deployment.Name,
+			Labels: map[string]string{
+				"app":        "prometheus",
+				"prometheus": deployment.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       deployment.Name,
+					UID:        deployment.UID,
+					Controller: &isController,
+				},
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: storage.Size,
+				},
+			},
+		},
+	}
+	if len(storage.StorageClassName) > 0 {
+		className := storage.StorageClassName
+		claim.Spec.StorageClassName = &className
+	}
+	return claim
+}
+
+// ensureStorageClaim creates the claim of the replica of the deployment if
+// it's missing. Claims aren't updated, as their size can at most grow and
+// their class is fixed; changes apply to new replicas.
+func (o *Operator) ensureStorageClaim(deployment *appsv1.Deployment, storage *api.StorageSpec) error {
+	claim := &corev1.PersistentVolumeClaim{}
+	err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: deployment.Namespace, Name: deployment.Name}, claim)
+	if err == nil {
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't fetch persistentvolumeclaim: %w", err)
+	}
+	claim = storageClaimManifest(deployment, storage)
+	if err := o.client.Create(context.TODO(), claim); err != nil {
+		return fmt.Errorf("couldn't create persistentvolumeclaim: %w", err)
+	}
+	o.log.Info("created persistentvolumeclaim", "name", claim.Name)
+	return nil
+}
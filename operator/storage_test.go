@@ -0,0 +1,51 @@
+package operator
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestApplyPersistentStorage(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "prometheus-1"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						{Name: "prometheus-storage-volume", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+						{Name: "prometheus-config"},
+					},
+					Containers: []corev1.Container{
+						{
+							Name: "prometheus",
+							Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+								corev1.ResourceMemory:           resource.MustParse("1Gi"),
+								corev1.ResourceEphemeralStorage: resource.MustParse("10Gi"),
+							}},
+						},
+					},
+				},
+			},
+		},
+	}
+	applyPersistentStorage(deployment)
+
+	volume := deployment.Spec.Template.Spec.Volumes[0]
+	if volume.PersistentVolumeClaim == nil || volume.PersistentVolumeClaim.ClaimName != "prometheus-1" || volume.EmptyDir != nil {
+		t.Errorf("expected the storage volume to be the prometheus-1 claim, got %+v", volume.VolumeSource)
+	}
+	requests := deployment.Spec.Template.Spec.Containers[0].Resources.Requests
+	if _, hasStorage := requests[corev1.ResourceEphemeralStorage]; hasStorage {
+		t.Errorf("expected the ephemeral storage request to be dropped")
+	}
+	if _, hasMemory := requests[corev1.ResourceMemory]; !hasMemory {
+		t.Errorf("expected the memory request to be kept")
+	}
+	if deployment.Spec.Strategy.Type != appsv1.RecreateDeploymentStrategyType {
+		t.Errorf("expected the recreate strategy, got %q", deployment.Spec.Strategy.Type)
+	}
+}
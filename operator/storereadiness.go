@@ -0,0 +1,143 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// A replica's pod is ready once Prometheus has opened its TSDB and the Thanos
+// sidecar reached it, but the sidecar may still be loading its view of the
+// data, and queries fanned out to it meanwhile return partial results. With
+// StoreReadinessGate, clusters' store services only select pods labeled with
+// StoreReadyLabel, which the store readiness controller sets once the
+// sidecar reports ready and Prometheus has loaded data: blocks, or series in
+// its head for sources archived with only a WAL. Ready pods are checked every
+// storeReadinessInterval until then, and pods which stop being ready lose the
+// label until they're checked again.
+
+// storeReadinessInterval is how often ready replicas are checked until their
+// data is loaded.
+const storeReadinessInterval = 10 * time.Second
+
+// storeReadinessTimeout bounds each request checking a replica.
+const storeReadinessTimeout = 5 * time.Second
+
+// storeSelector returns the labels of the pods the cluster's store service
+// selects.
+func (o *Operator) storeSelector(cluster *api.MetricsCluster) map[string]string {
+	selector := map[string]string{
+		"app":        "prometheus",
+		cluster.Name: "true",
+	}
+	if o.StoreReadinessGate {
+		selector[api.StoreReadyLabel] = "true"
+	}
+	return selector
+}
+
+// isStoreReady returns whether the pod has been found serving its data.
+func isStoreReady(pod *corev1.Pod) bool {
+	return pod.Labels[api.StoreReadyLabel] == "true"
+}
+
+func (o *Operator) reconcileStoreReadiness(request reconcile.Request) (reconcile.Result, error) {
+	pod := &corev1.Pod{}
+	if err := o.client.Get(context.TODO(), request.NamespacedName, pod); err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, fmt.Errorf("couldn't fetch pod: %w", err)
+	}
+	switch pod.Labels["app"] {
+	case "prometheus", "prometheus-pool":
+	default:
+		return reconcile.Result{}, nil
+	}
+	if pod.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+
+	ready := isPodReady(pod)
+	if ready && !isStoreReady(pod) {
+		loaded, err := storeLoaded(pod.Status.PodIP)
+		if err != nil {
+			o.log.Info("store not loaded yet", "pod", pod.Name, "reason", err.Error())
+		}
+		if !loaded {
+			return reconcile.Result{RequeueAfter: storeReadinessInterval}, nil
+		}
+	}
+	if ready == isStoreReady(pod) {
+		return reconcile.Result{}, nil
+	}
+	if ready {
+		pod.Labels[api.StoreReadyLabel] = "true"
+	} else {
+		delete(pod.Labels, api.StoreReadyLabel)
+	}
+	if err := o.client.Update(context.TODO(), pod); err != nil {
+		return reconcile.Result{}, fmt.Errorf("couldn't update store readiness of pod %s: %w", pod.Name, err)
+	}
+	if ready {
+		o.log.Info("added store to query view", "pod", pod.Name)
+	} else {
+		o.log.Info("removed unready store from query view", "pod", pod.Name)
+	}
+	return reconcile.Result{}, nil
+}
+
+// storeLoaded returns whether the sidecar of the replica at ip is ready and
+// its Prometheus has loaded data, or else why not.
+func storeLoaded(ip string) (bool, error) {
+	client := &http.Client{Timeout: storeReadinessTimeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s:10902/-/ready", ip))
+	if err != nil {
+		return false, fmt.Errorf("couldn't check sidecar: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("sidecar not ready: %s", resp.Status)
+	}
+
+	resp, err = client.Get(fmt.Sprintf("http://%s:9090/metrics", ip))
+	if err != nil {
+		return false, fmt.Errorf("couldn't fetch prometheus metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("couldn't fetch prometheus metrics: %s", resp.Status)
+	}
+	return tsdbLoaded(resp.Body)
+}
+
+// tsdbLoaded returns whether Prometheus's metrics show it serving blocks or
+// head series.
+func tsdbLoaded(metrics io.Reader) (bool, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(metrics)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse prometheus metrics: %w", err)
+	}
+	for _, name := range []string{"prometheus_tsdb_blocks_loaded", "prometheus_tsdb_head_series"} {
+		family, found := families[name]
+		if !found {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetGauge().GetValue() > 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("no blocks or head series loaded")
+}
@@ -0,0 +1,75 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestTSDBLoaded(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics string
+		loaded  bool
+	}{
+		{
+			name: "blocks",
+			metrics: `# TYPE prometheus_tsdb_blocks_loaded gauge
+prometheus_tsdb_blocks_loaded 12
+# TYPE prometheus_tsdb_head_series gauge
+prometheus_tsdb_head_series 0
+`,
+			loaded: true,
+		},
+		{
+			name: "head series",
+			metrics: `# TYPE prometheus_tsdb_blocks_loaded gauge
+prometheus_tsdb_blocks_loaded 0
+# TYPE prometheus_tsdb_head_series gauge
+prometheus_tsdb_head_series 3502
+`,
+			loaded: true,
+		},
+		{
+			name: "empty",
+			metrics: `# TYPE prometheus_tsdb_blocks_loaded gauge
+prometheus_tsdb_blocks_loaded 0
+# TYPE prometheus_tsdb_head_series gauge
+prometheus_tsdb_head_series 0
+`,
+		},
+		{
+			name:    "missing",
+			metrics: "# TYPE up gauge\nup 1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loaded, err := tsdbLoaded(strings.NewReader(test.metrics))
+			if loaded != test.loaded {
+				t.Errorf("expected loaded %t, got %t (%v)", test.loaded, loaded, err)
+			}
+			if !loaded && err == nil {
+				t.Errorf("expected a reason for data not being loaded")
+			}
+		})
+	}
+}
+
+func TestStoreSelector(t *testing.T) {
+	cluster := &api.MetricsCluster{ObjectMeta: metav1.ObjectMeta{Name: "a"}}
+
+	o := &Operator{}
+	if _, gated := o.storeSelector(cluster)[api.StoreReadyLabel]; gated {
+		t.Errorf("expected stores not to be gated")
+	}
+
+	o.StoreReadinessGate = true
+	selector := o.storeSelector(cluster)
+	if selector[api.StoreReadyLabel] != "true" || selector["a"] != "true" || selector["app"] != "prometheus" {
+		t.Errorf("unexpected selector %v", selector)
+	}
+}
@@ -0,0 +1,105 @@
+package operator
+
+import (
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	"github.com/ironcladlou/dowser/prow"
+)
+
+// Sources may be given as a Prometheus tarball rather than a prow build, e.g.
+// a snapshot from a must-gather or an upload: the https URL of a .tar, .tar.gz,
+// .tgz, .tar.zst or .tzst, the gs:// or s3:// URL of one in a public bucket, or, for the fetch
+// command, the file:// URL of one on disk. They're loaded without
+// looking up a prow job; one is made up for them, completed when the tarball
+// was last modified.
+
+// tarballSpan is how far back the data of a tarball source is assumed to go
+// before it was last modified, bounding its replays: Prometheus's default
+// retention, the most a snapshot holds unless configured otherwise.
+const tarballSpan = 15 * 24 * time.Hour
+
+// isTarballURL returns whether a source is given as the URL of a tarball.
+func isTarballURL(url string) bool {
+	parsed, err := neturl.Parse(url)
+	if err != nil {
+		return false
+	}
+	switch parsed.Scheme {
+	case "gs", "s3", "file":
+		return true
+	}
+	return hasTarballExtension(parsed.Path)
+}
+
+// hasTarballExtension returns whether a path names a tarball.
+func hasTarballExtension(path string) bool {
+	for _, extension := range []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tzst"} {
+		if strings.HasSuffix(path, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// tarballHTTPURL returns the URL the tarball of a tarball source is fetched
+// from. Objects in S3 are fetched from the bucket's virtual-hosted endpoint.
+func tarballHTTPURL(url string) (string, error) {
+	switch {
+	case strings.HasPrefix(url, "gs://"):
+		return prow.PublicObjectURL(url)
+	case strings.HasPrefix(url, "s3://"):
+		parsed, err := neturl.Parse(url)
+		if err != nil || len(parsed.Host) == 0 || len(strings.Trim(parsed.Path, "/")) == 0 {
+			return "", fmt.Errorf("%s isn't the url of an object in S3", url)
+		}
+		return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", parsed.Host, strings.TrimPrefix(parsed.Path, "/")), nil
+	}
+	return url, nil
+}
+
+// tarballProwJob returns the prow job standing in for a tarball source: named
+// after the build the tarball belongs to if its path says, or else after the
+// tarball, and completed when the tarball was last modified.
+func tarballProwJob(url, tarURL string) (prowapi.ProwJob, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Head(tarURL)
+	if err != nil {
+		return prowapi.ProwJob{}, fmt.Errorf("couldn't fetch %s: %w", tarURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return prowapi.ProwJob{}, fmt.Errorf("couldn't fetch %s: %s", tarURL, resp.Status)
+	}
+	completed := time.Now()
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		completed = modified
+	}
+
+	_, job, build := parseBuildURL(url)
+	if len(job) == 0 {
+		parsed, _ := neturl.Parse(url)
+		job = path.Base(parsed.Path)
+		for _, extension := range []string{".gz", ".tgz", ".zst", ".tzst", ".tar"} {
+			job = strings.TrimSuffix(job, extension)
+		}
+	}
+	completionTime := metav1.NewTime(completed)
+	return prowapi.ProwJob{
+		Spec: prowapi.ProwJobSpec{Job: job},
+		Status: prowapi.ProwJobStatus{
+			URL:            url,
+			BuildID:        build,
+			State:          prowapi.SuccessState,
+			StartTime:      metav1.NewTime(completed.Add(-tarballSpan)),
+			CompletionTime: &completionTime,
+		},
+	}, nil
+}
@@ -0,0 +1,23 @@
+package operator
+
+import "testing"
+
+func TestIsTarballURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{url: "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1", expected: false},
+		{url: "https://storage.googleapis.com/origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar", expected: true},
+		{url: "https://example.com/must-gather/prometheus.tar.gz?download=1", expected: true},
+		{url: "https://example.com/snapshot.tgz", expected: true},
+		{url: "https://example.com/snapshot.tar.zst", expected: true},
+		{url: "https://example.com/snapshot.zst", expected: false},
+		{url: "gs://dowser-uploads/snapshot", expected: true},
+	}
+	for _, test := range tests {
+		if isTarball := isTarballURL(test.url); isTarball != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.url, test.expected, isTarball)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters carry the teardown finalizer, so a deleted cluster's replicas are
+// released and its resources removed before the cluster itself goes away,
+// with progress reported by the TornDown condition. The garbage collector
+// would remove them too, but with nothing telling when it's done.
+const teardownFinalizer = "dowser.dowser/teardown"
+
+// teardownPollInterval is how often teardown checks whether the resources it
+// deleted are gone.
+const teardownPollInterval = 5 * time.Second
+
+// ensureTeardownFinalizer adds the teardown finalizer to clusters created
+// without it.
+func (o *Operator) ensureTeardownFinalizer(cluster *api.MetricsCluster) error {
+	if hasFinalizer(cluster, teardownFinalizer) {
+		return nil
+	}
+	cluster.Finalizers = append(cluster.Finalizers, teardownFinalizer)
+	if err := o.client.Update(context.TODO(), cluster); err != nil {
+		return fmt.Errorf("couldn't update metricscluster finalizers: %w", err)
+	}
+	return nil
+}
+
+// finalizeTeardown tears down a cluster being deleted, and lets the deletion
+// proceed once everything it removed is gone.
+func (o *Operator) finalizeTeardown(cluster *api.MetricsCluster) (reconcile.Result, error) {
+	if !hasFinalizer(cluster, teardownFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	remaining, err := o.teardown(cluster)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	originalStatus := cluster.Status.DeepCopy()
+	if len(remaining) > 0 {
+		setCondition(cluster, api.ConditionTornDown, corev1.ConditionFalse, "TearingDown",
+			fmt.Sprintf("waiting for %s to be deleted", strings.Join(remaining, ", ")))
+	} else {
+		setCondition(cluster, api.ConditionTornDown, corev1.ConditionTrue, "TornDown", "")
+	}
+	if !equality.Semantic.DeepEqual(*originalStatus, cluster.Status) {
+		if err := o.client.Status().Update(context.TODO(), cluster); err != nil {
+			return reconcile.Result{}, fmt.Errorf("couldn't update metricscluster status: %w", err)
+		}
+	}
+	if len(remaining) > 0 {
+		return reconcile.Result{RequeueAfter: teardownPollInterval}, nil
+	}
+
+	if err := o.forgetCachedArtifacts(cluster); err != nil {
+		return reconcile.Result{}, err
+	}
+	for _, job := range cluster.Status.Jobs {
+		o.deleteAnnotation(job.Annotation)
+	}
+	o.deleteDashboard(cluster)
+	removeFinalizer(cluster, teardownFinalizer)
+	if err := o.client.Update(context.TODO(), cluster); err != nil {
+		return reconcile.Result{}, fmt.Errorf("couldn't remove teardown finalizer: %w", err)
+	}
+	o.log.Info("tore down metricscluster", "name", cluster.Name)
+	return reconcile.Result{}, nil
+}
+
+// teardown releases the cluster's replicas, deleting those no other cluster
+// references, and deletes its resources and Jobs. It returns the resources
+// which aren't gone yet.
+func (o *Operator) teardown(cluster *api.MetricsCluster) ([]string, error) {
+	var remaining []string
+	background := client.PropagationPolicy(metav1.DeletePropagationBackground)
+
+	deployments := &appsv1.DeploymentList{}
+	if err := o.client.List(context.TODO(), deployments, client.InNamespace(o.Namespace), client.MatchingLabels{"app": "prometheus"}); err != nil {
+		return nil, fmt.Errorf("couldn't list deployments: %w", err)
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		_, hasReference := deployment.Spec.Template.Labels[cluster.Name]
+		if !hasReference && !isOwnedBy(deployment, cluster) {
+			continue
+		}
+		if deployment.DeletionTimestamp != nil {
+			remaining = append(remaining, "deployment "+deployment.Name)
+			continue
+		}
+		removeOwner(deployment, cluster.Name)
+		if !isShared(deployment, cluster.Name) {
+			if err := o.releaseClaimedPod(deployment); err != nil {
+				return nil, err
+			}
+			if err := o.client.Delete(context.TODO(), deployment, background); err != nil && !errors.IsNotFound(err) {
+				return nil, fmt.Errorf("couldn't delete deployment: %w", err)
+			}
+			o.log.Info("deleted deployment", "name", deployment.Name, "cluster", cluster.Name)
+			remaining = append(remaining, "deployment "+deployment.Name)
+			continue
+		}
+		if err := o.unreferenceClaimedPod(deployment, cluster.Name); err != nil {
+			return nil, err
+		}
+		delete(deployment.Spec.Template.Labels, cluster.Name)
+		if err := o.client.Update(context.TODO(), deployment); err != nil {
+			return nil, fmt.Errorf("couldn't update deployment to remove reference: %w", err)
+		}
+		o.log.Info("released shared deployment", "name", deployment.Name, "cluster", cluster.Name)
+	}
+
+	for _, resource := range o.clusterResources(cluster) {
+		if err := o.client.Get(context.TODO(), resource.name, resource.object); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("couldn't fetch %s: %w", resource.kind, err)
+		}
+		object, err := meta.Accessor(resource.object)
+		if err != nil {
+			return nil, err
+		}
+		if controller := metav1.GetControllerOf(object); controller != nil && controller.UID != cluster.UID {
+			continue
+		}
+		remaining = append(remaining, resource.kind)
+		if object.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if err := o.client.Delete(context.TODO(), resource.object, background); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("couldn't delete %s: %w", resource.kind, err)
+		}
+		o.log.Info("deleted "+resource.kind, "name", resource.name.Name, "cluster", cluster.Name)
+	}
+
+	jobs := &batchv1.JobList{}
+	if err := o.client.List(context.TODO(), jobs, client.InNamespace(o.Namespace), client.MatchingLabels{"cluster": cluster.Name}); err != nil {
+		return nil, fmt.Errorf("couldn't list jobs: %w", err)
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if !metav1.IsControlledBy(job, cluster) {
+			continue
+		}
+		remaining = append(remaining, "job "+job.Name)
+		if job.DeletionTimestamp != nil {
+			continue
+		}
+		if err := o.client.Delete(context.TODO(), job, background); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("couldn't delete job: %w", err)
+		}
+		o.log.Info("deleted job", "name", job.Name, "cluster", cluster.Name)
+	}
+	return remaining, nil
+}
+
+// isShared returns whether a replica's deployment is owned or referenced by
+// clusters other than the named one.
+func isShared(deployment *appsv1.Deployment, clusterName string) bool {
+	for owner := range ownerClusters(deployment) {
+		if owner != clusterName {
+			return true
+		}
+	}
+	for label, value := range deployment.Spec.Template.Labels {
+		if label != clusterName && (value == "true" || value == excludedReferenceValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetCachedArtifacts drops what's cached about the cluster's sources, the
+// location, size and block version of their tarballs, unless other clusters
+// still serve them.
+func (o *Operator) forgetCachedArtifacts(cluster *api.MetricsCluster) error {
+	clusters, err := o.namespaceClusters(cluster)
+	if err != nil {
+		return err
+	}
+	inUse := map[string]bool{}
+	for name, other := range clusters {
+		if name == cluster.Name {
+			continue
+		}
+		for _, url := range other.Status.URLs {
+			inUse[url] = true
+		}
+	}
+	for _, url := range cluster.Status.URLs {
+		if inUse[url] {
+			continue
+		}
+		prometheusLock.Lock()
+		tarURL, found := prometheusURLs[url]
+		delete(prometheusURLs, url)
+		prometheusLock.Unlock()
+		if !found {
+			tarURL = url
+			if isTarballURL(url) {
+				tarURL, _ = tarballHTTPURL(url)
+			}
+		}
+		tarSizeLock.Lock()
+		delete(tarSizes, tarURL)
+		tarSizeLock.Unlock()
+		blockVersionLock.Lock()
+		delete(blockVersions, tarURL)
+		blockVersionLock.Unlock()
+		o.artifacts.forget(url)
+		forgetSourcePanics(url)
+	}
+	return nil
+}
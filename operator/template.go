@@ -0,0 +1,101 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// A cluster referencing a MetricsClusterTemplate takes the template's
+// settings where it doesn't set its own. Templates are applied to the cluster
+// as it's reconciled, never written to it, so changes to a template reach
+// every cluster referencing it, and a cluster's own settings keep
+// precedence.
+
+// applyClusterTemplate fetches the cluster's template, if it references one,
+// and applies it to the cluster.
+func (o *Operator) applyClusterTemplate(cluster *api.MetricsCluster) error {
+	if cluster.Spec.TemplateRef == nil {
+		return nil
+	}
+	template := &api.MetricsClusterTemplate{}
+	err := o.client.Get(context.TODO(), types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Spec.TemplateRef.Name}, template)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("metricsclustertemplate %s not found", cluster.Spec.TemplateRef.Name)
+		}
+		return fmt.Errorf("couldn't fetch metricsclustertemplate %s: %w", cluster.Spec.TemplateRef.Name, err)
+	}
+	applyTemplate(cluster, &template.Spec)
+	return nil
+}
+
+// applyTemplate fills the settings the cluster leaves unset from the
+// template. Images and external labels are merged, the cluster's winning.
+func applyTemplate(cluster *api.MetricsCluster, template *api.MetricsClusterTemplateSpec) {
+	spec := &cluster.Spec
+	if spec.TTL == nil && template.TTL != nil {
+		spec.TTL = template.TTL.DeepCopy()
+	}
+	if spec.SidecarResources == nil && template.SidecarResources != nil {
+		spec.SidecarResources = template.SidecarResources.DeepCopy()
+	}
+	if spec.PrometheusResources == nil && template.PrometheusResources != nil {
+		spec.PrometheusResources = template.PrometheusResources.DeepCopy()
+	}
+	if spec.ThanosResources == nil && template.ThanosResources != nil {
+		spec.ThanosResources = template.ThanosResources.DeepCopy()
+	}
+	if spec.Query == nil && template.Query != nil {
+		spec.Query = template.Query.DeepCopy()
+	}
+	if spec.QueryFrontend == nil && template.QueryFrontend != nil {
+		spec.QueryFrontend = template.QueryFrontend.DeepCopy()
+	}
+	if template.Images != nil {
+		if spec.Images == nil {
+			spec.Images = &api.ImagesSpec{}
+		}
+		if len(spec.Images.Prometheus) == 0 {
+			spec.Images.Prometheus = template.Images.Prometheus
+		}
+		if len(spec.Images.Thanos) == 0 {
+			spec.Images.Thanos = template.Images.Thanos
+		}
+	}
+	for name, value := range template.ExternalLabels {
+		if _, set := spec.ExternalLabels[name]; set {
+			continue
+		}
+		if spec.ExternalLabels == nil {
+			spec.ExternalLabels = map[string]string{}
+		}
+		spec.ExternalLabels[name] = value
+	}
+}
+
+// clustersReferencingTemplate maps a template to the clusters referencing
+// it.
+func (o *Operator) clustersReferencingTemplate() handler.ToRequestsFunc {
+	return func(object handler.MapObject) []reconcile.Request {
+		clusters := &api.MetricsClusterList{}
+		if err := o.client.List(context.TODO(), clusters, client.InNamespace(object.Meta.GetNamespace())); err != nil {
+			o.log.Error(err, "couldn't list metricsclusters")
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, cluster := range clusters.Items {
+			if cluster.Spec.TemplateRef != nil && cluster.Spec.TemplateRef.Name == object.Meta.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}})
+			}
+		}
+		return requests
+	}
+}
@@ -0,0 +1,116 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestApplyTemplate(t *testing.T) {
+	template := &api.MetricsClusterTemplateSpec{
+		TTL: &metav1.Duration{Duration: 72 * time.Hour},
+		PrometheusResources: &corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")},
+		},
+		Images:         &api.ImagesSpec{Prometheus: "quay.io/prometheus/prometheus:v2.22.0", Thanos: "quay.io/thanos/thanos:v0.16.0"},
+		ExternalLabels: map[string]string{"team": "release", "tier": "ci"},
+		Query:          &api.QuerySpec{Replicas: 2},
+	}
+	cluster := &api.MetricsCluster{
+		Spec: api.MetricsClusterSpec{
+			URLs:           []string{"https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/e2e/1"},
+			TTL:            &metav1.Duration{Duration: time.Hour},
+			Images:         &api.ImagesSpec{Thanos: "quay.io/thanos/thanos:v0.17.0"},
+			ExternalLabels: map[string]string{"team": "installer"},
+		},
+	}
+	applyTemplate(cluster, template)
+
+	if cluster.Spec.TTL.Duration != time.Hour {
+		t.Errorf("expected the cluster's own ttl kept, got %s", cluster.Spec.TTL.Duration)
+	}
+	if cluster.Spec.PrometheusResources == nil || cluster.Spec.Query == nil || cluster.Spec.Query.Replicas != 2 {
+		t.Errorf("expected the template's resources and query settings, got %+v", cluster.Spec)
+	}
+	if cluster.Spec.Images.Prometheus != template.Images.Prometheus || cluster.Spec.Images.Thanos != "quay.io/thanos/thanos:v0.17.0" {
+		t.Errorf("expected the images merged, the cluster's winning, got %+v", cluster.Spec.Images)
+	}
+	if cluster.Spec.ExternalLabels["team"] != "installer" || cluster.Spec.ExternalLabels["tier"] != "ci" {
+		t.Errorf("expected the external labels merged, the cluster's winning, got %v", cluster.Spec.ExternalLabels)
+	}
+
+	// The template's settings are copied, so a reconcile can't change them.
+	cluster.Spec.Query.Replicas = 3
+	if template.Query.Replicas != 2 {
+		t.Errorf("expected the template left alone")
+	}
+}
+
+func TestExternalLabels(t *testing.T) {
+	o := &Operator{}
+	team := &api.MetricsCluster{Spec: api.MetricsClusterSpec{ExternalLabels: map[string]string{
+		"team":         "release",
+		"build":        "{{.Job}}/{{.BuildID}}",
+		"cluster_name": "overridden",
+	}}}
+	other := &api.MetricsCluster{Spec: api.MetricsClusterSpec{ExternalLabels: map[string]string{"team": "installer", "pull": "{{.Pull}}"}}}
+	var additions []*additionalConfig
+	for _, cluster := range []*api.MetricsCluster{team, other} {
+		addition, err := o.loadAdditionalConfig(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		additions = append(additions, addition)
+	}
+	job := &Job{ProwJob: prowapi.ProwJob{
+		Spec:   prowapi.ProwJobSpec{Job: "e2e-aws"},
+		Status: prowapi.ProwJobStatus{URL: "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/e2e-aws/1234"},
+	}}
+
+	files, err := renderPrometheusConfig("prometheus-0123456789ab", job, additions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := files[prometheusConfigKey]
+	for _, expected := range []string{"team: release", "build: e2e-aws/1234", "cluster_name: prometheus-0123456789ab"} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("expected %q in the config:\n%s", expected, config)
+		}
+	}
+	if strings.Contains(config, "pull:") {
+		t.Errorf("expected a label rendering empty to be left out:\n%s", config)
+	}
+
+	invalid := &api.MetricsCluster{Spec: api.MetricsClusterSpec{ExternalLabels: map[string]string{"team-name": "release"}}}
+	if _, err := o.loadAdditionalConfig(invalid); err == nil {
+		t.Errorf("expected an invalid label name to be refused")
+	}
+}
+
+func TestApplyPrometheusImage(t *testing.T) {
+	o := &Operator{PrometheusImage: "quay.io/prometheus/prometheus:v2.17.2"}
+	referencing := []*api.MetricsCluster{
+		{},
+		{Spec: api.MetricsClusterSpec{Images: &api.ImagesSpec{Prometheus: "quay.io/prometheus/prometheus:v2.22.0"}}},
+	}
+
+	podSpec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "prometheus", Image: o.PrometheusImage}}}
+	o.applyPrometheusImage(podSpec, referencing)
+	if podSpec.Containers[0].Image != "quay.io/prometheus/prometheus:v2.22.0" {
+		t.Errorf("expected the image of the first cluster setting one, got %s", podSpec.Containers[0].Image)
+	}
+
+	// The image selected for the data's block format is kept.
+	podSpec = &corev1.PodSpec{Containers: []corev1.Container{{Name: "prometheus", Image: "quay.io/prometheus/prometheus:v2.1.0"}}}
+	o.applyPrometheusImage(podSpec, referencing)
+	if podSpec.Containers[0].Image != "quay.io/prometheus/prometheus:v2.1.0" {
+		t.Errorf("expected the block format's image kept, got %s", podSpec.Containers[0].Image)
+	}
+}
@@ -0,0 +1,46 @@
+package operator
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// Deployments read back from the API server have their specs defaulted, so
+// they never equal the desired specs they were created from, and comparing
+// them updated deployments on every reconcile. Instead, the hash of the
+// desired spec is recorded on the deployment, and it's only updated when the
+// hash, or its scale, changes.
+
+// templateHashAnnotation is the hash of the spec a deployment was last
+// written with, besides its replicas.
+const templateHashAnnotation = "dowser.dowser/template-hash"
+
+// setTemplateHash records the hash of the desired deployment's spec, which
+// must be complete, in its annotations.
+func setTemplateHash(deployment *appsv1.Deployment) {
+	spec := deployment.Spec.DeepCopy()
+	spec.Replicas = nil
+	data, err := json.Marshal(spec)
+	if err != nil {
+		// Specs always encode; an unhashable one is just always updated.
+		return
+	}
+	hash := sha256.Sum256(data)
+	if deployment.Annotations == nil {
+		deployment.Annotations = map[string]string{}
+	}
+	deployment.Annotations[templateHashAnnotation] = fmt.Sprintf("%x", hash[:8])
+}
+
+// specChanged returns whether the deployment's spec differs from the
+// desired one, whose hash is set: whether it was written from another spec,
+// or is scaled differently.
+func specChanged(current, desired *appsv1.Deployment) bool {
+	hash, hasHash := current.Annotations[templateHashAnnotation]
+	return !hasHash || hash != desired.Annotations[templateHashAnnotation] ||
+		!equality.Semantic.DeepEqual(current.Spec.Replicas, desired.Spec.Replicas)
+}
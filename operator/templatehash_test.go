@@ -0,0 +1,44 @@
+package operator
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSpecChanged(t *testing.T) {
+	deployment := func(replicas int32, image string) *appsv1.Deployment {
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "prometheus-1"},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "prometheus", Image: image}}},
+				},
+			},
+		}
+		setTemplateHash(deployment)
+		return deployment
+	}
+
+	current := deployment(1, "prometheus:v2.17.2")
+	// The API server defaults fields the desired spec leaves unset.
+	current.Spec.Template.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent
+	current.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+
+	if specChanged(current, deployment(1, "prometheus:v2.17.2")) {
+		t.Errorf("expected a defaulted spec to be unchanged")
+	}
+	if !specChanged(current, deployment(1, "prometheus:v2.20.0")) {
+		t.Errorf("expected a new image to change the spec")
+	}
+	if !specChanged(current, deployment(0, "prometheus:v2.17.2")) {
+		t.Errorf("expected scaling to change the spec")
+	}
+	delete(current.Annotations, templateHashAnnotation)
+	if !specChanged(current, deployment(1, "prometheus:v2.17.2")) {
+		t.Errorf("expected a deployment without a hash to be updated")
+	}
+}
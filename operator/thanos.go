@@ -0,0 +1,59 @@
+package operator
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// thanosEndpointVersion is the first Thanos release whose querier takes
+// --endpoint; earlier ones only understand --store.
+const thanosEndpointVersion = "v0.22.0"
+
+// resolveThanosVersion returns the Thanos version flags are generated for:
+// the given hint if set, otherwise the version in the image tag. An empty
+// result means the version is unknown and the newest flags are used.
+func resolveThanosVersion(image, hint string) (string, error) {
+	if len(hint) > 0 {
+		version := canonicalVersion(hint)
+		if len(version) == 0 {
+			return "", fmt.Errorf("invalid thanos version %q", hint)
+		}
+		return version, nil
+	}
+	// Digests pin an image without naming its version.
+	if strings.Contains(image, "@") {
+		return "", nil
+	}
+	slash := strings.LastIndex(image, "/")
+	colon := strings.LastIndex(image, ":")
+	if colon <= slash {
+		return "", nil
+	}
+	return canonicalVersion(image[colon+1:]), nil
+}
+
+// canonicalVersion parses tags like v0.14.0, 0.14 or v0.28.1-rc.0, returning
+// an empty string for anything else, e.g. latest or main-2022-01-01.
+func canonicalVersion(tag string) string {
+	if !strings.HasPrefix(tag, "v") {
+		tag = "v" + tag
+	}
+	return semver.Canonical(tag)
+}
+
+// thanosAtLeast returns whether the configured Thanos version is at least the
+// given one. Unknown versions are assumed to be recent.
+func (o *Operator) thanosAtLeast(version string) bool {
+	return len(o.thanosVersion) == 0 || semver.Compare(o.thanosVersion, version) >= 0
+}
+
+// thanosStoreFlag returns the querier flag adding the store API endpoints at
+// address.
+func (o *Operator) thanosStoreFlag(address string) string {
+	if o.thanosAtLeast(thanosEndpointVersion) {
+		return "--endpoint=" + address
+	}
+	return "--store=" + address
+}
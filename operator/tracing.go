@@ -0,0 +1,34 @@
+package operator
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// With TracingEndpoint, the query frontend, query, store gateway and replica
+// sidecars of clusters send their spans to a Jaeger collector, or any
+// collector receiving Jaeger's protocol such as OpenTelemetry's. Thanos
+// propagates the trace context over gRPC, so a slow federated query is
+// traced from the query through every store it fans out to.
+
+// tracingConfig returns the Thanos tracing configuration of the service.
+// It's in YAML's flow style so the flag holding it stays on a single line.
+func (o *Operator) tracingConfig(service string) string {
+	return fmt.Sprintf("{type: JAEGER, config: {service_name: %s, endpoint: %q, sampler_type: probabilistic, sampler_param: %s}}",
+		service, o.TracingEndpoint, strconv.FormatFloat(o.TracingSampleRatio, 'g', -1, 64))
+}
+
+// applyTracing has the named Thanos container of the pod trace its requests
+// as the service, if TracingEndpoint is set.
+func (o *Operator) applyTracing(podSpec *corev1.PodSpec, container, service string) {
+	if len(o.TracingEndpoint) == 0 {
+		return
+	}
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == container {
+			podSpec.Containers[i].Command = append(podSpec.Containers[i].Command, "--tracing.config="+o.tracingConfig(service))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package operator
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestApplyTracing(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		expect   bool
+	}{
+		{name: "disabled", endpoint: "", expect: false},
+		{name: "enabled", endpoint: "http://jaeger-collector:14268/api/traces", expect: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := &Operator{TracingEndpoint: test.endpoint, TracingSampleRatio: 0.25}
+			podSpec := &corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "prometheus", Command: []string{"prometheus"}},
+				{Name: "thanos-sidecar", Command: []string{"thanos", "sidecar"}},
+			}}
+			o.applyTracing(podSpec, "thanos-sidecar", "thanos-sidecar")
+
+			if len(podSpec.Containers[0].Command) != 1 {
+				t.Errorf("expected other containers to be left alone, got %v", podSpec.Containers[0].Command)
+			}
+			sidecar := podSpec.Containers[1].Command
+			if !test.expect {
+				if len(sidecar) != 2 {
+					t.Errorf("expected no tracing flag, got %v", sidecar)
+				}
+				return
+			}
+			flag := sidecar[len(sidecar)-1]
+			if !strings.HasPrefix(flag, "--tracing.config=") {
+				t.Fatalf("expected a tracing flag, got %v", sidecar)
+			}
+			var config struct {
+				Type   string `json:"type"`
+				Config struct {
+					ServiceName  string  `json:"service_name"`
+					Endpoint     string  `json:"endpoint"`
+					SamplerType  string  `json:"sampler_type"`
+					SamplerParam float64 `json:"sampler_param"`
+				} `json:"config"`
+			}
+			if err := yaml.Unmarshal([]byte(strings.TrimPrefix(flag, "--tracing.config=")), &config); err != nil {
+				t.Fatalf("couldn't parse tracing config: %v", err)
+			}
+			if config.Type != "JAEGER" || config.Config.ServiceName != "thanos-sidecar" || config.Config.Endpoint != test.endpoint || config.Config.SamplerParam != 0.25 {
+				t.Errorf("unexpected tracing config %+v", config)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package operator
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// blockInspectionTimeout bounds reading a tarball in search of block
+// metadata. Blocks usually come first, but a tarball holding only a WAL is
+// read to the end.
+const blockInspectionTimeout = 5 * time.Minute
+
+var blockVersions map[string]int
+var blockVersionLock sync.Mutex
+
+// blockMeta is the part of a TSDB block's meta.json the operator reads.
+type blockMeta struct {
+	Version int `json:"version"`
+}
+
+// parsePrometheusImages parses the block format version to image mapping
+// given on the command line.
+func parsePrometheusImages(images map[string]string) (map[int]string, error) {
+	parsed := map[int]string{}
+	for version, image := range images {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block version %q: %w", version, err)
+		}
+		parsed[v] = image
+	}
+	return parsed, nil
+}
+
+// prometheusImageFor returns the image able to read the tarball's blocks: the
+// one mapped to the lowest block version at least as new as the tarball's,
+// or the default image if there's none or the version isn't known.
+func (o *Operator) prometheusImageFor(tarURL string) (string, error) {
+	if len(o.prometheusImages) == 0 {
+		return o.PrometheusImage, nil
+	}
+	version, err := findBlockVersion(tarURL)
+	if err != nil {
+		return "", err
+	}
+	if version == 0 {
+		return o.PrometheusImage, nil
+	}
+	var versions []int
+	for v := range o.prometheusImages {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	for _, v := range versions {
+		if v >= version {
+			return o.prometheusImages[v], nil
+		}
+	}
+	return o.PrometheusImage, nil
+}
+
+// findBlockVersion returns the format version of the tarball's blocks, or 0
+// if it holds none. Results are cached as tarballs don't change.
+func findBlockVersion(tarURL string) (int, error) {
+	blockVersionLock.Lock()
+	defer blockVersionLock.Unlock()
+	if blockVersions == nil {
+		blockVersions = map[string]int{}
+	}
+	if version, found := blockVersions[tarURL]; found {
+		return version, nil
+	}
+	version, err := readBlockVersion(tarURL)
+	if err != nil {
+		return 0, err
+	}
+	blockVersions[tarURL] = version
+	return version, nil
+}
+
+func readBlockVersion(tarURL string) (int, error) {
+	client := &http.Client{Timeout: blockInspectionTimeout}
+	resp, err := client.Get(tarURL)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't fetch %s: %w", tarURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("couldn't fetch %s: %s", tarURL, resp.Status)
+	}
+	stream, err := decompress(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't decompress %s: %w", tarURL, err)
+	}
+	defer stream.Close()
+
+	// Blocks written by one Prometheus share a format, so the first block's
+	// metadata is enough.
+	archive := tar.NewReader(stream)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("couldn't read %s: %w", tarURL, err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Base(header.Name) != "meta.json" {
+			continue
+		}
+		var meta blockMeta
+		if err := json.NewDecoder(archive).Decode(&meta); err != nil {
+			return 0, fmt.Errorf("couldn't decode %s in %s: %w", header.Name, tarURL, err)
+		}
+		return meta.Version, nil
+	}
+}
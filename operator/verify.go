@@ -0,0 +1,149 @@
+package operator
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// The archive bucket is verified once per set of sources, after they're all
+// ready, by a Job named after the sources. Jobs for earlier sets are removed.
+
+func (o *Operator) verifyJobName(cluster *api.MetricsCluster) types.NamespacedName {
+	urls := append([]string{}, cluster.Status.URLs...)
+	sort.Strings(urls)
+	hash := sha256.Sum256([]byte(strings.Join(urls, "\n")))
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("verify-%s-%x", cluster.Name, hash[:6])}
+}
+
+func (o *Operator) verifyJobManifest(cluster *api.MetricsCluster) *batchv1.Job {
+	name := o.verifyJobName(cluster)
+	var backoffLimit int32 = 1
+	labels := map[string]string{
+		"app":     "bucket-verify",
+		"cluster": cluster.Name,
+	}
+
+	volumes := []corev1.Volume{objstoreVolume(cluster)}
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "objstore",
+			MountPath: "/etc/thanos/",
+			ReadOnly:  true,
+		},
+	}
+	command := append(o.thanosBucketCommand("verify"), "--objstore.config-file=/etc/thanos/"+objstoreConfigKey)
+	if backup := cluster.Spec.ObjectStorage.BackupSecretName; len(backup) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: "objstore-backup",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: backup},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      "objstore-backup",
+			MountPath: "/etc/thanos-backup/",
+			ReadOnly:  true,
+		})
+		command = append(command, "--repair", "--objstore-backup.config-file=/etc/thanos-backup/"+objstoreConfigKey)
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Volumes:       volumes,
+					Containers: []corev1.Container{
+						{
+							Name:         "verify",
+							Image:        o.ThanosImage,
+							Command:      command,
+							VolumeMounts: mounts,
+						},
+					},
+				},
+			},
+		},
+	}
+	o.hardenPodSpec(&job.Spec.Template.Spec)
+	return job
+}
+
+// verifyBucket runs the bucket verifier for the cluster's current sources once
+// they're ready, and reports its result in the BucketVerified condition.
+func (o *Operator) verifyBucket(cluster *api.MetricsCluster) error {
+	if cluster.Spec.ObjectStorage == nil || !cluster.Spec.ObjectStorage.Verify {
+		removeCondition(cluster, api.ConditionBucketVerified)
+		return nil
+	}
+	if cluster.Status.Phase != api.PhaseReady {
+		return nil
+	}
+
+	name := o.verifyJobName(cluster)
+	jobs := &batchv1.JobList{}
+	err := o.client.List(context.TODO(), jobs, client.InNamespace(o.Namespace), client.MatchingLabels{"app": "bucket-verify", "cluster": cluster.Name})
+	if err != nil {
+		return fmt.Errorf("couldn't list verify jobs: %w", err)
+	}
+	var job *batchv1.Job
+	for i := range jobs.Items {
+		if jobs.Items[i].Name == name.Name {
+			job = &jobs.Items[i]
+			continue
+		}
+		// Pods of earlier verifications go with their Job.
+		propagation := metav1.DeletePropagationBackground
+		err := o.client.Delete(context.TODO(), &jobs.Items[i], &client.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete verify job: %w", err)
+		}
+	}
+
+	if job == nil {
+		job = o.verifyJobManifest(cluster)
+		if err := o.client.Create(context.TODO(), job); err != nil {
+			return fmt.Errorf("couldn't create verify job: %w", err)
+		}
+		o.log.Info("created verify job", "name", job.Name)
+		setCondition(cluster, api.ConditionBucketVerified, corev1.ConditionUnknown, "Verifying", "verifying the bucket")
+		return nil
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			setCondition(cluster, api.ConditionBucketVerified, corev1.ConditionTrue, "Verified", fmt.Sprintf("verified by job %s", job.Name))
+			return nil
+		case batchv1.JobFailed:
+			setCondition(cluster, api.ConditionBucketVerified, corev1.ConditionFalse, "VerificationFailed", fmt.Sprintf("job %s failed; see its logs", job.Name))
+			return nil
+		}
+	}
+	setCondition(cluster, api.ConditionBucketVerified, corev1.ConditionUnknown, "Verifying", "verifying the bucket")
+	return nil
+}
@@ -0,0 +1,193 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// Clusters using the VictoriaMetrics backend import each source into a
+// single-node VictoriaMetrics through the remote write replay, instead of
+// serving it from a Prometheus replica, and expose VictoriaMetrics in place of
+// Thanos query.
+
+const victoriaMetricsPort = 8428
+
+func (o *Operator) victoriaMetricsName(cluster *api.MetricsCluster) types.NamespacedName {
+	return types.NamespacedName{Namespace: o.Namespace, Name: fmt.Sprintf("victoriametrics-%s", cluster.Name)}
+}
+
+// victoriaMetricsEndpoint returns the environment of the replay command
+// importing into the cluster's VictoriaMetrics.
+func (o *Operator) victoriaMetricsEndpoint(cluster *api.MetricsCluster) []corev1.EnvVar {
+	name := o.victoriaMetricsName(cluster)
+	return []corev1.EnvVar{
+		{
+			Name:  "REMOTE_WRITE_URL",
+			Value: fmt.Sprintf("http://%s.%s.svc:%d/api/v1/write", name.Name, name.Namespace, victoriaMetricsPort),
+		},
+	}
+}
+
+func (o *Operator) victoriaMetricsDeploymentManifest(cluster *api.MetricsCluster) *appsv1.Deployment {
+	name := o.victoriaMetricsName(cluster)
+	var replicas int32 = 1
+	labels := map[string]string{
+		"app":     "victoriametrics",
+		"cluster": cluster.Name,
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			Labels:          labels,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						{
+							Name: "storage",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:  "victoriametrics",
+							Image: o.VictoriaMetricsImage,
+							Args: []string{
+								"-storageDataPath=/storage",
+								fmt.Sprintf("-httpListenAddr=:%d", victoriaMetricsPort),
+								// CI data is old by the time it's imported;
+								// keep it as long as possible (in months).
+								"-retentionPeriod=1200",
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: victoriaMetricsPort,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "storage",
+									MountPath: "/storage",
+								},
+							},
+							ReadinessProbe: readinessProbe("/health", victoriaMetricsPort),
+							LivenessProbe:  livenessProbe("/health", victoriaMetricsPort),
+						},
+					},
+				},
+			},
+		},
+	}
+	o.hardenPodSpec(&deployment.Spec.Template.Spec)
+	return deployment
+}
+
+func (o *Operator) victoriaMetricsServiceManifest(cluster *api.MetricsCluster) *corev1.Service {
+	name := o.victoriaMetricsName(cluster)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       name.Namespace,
+			Name:            name.Name,
+			OwnerReferences: clusterOwner(cluster),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port:     victoriaMetricsPort,
+					Protocol: corev1.ProtocolTCP,
+					Name:     "http",
+				},
+			},
+			Selector: map[string]string{
+				"app":     "victoriametrics",
+				"cluster": cluster.Name,
+			},
+		},
+	}
+}
+
+// importSource imports the job's source into the cluster's VictoriaMetrics,
+// and returns its status and whether the import failed.
+func (o *Operator) importSource(cluster *api.MetricsCluster, job *Job, url, deploymentName string) (api.JobStatus, bool, error) {
+	jobStatus := api.JobStatus{URL: url}
+	var err error
+	jobStatus.Replay, err = o.ensureReplay(o.replayJobName("import", cluster, deploymentName), cluster, job, deploymentName, o.victoriaMetricsEndpoint(cluster))
+	if err != nil {
+		return jobStatus, false, err
+	}
+	switch jobStatus.Replay {
+	case api.ReplaySucceeded:
+		jobStatus.Ready = true
+	case api.ReplayFailed:
+		return jobStatus, true, nil
+	case "":
+		jobStatus.Message = "waiting for the job to complete"
+	}
+	return jobStatus, false, nil
+}
+
+// ensureVictoriaMetrics creates the cluster's VictoriaMetrics and returns its
+// service and whether it's available.
+func (o *Operator) ensureVictoriaMetrics(cluster *api.MetricsCluster) (string, bool, error) {
+	name := o.victoriaMetricsName(cluster)
+
+	deployment := &appsv1.Deployment{}
+	hasDeployment := true
+	err := o.client.Get(context.TODO(), name, deployment)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			hasDeployment = false
+		} else {
+			return "", false, fmt.Errorf("couldn't fetch deployment: %w", err)
+		}
+	}
+	if !hasDeployment {
+		deployment = o.victoriaMetricsDeploymentManifest(cluster)
+		if err := o.client.Create(context.TODO(), deployment); err != nil {
+			return "", false, fmt.Errorf("couldn't create deployment: %w", err)
+		}
+		o.log.Info("created deployment", "name", deployment.Name)
+	}
+
+	service := &corev1.Service{}
+	hasService := true
+	err = o.client.Get(context.TODO(), name, service)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			hasService = false
+		} else {
+			return "", false, fmt.Errorf("couldn't fetch service: %w", err)
+		}
+	}
+	if !hasService {
+		service = o.victoriaMetricsServiceManifest(cluster)
+		if err := o.client.Create(context.TODO(), service); err != nil {
+			return "", false, fmt.Errorf("couldn't create service: %w", err)
+		}
+		o.log.Info("created service", "name", service.Name)
+	}
+
+	return name.Name, deployment.Status.AvailableReplicas > 0, nil
+}
@@ -0,0 +1,102 @@
+package operator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Prometheus replays the WAL of the archived instance before it serves
+// anything, which for a busy instance takes longer than loading all of its
+// blocks, although their data is mostly in the blocks already. With
+// --trim-wal-over, fetchers drop WALs larger than the given size, along with
+// the head chunks they index, from tarballs holding blocks, so replicas start
+// right away at the cost of the samples not yet compacted. The WAL is dropped
+// whole: Prometheus refuses a WAL with missing segments, and dropping the
+// first ones would lose the series later samples refer to. Tarballs holding
+// only a WAL keep it, since it's all their data.
+
+// walDirs are the directories of the TSDB's head, dropped together.
+var walDirs = []string{"wal", "chunks_head"}
+
+// parseWALTrimming returns the size over which WALs are dropped, given as a
+// quantity of bytes, or zero if none is given.
+func parseWALTrimming(size string) (int64, error) {
+	if len(size) == 0 {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid wal trimming size %q: %w", size, err)
+	}
+	if quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid wal trimming size %q: not positive", size)
+	}
+	return quantity.Value(), nil
+}
+
+// applyWALTrimming has the pod's setup container drop large WALs.
+func (o *Operator) applyWALTrimming(podSpec *corev1.PodSpec) {
+	if o.trimWALOver == 0 {
+		return
+	}
+	setup := &podSpec.InitContainers[0]
+	setup.Env = append(setup.Env, corev1.EnvVar{Name: "TRIM_WAL_OVER", Value: strconv.FormatInt(o.trimWALOver, 10)})
+}
+
+// trimWAL drops the WAL and head chunks extracted into dir if the WAL is
+// larger than max bytes and dir holds blocks. A zero max keeps the WAL.
+func trimWAL(dir string, max int64, log logr.Logger) error {
+	if max <= 0 {
+		return nil
+	}
+	size, err := treeSize(filepath.Join(dir, "wal"))
+	if err != nil {
+		return err
+	}
+	if size <= max {
+		return nil
+	}
+	blocks, err := filepath.Glob(filepath.Join(dir, "*", "meta.json"))
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		log.Info("keeping the WAL of a tarball without blocks", "dir", dir, "bytes", size)
+		return nil
+	}
+	for _, name := range walDirs {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("couldn't drop the %s: %w", name, err)
+		}
+	}
+	log.Info("dropped the WAL", "dir", dir, "bytes", size, "blocks", len(blocks))
+	return nil
+}
+
+// treeSize returns the size of the files under path, zero if it doesn't
+// exist.
+func treeSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("couldn't measure %s: %w", path, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,84 @@
+package operator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	logging "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestTrimWAL(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		max     int64
+		trimmed bool
+	}{
+		{
+			name:    "large WAL",
+			files:   map[string]string{"01EXAMPLE/meta.json": "{}", "wal/00000000": strings.Repeat("wal", 100), "chunks_head/000001": "chunks"},
+			max:     100,
+			trimmed: true,
+		},
+		{
+			name:  "small WAL",
+			files: map[string]string{"01EXAMPLE/meta.json": "{}", "wal/00000000": "wal", "chunks_head/000001": "chunks"},
+			max:   100,
+		},
+		{
+			name:  "only a WAL",
+			files: map[string]string{"wal/00000000": strings.Repeat("wal", 100)},
+			max:   100,
+		},
+		{
+			name:  "trimming disabled",
+			files: map[string]string{"01EXAMPLE/meta.json": "{}", "wal/00000000": strings.Repeat("wal", 100)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, content := range test.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := trimWAL(dir, test.max, logging.Log); err != nil {
+				t.Fatal(err)
+			}
+			for name := range test.files {
+				_, err := os.Stat(filepath.Join(dir, name))
+				dropped := os.IsNotExist(err)
+				if expected := test.trimmed && !strings.HasPrefix(name, "01EXAMPLE/"); dropped != expected {
+					t.Errorf("%s: expected dropped %t, got %t", name, expected, dropped)
+				}
+			}
+		})
+	}
+}
+
+func TestParseWALTrimming(t *testing.T) {
+	if size, err := parseWALTrimming(""); err != nil || size != 0 {
+		t.Errorf("expected no trimming by default, got %d (%v)", size, err)
+	}
+	if size, err := parseWALTrimming("1Gi"); err != nil || size != 1<<30 {
+		t.Errorf("expected 1Gi parsed, got %d (%v)", size, err)
+	}
+	for _, invalid := range []string{"0", "-1Gi", "lots"} {
+		if _, err := parseWALTrimming(invalid); err == nil {
+			t.Errorf("expected %q refused", invalid)
+		}
+	}
+}
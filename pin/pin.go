@@ -0,0 +1,106 @@
+// Package pin keeps clusters from expiring for a while, recording who asked
+// for it, instead of users editing expiry settings by hand.
+package pin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+type pinOptions struct {
+	For       time.Duration
+	By        string
+	Namespace string
+}
+
+func NewPinCommand() *cobra.Command {
+	var options pinOptions
+
+	var command = &cobra.Command{
+		Use:   "pin CLUSTER",
+		Short: "Pins a cluster so it doesn't expire.",
+		Long: `Pins a cluster so it doesn't expire for a while.
+
+The pin runs out after --for, which the operator bounds with its
+--max-pin-duration. Pinning again replaces the previous pin, and --for=0
+unpins the cluster.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := pin(options, args[0], time.Now())
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().DurationVarP(&options.For, "for", "", 72*time.Hour, "how long to pin the cluster for (0 to unpin)")
+	command.Flags().StringVarP(&options.By, "by", "", os.Getenv("USER"), "who is pinning the cluster")
+	command.Flags().StringVarP(&options.Namespace, "namespace", "", "dowser", "namespace of the cluster")
+
+	return command
+}
+
+// pinPatch returns the merge patch pinning a cluster, or unpinning it if
+// duration is zero.
+func pinPatch(duration time.Duration, by string, now time.Time) ([]byte, error) {
+	annotations := map[string]interface{}{
+		api.PinnedUntilAnnotation: nil,
+		api.PinnedByAnnotation:    nil,
+	}
+	if duration > 0 {
+		annotations[api.PinnedUntilAnnotation] = now.Add(duration).UTC().Format(time.RFC3339)
+		annotations[api.PinnedByAnnotation] = by
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+}
+
+func pin(options pinOptions, clusterName string, now time.Time) error {
+	if options.For < 0 {
+		return fmt.Errorf("invalid duration %s", options.For)
+	}
+	if options.For > 0 && len(options.By) == 0 {
+		return fmt.Errorf("no --by given")
+	}
+	patch, err := pinPatch(options.For, options.By, now)
+	if err != nil {
+		return err
+	}
+	config, err := clientconfig.GetConfig()
+	if err != nil {
+		return fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	clientScheme := runtime.NewScheme()
+	if err := api.AddToScheme(clientScheme); err != nil {
+		return err
+	}
+	kubeClient, err := client.New(config, client.Options{Scheme: clientScheme})
+	if err != nil {
+		return fmt.Errorf("couldn't create client: %w", err)
+	}
+	cluster := &api.MetricsCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: options.Namespace, Name: clusterName},
+	}
+	if err := kubeClient.Patch(context.TODO(), cluster, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		return fmt.Errorf("couldn't pin metricscluster %s: %w", clusterName, err)
+	}
+	if options.For == 0 {
+		fmt.Printf("metricscluster %s unpinned\n", clusterName)
+	} else {
+		fmt.Printf("metricscluster %s pinned until %s\n", clusterName, cluster.Annotations[api.PinnedUntilAnnotation])
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package prow
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	prowio "k8s.io/test-infra/prow/io"
+)
+
+// prometheusTarPath is where a build's steps archive Prometheus's data,
+// relative to their artifacts.
+const prometheusTarPath = "metrics/prometheus.tar"
+
+// gcsPublicURL serves the objects of public GCS buckets.
+const gcsPublicURL = "https://storage.googleapis.com"
+
+// NewStorageOpener returns an opener reading GCS with the service account in
+// credentialsFile, or with the default credentials if it's empty, falling
+// back to anonymous access.
+func NewStorageOpener(ctx context.Context, credentialsFile string) (prowio.Opener, error) {
+	opener, err := prowio.NewOpener(ctx, credentialsFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create storage client: %w", err)
+	}
+	return opener, nil
+}
+
+// FindPrometheusTar returns the URL of the Prometheus tarball archived by the
+// build whose spyglass view is at viewURL, by listing the build's artifacts.
+// Builds running several steps may archive more than one; the one gathered
+// after the e2e tests is preferred. Builds archiving it elsewhere than under
+// metrics/prometheus.tar are given patterns instead: globs of its path
+// relative to the build's directory, tried in order.
+func FindPrometheusTar(ctx context.Context, opener prowio.Opener, viewURL string, patterns []string) (string, error) {
+	bucketName, root, err := parseViewURL(viewURL)
+	if err != nil {
+		return "", err
+	}
+	bucket := blobStorageBucket{bucketName, "gs", opener}
+	if len(patterns) > 0 {
+		return findPrometheusTarMatching(ctx, bucket, root, viewURL, patterns)
+	}
+	artifacts := path.Join(root, "artifacts") + "/"
+	keys, err := bucket.listAll(ctx, artifacts)
+	if err != nil {
+		return "", fmt.Errorf("couldn't list artifacts of %s: %w", viewURL, err)
+	}
+	best, bestRank := "", -1
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/"+prometheusTarPath) {
+			continue
+		}
+		if rank := prometheusTarRank(strings.TrimPrefix(key, artifacts)); rank > bestRank {
+			best, bestRank = key, rank
+		}
+	}
+	if bestRank < 0 {
+		return "", fmt.Errorf("no %s in the artifacts of %s", prometheusTarPath, viewURL)
+	}
+	return fmt.Sprintf("%s/%s/%s", gcsPublicURL, bucketName, best), nil
+}
+
+// findPrometheusTarMatching returns the URL of the tarball matching the first
+// of patterns matching any object of the build at root, preferring the
+// tarball of the e2e tests among several.
+func findPrometheusTarMatching(ctx context.Context, bucket blobStorageBucket, root, viewURL string, patterns []string) (string, error) {
+	prefix := root + "/"
+	keys, err := bucket.listAll(ctx, prefix)
+	if err != nil {
+		return "", fmt.Errorf("couldn't list the objects of %s: %w", viewURL, err)
+	}
+	for _, pattern := range patterns {
+		best, bestRank := "", -1
+		for _, key := range keys {
+			relative := strings.TrimPrefix(key, prefix)
+			if matched, _ := path.Match(pattern, relative); !matched {
+				continue
+			}
+			if rank := prometheusTarRank(strings.TrimPrefix(relative, "artifacts/")); rank > bestRank {
+				best, bestRank = key, rank
+			}
+		}
+		if bestRank >= 0 {
+			return fmt.Sprintf("%s/%s/%s", gcsPublicURL, bucket.name, best), nil
+		}
+	}
+	return "", fmt.Errorf("nothing matching %s in the objects of %s", strings.Join(patterns, ", "), viewURL)
+}
+
+// FindArtifacts returns the URLs of the artifacts of the build whose spyglass
+// view is at viewURL matching each kind's pattern, a glob of their file name,
+// e.g. alerts.json.
+func FindArtifacts(ctx context.Context, opener prowio.Opener, viewURL string, patterns map[string]string) (map[string][]string, error) {
+	bucketName, root, err := parseViewURL(viewURL)
+	if err != nil {
+		return nil, err
+	}
+	bucket := blobStorageBucket{bucketName, "gs", opener}
+	keys, err := bucket.listAll(ctx, path.Join(root, "artifacts")+"/")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list artifacts of %s: %w", viewURL, err)
+	}
+	found := map[string][]string{}
+	for _, key := range keys {
+		for kind, pattern := range patterns {
+			if matched, _ := path.Match(pattern, path.Base(key)); matched {
+				found[kind] = append(found[kind], fmt.Sprintf("%s/%s/%s", gcsPublicURL, bucketName, key))
+			}
+		}
+	}
+	for kind := range found {
+		sort.Strings(found[kind])
+	}
+	return found, nil
+}
+
+// prometheusTarRank orders the tarballs of a build by preference given their
+// path under its artifacts: those of e2e steps, then those gathered by
+// gather-extra.
+func prometheusTarRank(artifactPath string) int {
+	rank := 0
+	if strings.Contains(strings.SplitN(artifactPath, "/", 2)[0], "e2e") {
+		rank += 2
+	}
+	if strings.Contains(artifactPath, "/gather-extra/") {
+		rank++
+	}
+	return rank
+}
+
+// PublicObjectURL returns the URL serving the object at a gs://<bucket>/<path>
+// URL, which must be in a public bucket.
+func PublicObjectURL(gsURL string) (string, error) {
+	parsed, err := url.Parse(gsURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid object url %s: %w", gsURL, err)
+	}
+	if parsed.Scheme != "gs" || len(parsed.Host) == 0 || len(strings.Trim(parsed.Path, "/")) == 0 {
+		return "", fmt.Errorf("%s isn't the url of an object in GCS", gsURL)
+	}
+	return fmt.Sprintf("%s/%s/%s", gcsPublicURL, parsed.Host, strings.TrimPrefix(parsed.Path, "/")), nil
+}
+
+// parseViewURL returns the bucket and path of the build viewed at a spyglass
+// URL, e.g. https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/job/1.
+func parseViewURL(viewURL string) (string, string, error) {
+	parsed, err := url.Parse(viewURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid build url %s: %w", viewURL, err)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(parsed.Path, spyglassPrefix+"/"), "/", 3)
+	if !strings.HasPrefix(parsed.Path, spyglassPrefix+"/") || len(parts) != 3 || parts[0] != "gs" || len(parts[2]) == 0 {
+		return "", "", fmt.Errorf("%s isn't the view of a build in GCS", viewURL)
+	}
+	return parts[1], strings.TrimSuffix(parts[2], "/"), nil
+}
@@ -0,0 +1,73 @@
+package prow
+
+import "testing"
+
+func TestParseViewURL(t *testing.T) {
+	bucket, root, err := parseViewURL("https://prow.ci.openshift.org/view/gs/origin-ci-test/logs/release-openshift-ocp-installer-e2e-aws-4.6/1305723582000664576/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket != "origin-ci-test" || root != "logs/release-openshift-ocp-installer-e2e-aws-4.6/1305723582000664576" {
+		t.Errorf("unexpected bucket %q and root %q", bucket, root)
+	}
+	for _, invalid := range []string{
+		"https://prow.ci.openshift.org/job-history/gs/origin-ci-test/logs/job",
+		"https://prow.ci.openshift.org/view/s3/bucket/logs/job/1",
+		"https://prow.ci.openshift.org/view/gs/origin-ci-test",
+	} {
+		if _, _, err := parseViewURL(invalid); err == nil {
+			t.Errorf("expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func TestPublicObjectURL(t *testing.T) {
+	public, err := PublicObjectURL("gs://dowser-uploads/must-gather/prometheus.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public != "https://storage.googleapis.com/dowser-uploads/must-gather/prometheus.tar.gz" {
+		t.Errorf("unexpected url %q", public)
+	}
+	for _, invalid := range []string{
+		"https://storage.googleapis.com/dowser-uploads/prometheus.tar",
+		"gs://dowser-uploads",
+		"gs:///prometheus.tar",
+	} {
+		if _, err := PublicObjectURL(invalid); err == nil {
+			t.Errorf("expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func TestPrometheusTarRank(t *testing.T) {
+	paths := []string{
+		"release-payload/metrics/prometheus.tar",
+		"e2e-aws/metrics/prometheus.tar",
+		"e2e-aws/gather-extra/metrics/prometheus.tar",
+	}
+	for i := 1; i < len(paths); i++ {
+		if prometheusTarRank(paths[i]) <= prometheusTarRank(paths[i-1]) {
+			t.Errorf("expected %s to be preferred over %s", paths[i], paths[i-1])
+		}
+	}
+}
+
+func TestMirrorObjectURL(t *testing.T) {
+	tests := map[string]string{
+		"https://storage.googleapis.com/origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar": "gs://mirror/tarballs/origin-ci-test/logs/job/1/artifacts/metrics/prometheus.tar",
+		"gs://other-bucket/snapshots/prometheus.tar.gz":                                             "gs://mirror/tarballs/other-bucket/snapshots/prometheus.tar.gz",
+		"https://example.com/uploads/prometheus.tgz":                                                "gs://mirror/tarballs/example.com/uploads/prometheus.tgz",
+	}
+	for objectURL, expected := range tests {
+		actual, err := MirrorObjectURL("gs://mirror/tarballs/", objectURL)
+		if err != nil {
+			t.Errorf("%s: %v", objectURL, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %s, got %s", objectURL, expected, actual)
+		}
+	}
+	if _, err := MirrorObjectURL("https://mirror", "gs://bucket/object"); err == nil {
+		t.Errorf("expected a mirror outside of GCS to be refused")
+	}
+}
@@ -0,0 +1,126 @@
+package prow
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	prowio "k8s.io/test-infra/prow/io"
+	"k8s.io/test-infra/prow/pod-utils/gcs"
+)
+
+// Selector matches finished builds of periodic and postsubmit jobs.
+type Selector struct {
+	// Name matches the names of the jobs.
+	Name *regexp.Regexp
+	// Branch, if set, must be the branch of a repository the build checked
+	// out.
+	Branch string
+	// Since is the earliest start time of matching builds.
+	Since time.Time
+	// Limit is the maximum number of builds returned, the most recent first.
+	Limit int
+}
+
+// DiscoveredBuild is a finished build matching a selector.
+type DiscoveredBuild struct {
+	Job     string
+	ID      string
+	Started time.Time
+}
+
+// URL returns the build's URL under viewBaseURL, the URL of the spyglass view
+// of the bucket.
+func (b DiscoveredBuild) URL(viewBaseURL string) string {
+	return strings.TrimSuffix(viewBaseURL, "/") + "/" + path.Join(logsPrefix, b.Job, b.ID)
+}
+
+// Discover lists the finished builds in the GCS bucket matching the selector,
+// the most recent first.
+func Discover(ctx context.Context, opener prowio.Opener, bucketName string, selector Selector) ([]DiscoveredBuild, error) {
+	bucket := blobStorageBucket{bucketName, "gs", opener}
+
+	dirs, err := bucket.listSubDirs(ctx, logsPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list jobs: %w", err)
+	}
+	var builds []DiscoveredBuild
+	for _, dir := range dirs {
+		job := path.Base(dir)
+		if !selector.Name.MatchString(job) {
+			continue
+		}
+		jobBuilds, err := discoverJobBuilds(ctx, bucket, job, selector)
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, jobBuilds...)
+	}
+	sort.SliceStable(builds, func(i, j int) bool { return builds[i].Started.After(builds[j].Started) })
+	if selector.Limit > 0 && len(builds) > selector.Limit {
+		builds = builds[:selector.Limit]
+	}
+	return builds, nil
+}
+
+// discoverJobBuilds returns the job's matching builds, walking back from the
+// most recent until they started before the selector's window.
+func discoverJobBuilds(ctx context.Context, bucket blobStorageBucket, job string, selector Selector) ([]DiscoveredBuild, error) {
+	root := path.Join(logsPrefix, job)
+	ids, err := bucket.listBuildIDs(ctx, root)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list builds of job %s: %w", job, err)
+	}
+	sort.Sort(sort.Reverse(int64slice(ids)))
+
+	var builds []DiscoveredBuild
+	for _, buildID := range ids {
+		if selector.Limit > 0 && len(builds) >= selector.Limit {
+			break
+		}
+		id := strconv.FormatInt(buildID, 10)
+		dir := path.Join(root, id)
+		started := gcs.Started{}
+		if err := readJSON(ctx, bucket, path.Join(dir, "started.json"), &started); err != nil {
+			continue
+		}
+		startTime := time.Unix(started.Timestamp, 0)
+		if startTime.Before(selector.Since) {
+			break
+		}
+		if len(selector.Branch) > 0 && !checkedOutBranch(started, selector.Branch) {
+			continue
+		}
+		// Builds only upload their metrics once they finish.
+		finished := gcs.Finished{}
+		if err := readJSON(ctx, bucket, path.Join(dir, "finished.json"), &finished); err != nil || finished.Timestamp == nil {
+			continue
+		}
+		builds = append(builds, DiscoveredBuild{Job: job, ID: id, Started: startTime})
+	}
+	return builds, nil
+}
+
+// ReadFinished returns the finished.json of the build in dir of the GCS
+// bucket.
+func ReadFinished(ctx context.Context, opener prowio.Opener, bucketName, dir string) (gcs.Finished, error) {
+	finished := gcs.Finished{}
+	err := readJSON(ctx, blobStorageBucket{bucketName, "gs", opener}, path.Join(dir, "finished.json"), &finished)
+	return finished, err
+}
+
+// checkedOutBranch returns whether the build checked out the branch of any
+// repository. Repository versions are recorded as branch:commit.
+func checkedOutBranch(started gcs.Started, branch string) bool {
+	for _, version := range started.Repos {
+		if strings.SplitN(version, ":", 2)[0] == branch {
+			return true
+		}
+	}
+	return false
+}
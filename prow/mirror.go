@@ -0,0 +1,188 @@
+package prow
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	prowio "k8s.io/test-infra/prow/io"
+)
+
+// MirrorObjectURL returns the gs:// URL the object at objectURL is mirrored to
+// under mirrorURL, a gs://<bucket>/<prefix> URL. Objects served by GCS keep
+// their bucket and path, and others their host and path, so that each object
+// has a single copy.
+func MirrorObjectURL(mirrorURL, objectURL string) (string, error) {
+	mirror, err := url.Parse(mirrorURL)
+	if err != nil || mirror.Scheme != "gs" || len(mirror.Host) == 0 {
+		return "", fmt.Errorf("%s isn't the url of a GCS bucket", mirrorURL)
+	}
+	object, err := url.Parse(objectURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid object url %s: %w", objectURL, err)
+	}
+	if len(strings.Trim(object.Path, "/")) == 0 {
+		return "", fmt.Errorf("%s isn't the url of an object", objectURL)
+	}
+	objectPath := path.Join(object.Host, object.Path)
+	if fmt.Sprintf("%s://%s", object.Scheme, object.Host) == gcsPublicURL {
+		objectPath = strings.TrimPrefix(object.Path, "/")
+	}
+	return fmt.Sprintf("gs://%s/%s", mirror.Host, path.Join(strings.TrimPrefix(mirror.Path, "/"), objectPath)), nil
+}
+
+// ObjectBucket returns the GCS bucket of the object at objectURL, a gs:// URL
+// or one served by GCS, or else the host serving it.
+func ObjectBucket(objectURL string) string {
+	object, err := url.Parse(objectURL)
+	if err != nil {
+		return ""
+	}
+	if fmt.Sprintf("%s://%s", object.Scheme, object.Host) == gcsPublicURL {
+		return strings.SplitN(strings.TrimPrefix(object.Path, "/"), "/", 2)[0]
+	}
+	return object.Host
+}
+
+// MirrorObject copies the object served at objectURL to mirroredURL, a gs://
+// URL, unless it's already there. Copies which fail are abandoned rather than
+// left incomplete.
+func MirrorObject(ctx context.Context, opener prowio.Opener, objectURL, mirroredURL string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, err := opener.Attributes(ctx, mirroredURL); err == nil {
+		return nil
+	} else if !prowio.IsNotExist(err) {
+		return fmt.Errorf("couldn't check %s: %w", mirroredURL, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch %s: %w", objectURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("couldn't fetch %s: %s", objectURL, resp.Status)
+	}
+	writer, err := opener.Writer(ctx, mirroredURL)
+	if err != nil {
+		return fmt.Errorf("couldn't write %s: %w", mirroredURL, err)
+	}
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		cancel()
+		writer.Close()
+		return fmt.Errorf("couldn't copy %s to %s: %w", objectURL, mirroredURL, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("couldn't write %s: %w", mirroredURL, err)
+	}
+	return nil
+}
+
+// Lifecycle rules apply to a whole bucket, so the age after which a mirror
+// bucket deletes objects is that of its rules deleting any object by age,
+// other rules being left alone.
+
+// isExpiryRule returns whether the rule deletes every object of some age.
+func isExpiryRule(rule storage.LifecycleRule) bool {
+	condition := rule.Condition
+	return rule.Action.Type == storage.DeleteAction && condition.AgeInDays > 0 && condition.CreatedBefore.IsZero() &&
+		condition.Liveness == storage.LiveAndArchived && len(condition.MatchesStorageClasses) == 0 && condition.NumNewerVersions == 0
+}
+
+// ExpiryDays returns the age in days after which the lifecycle deletes
+// objects, the shortest if several rules do, or zero if none does.
+func ExpiryDays(lifecycle storage.Lifecycle) int64 {
+	var days int64
+	for _, rule := range lifecycle.Rules {
+		if isExpiryRule(rule) && (days == 0 || rule.Condition.AgeInDays < days) {
+			days = rule.Condition.AgeInDays
+		}
+	}
+	return days
+}
+
+// WithExpiry returns the lifecycle with its rules deleting objects by age
+// replaced by one deleting them after the given days, and whether that
+// changed it.
+func WithExpiry(lifecycle storage.Lifecycle, days int64) (storage.Lifecycle, bool) {
+	updated := storage.Lifecycle{}
+	expiring := 0
+	for _, rule := range lifecycle.Rules {
+		if isExpiryRule(rule) {
+			expiring++
+			continue
+		}
+		updated.Rules = append(updated.Rules, rule)
+	}
+	updated.Rules = append(updated.Rules, storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{AgeInDays: days},
+	})
+	return updated, expiring != 1 || ExpiryDays(lifecycle) != days
+}
+
+// mirrorBucket returns the bucket of mirrorURL, a gs://<bucket>/<prefix> URL,
+// with a client of the given credentials, or the default ones if unset.
+func mirrorBucket(ctx context.Context, credentialsFile, mirrorURL string) (*storage.Client, *storage.BucketHandle, error) {
+	mirror, err := url.Parse(mirrorURL)
+	if err != nil || mirror.Scheme != "gs" || len(mirror.Host) == 0 {
+		return nil, nil, fmt.Errorf("%s isn't the url of a GCS bucket", mirrorURL)
+	}
+	var options []option.ClientOption
+	if len(credentialsFile) > 0 {
+		options = append(options, option.WithCredentialsFile(credentialsFile))
+	}
+	client, err := storage.NewClient(ctx, options...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create storage client: %w", err)
+	}
+	return client, client.Bucket(mirror.Host), nil
+}
+
+// MirrorExpiryDays returns the age in days after which the bucket of
+// mirrorURL deletes objects, or zero if it keeps them.
+func MirrorExpiryDays(ctx context.Context, credentialsFile, mirrorURL string) (int64, error) {
+	client, bucket, err := mirrorBucket(ctx, credentialsFile, mirrorURL)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read the lifecycle of %s: %w", mirrorURL, err)
+	}
+	return ExpiryDays(attrs.Lifecycle), nil
+}
+
+// EnsureMirrorExpiry has the bucket of mirrorURL delete objects after the
+// given days, and returns whether its lifecycle changed.
+func EnsureMirrorExpiry(ctx context.Context, credentialsFile, mirrorURL string, days int64) (bool, error) {
+	client, bucket, err := mirrorBucket(ctx, credentialsFile, mirrorURL)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return false, fmt.Errorf("couldn't read the lifecycle of %s: %w", mirrorURL, err)
+	}
+	lifecycle, changed := WithExpiry(attrs.Lifecycle, days)
+	if !changed {
+		return false, nil
+	}
+	if _, err := bucket.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle}); err != nil {
+		return false, fmt.Errorf("couldn't update the lifecycle of %s: %w", mirrorURL, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,56 @@
+package prow
+
+import (
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestWithExpiry(t *testing.T) {
+	expiry := func(days int64) storage.LifecycleRule {
+		return storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{AgeInDays: days},
+		}
+	}
+	archive := storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "ARCHIVE"},
+		Condition: storage.LifecycleCondition{AgeInDays: 30},
+	}
+	noncurrent := storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{AgeInDays: 7, Liveness: storage.Archived},
+	}
+
+	tests := []struct {
+		name      string
+		rules     []storage.LifecycleRule
+		days      int64
+		current   int64
+		changed   bool
+		remaining int
+	}{
+		{name: "no rules", days: 90, changed: true, remaining: 1},
+		{name: "same expiry", rules: []storage.LifecycleRule{expiry(90)}, days: 90, current: 90, remaining: 1},
+		{name: "other expiry", rules: []storage.LifecycleRule{expiry(30)}, days: 90, current: 30, changed: true, remaining: 1},
+		{name: "several expiries", rules: []storage.LifecycleRule{expiry(90), expiry(60)}, days: 90, current: 60, changed: true, remaining: 1},
+		{name: "other rules kept", rules: []storage.LifecycleRule{archive, noncurrent, expiry(90)}, days: 90, current: 90, remaining: 3},
+		{name: "other rules only", rules: []storage.LifecycleRule{archive, noncurrent}, days: 90, changed: true, remaining: 3},
+	}
+	for _, test := range tests {
+		lifecycle := storage.Lifecycle{Rules: test.rules}
+		if current := ExpiryDays(lifecycle); current != test.current {
+			t.Errorf("%s: expected objects deleted after %d days, got %d", test.name, test.current, current)
+		}
+		updated, changed := WithExpiry(lifecycle, test.days)
+		if changed != test.changed {
+			t.Errorf("%s: expected changed %t, got %t", test.name, test.changed, changed)
+		}
+		if days := ExpiryDays(updated); days != test.days {
+			t.Errorf("%s: expected the update to delete objects after %d days, got %d", test.name, test.days, days)
+		}
+		if len(updated.Rules) != test.remaining {
+			t.Errorf("%s: expected %d rules, got %d", test.name, test.remaining, len(updated.Rules))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	routev1 "github.com/openshift/api/route/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+// ResolveEndpoint returns the API root of a cluster's query frontend.
+// nameOrURL is either a URL, which is used as is, or the name of a
+// MetricsCluster in namespace whose query URL is looked up with the current
+// kubeconfig.
+func ResolveEndpoint(ctx context.Context, nameOrURL string, namespace string) (string, error) {
+	if strings.HasPrefix(nameOrURL, "http://") || strings.HasPrefix(nameOrURL, "https://") {
+		return nameOrURL, nil
+	}
+	config, err := clientconfig.GetConfig()
+	if err != nil {
+		return "", fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	clientScheme := runtime.NewScheme()
+	if err := api.AddToScheme(clientScheme); err != nil {
+		return "", err
+	}
+	kubeClient, err := client.New(config, client.Options{Scheme: clientScheme})
+	if err != nil {
+		return "", fmt.Errorf("couldn't create client: %w", err)
+	}
+	cluster := &api.MetricsCluster{}
+	if err := kubeClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: nameOrURL}, cluster); err != nil {
+		return "", fmt.Errorf("couldn't fetch cluster %s: %w", nameOrURL, err)
+	}
+	if len(cluster.Status.QueryURL) == 0 {
+		return "", fmt.Errorf("cluster %s isn't exposed yet", nameOrURL)
+	}
+	return cluster.Status.QueryURL, nil
+}
+
+// RouteURL returns the URL a route exposes, or an empty string if it has no
+// host yet.
+func RouteURL(route *routev1.Route) string {
+	host := route.Spec.Host
+	if len(host) == 0 && len(route.Status.Ingress) > 0 {
+		host = route.Status.Ingress[0].Host
+	}
+	if len(host) == 0 {
+		return ""
+	}
+	scheme := "http"
+	if route.Spec.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
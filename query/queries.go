@@ -0,0 +1,50 @@
+package query
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"sigs.k8s.io/yaml"
+)
+
+// NamedQuery is a PromQL expression with a name identifying its results.
+type NamedQuery struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// Threshold is the relative change in the query's results worth
+	// highlighting when comparing them, e.g. 0.1 for 10%. Zero means the
+	// caller's default.
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// QueryFile is a YAML document listing queries.
+type QueryFile struct {
+	Queries []NamedQuery `json:"queries"`
+}
+
+// ParseQueries reads a YAML document of queries.
+func ParseQueries(content []byte) ([]NamedQuery, error) {
+	var file QueryFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+	for i, q := range file.Queries {
+		if len(q.Name) == 0 || len(q.Query) == 0 {
+			return nil, fmt.Errorf("query %d needs a name and an expression", i)
+		}
+	}
+	return file.Queries, nil
+}
+
+// LoadQueries reads a YAML file of queries.
+func LoadQueries(path string) ([]NamedQuery, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read queries: %w", err)
+	}
+	queries, err := ParseQueries(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queries in %s: %w", path, err)
+	}
+	return queries, nil
+}
@@ -0,0 +1,204 @@
+// Package query is a minimal client for the Prometheus HTTP query API, which
+// is also served by Thanos query.
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Client evaluates PromQL against a Prometheus compatible API.
+type Client struct {
+	// BaseURL is the API root, e.g. http://query-foo.dowser.svc:19192.
+	BaseURL string
+
+	HTTP *http.Client
+}
+
+// NewClient returns a client for the API rooted at baseURL.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTP:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Error is an error reported by the API, e.g. for an unparseable expression.
+type Error struct {
+	Type    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+type response struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+}
+
+type queryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// Instant evaluates expr at time t. Extra API parameters (e.g. Thanos'
+// storeMatch[]) may be passed in params.
+func (c *Client) Instant(ctx context.Context, expr string, t time.Time, params url.Values) (model.Value, error) {
+	values := url.Values{}
+	for k, v := range params {
+		values[k] = v
+	}
+	values.Set("query", expr)
+	if !t.IsZero() {
+		values.Set("time", formatTime(t))
+	}
+	return c.query(ctx, "/api/v1/query", values)
+}
+
+// Range evaluates expr over the range from start to end at the given step.
+func (c *Client) Range(ctx context.Context, expr string, start, end time.Time, step time.Duration, params url.Values) (model.Value, error) {
+	values := url.Values{}
+	for k, v := range params {
+		values[k] = v
+	}
+	values.Set("query", expr)
+	values.Set("start", formatTime(start))
+	values.Set("end", formatTime(end))
+	values.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+	return c.query(ctx, "/api/v1/query_range", values)
+}
+
+// Store is a store of the Thanos query layer.
+type Store struct {
+	Name    string `json:"name"`
+	MinTime int64  `json:"minTime"`
+	MaxTime int64  `json:"maxTime"`
+}
+
+// Stores returns the stores of a Thanos query frontend by type, e.g. sidecar.
+func (c *Client) Stores(ctx context.Context) (map[string][]Store, error) {
+	data, err := c.call(ctx, http.MethodGet, "/api/v1/stores", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var stores map[string][]Store
+	if err := json.Unmarshal(data, &stores); err != nil {
+		return nil, fmt.Errorf("couldn't decode stores: %w", err)
+	}
+	return stores, nil
+}
+
+// LabelValues returns the values of the label across all series.
+func (c *Client) LabelValues(ctx context.Context, label string) ([]string, error) {
+	data, err := c.call(ctx, http.MethodGet, "/api/v1/label/"+url.PathEscape(label)+"/values", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("couldn't decode label values: %w", err)
+	}
+	return values, nil
+}
+
+// call invokes an API endpoint and returns the data of a successful response.
+func (c *Client) call(ctx context.Context, method, path string, values url.Values) (json.RawMessage, error) {
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		req, err = http.NewRequest(method, c.BaseURL+path+"?"+values.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, c.BaseURL+path, strings.NewReader(values.Encode()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't query %s: %w", c.BaseURL, err)
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("couldn't decode response from %s (%s): %w", c.BaseURL, resp.Status, err)
+	}
+	if r.Status != "success" {
+		return nil, &Error{Type: r.ErrorType, Message: r.Error}
+	}
+	return r.Data, nil
+}
+
+func (c *Client) query(ctx context.Context, path string, values url.Values) (model.Value, error) {
+	data, err := c.call(ctx, http.MethodPost, path, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var result queryData
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("couldn't decode query result: %w", err)
+	}
+	var value model.Value
+	switch result.ResultType {
+	case model.ValVector:
+		var v model.Vector
+		err = json.Unmarshal(result.Result, &v)
+		value = v
+	case model.ValMatrix:
+		var v model.Matrix
+		err = json.Unmarshal(result.Result, &v)
+		value = v
+	case model.ValScalar:
+		var v model.Scalar
+		err = json.Unmarshal(result.Result, &v)
+		value = &v
+	case model.ValString:
+		var v model.String
+		err = json.Unmarshal(result.Result, &v)
+		value = &v
+	default:
+		return nil, fmt.Errorf("unsupported result type %q", result.ResultType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode %s result: %w", result.ResultType, err)
+	}
+	return value, nil
+}
+
+// SampleCount returns the number of samples in a query result. Scalar and
+// string results aren't samples of any series and count as none.
+func SampleCount(value model.Value) int {
+	switch v := value.(type) {
+	case model.Vector:
+		return len(v)
+	case model.Matrix:
+		n := 0
+		for _, series := range v {
+			n += len(series.Values)
+		}
+		return n
+	}
+	return 0
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', -1, 64)
+}
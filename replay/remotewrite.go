@@ -0,0 +1,158 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Writer sends samples to a Prometheus remote write endpoint.
+type Writer struct {
+	URL string
+
+	// Credentials, if any. A bearer token takes precedence over basic auth.
+	Username    string
+	Password    string
+	BearerToken string
+
+	HTTP *http.Client
+}
+
+// Write sends the series in a single request, retrying transient failures.
+func (w *Writer) Write(ctx context.Context, series []*model.SampleStream, extraLabels model.LabelSet) error {
+	body := snappyEncode(encodeWriteRequest(series, extraLabels))
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := w.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == maxWriteAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+const maxWriteAttempts = 5
+
+// send posts a request, returning whether a failure may be retried.
+func (w *Writer) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case len(w.BearerToken) > 0:
+		req.Header.Set("Authorization", "Bearer "+w.BearerToken)
+	case len(w.Username) > 0:
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	resp, err := w.HTTP.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("couldn't write to %s: %w", w.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("couldn't write to %s: %s: %s", w.URL, resp.Status, bytes.TrimSpace(message))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []*model.SampleStream, extraLabels model.LabelSet) []byte {
+	var request []byte
+	for _, stream := range series {
+		labels := model.LabelSet{}
+		for name, value := range stream.Metric {
+			labels[name] = value
+		}
+		for name, value := range extraLabels {
+			labels[name] = value
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, string(name))
+		}
+		// Remote write requires labels sorted by name.
+		sort.Strings(names)
+
+		var timeSeries []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, string(labels[model.LabelName(name)]))
+			timeSeries = protowire.AppendTag(timeSeries, 1, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, label)
+		}
+		for _, pair := range stream.Values {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(float64(pair.Value)))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(int64(pair.Timestamp)))
+			timeSeries = protowire.AppendTag(timeSeries, 2, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, sample)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, timeSeries)
+	}
+	return request
+}
+
+// snappyEncode frames data in the snappy block format remote write expects.
+// It stores the data as literals rather than compressing it, which every
+// snappy decoder accepts.
+func snappyEncode(data []byte) []byte {
+	out := make([]byte, binary.MaxVarintLen64, len(data)+len(data)/maxSnappyLiteral*3+binary.MaxVarintLen64+3)
+	out = out[:binary.PutUvarint(out, uint64(len(data)))]
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxSnappyLiteral {
+			n = maxSnappyLiteral
+		}
+		// Literal tags carry the length minus one, inline below 60 and
+		// in one or two following bytes otherwise.
+		switch length := n - 1; {
+		case length < 60:
+			out = append(out, byte(length<<2))
+		case length < 1<<8:
+			out = append(out, 60<<2, byte(length))
+		default:
+			out = append(out, 61<<2, byte(length), byte(length>>8))
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+const maxSnappyLiteral = 1 << 16
@@ -0,0 +1,110 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// snappyDecodeLiterals decodes snappy blocks made only of literals.
+func snappyDecodeLiterals(t *testing.T, data []byte) []byte {
+	length, n := binary.Uvarint(data)
+	data = data[n:]
+	var out []byte
+	for len(data) > 0 {
+		tag := data[0]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected non-literal tag %x", tag)
+		}
+		size := int(tag >> 2)
+		data = data[1:]
+		switch size {
+		case 60:
+			size = int(data[0])
+			data = data[1:]
+		case 61:
+			size = int(data[0]) | int(data[1])<<8
+			data = data[2:]
+		}
+		size++
+		out = append(out, data[:size]...)
+		data = data[size:]
+	}
+	if uint64(len(out)) != length {
+		t.Fatalf("decoded %d bytes, preamble says %d", len(out), length)
+	}
+	return out
+}
+
+func TestSnappyEncode(t *testing.T) {
+	for _, size := range []int{0, 1, 59, 60, 61, 255, 256, 257, 65535, 65536, 65537, 200000} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		if decoded := snappyDecodeLiterals(t, snappyEncode(data)); !bytes.Equal(decoded, data) {
+			t.Errorf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	series := []*model.SampleStream{
+		{
+			Metric: model.Metric{"__name__": "up", "job": "kubelet"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0.5}},
+		},
+	}
+	request := encodeWriteRequest(series, model.LabelSet{"cluster_job": "e2e"})
+
+	num, typ, n := protowire.ConsumeTag(request)
+	if num != 1 || typ != protowire.BytesType {
+		t.Fatalf("expected timeseries field, got %d/%d", num, typ)
+	}
+	timeSeries, m := protowire.ConsumeBytes(request[n:])
+	if n+m != len(request) {
+		t.Fatalf("expected a single timeseries")
+	}
+
+	var labels []string
+	var samples [][2]float64
+	for len(timeSeries) > 0 {
+		num, _, n := protowire.ConsumeTag(timeSeries)
+		field, m := protowire.ConsumeBytes(timeSeries[n:])
+		timeSeries = timeSeries[n+m:]
+		switch num {
+		case 1:
+			_, _, n := protowire.ConsumeTag(field)
+			name, m := protowire.ConsumeString(field[n:])
+			field = field[n+m:]
+			_, _, n = protowire.ConsumeTag(field)
+			value, _ := protowire.ConsumeString(field[n:])
+			labels = append(labels, name+"="+value)
+		case 2:
+			_, _, n := protowire.ConsumeTag(field)
+			bits, m := protowire.ConsumeFixed64(field[n:])
+			field = field[n+m:]
+			_, _, n = protowire.ConsumeTag(field)
+			timestamp, _ := protowire.ConsumeVarint(field[n:])
+			samples = append(samples, [2]float64{float64(timestamp), math.Float64frombits(bits)})
+		}
+	}
+
+	expectedLabels := []string{"__name__=up", "cluster_job=e2e", "job=kubelet"}
+	if len(labels) != len(expectedLabels) {
+		t.Fatalf("expected labels %v, got %v", expectedLabels, labels)
+	}
+	for i := range labels {
+		if labels[i] != expectedLabels[i] {
+			t.Errorf("expected labels %v, got %v", expectedLabels, labels)
+		}
+	}
+	expectedSamples := [][2]float64{{1000, 1}, {2000, 0.5}}
+	if len(samples) != len(expectedSamples) || samples[0] != expectedSamples[0] || samples[1] != expectedSamples[1] {
+		t.Errorf("expected samples %v, got %v", expectedSamples, samples)
+	}
+}
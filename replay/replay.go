@@ -0,0 +1,198 @@
+// Package replay streams the samples held by a Prometheus to a remote write
+// endpoint, for loading CI metrics into long-term storage.
+package replay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+
+	"github.com/ironcladlou/dowser/query"
+)
+
+type replayOptions struct {
+	PrometheusURL  string
+	RemoteWriteURL string
+	Start          string
+	End            string
+	Window         time.Duration
+	BatchSize      int
+	ReadyTimeout   time.Duration
+	Labels         map[string]string
+	Quit           bool
+}
+
+func NewReplayCommand() *cobra.Command {
+	var options replayOptions
+
+	var command = &cobra.Command{
+		Use:   "replay",
+		Short: "Replays the samples of a Prometheus to a remote write endpoint.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := replay(options)
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.PrometheusURL, "prometheus-url", "", "http://localhost:9090", "Prometheus to read samples from")
+	command.Flags().StringVarP(&options.RemoteWriteURL, "remote-write-url", "", os.Getenv("REMOTE_WRITE_URL"), "remote write endpoint (defaults to $REMOTE_WRITE_URL)")
+	command.Flags().StringVarP(&options.Start, "start", "", "", "start of the time range to replay (RFC3339)")
+	command.Flags().StringVarP(&options.End, "end", "", "", "end of the time range to replay (RFC3339)")
+	command.Flags().DurationVarP(&options.Window, "window", "", time.Hour, "time range of samples read per query")
+	command.Flags().IntVarP(&options.BatchSize, "batch-size", "", 5000, "maximum number of samples per remote write request")
+	command.Flags().DurationVarP(&options.ReadyTimeout, "ready-timeout", "", 30*time.Minute, "how long to wait for Prometheus to become ready")
+	command.Flags().StringToStringVarP(&options.Labels, "label", "", nil, "label added to every replayed series (name=value)")
+	command.Flags().BoolVarP(&options.Quit, "quit", "", false, "shut Prometheus down through its lifecycle endpoint when done")
+
+	return command
+}
+
+func replay(options replayOptions) error {
+	if len(options.RemoteWriteURL) == 0 {
+		return fmt.Errorf("no remote write URL given")
+	}
+	if options.BatchSize <= 0 || options.Window < time.Second {
+		return fmt.Errorf("batch size must be positive and window at least a second")
+	}
+	start, err := time.Parse(time.RFC3339, options.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start: %w", err)
+	}
+	end, err := time.Parse(time.RFC3339, options.End)
+	if err != nil {
+		return fmt.Errorf("invalid end: %w", err)
+	}
+	labels := model.LabelSet{}
+	for name, value := range options.Labels {
+		labels[model.LabelName(name)] = model.LabelValue(value)
+	}
+
+	ctx := context.Background()
+	prometheus := query.NewClient(options.PrometheusURL)
+	prometheus.HTTP.Timeout = 5 * time.Minute
+	writer := &Writer{
+		URL:         options.RemoteWriteURL,
+		Username:    os.Getenv("REMOTE_WRITE_USERNAME"),
+		Password:    os.Getenv("REMOTE_WRITE_PASSWORD"),
+		BearerToken: os.Getenv("REMOTE_WRITE_BEARER_TOKEN"),
+		HTTP:        &http.Client{Timeout: time.Minute},
+	}
+
+	if err := waitForReady(ctx, options.PrometheusURL, options.ReadyTimeout); err != nil {
+		return err
+	}
+	names, err := prometheus.LabelValues(ctx, model.MetricNameLabel)
+	if err != nil {
+		return fmt.Errorf("couldn't list metric names: %w", err)
+	}
+
+	batch := &batcher{writer: writer, labels: labels, size: options.BatchSize}
+	for _, name := range names {
+		// Range selectors return raw samples, so each window is read as the
+		// samples within (t, t+window].
+		for t := start.Truncate(time.Second).Add(-time.Second); t.Before(end); t = t.Add(options.Window) {
+			at := t.Add(options.Window)
+			if at.After(end) {
+				at = end.Truncate(time.Second).Add(time.Second)
+			}
+			expr := fmt.Sprintf("{%s=%q}[%ds]", model.MetricNameLabel, name, int64(at.Sub(t)/time.Second))
+			value, err := prometheus.Instant(ctx, expr, at, nil)
+			if err != nil {
+				return fmt.Errorf("couldn't read %s: %w", name, err)
+			}
+			matrix, ok := value.(model.Matrix)
+			if !ok {
+				return fmt.Errorf("unexpected %s result reading %s", value.Type(), name)
+			}
+			for _, stream := range matrix {
+				if err := batch.add(ctx, stream); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := batch.flush(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("replayed %d samples of %d metrics\n", batch.written, len(names))
+
+	if options.Quit {
+		resp, err := http.Post(strings.TrimSuffix(options.PrometheusURL, "/")+"/-/quit", "", nil)
+		if err != nil {
+			return fmt.Errorf("couldn't shut down prometheus: %w", err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// waitForReady polls Prometheus until it has loaded its data.
+func waitForReady(ctx context.Context, prometheusURL string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		resp, err := client.Get(strings.TrimSuffix(prometheusURL, "/") + "/-/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("prometheus wasn't ready after %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// batcher groups series into remote write requests of about size samples.
+type batcher struct {
+	writer  *Writer
+	labels  model.LabelSet
+	size    int
+	series  []*model.SampleStream
+	samples int
+	written int
+}
+
+func (b *batcher) add(ctx context.Context, stream *model.SampleStream) error {
+	for len(stream.Values) > 0 {
+		n := b.size - b.samples
+		if n > len(stream.Values) {
+			n = len(stream.Values)
+		}
+		b.series = append(b.series, &model.SampleStream{Metric: stream.Metric, Values: stream.Values[:n]})
+		b.samples += n
+		stream = &model.SampleStream{Metric: stream.Metric, Values: stream.Values[n:]}
+		if b.samples >= b.size {
+			if err := b.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *batcher) flush(ctx context.Context) error {
+	if len(b.series) == 0 {
+		return nil
+	}
+	if err := b.writer.Write(ctx, b.series, b.labels); err != nil {
+		return err
+	}
+	b.written += b.samples
+	b.series, b.samples = nil, 0
+	return nil
+}
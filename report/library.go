@@ -0,0 +1,33 @@
+package report
+
+// library is the default set of OpenShift health queries. Queries aggregate
+// across the cluster's sources, whose data usually covers different times.
+const library = `
+queries:
+- name: API request latency p99 (seconds)
+  query: histogram_quantile(0.99, sum by (le) (rate(apiserver_request_duration_seconds_bucket{verb!~"WATCH|CONNECT"}[5m])))
+- name: API server errors (requests/s)
+  query: sum(rate(apiserver_request_total{code=~"5.."}[5m]))
+- name: API requests (requests/s)
+  query: sum(rate(apiserver_request_total[5m]))
+- name: etcd WAL fsync p99 (seconds)
+  query: histogram_quantile(0.99, sum by (le) (rate(etcd_disk_wal_fsync_duration_seconds_bucket[5m])))
+- name: etcd backend commit p99 (seconds)
+  query: histogram_quantile(0.99, sum by (le) (rate(etcd_disk_backend_commit_duration_seconds_bucket[5m])))
+- name: etcd leader changes
+  query: sum(increase(etcd_server_leader_changes_seen_total[5m]))
+- name: etcd database size (bytes)
+  query: max(etcd_mvcc_db_total_size_in_bytes)
+- name: Kubelet PLEG relist p99 (seconds)
+  query: histogram_quantile(0.99, sum by (le) (rate(kubelet_pleg_relist_duration_seconds_bucket[5m])))
+- name: Running pods
+  query: sum(kubelet_running_pods or kubelet_running_pod_count)
+- name: Node CPU utilization (max)
+  query: max(1 - avg by (instance) (rate(node_cpu_seconds_total{mode="idle"}[5m])))
+- name: Node memory utilization (max)
+  query: max(1 - node_memory_MemAvailable_bytes / node_memory_MemTotal_bytes)
+- name: Node load per CPU (max)
+  query: max(node_load1 / on (instance) count by (instance) (node_cpu_seconds_total{mode="idle"}))
+- name: Node disk IO utilization (max)
+  query: max(rate(node_disk_io_time_seconds_total[5m]))
+`
@@ -0,0 +1,279 @@
+// Package report evaluates a library of OpenShift health queries against a
+// cluster and writes a summary with sparklines of their results.
+package report
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+
+	"github.com/ironcladlou/dowser/query"
+)
+
+type reportOptions struct {
+	QueriesFile string
+	Namespace   string
+	Start       string
+	End         string
+	Points      int
+	Format      string
+	OutputDir   string
+}
+
+func NewReportCommand() *cobra.Command {
+	var options reportOptions
+
+	var command = &cobra.Command{
+		Use:   "report CLUSTER",
+		Short: "Writes a health report of a cluster.",
+		Long: `Writes a health report of a cluster.
+
+The cluster is the name of a MetricsCluster, whose query route is looked up
+with the current kubeconfig, or the URL of a Prometheus compatible API. The
+time range defaults to the data served by the cluster's Thanos stores.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := report(options, args[0])
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.QueriesFile, "queries", "", "", "YAML file of queries to report instead of the built in library")
+	command.Flags().StringVarP(&options.Namespace, "namespace", "", "dowser", "namespace of the cluster")
+	command.Flags().StringVarP(&options.Start, "start", "", "", "start of the time range (RFC3339)")
+	command.Flags().StringVarP(&options.End, "end", "", "", "end of the time range (RFC3339)")
+	command.Flags().IntVarP(&options.Points, "points", "", 240, "number of points per sparkline")
+	command.Flags().StringVarP(&options.Format, "format", "", "markdown", "report format (markdown or html)")
+	command.Flags().StringVarP(&options.OutputDir, "output-dir", "", "", "directory to write the report to (defaults to report-CLUSTER)")
+
+	return command
+}
+
+// result is the outcome of a report query.
+type result struct {
+	Query query.NamedQuery
+	Error error
+	Stats stats
+	Image string
+}
+
+// stats summarizes the samples of a range query result.
+type stats struct {
+	Samples       int
+	Min, Avg, Max float64
+}
+
+func report(options reportOptions, cluster string) error {
+	if options.Format != "markdown" && options.Format != "html" {
+		return fmt.Errorf("unknown format %q", options.Format)
+	}
+	if options.Points < 2 {
+		return fmt.Errorf("at least 2 points are needed")
+	}
+	queries, err := query.ParseQueries([]byte(library))
+	if err != nil {
+		return fmt.Errorf("invalid query library: %w", err)
+	}
+	if len(options.QueriesFile) > 0 {
+		queries, err = query.LoadQueries(options.QueriesFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	endpoint, err := query.ResolveEndpoint(ctx, cluster, options.Namespace)
+	if err != nil {
+		return err
+	}
+	client := query.NewClient(endpoint)
+	client.HTTP.Timeout = 2 * time.Minute
+	start, end, err := timeRange(ctx, client, options.Start, options.End)
+	if err != nil {
+		return err
+	}
+	step := end.Sub(start) / time.Duration(options.Points-1)
+	if step < time.Second {
+		step = time.Second
+	}
+
+	var results []result
+	for _, q := range queries {
+		r := result{Query: q}
+		value, err := client.Range(ctx, q.Query, start, end, step, nil)
+		if err != nil {
+			r.Error = err
+		} else if matrix, ok := value.(model.Matrix); ok {
+			r.Stats = summarize(matrix)
+			r.Image = sparkline(matrix, model.TimeFromUnixNano(start.UnixNano()), model.TimeFromUnixNano(end.UnixNano()))
+		} else {
+			r.Error = fmt.Errorf("unexpected %s result", value.Type())
+		}
+		results = append(results, r)
+	}
+
+	outputDir := options.OutputDir
+	if len(outputDir) == 0 {
+		outputDir = "report-" + filepath.Base(cluster)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("couldn't create output directory: %w", err)
+	}
+	var path string
+	if options.Format == "html" {
+		path = filepath.Join(outputDir, "report.html")
+		err = ioutil.WriteFile(path, []byte(renderHTML(cluster, start, end, results)), 0644)
+	} else {
+		path = filepath.Join(outputDir, "report.md")
+		err = writeMarkdown(path, outputDir, cluster, start, end, results)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+// timeRange parses the report's time range, filling in what isn't given from
+// the range of data served by the query frontend's stores.
+func timeRange(ctx context.Context, client *query.Client, startFlag, endFlag string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+	if len(startFlag) > 0 {
+		if start, err = time.Parse(time.RFC3339, startFlag); err != nil {
+			return start, end, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+	if len(endFlag) > 0 {
+		if end, err = time.Parse(time.RFC3339, endFlag); err != nil {
+			return start, end, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+	if start.IsZero() || end.IsZero() {
+		stores, err := client.Stores(ctx)
+		if err != nil {
+			return start, end, fmt.Errorf("couldn't find the time range of the data, use --start and --end: %w", err)
+		}
+		var minTime, maxTime int64
+		for _, store := range stores["sidecar"] {
+			if minTime == 0 || store.MinTime < minTime {
+				minTime = store.MinTime
+			}
+			if store.MaxTime > maxTime {
+				maxTime = store.MaxTime
+			}
+		}
+		if maxTime <= minTime {
+			return start, end, fmt.Errorf("no stores serve data yet, use --start and --end")
+		}
+		if start.IsZero() {
+			start = time.Unix(0, minTime*int64(time.Millisecond))
+		}
+		if end.IsZero() {
+			end = time.Unix(0, maxTime*int64(time.Millisecond))
+		}
+	}
+	if !end.After(start) {
+		return start, end, fmt.Errorf("end must be after start")
+	}
+	return start.UTC(), end.UTC(), nil
+}
+
+func summarize(matrix model.Matrix) stats {
+	s := stats{Min: math.Inf(1), Max: math.Inf(-1)}
+	sum := 0.0
+	for _, series := range matrix {
+		for _, pair := range series.Values {
+			v := float64(pair.Value)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			s.Samples++
+			sum += v
+			s.Min, s.Max = math.Min(s.Min, v), math.Max(s.Max, v)
+		}
+	}
+	if s.Samples > 0 {
+		s.Avg = sum / float64(s.Samples)
+	}
+	return s
+}
+
+// summary returns the result's statistics, or why there are none.
+func (r result) summary() (string, string, string) {
+	switch {
+	case r.Error != nil:
+		return "error: " + r.Error.Error(), "", ""
+	case r.Stats.Samples == 0:
+		return "no data", "", ""
+	}
+	return fmt.Sprintf("%.4g", r.Stats.Min), fmt.Sprintf("%.4g", r.Stats.Avg), fmt.Sprintf("%.4g", r.Stats.Max)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// writeMarkdown writes the report, with its sparklines as SVG files alongside.
+func writeMarkdown(path, outputDir, cluster string, start, end time.Time, results []result) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Health report: %s\n\n", cluster)
+	fmt.Fprintf(&b, "%s to %s\n\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	b.WriteString("| Query | Min | Avg | Max | Trend |\n")
+	b.WriteString("|---|---|---|---|---|\n")
+	for i, r := range results {
+		image := ""
+		if r.Error == nil && r.Stats.Samples > 0 {
+			name := fmt.Sprintf("%02d-%s.svg", i, strings.Trim(unsafeFileChars.ReplaceAllString(strings.ToLower(r.Query.Name), "-"), "-"))
+			if err := ioutil.WriteFile(filepath.Join(outputDir, name), []byte(r.Image), 0644); err != nil {
+				return fmt.Errorf("couldn't write sparkline: %w", err)
+			}
+			image = fmt.Sprintf("![trend](%s)", name)
+		}
+		min, avg, max := r.summary()
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", markdownCell(r.Query.Name), markdownCell(min), avg, max, image)
+	}
+	b.WriteString("\n## Queries\n\n")
+	for _, r := range results {
+		fmt.Fprintf(&b, "- **%s**: `%s`\n", r.Query.Name, r.Query.Query)
+	}
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("couldn't write report: %w", err)
+	}
+	return nil
+}
+
+func markdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+// renderHTML returns a standalone report with its sparklines inline.
+func renderHTML(cluster string, start, end time.Time, results []result) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Health report: %s</title>\n", html.EscapeString(cluster))
+	b.WriteString("<style>body{font-family:sans-serif}td,th{padding:4px 8px;text-align:left}tr:nth-child(even){background:#f4f4f4}</style>\n")
+	fmt.Fprintf(&b, "</head><body>\n<h1>Health report: %s</h1>\n", html.EscapeString(cluster))
+	fmt.Fprintf(&b, "<p>%s to %s</p>\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	b.WriteString("<table>\n<tr><th>Query</th><th>Min</th><th>Avg</th><th>Max</th><th>Trend</th></tr>\n")
+	for _, r := range results {
+		image := ""
+		if r.Error == nil && r.Stats.Samples > 0 {
+			image = r.Image
+		}
+		min, avg, max := r.summary()
+		fmt.Fprintf(&b, "<tr><td title=\"%s\">%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(r.Query.Query), html.EscapeString(r.Query.Name), html.EscapeString(min), avg, max, image)
+	}
+	b.WriteString("</table>\n</body></html>\n")
+	return b.String()
+}
@@ -0,0 +1,35 @@
+package report
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/ironcladlou/dowser/query"
+)
+
+func TestLibrary(t *testing.T) {
+	queries, err := query.ParseQueries([]byte(library))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, q := range queries {
+		if names[q.Name] {
+			t.Errorf("duplicate query name %q", q.Name)
+		}
+		names[q.Name] = true
+	}
+}
+
+func TestSparklineGaps(t *testing.T) {
+	series := &model.SampleStream{Metric: model.Metric{}}
+	for _, ts := range []model.Time{0, 1000, 2000, 10000, 11000} {
+		series.Values = append(series.Values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+	}
+	svg := sparkline(model.Matrix{series}, 0, 11000)
+	if lines := strings.Count(svg, "<polyline"); lines != 2 {
+		t.Errorf("expected the gap to split the series into 2 lines, got %d: %s", lines, svg)
+	}
+}
@@ -0,0 +1,86 @@
+package report
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	sparklineWidth  = 240
+	sparklineHeight = 40
+)
+
+// sparkline draws the series of a range query result as an SVG image spanning
+// the range from start to end. Each series gets its own line, and gaps in a
+// series break its line.
+func sparkline(matrix model.Matrix, start, end model.Time) string {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, series := range matrix {
+		for _, pair := range series.Values {
+			v := float64(pair.Value)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			min, max = math.Min(min, v), math.Max(max, v)
+		}
+	}
+	if max < min {
+		min, max = 0, 0
+	}
+	if max == min {
+		max = min + 1
+	}
+	span := float64(end - start)
+	if span <= 0 {
+		span = 1
+	}
+	// Points further apart than this are taken to be on either side of a gap.
+	gap := 3 * minInterval(matrix)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, sparklineWidth, sparklineHeight, sparklineWidth, sparklineHeight)
+	for _, series := range matrix {
+		var points []string
+		var last model.Time
+		flush := func() {
+			if len(points) > 0 {
+				fmt.Fprintf(&b, `<polyline fill="none" stroke="#3366cc" stroke-width="1" points="%s"/>`, strings.Join(points, " "))
+			}
+			points = nil
+		}
+		for _, pair := range series.Values {
+			v := float64(pair.Value)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			if len(points) > 0 && gap > 0 && pair.Timestamp-last > gap {
+				flush()
+			}
+			x := float64(pair.Timestamp-start) / span * sparklineWidth
+			y := sparklineHeight - 1 - (v-min)/(max-min)*(sparklineHeight-2)
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+			last = pair.Timestamp
+		}
+		flush()
+	}
+	b.WriteString("</svg>")
+	return b.String()
+}
+
+// minInterval returns the smallest interval between consecutive points of any
+// series, which is the query's step.
+func minInterval(matrix model.Matrix) model.Time {
+	var interval model.Time
+	for _, series := range matrix {
+		for i := 1; i < len(series.Values); i++ {
+			d := series.Values[i].Timestamp - series.Values[i-1].Timestamp
+			if interval == 0 || d < interval {
+				interval = d
+			}
+		}
+	}
+	return interval
+}
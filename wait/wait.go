@@ -0,0 +1,165 @@
+// Package wait blocks until a MetricsCluster reaches a phase or condition, for
+// pipelines which create clusters and then query them.
+package wait
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+type waitOptions struct {
+	For          string
+	Namespace    string
+	Timeout      time.Duration
+	PollInterval time.Duration
+}
+
+func NewWaitCommand() *cobra.Command {
+	var options waitOptions
+
+	var command = &cobra.Command{
+		Use:   "wait CLUSTER",
+		Short: "Waits for a cluster to reach a phase or condition.",
+		Long: `Waits for a cluster to reach a phase or condition.
+
+--for is either a phase, like Ready, or condition=TYPE[=STATUS], like
+condition=StorageAvailable, which waits for the condition's status to be
+True unless another status is given.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := wait(options, args[0])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	command.Flags().StringVarP(&options.For, "for", "", string(api.PhaseReady), "phase or condition=TYPE[=STATUS] to wait for")
+	command.Flags().StringVarP(&options.Namespace, "namespace", "", "dowser", "namespace of the cluster")
+	command.Flags().DurationVarP(&options.Timeout, "timeout", "", 30*time.Minute, "how long to wait before giving up")
+	command.Flags().DurationVarP(&options.PollInterval, "poll-interval", "", 5*time.Second, "how often to check the cluster")
+
+	return command
+}
+
+// target is the state being waited for: either a phase, or the status of a
+// condition.
+type target struct {
+	phase           api.MetricsClusterPhase
+	condition       api.ClusterConditionType
+	conditionStatus corev1.ConditionStatus
+}
+
+func parseTarget(s string) (target, error) {
+	if !strings.HasPrefix(s, "condition=") {
+		if len(s) == 0 {
+			return target{}, fmt.Errorf("no phase or condition given")
+		}
+		return target{phase: api.MetricsClusterPhase(s)}, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "condition="), "=", 2)
+	if len(parts[0]) == 0 {
+		return target{}, fmt.Errorf("invalid condition %q: no type given", s)
+	}
+	t := target{condition: api.ClusterConditionType(parts[0]), conditionStatus: corev1.ConditionTrue}
+	if len(parts) == 2 {
+		t.conditionStatus = corev1.ConditionStatus(parts[1])
+	}
+	return t, nil
+}
+
+func (t target) String() string {
+	if len(t.condition) > 0 {
+		return fmt.Sprintf("condition %s=%s", t.condition, t.conditionStatus)
+	}
+	return fmt.Sprintf("phase %s", t.phase)
+}
+
+// reached returns whether the cluster is in the target state, and otherwise a
+// description of its current state.
+func (t target) reached(cluster *api.MetricsCluster) (bool, string) {
+	if len(t.condition) == 0 {
+		if cluster.Status.Phase == t.phase {
+			return true, ""
+		}
+		if len(cluster.Status.Phase) == 0 {
+			return false, "phase not reported yet"
+		}
+		return false, fmt.Sprintf("phase is %s", cluster.Status.Phase)
+	}
+	for _, condition := range cluster.Status.Conditions {
+		if condition.Type != t.condition {
+			continue
+		}
+		if condition.Status == t.conditionStatus {
+			return true, ""
+		}
+		state := fmt.Sprintf("condition %s is %s", condition.Type, condition.Status)
+		if len(condition.Message) > 0 {
+			state += ": " + condition.Message
+		}
+		return false, state
+	}
+	return false, fmt.Sprintf("condition %s not reported yet", t.condition)
+}
+
+func wait(options waitOptions, clusterName string) error {
+	t, err := parseTarget(options.For)
+	if err != nil {
+		return err
+	}
+	config, err := clientconfig.GetConfig()
+	if err != nil {
+		return fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	clientScheme := runtime.NewScheme()
+	if err := api.AddToScheme(clientScheme); err != nil {
+		return err
+	}
+	kubeClient, err := client.New(config, client.Options{Scheme: clientScheme})
+	if err != nil {
+		return fmt.Errorf("couldn't create client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+	name := types.NamespacedName{Namespace: options.Namespace, Name: clusterName}
+	state := "cluster not found yet"
+	ticker := time.NewTicker(options.PollInterval)
+	defer ticker.Stop()
+	for {
+		cluster := &api.MetricsCluster{}
+		err := kubeClient.Get(ctx, name, cluster)
+		switch {
+		case err == nil:
+			var reached bool
+			if reached, state = t.reached(cluster); reached {
+				fmt.Printf("metricscluster %s reached %s\n", clusterName, t)
+				return nil
+			}
+		case errors.IsNotFound(err):
+			state = "cluster not found yet"
+		case ctx.Err() == nil:
+			return fmt.Errorf("couldn't fetch metricscluster %s: %w", clusterName, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for metricscluster %s to reach %s: %s", clusterName, t, state)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package wait
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/ironcladlou/dowser/api/v1"
+)
+
+func TestReached(t *testing.T) {
+	cluster := &api.MetricsCluster{
+		Status: api.MetricsClusterStatus{
+			Phase: api.PhasePending,
+			Conditions: []api.ClusterCondition{
+				{Type: api.ConditionStorageAvailable, Status: corev1.ConditionFalse, Message: "source too large"},
+				{Type: api.ConditionBucketVerified, Status: corev1.ConditionTrue},
+			},
+		},
+	}
+	tests := []struct {
+		For     string
+		Reached bool
+		State   string
+	}{
+		{For: "Ready", State: "phase is Pending"},
+		{For: "Pending", Reached: true},
+		{For: "condition=BucketVerified", Reached: true},
+		{For: "condition=StorageAvailable", State: "condition StorageAvailable is False: source too large"},
+		{For: "condition=StorageAvailable=False", Reached: true},
+		{For: "condition=ExpressionsValid", State: "condition ExpressionsValid not reported yet"},
+	}
+	for _, test := range tests {
+		target, err := parseTarget(test.For)
+		if err != nil {
+			t.Fatalf("%s: %v", test.For, err)
+		}
+		reached, state := target.reached(cluster)
+		if reached != test.Reached || state != test.State {
+			t.Errorf("%s: expected %v %q, got %v %q", test.For, test.Reached, test.State, reached, state)
+		}
+	}
+
+	for _, invalid := range []string{"", "condition=", "condition==True"} {
+		if _, err := parseTarget(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}